@@ -0,0 +1,164 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/bbfw"
+	"github.com/blacktop/ipsw/pkg/info"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(bbCmd)
+
+	bbCmd.Flags().BoolP("json", "j", false, "Print the baseband firmware info as JSON")
+	bbCmd.Flags().StringP("output", "o", "", "Folder to extract the baseband images to")
+	bbCmd.MarkZshCompPositionalArgumentFile(1, "*.bbfw", "*.ipsw")
+}
+
+// parseIPSWBasebands parses the baseband firmware bundles of an IPSW (with the BasebandChipIDs of its BuildManifest)
+func parseIPSWBasebands(ipswPath string) ([]*bbfw.Bundle, map[string][]string, error) {
+	zr, err := zip.OpenReader(ipswPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %v", ipswPath, err)
+	}
+	defer zr.Close()
+
+	chipIDs := make(map[string][]string)
+	if bm, err := readBuildManifest(ipswPath); err != nil {
+		log.Warnf("failed to read BuildManifest.plist: %v", err)
+	} else {
+		for _, bID := range bm.BuildIdentities {
+			if bb, ok := bID.Manifest["BasebandFirmware"]; ok && len(bb.Info.Path) > 0 && len(bID.BbChipID) > 0 {
+				chipIDs[bb.Info.Path] = append(chipIDs[bb.Info.Path], bID.BbChipID)
+			}
+		}
+	}
+
+	var bundles []*bbfw.Bundle
+	for _, zf := range zr.File {
+		if !strings.HasSuffix(zf.Name, ".bbfw") {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open %s in zip: %v", zf.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s in zip: %v", zf.Name, err)
+		}
+		b, err := bbfw.Parse(zf.Name, data)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to parse %s", zf.Name)
+		}
+		bundles = append(bundles, b)
+	}
+
+	return bundles, chipIDs, nil
+}
+
+// bbCmd represents the bb command
+var bbCmd = &cobra.Command{
+	Use:   "bb <BBFW|IPSW>",
+	Short: "Parse baseband firmware bundles",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		asJSON, _ := cmd.Flags().GetBool("json")
+		output, _ := cmd.Flags().GetString("output")
+
+		src := filepath.Clean(args[0])
+
+		var bundles []*bbfw.Bundle
+		chipIDs := make(map[string][]string)
+		if strings.HasSuffix(src, ".bbfw") {
+			b, err := bbfw.Open(src)
+			if err != nil {
+				return errors.Wrapf(err, "failed to parse %s", src)
+			}
+			bundles = append(bundles, b)
+		} else if isZipFile(src) {
+			var err error
+			bundles, chipIDs, err = parseIPSWBasebands(src)
+			if err != nil {
+				return err
+			}
+			if len(bundles) == 0 {
+				return fmt.Errorf("no baseband firmware found in %s", src)
+			}
+		} else {
+			return fmt.Errorf("%s is not a .bbfw or an IPSW", src)
+		}
+
+		db, err := info.GetIpswDB()
+		if err != nil {
+			return err
+		}
+		for _, b := range bundles {
+			b.Match(db, chipIDs[b.Name]...)
+		}
+
+		if len(output) > 0 {
+			for _, b := range bundles {
+				dir := filepath.Join(output, strings.TrimSuffix(filepath.Base(b.Name), filepath.Ext(b.Name)))
+				log.Infof("Extracting %s to %s", filepath.Base(b.Name), dir)
+				files, err := b.Extract(dir)
+				if err != nil {
+					return errors.Wrapf(err, "failed to extract %s", b.Name)
+				}
+				for _, f := range files {
+					utils.Indent(log.Info, 2)(fmt.Sprintf("Created %s", f))
+				}
+			}
+		}
+
+		if asJSON {
+			dat, err := json.MarshalIndent(bundles, "", "    ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(dat))
+		} else {
+			for _, b := range bundles {
+				fmt.Println(b)
+			}
+		}
+
+		return nil
+	},
+}
@@ -22,11 +22,13 @@ THE SOFTWARE.
 package cmd
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 
 	// "sort"
 	"io/ioutil"
@@ -35,6 +37,7 @@ import (
 	"github.com/blacktop/ipsw/internal/download"
 	"github.com/blacktop/ipsw/internal/utils"
 	"github.com/blacktop/ipsw/pkg/devicetree"
+	"github.com/blacktop/ipsw/pkg/img3"
 	"github.com/pkg/errors"
 
 	"github.com/spf13/cobra"
@@ -46,12 +49,53 @@ func init() {
 	deviceTreeCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
 	deviceTreeCmd.Flags().BoolP("json", "j", false, "Output to stdout as JSON")
 	deviceTreeCmd.Flags().BoolP("remote", "r", false, "Extract from URL")
+	deviceTreeCmd.Flags().BoolP("mmio", "m", false, "Output the physical MMIO ranges and IRQs of every device")
+	deviceTreeCmd.Flags().StringP("iv-key", "k", "", "AES key (to decrypt an encrypted Img3 DeviceTree)")
+	deviceTreeCmd.Flags().StringP("device", "d", "", "Device to look up the Img3 key for (e.g. iPhone3,1)")
+	deviceTreeCmd.Flags().StringP("build", "b", "", "Build to look up the Img3 key for (e.g. 8A293)")
+	deviceTreeCmd.Flags().String("keys", "", "Key database JSON to look up keys in (in addition to the embedded one)")
 	deviceTreeCmd.MarkZshCompPositionalArgumentFile(1, "DeviceTree*im4p")
 	deviceTreeCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"im4p"}, cobra.ShellCompDirectiveFilterFileExt
 	}
 }
 
+func printMMIO(out io.Writer, devs []devicetree.MMIODevice) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tCOMPATIBLE\tMMIO\tIRQS")
+	for _, dev := range devs {
+		var compatible string
+		if len(dev.Compatible) > 0 {
+			compatible = dev.Compatible[0]
+		}
+		var irqs string
+		if len(dev.Interrupts) > 0 {
+			var nums []string
+			for _, irq := range dev.Interrupts {
+				nums = append(nums, fmt.Sprintf("%d", irq))
+			}
+			irqs = strings.Join(nums, ",")
+			if len(dev.InterruptParent) > 0 {
+				irqs += fmt.Sprintf(" (%s)", filepath.Base(dev.InterruptParent))
+			}
+		}
+		if len(dev.Regs) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", dev.Path, compatible, "-", irqs)
+		}
+		for idx, reg := range dev.Regs {
+			if idx == 0 {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", dev.Path, compatible, reg, irqs)
+			} else {
+				fmt.Fprintf(w, "\t\t%s\t\n", reg)
+			}
+		}
+		if len(dev.Error) > 0 {
+			fmt.Fprintf(w, "\t\t⚠️  %s\t\n", dev.Error)
+		}
+	}
+	w.Flush()
+}
+
 // deviceTreeCmd represents the deviceTree command
 var deviceTreeCmd = &cobra.Command{
 	Use:           "dtree <DeviceTree>",
@@ -71,8 +115,16 @@ var deviceTreeCmd = &cobra.Command{
 		// flags
 		remoteFlag, _ := cmd.Flags().GetBool("remote")
 		asJSON, _ := cmd.Flags().GetBool("json")
+		mmio, _ := cmd.Flags().GetBool("mmio")
+		ivkeyStr, _ := cmd.Flags().GetString("iv-key")
+		device, _ := cmd.Flags().GetString("device")
+		build, _ := cmd.Flags().GetString("build")
+		keysFile, _ := cmd.Flags().GetString("keys")
 
 		if remoteFlag {
+			if mmio {
+				return fmt.Errorf("--mmio is not supported with --remote (extract the DeviceTree first)")
+			}
 			zr, err := download.NewRemoteZipReader(args[0], &download.RemoteConfig{
 				Proxy:    proxy,
 				Insecure: insecure,
@@ -115,19 +167,39 @@ var deviceTreeCmd = &cobra.Command{
 				return errors.Wrap(err, "failed to read DeviceTree")
 			}
 
-			var dtree *devicetree.DeviceTree
-			if bytes.Contains(content[:4], []byte("3gmI")) {
-				dtree, err = devicetree.ParseImg3Data(content)
+			var t *devicetree.Tree
+			if img3.IsImg3(content) {
+				iv, key, err := getImg3Key(content, ivkeyStr, device, build, keysFile, "DeviceTree", filepath.Base(args[0]))
+				if err != nil {
+					return err
+				}
+				t, err = devicetree.ParseImg3TreeWithKey(content, iv, key)
 				if err != nil {
 					return errors.Wrap(err, "failed to extract DeviceTree")
 				}
 			} else {
-				dtree, err = devicetree.ParseImg4Data(content)
+				t, err = devicetree.ParseImg4Tree(content)
 				if err != nil {
 					return errors.Wrap(err, "failed to extract DeviceTree")
 				}
 			}
 
+			if mmio {
+				devs := t.MMIO()
+				if asJSON {
+					j, err := json.Marshal(devs)
+					if err != nil {
+						return err
+					}
+					fmt.Println(string(j))
+				} else {
+					printMMIO(os.Stdout, devs)
+				}
+				return nil
+			}
+
+			dtree := t.DeviceTree()
+
 			if asJSON {
 				// jq '.[ "device-tree" ].children [] | select(.product != null) | .product."product-name"'
 				// jq '.[ "device-tree" ].compatible'
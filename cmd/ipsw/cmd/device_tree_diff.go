@@ -0,0 +1,201 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/download"
+	"github.com/blacktop/ipsw/pkg/devicetree"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	deviceTreeCmd.AddCommand(dtreeDiffCmd)
+
+	dtreeDiffCmd.Flags().BoolP("remote", "r", false, "Read URL arguments as remote IPSWs")
+	dtreeDiffCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
+	dtreeDiffCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
+	dtreeDiffCmd.Flags().BoolP("all", "a", false, "Also diff volatile properties (time-stamp, AAPL,phandle)")
+	dtreeDiffCmd.Flags().StringArrayP("ignore", "i", []string{}, "Property to ignore (can be repeated)")
+	dtreeDiffCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+
+	dtreeDiffCmd.MarkZshCompPositionalArgumentFile(1)
+	dtreeDiffCmd.MarkZshCompPositionalArgumentFile(2)
+}
+
+type dtreeDiffResult struct {
+	Old         string                  `json:"old"`
+	New         string                  `json:"new"`
+	Differences []devicetree.Difference `json:"differences"`
+}
+
+// loadDeviceTreeTrees parses the DeviceTree(s) of a DeviceTree file, a local IPSW or a remote IPSW URL
+func loadDeviceTreeTrees(src string, remote bool, proxy string, insecure bool) (map[string]*devicetree.Tree, error) {
+	if remote && isURL(src) {
+		zr, err := download.NewRemoteZipReader(src, &download.RemoteConfig{
+			Proxy:    proxy,
+			Insecure: insecure,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create new remote zip reader")
+		}
+		return devicetree.ParseZipFilesTrees(zr.File)
+	}
+
+	if isZipFile(src) {
+		return devicetree.ParseTrees(src)
+	}
+
+	t, _, err := loadDeviceTreeTree(src)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*devicetree.Tree{filepath.Base(src): t}, nil
+}
+
+func sortedTreeNames(trees map[string]*devicetree.Tree) []string {
+	var names []string
+	for name := range trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func printDeviceTreeDiff(diffs []devicetree.Difference) {
+	added := color.New(color.FgGreen)
+	removed := color.New(color.FgRed)
+	changed := color.New(color.FgYellow)
+
+	for _, d := range diffs {
+		switch {
+		case d.Kind == devicetree.DiffAdded && len(d.Property) == 0:
+			added.Printf("+ %s\n", d.Path)
+		case d.Kind == devicetree.DiffRemoved && len(d.Property) == 0:
+			removed.Printf("- %s\n", d.Path)
+		case d.Kind == devicetree.DiffAdded:
+			added.Printf("+ %s %s: %s\n", d.Path, d.Property, d.New)
+		case d.Kind == devicetree.DiffRemoved:
+			removed.Printf("- %s %s: %s\n", d.Path, d.Property, d.Old)
+		default:
+			changed.Printf("~ %s %s: %s -> %s\n", d.Path, d.Property, d.Old, d.New)
+		}
+	}
+}
+
+// dtreeDiffCmd represents the dtree diff command
+var dtreeDiffCmd = &cobra.Command{
+	Use:           "diff <DeviceTree|IPSW|URL> <DeviceTree|IPSW|URL>",
+	Short:         "Diff DeviceTrees",
+	Args:          cobra.ExactArgs(2),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		remote, _ := cmd.Flags().GetBool("remote")
+		proxy, _ := cmd.Flags().GetString("proxy")
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		all, _ := cmd.Flags().GetBool("all")
+		ignore, _ := cmd.Flags().GetStringArray("ignore")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		oldTrees, err := loadDeviceTreeTrees(args[0], remote, proxy, insecure)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse DeviceTrees of %s", args[0])
+		}
+		newTrees, err := loadDeviceTreeTrees(args[1], remote, proxy, insecure)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse DeviceTrees of %s", args[1])
+		}
+
+		conf := &devicetree.DiffConfig{}
+		if !all {
+			conf.Ignore = append(conf.Ignore, devicetree.VolatileProperties...)
+		}
+		conf.Ignore = append(conf.Ignore, ignore...)
+
+		var results []dtreeDiffResult
+		if len(oldTrees) == 1 && len(newTrees) == 1 {
+			// compare the two DeviceTrees whatever their names (e.g. across devices)
+			oldName, newName := sortedTreeNames(oldTrees)[0], sortedTreeNames(newTrees)[0]
+			results = append(results, dtreeDiffResult{
+				Old:         oldName,
+				New:         newName,
+				Differences: devicetree.Diff(oldTrees[oldName], newTrees[newName], conf),
+			})
+		} else {
+			// compare the DeviceTrees with the same names (e.g. across firmware versions)
+			for _, name := range sortedTreeNames(oldTrees) {
+				if t, ok := newTrees[name]; ok {
+					results = append(results, dtreeDiffResult{
+						Old:         name,
+						New:         name,
+						Differences: devicetree.Diff(oldTrees[name], t, conf),
+					})
+				} else {
+					log.Warnf("%s is only in %s", name, args[0])
+				}
+			}
+			for _, name := range sortedTreeNames(newTrees) {
+				if _, ok := oldTrees[name]; !ok {
+					log.Warnf("%s is only in %s", name, args[1])
+				}
+			}
+		}
+
+		if asJSON {
+			j, err := json.Marshal(results)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(j))
+			return nil
+		}
+
+		for _, res := range results {
+			if res.Old == res.New {
+				log.Info(res.Old)
+			} else {
+				log.Infof("%s -> %s", res.Old, res.New)
+			}
+			if len(res.Differences) == 0 {
+				fmt.Println("  no differences")
+				continue
+			}
+			printDeviceTreeDiff(res.Differences)
+			fmt.Println()
+		}
+
+		return nil
+	},
+}
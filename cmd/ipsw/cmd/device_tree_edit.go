@@ -0,0 +1,268 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/devicetree"
+	"github.com/blacktop/ipsw/pkg/img3"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	deviceTreeCmd.AddCommand(dtreeSetCmd)
+	deviceTreeCmd.AddCommand(dtreeAddCmd)
+	deviceTreeCmd.AddCommand(dtreeDeleteCmd)
+
+	for _, cmd := range []*cobra.Command{dtreeSetCmd, dtreeAddCmd, dtreeDeleteCmd} {
+		cmd.Flags().StringP("output", "o", "", "Output file (default is <DeviceTree>.patched)")
+		cmd.Flags().Bool("raw", false, "Output the flattened DeviceTree (do not re-wrap it into an IM4P)")
+		cmd.MarkZshCompPositionalArgumentFile(1, "DeviceTree*")
+	}
+	for _, cmd := range []*cobra.Command{dtreeSetCmd, dtreeAddCmd} {
+		cmd.Flags().StringP("type", "t", devicetree.ValueString, "Property value type (string, strings, u32, u64, cells, hex or empty)")
+	}
+}
+
+// loadDeviceTreeTree parses a DeviceTree IM4P, Img3 or flattened DeviceTree file (and returns the IM4P to re-wrap it like)
+func loadDeviceTreeTree(path string) (*devicetree.Tree, *devicetree.Img4, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read DeviceTree")
+	}
+
+	if img3.IsImg3(content) {
+		iv, key, err := getImg3Key(content, "", "", "", "", "DeviceTree", filepath.Base(path))
+		if err != nil {
+			return nil, nil, err
+		}
+		t, err := devicetree.ParseImg3TreeWithKey(content, iv, key)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to parse DeviceTree")
+		}
+		return t, nil, nil
+	}
+
+	if len(content) > 16 && bytes.Contains(content[:16], []byte("IM4P")) {
+		var i devicetree.Img4
+		if _, err := asn1.Unmarshal(content, &i); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to parse DeviceTree IM4P")
+		}
+		t, err := devicetree.ParseImg4Tree(content)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to parse DeviceTree")
+		}
+		return t, &i, nil
+	}
+
+	t, err := devicetree.ParseTree(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse flattened DeviceTree")
+	}
+	return t, nil, nil
+}
+
+// writeDeviceTreeTree serializes a DeviceTree (re-wrapped into an IM4P like the input unless raw)
+func writeDeviceTreeTree(t *devicetree.Tree, im4p *devicetree.Img4, input, output string, raw bool) error {
+	var data []byte
+	var err error
+	if im4p != nil && !raw {
+		data, err = t.MarshalIm4p(im4p.Name, im4p.Version)
+	} else {
+		data, err = t.Marshal()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize DeviceTree")
+	}
+
+	if len(output) == 0 {
+		ext := filepath.Ext(input)
+		if (im4p != nil && raw) || strings.EqualFold(ext, ".img3") {
+			ext = "" // Img3 DeviceTrees are written as flattened DeviceTrees
+		}
+		output = strings.TrimSuffix(input, filepath.Ext(input)) + ".patched" + ext
+	}
+
+	utils.Indent(log.Info, 2)(fmt.Sprintf("Creating %s", output))
+	if err := ioutil.WriteFile(output, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write file: %s", output)
+	}
+
+	return nil
+}
+
+// dtreeSetCmd represents the dtree set command
+var dtreeSetCmd = &cobra.Command{
+	Use:           "set <DeviceTree> <NODE_PATH> <PROPERTY> <VALUE>",
+	Short:         "Set the value of an existing DeviceTree property",
+	Args:          cobra.ExactArgs(4),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		raw, _ := cmd.Flags().GetBool("raw")
+		typ, _ := cmd.Flags().GetString("type")
+
+		t, im4p, err := loadDeviceTreeTree(args[0])
+		if err != nil {
+			return err
+		}
+
+		node, err := t.Find(args[1])
+		if err != nil {
+			return err
+		}
+		if node.Property(args[2]) == nil {
+			return fmt.Errorf("property %s not found in %s (use `ipsw dtree add` to add it)", args[2], node.Path())
+		}
+
+		value, err := devicetree.EncodeValue(typ, args[3])
+		if err != nil {
+			return err
+		}
+		if err := node.SetProperty(args[2], value); err != nil {
+			return err
+		}
+		log.Infof("Set %s %s to %v", node.Path(), args[2], node.Value(node.Property(args[2])))
+
+		return writeDeviceTreeTree(t, im4p, args[0], output, raw)
+	},
+}
+
+// dtreeAddCmd represents the dtree add command
+var dtreeAddCmd = &cobra.Command{
+	Use:           "add <DeviceTree> <NODE_PATH> [PROPERTY VALUE]",
+	Short:         "Add a DeviceTree node (or a property to an existing node)",
+	Args:          cobra.RangeArgs(2, 4),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		raw, _ := cmd.Flags().GetBool("raw")
+		typ, _ := cmd.Flags().GetString("type")
+
+		if len(args) == 3 && typ != devicetree.ValueEmpty {
+			return fmt.Errorf("a property needs a VALUE (or --type empty)")
+		}
+
+		t, im4p, err := loadDeviceTreeTree(args[0])
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 2 {
+			parentPath, name := filepath.Split(strings.TrimRight(args[1], "/"))
+			parent, err := t.Find(parentPath)
+			if err != nil {
+				return err
+			}
+			node, err := parent.AddChild(name)
+			if err != nil {
+				return err
+			}
+			log.Infof("Added node %s", node.Path())
+		} else {
+			node, err := t.Find(args[1])
+			if err != nil {
+				return err
+			}
+			if node.Property(args[2]) != nil {
+				return fmt.Errorf("property %s already exists in %s (use `ipsw dtree set` to change it)", args[2], node.Path())
+			}
+			var val string
+			if len(args) == 4 {
+				val = args[3]
+			}
+			value, err := devicetree.EncodeValue(typ, val)
+			if err != nil {
+				return err
+			}
+			if err := node.SetProperty(args[2], value); err != nil {
+				return err
+			}
+			log.Infof("Added %s %s = %v", node.Path(), args[2], node.Value(node.Property(args[2])))
+		}
+
+		return writeDeviceTreeTree(t, im4p, args[0], output, raw)
+	},
+}
+
+// dtreeDeleteCmd represents the dtree delete command
+var dtreeDeleteCmd = &cobra.Command{
+	Use:           "delete <DeviceTree> <NODE_PATH> [PROPERTY]",
+	Aliases:       []string{"rm"},
+	Short:         "Delete a DeviceTree node (or one of its properties)",
+	Args:          cobra.RangeArgs(2, 3),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		raw, _ := cmd.Flags().GetBool("raw")
+
+		t, im4p, err := loadDeviceTreeTree(args[0])
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 3 {
+			node, err := t.Find(args[1])
+			if err != nil {
+				return err
+			}
+			if err := node.DeleteProperty(args[2]); err != nil {
+				return err
+			}
+			log.Infof("Deleted %s %s", node.Path(), args[2])
+		} else {
+			if err := t.Delete(args[1]); err != nil {
+				return err
+			}
+			log.Infof("Deleted node %s", args[1])
+		}
+
+		return writeDeviceTreeTree(t, im4p, args[0], output, raw)
+	},
+}
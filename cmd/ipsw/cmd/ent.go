@@ -47,6 +47,11 @@ func init() {
 	entCmd.Flags().StringP("ent", "e", "", "Entitlement to search for")
 	entCmd.Flags().String("db", "", "Path to entitlement database to use")
 	entCmd.Flags().StringP("file", "f", "", "Output entitlements for file")
+	entCmd.Flags().String("vfkey", "", "VFDecrypt key to decrypt a legacy encrypted File System DMG with")
+	entCmd.Flags().String("keys", "", "Path to a JSON firmware key database")
+	entCmd.Flags().Bool("wiki-keys", false, "Look up a missing VFDecrypt key on theiphonewiki.com")
+	entCmd.Flags().String("proxy", "", "HTTP/HTTPS proxy")
+	entCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
 }
 
 type Entitlements map[string]interface{}
@@ -68,6 +73,11 @@ var entCmd = &cobra.Command{
 		entitlement, _ := cmd.Flags().GetString("ent")
 		entDBPath, _ := cmd.Flags().GetString("db")
 		searchFile, _ := cmd.Flags().GetString("file")
+		vfKey, _ := cmd.Flags().GetString("vfkey")
+		keysFile, _ := cmd.Flags().GetString("keys")
+		wikiKeys, _ := cmd.Flags().GetBool("wiki-keys")
+		proxy, _ := cmd.Flags().GetString("proxy")
+		insecure, _ := cmd.Flags().GetBool("insecure")
 
 		if len(entitlement) == 0 && len(searchFile) == 0 {
 			log.Errorf("you must supply a --ent OR --file")
@@ -95,8 +105,11 @@ var entCmd = &cobra.Command{
 					found = true
 				}
 			}
-			if !found {
-				return fmt.Errorf("failed to parse ipsw info: %v", err)
+			if !found { // legacy (HFS+) IPSWs
+				fsDMG = i.GetOsDmg()
+				if len(fsDMG) == 0 {
+					return fmt.Errorf("failed to find the File System DMG in ipsw")
+				}
 			}
 
 			fileSystem, err := utils.Unzip(ipswPath, "", func(f *zip.File) bool {
@@ -107,6 +120,10 @@ var entCmd = &cobra.Command{
 			}
 			defer os.Remove(fileSystem[0])
 
+			if err := decryptFsDMG(fileSystem[0], vfKey, keysFile, i, wikiKeys, proxy, insecure); err != nil {
+				return fmt.Errorf("failed to decrypt %s: %v", fileSystem[0], err)
+			}
+
 			mountPoint := "/tmp/filesystem_dmg"
 			utils.Indent(log.Info, 2)(fmt.Sprintf("Mounting DMG %s", fileSystem[0]))
 			if err := utils.Mount(fileSystem[0], mountPoint); err != nil {
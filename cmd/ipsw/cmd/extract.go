@@ -37,6 +37,7 @@ import (
 	"github.com/blacktop/ipsw/pkg/dyld"
 	"github.com/blacktop/ipsw/pkg/info"
 	"github.com/blacktop/ipsw/pkg/kernelcache"
+	"github.com/blacktop/ipsw/pkg/vfdecrypt"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -53,10 +54,13 @@ func init() {
 	extractCmd.Flags().BoolP("dtree", "t", false, "Extract DeviceTree")
 	extractCmd.Flags().BoolP("dmg", "f", false, "Extract File System DMG")
 	extractCmd.Flags().BoolP("iboot", "i", false, "Extract iBoot")
-	extractCmd.Flags().BoolP("sep", "s", false, "Extract sep-firmware")
+	extractCmd.Flags().BoolP("sep", "s", false, "Extract sep-firmware (and split it into its MachOs)")
 	extractCmd.Flags().String("pattern", "", "Download remote files that match (not regex)")
 	extractCmd.Flags().StringP("output", "o", "", "Folder to extract files to")
 	extractCmd.Flags().StringArrayP("dyld-arch", "a", []string{}, "dyld_shared_cache architecture to extract")
+	extractCmd.Flags().String("vfkey", "", "VFDecrypt key to decrypt a legacy encrypted File System DMG with")
+	extractCmd.Flags().String("keys", "", "Path to a JSON firmware key database (to decrypt the File System DMG or sep-firmware with)")
+	extractCmd.Flags().Bool("wiki-keys", false, "Look up a missing VFDecrypt key on theiphonewiki.com")
 
 	extractCmd.MarkZshCompPositionalArgumentFile(1, "*.ipsw")
 	extractCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -69,6 +73,65 @@ func isURL(str string) bool {
 	return err == nil && u.Scheme != "" && u.Host != ""
 }
 
+// getVFDecryptKey returns the VFDecrypt key of an encrypted File System DMG from --vfkey, the firmware key database
+// or (with --wiki-keys) the device's keys page on theiphonewiki.com
+func getVFDecryptKey(vfKey, keysFile string, devices []string, build, dmgName string, wiki bool, proxy string, insecure bool) ([]byte, error) {
+	if len(vfKey) > 0 {
+		return vfdecrypt.ParseKey(vfKey)
+	}
+	db, err := getKeyDB(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if key, err := db.Lookup(device, build, "RootFileSystem", dmgName); err == nil {
+			return vfdecrypt.ParseKey(key.Key)
+		}
+	}
+	if !wiki {
+		return nil, fmt.Errorf("failed to find VFDecrypt key for %s (supply one with --vfkey or --keys, or look it up with --wiki-keys)", dmgName)
+	}
+	for _, device := range devices {
+		utils.Indent(log.Info, 2)(fmt.Sprintf("Looking up %s %s VFDecrypt key on theiphonewiki.com", device, build))
+		keys, err := download.GetWikiFirmwareKeys(device, build, proxy, insecure)
+		if err != nil {
+			log.Debugf("failed to get theiphonewiki.com keys for %s: %v", device, err)
+			continue
+		}
+		if len(keys.RootFSKey) > 0 && (len(keys.RootFS) == 0 || strings.EqualFold(strings.TrimSuffix(dmgName, ".dmg"), keys.RootFS)) {
+			return vfdecrypt.ParseKey(keys.RootFSKey)
+		}
+	}
+	return nil, fmt.Errorf("failed to find VFDecrypt key for %s (supply one with --vfkey or --keys)", dmgName)
+}
+
+// decryptFsDMG decrypts a legacy encrcdsa File System DMG in place (if it is encrypted)
+func decryptFsDMG(dmgPath, vfKey, keysFile string, i *info.Info, wiki bool, proxy string, insecure bool) error {
+	f, err := os.Open(dmgPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", dmgPath, err)
+	}
+	encrypted := vfdecrypt.IsEncrypted(f)
+	f.Close()
+	if !encrypted {
+		return nil
+	}
+
+	key, err := getVFDecryptKey(vfKey, keysFile, i.Plists.BuildManifest.SupportedProductTypes, i.Plists.BuildManifest.ProductBuildVersion, filepath.Base(dmgPath), wiki, proxy, insecure)
+	if err != nil {
+		return err
+	}
+
+	utils.Indent(log.Info, 2)(fmt.Sprintf("Decrypting File System DMG %s", filepath.Base(dmgPath)))
+	decPath := dmgPath + ".dec"
+	if err := vfdecrypt.DecryptFile(dmgPath, decPath, key); err != nil {
+		os.Remove(decPath)
+		return err
+	}
+
+	return os.Rename(decPath, dmgPath)
+}
+
 // extractCmd represents the extract command
 var extractCmd = &cobra.Command{
 	Use:           "extract <IPSW/OTA | URL>",
@@ -92,6 +155,11 @@ var extractCmd = &cobra.Command{
 		pattern, _ := cmd.Flags().GetString("pattern")
 		output, _ := cmd.Flags().GetString("output")
 		dyldArches, _ := cmd.Flags().GetStringArray("dyld-arch")
+		vfKey, _ := cmd.Flags().GetString("vfkey")
+		keysFile, _ := cmd.Flags().GetString("keys")
+		wikiKeys, _ := cmd.Flags().GetBool("wiki-keys")
+		proxy, _ := cmd.Flags().GetString("proxy")
+		insecure, _ := cmd.Flags().GetBool("insecure")
 
 		if len(dyldArches) > 0 && !dyldFlag {
 			return errors.New("--dyld-arch or -a can only be used with --dyld or -d")
@@ -107,9 +175,6 @@ var extractCmd = &cobra.Command{
 		destPath := filepath.Clean(output)
 
 		if remote {
-			proxy, _ := cmd.Flags().GetString("proxy")
-			insecure, _ := cmd.Flags().GetBool("insecure")
-
 			remoteURL := args[0]
 
 			if !isURL(remoteURL) {
@@ -211,12 +276,17 @@ var extractCmd = &cobra.Command{
 
 			if dmgFlag {
 				log.Info("Extracting File System DMG")
-				_, err = utils.Unzip(ipswPath, destPath, func(f *zip.File) bool {
+				dmgs, err := utils.Unzip(ipswPath, destPath, func(f *zip.File) bool {
 					return strings.EqualFold(filepath.Base(f.Name), i.GetOsDmg())
 				})
 				if err != nil {
 					return fmt.Errorf("failed extract %s from ipsw: %v", i.GetOsDmg(), err)
 				}
+				for _, dmg := range dmgs {
+					if err := decryptFsDMG(filepath.Join(destPath, dmg), vfKey, keysFile, i, wikiKeys, proxy, insecure); err != nil {
+						return fmt.Errorf("failed to decrypt %s: %v", dmg, err)
+					}
+				}
 				log.Infof("Created %s", filepath.Join(destPath, i.GetOsDmg()))
 			}
 
@@ -234,7 +304,7 @@ var extractCmd = &cobra.Command{
 
 			if sepFlag {
 				log.Info("Extracting sep-firmwares")
-				_, err := utils.Unzip(ipswPath, destPath, func(f *zip.File) bool {
+				seps, err := utils.Unzip(ipswPath, destPath, func(f *zip.File) bool {
 					var validSEP = regexp.MustCompile(`.*sep-firmware.*im4p$`)
 					return validSEP.MatchString(f.Name)
 				})
@@ -242,6 +312,13 @@ var extractCmd = &cobra.Command{
 				if err != nil {
 					return errors.Wrap(err, "failed to extract sep-firmware from ipsw")
 				}
+
+				for _, sepFw := range seps {
+					outDir := filepath.Join(destPath, strings.TrimSuffix(sepFw, filepath.Ext(sepFw)))
+					if err := splitSEPFirmware(filepath.Join(destPath, sepFw), outDir, keysFile, i); err != nil {
+						log.Warnf("failed to split %s: %v", sepFw, err)
+					}
+				}
 			}
 		}
 
@@ -0,0 +1,223 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/ftab"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/blacktop/ipsw/pkg/rtkit"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(fwCmd)
+
+	fwCmd.Flags().BoolP("json", "j", false, "Print the firmwares as JSON")
+	fwCmd.Flags().StringP("output", "o", "", "Folder to split the ftab segments into")
+}
+
+// fwEntry is a coprocessor firmware found in a file
+type fwEntry struct {
+	File      string `json:"file"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+	*rtkit.Firmware
+}
+
+// isFirmwareHead returns true if the first bytes of a file are an Im4p or ftab header
+func isFirmwareHead(head []byte) bool {
+	return utils.IsIm4p(head) || ftab.IsFtab(head)
+}
+
+// inventoryFirmware identifies the coprocessor firmwares in a file (an Im4p, ftab or raw firmware).
+// If all is false only RTKit firmwares and known coprocessor components are returned.
+func inventoryFirmware(path string, data []byte, all bool, output string) ([]fwEntry, error) {
+	var tag string
+	if utils.IsIm4p(data) {
+		im4p, err := img4.ParseIm4p(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		tag = im4p.Type
+		if im4p.Encrypted() {
+			if _, ok := rtkit.Components[tag]; !ok && !all {
+				return nil, nil
+			}
+			return []fwEntry{{
+				File:      path,
+				Encrypted: true,
+				Firmware:  &rtkit.Firmware{Name: rtkit.Name(tag), Tag: tag},
+			}}, nil
+		}
+		if data, err = decryptIm4p(im4p.Data, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if ftab.IsFtab(data) {
+		ft, err := ftab.Parse(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(output) > 0 {
+			folder := filepath.Join(output, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+			if err := os.MkdirAll(folder, 0755); err != nil {
+				return nil, err
+			}
+			seen := make(map[string]int)
+			for _, e := range ft.Entries {
+				name := e.Tag
+				if n := seen[e.Tag]; n > 0 { // don't overwrite entries with the same tag
+					name = fmt.Sprintf("%s_%d", e.Tag, n)
+				}
+				seen[e.Tag]++
+				fname := filepath.Join(folder, filepath.Clean("/"+name+".bin")) // keep the entries inside folder
+				if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+					return nil, err
+				}
+				if err := ioutil.WriteFile(fname, e.Data(), 0644); err != nil {
+					return nil, errors.Wrapf(err, "failed to write %s", fname)
+				}
+				utils.Indent(log.Info, 2)(fmt.Sprintf("Created %s", fname))
+			}
+		}
+		var fws []fwEntry
+		for _, e := range ft.Entries {
+			fw := rtkit.Parse(e.Tag, e.Data())
+			if _, ok := rtkit.Components[e.Tag]; !ok || e.Tag == ft.Tag {
+				// the segments of an ftab are tagged the same for every coprocessor (e.g. rkos)
+				if name := rtkit.NameFromPath(path); len(name) > 0 {
+					fw.Name = name
+				}
+			}
+			fws = append(fws, fwEntry{File: path + ":" + e.Tag, Firmware: fw})
+		}
+		return fws, nil
+	}
+
+	if _, ok := rtkit.Components[tag]; !ok && !all && !rtkit.IsRTKit(data) && len(rtkit.NameFromPath(path)) == 0 {
+		return nil, nil
+	}
+	fw := rtkit.Parse(tag, data)
+	if _, ok := rtkit.Components[tag]; !ok {
+		if name := rtkit.NameFromPath(path); len(name) > 0 {
+			fw.Name = name
+		} else if len(fw.Name) == 0 {
+			fw.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+	}
+	return []fwEntry{{File: path, Firmware: fw}}, nil
+}
+
+// fwCmd represents the fw command
+var fwCmd = &cobra.Command{
+	Use:   "fw <FIRMWARE|IPSW>",
+	Short: "Identify coprocessor (RTKit) firmwares",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		asJSON, _ := cmd.Flags().GetBool("json")
+		output, _ := cmd.Flags().GetString("output")
+
+		src := filepath.Clean(args[0])
+		fi, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+
+		var fws []fwEntry
+		if fi.IsDir() || isZipFile(src) {
+			if err := walkFiles(src, isFirmwareHead, func(path string, data []byte) error {
+				found, err := inventoryFirmware(path, data, false, output)
+				if err != nil {
+					log.Warnf("failed to parse %s: %v", path, err)
+					return nil
+				}
+				fws = append(fws, found...)
+				return nil
+			}); err != nil {
+				return errors.Wrapf(err, "failed to walk %s", src)
+			}
+		} else {
+			data, err := ioutil.ReadFile(src)
+			if err != nil {
+				return err
+			}
+			if fws, err = inventoryFirmware(filepath.Base(src), data, true, output); err != nil {
+				return errors.Wrapf(err, "failed to parse %s", src)
+			}
+		}
+
+		if asJSON {
+			dat, err := json.MarshalIndent(fws, "", "    ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(dat))
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FILE\tNAME\tTAG\tARCH\tFORMAT\tVERSION")
+		for _, fw := range fws {
+			version := fw.Version
+			if fw.Encrypted {
+				version = "(encrypted)"
+			} else if len(version) == 0 {
+				version = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", fw.File, fw.Name, fw.Tag, fw.Arch, fw.Format, version)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if Verbose {
+			for _, fw := range fws {
+				if len(fw.Segments) == 0 {
+					continue
+				}
+				fmt.Printf("\n%s (%s)\n", fw.File, fw.Name)
+				for _, seg := range fw.Segments {
+					fmt.Printf("  %-16s %#x-%#x offset: %#x size: %#x\n", seg.Name, seg.VMAddr, seg.VMAddr+seg.VMSize, seg.Offset, seg.Size)
+				}
+			}
+		}
+
+		return nil
+	},
+}
@@ -23,16 +23,17 @@ package cmd
 
 import (
 	"bytes"
-	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/apex/log"
-	// lzfse "github.com/blacktop/go-lzfse"
 	"github.com/blacktop/ipsw/internal/utils"
-	"github.com/blacktop/ipsw/pkg/lzfse"
+	"github.com/blacktop/ipsw/pkg/iboot"
+	"github.com/blacktop/ipsw/pkg/img4"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -40,90 +41,113 @@ import (
 func init() {
 	rootCmd.AddCommand(ibootCmd)
 
-	// Here you will define your flags and configuration settings.
+	ibootCmd.Flags().BoolP("info", "i", false, "Only print the iBoot info (don't dump the embedded firmwares)")
+	ibootCmd.Flags().BoolP("json", "j", false, "Print the iBoot info as JSON")
+	ibootCmd.Flags().StringP("output", "o", "", "Folder to dump the embedded firmwares to")
+	ibootCmd.Flags().StringP("symbols", "s", "", "Recover function names and write them to a symbols file")
+	ibootCmd.Flags().StringP("format", "f", "", "Symbols file format (json, ida or ghidra; default is from the file extension)")
+}
+
+// symbolsFormat returns the symbols file format from the file extension (.json, .py or anything else for Ghidra)
+func symbolsFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return iboot.FormatJSON
+	case ".py":
+		return iboot.FormatIDA
+	}
+	return iboot.FormatGhidra
+}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// ibootCmd.PersistentFlags().String("foo", "", "A help for foo")
+// loadIBoot reads a decrypted iBoot (raw or as an unencrypted IM4P)
+func loadIBoot(path string) (*iboot.IBoot, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unabled to read file: %s", path)
+	}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// ibootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	if len(dat) > 0 && dat[0] == 0x30 { // ASN.1 SEQUENCE
+		i, err := img4.ParseIm4p(bytes.NewReader(dat))
+		if err != nil {
+			return nil, err
+		}
+		if i.Encrypted() {
+			return nil, fmt.Errorf("%s is encrypted (decrypt it with `ipsw img4 dec` first)", path)
+		}
+		if dat, err = decryptIm4p(i.Data, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return iboot.Parse(dat)
 }
 
 // ibootCmd represents the iboot command
 var ibootCmd = &cobra.Command{
 	Use:   "iboot <IBOOT_BIN>",
-	Short: "Dump firmwares",
+	Short: "Parse iBoot and dump its embedded firmwares",
 	Args:  cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var name string
 
 		if Verbose {
 			log.SetLevel(log.DebugLevel)
 		}
 
-		f, err := os.Open(args[0])
-		if err != nil {
-			return errors.Wrapf(err, "unabled to open file: %s", args[0])
-		}
+		infoOnly, _ := cmd.Flags().GetBool("info")
+		asJSON, _ := cmd.Flags().GetBool("json")
+		output, _ := cmd.Flags().GetString("output")
+		symbolsFile, _ := cmd.Flags().GetString("symbols")
+		format, _ := cmd.Flags().GetString("format")
 
-		dat, err := ioutil.ReadAll(f)
+		ib, err := loadIBoot(args[0])
 		if err != nil {
-			return errors.Wrapf(err, "unabled to read file: %s", args[0])
+			return errors.Wrapf(err, "failed to parse iBoot %s", args[0])
 		}
 
-		lzfseStart := make([]byte, 4)
-		lzfseEnd := make([]byte, 4)
-		binary.LittleEndian.PutUint32(lzfseStart, 0x32787662)
-		binary.LittleEndian.PutUint32(lzfseEnd, 0x24787662)
-
-		found := 0
-
-		for {
-			firstStartMatch := bytes.Index(dat, lzfseStart)
-			firstEndMatch := bytes.Index(dat, lzfseEnd)
-
-			if firstStartMatch < 0 || firstEndMatch < 0 {
-				break
+		if len(symbolsFile) > 0 {
+			if len(format) == 0 {
+				format = symbolsFormat(symbolsFile)
 			}
+			funcs, err := ib.Symbolicate()
+			if err != nil {
+				return errors.Wrap(err, "failed to recover function names")
+			}
+			buf := new(bytes.Buffer)
+			if err := ib.WriteSymbols(buf, format); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(symbolsFile, buf.Bytes(), 0644); err != nil {
+				return errors.Wrapf(err, "unabled to write file: %s", symbolsFile)
+			}
+			log.Infof("Recovered %d function names (%s symbols written to %s)", len(funcs), format, symbolsFile)
+		}
 
-			decData, err := lzfse.NewDecoder(dat[firstStartMatch : firstEndMatch+4]).DecodeBuffer()
+		if asJSON {
+			dat, err := json.MarshalIndent(ib, "", "    ")
 			if err != nil {
-				return fmt.Errorf("failed to lzfse decompress embedded firmware: %v", err)
+				return err
 			}
+			fmt.Println(string(dat))
+		} else {
+			fmt.Print(ib)
+		}
 
-			// decData := lzfse.DecodeBuffer(dat[firstStartMatch : firstEndMatch+4])
-			// lr := bytes.NewReader(dat[firstStartMatch : firstEndMatch+4])
-			// buf := new(bytes.Buffer)
-
-			// _, err := buf.ReadFrom(lr)
-			// if err != nil {
-			// 	return errors.Wrap(err, "failed to lzfse decompress embedded firmware")
-			// }
-
-			matches := utils.GrepStrings(decData, "AppleSMCFirmware")
-			if len(matches) > 0 {
-				name = strings.TrimPrefix(matches[0], "@@") + ".bin"
-			} else {
-				matches = utils.GrepStrings(decData, "AppleStorageProcessorANS2")
-				if len(matches) > 0 {
-					name = matches[0] + ".bin"
-				} else {
-					name = fmt.Sprintf("firmware%d.bin", found)
-				}
+		if infoOnly {
+			return nil
+		}
+
+		if len(output) > 0 {
+			if err := os.MkdirAll(output, 0755); err != nil {
+				return errors.Wrapf(err, "failed to create output folder %s", output)
 			}
+		}
 
+		for _, p := range ib.Payloads {
+			name := filepath.Join(output, p.Name)
 			utils.Indent(log.Info, 2)(fmt.Sprintf("Dumping %s", name))
-			ioutil.WriteFile(name, decData, 0644)
-			if err != nil {
+			if err := ioutil.WriteFile(name, p.Data(), 0644); err != nil {
 				return errors.Wrapf(err, "unabled to write file: %s", name)
 			}
-
-			// io.Copy(outf, lr)
-
-			found++
-			dat = dat[firstEndMatch+4:]
 		}
 
 		return nil
@@ -32,7 +32,7 @@ func init() {
 // img4Cmd represents the img4 command
 var img4Cmd = &cobra.Command{
 	Use:   "img4",
-	Short: "Parse Img4",
+	Short: "Parse and create Img4",
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
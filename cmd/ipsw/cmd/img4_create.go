@@ -0,0 +1,154 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/blacktop/ipsw/pkg/kernelcache"
+	"github.com/blacktop/ipsw/pkg/shsh"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	img4Cmd.AddCommand(img4CreateCmd)
+
+	img4CreateCmd.Flags().StringP("type", "t", "", "Im4p type (4 chars, e.g. krnl)")
+	img4CreateCmd.Flags().StringP("description", "d", "", "Im4p description (e.g. KernelCacheBuilder-...)")
+	img4CreateCmd.Flags().StringP("compress", "c", "none", "Compress payload (lzss, lzfse or none)")
+	img4CreateCmd.Flags().StringP("im4m", "m", "", "Im4m manifest to attach (creates an Img4)")
+	img4CreateCmd.Flags().StringP("shsh", "s", "", "SHSH blob to take the Im4m (and boot nonce generator) from (creates an Img4)")
+	img4CreateCmd.Flags().StringP("boot-nonce", "g", "", "Boot nonce generator for the Im4r BNCN (e.g. 0x1111111111111111)")
+	img4CreateCmd.Flags().StringP("output", "o", "", "Output file")
+	img4CreateCmd.MarkFlagRequired("type")
+
+	img4CreateCmd.MarkZshCompPositionalArgumentFile(1)
+}
+
+// img4CreateCmd represents the create command
+var img4CreateCmd = &cobra.Command{
+	Use:   "create <payload>",
+	Short: "Create an Im4p (or Img4) from a raw payload",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		typ, _ := cmd.Flags().GetString("type")
+		desc, _ := cmd.Flags().GetString("description")
+		compression, _ := cmd.Flags().GetString("compress")
+		im4mFile, _ := cmd.Flags().GetString("im4m")
+		shshFile, _ := cmd.Flags().GetString("shsh")
+		generator, _ := cmd.Flags().GetString("boot-nonce")
+		outputFile, _ := cmd.Flags().GetString("output")
+
+		if len(im4mFile) > 0 && len(shshFile) > 0 {
+			return errors.New("you can only supply one of --im4m or --shsh")
+		}
+
+		payload, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return errors.Wrapf(err, "unabled to read file: %s", args[0])
+		}
+
+		data, err := kernelcache.CompressData(payload, strings.ToLower(compression))
+		if err != nil {
+			return err
+		}
+
+		im4p, err := img4.CreateIm4p(typ, desc, data, nil)
+		if err != nil {
+			return err
+		}
+
+		var im4m []byte
+		if len(im4mFile) > 0 {
+			im4m, err = ioutil.ReadFile(im4mFile)
+			if err != nil {
+				return errors.Wrapf(err, "unabled to read file: %s", im4mFile)
+			}
+		} else if len(shshFile) > 0 {
+			f, err := os.Open(shshFile)
+			if err != nil {
+				return errors.Wrapf(err, "unabled to open file: %s", shshFile)
+			}
+			defer f.Close()
+			blob, err := shsh.Parse(f)
+			if err != nil {
+				return err
+			}
+			im4m = blob.ApImg4Ticket
+			if len(generator) == 0 {
+				generator = blob.Generator
+			}
+		}
+
+		var im4r []byte
+		if len(generator) > 0 {
+			if len(im4m) == 0 {
+				return errors.New("a boot nonce generator requires an Im4m (--im4m or --shsh)")
+			}
+			gen, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(generator), "0x"), 16, 64)
+			if err != nil {
+				return errors.Wrapf(err, "invalid boot nonce generator: %s", generator)
+			}
+			bncn := make([]byte, 8)
+			binary.LittleEndian.PutUint64(bncn, gen)
+			im4r, err = img4.CreateIm4r(bncn)
+			if err != nil {
+				return err
+			}
+		}
+
+		out := im4p
+		ext := ".im4p"
+		if len(im4m) > 0 {
+			out, err = img4.CreateImg4(im4p, im4m, im4r)
+			if err != nil {
+				return err
+			}
+			ext = ".img4"
+		}
+
+		if len(outputFile) == 0 {
+			outputFile = args[0] + ext
+		}
+
+		utils.Indent(log.Info, 2)(fmt.Sprintf("Creating %s", outputFile))
+		if err := ioutil.WriteFile(outputFile, out, 0644); err != nil {
+			return errors.Wrapf(err, "failed to write file: %s", outputFile)
+		}
+
+		return nil
+	},
+}
@@ -22,18 +22,21 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"archive/zip"
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/apex/log"
-	// lzfse "github.com/blacktop/go-lzfse"
 	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/img3"
 	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/blacktop/ipsw/pkg/info"
 	"github.com/blacktop/ipsw/pkg/lzfse"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -43,12 +46,246 @@ func init() {
 	img4Cmd.AddCommand(decImg4Cmd)
 
 	decImg4Cmd.PersistentFlags().StringP("iv-key", "k", "", "AES key")
-	decImg4Cmd.PersistentFlags().StringP("output", "o", "", "Output file")
+	decImg4Cmd.PersistentFlags().StringP("device", "d", "", "Device to look up the key for (e.g. iPhone12,3)")
+	decImg4Cmd.PersistentFlags().StringP("build", "b", "", "Build to look up the key for (e.g. 17A577)")
+	decImg4Cmd.PersistentFlags().String("keys", "", "Key database JSON to look up keys in (in addition to the embedded one)")
+	decImg4Cmd.PersistentFlags().StringP("output", "o", "", "Output file (or folder when decrypting an IPSW)")
+
+	decImg4Cmd.MarkZshCompPositionalArgumentFile(1)
+}
+
+// getKeyDB returns the embedded firmware key database plus the keys of a user supplied one
+func getKeyDB(keysFile string) (*info.KeyDB, error) {
+	db, err := info.GetKeyDB()
+	if err != nil {
+		return nil, err
+	}
+	if len(keysFile) > 0 {
+		if err := db.LoadFile(keysFile); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// kbagValues returns the KBAG values (the encrypted IV and key) to look up keys with
+func kbagValues[K interface{ Value() []byte }](kbags []K) [][]byte {
+	var values [][]byte
+	for _, kbag := range kbags {
+		values = append(values, kbag.Value())
+	}
+	return values
+}
+
+// lookupFirmwareKey looks up the IV and key of an encrypted firmware component in the key database
+func lookupFirmwareKey(db *info.KeyDB, kbagValues [][]byte, devices []string, build, component, filename string) ([]byte, []byte, error) {
+	if len(devices) == 0 {
+		devices = []string{""}
+	}
+
+	var err error
+	for _, device := range devices {
+		var key *info.FirmwareKey
+		key, err = db.Lookup(device, build, component, filename, kbagValues...)
+		if err == nil {
+			return key.IVKey()
+		}
+	}
+
+	return nil, nil, err
+}
+
+// parseIVKey decodes a hex encoded IV and key
+func parseIVKey(ivkeyStr string) ([]byte, []byte, error) {
+	ivkey, err := hex.DecodeString(ivkeyStr)
+	if err != nil || len(ivkey) <= 16 {
+		return nil, nil, errors.Errorf("invalid --iv-key %s", ivkeyStr)
+	}
+	return ivkey[:16], ivkey[16:], nil
+}
+
+// getImg3Key returns the IV and key to decrypt an Img3 with (nil if it isn't encrypted)
+func getImg3Key(data []byte, ivkeyStr, device, build, keysFile, component, filename string) ([]byte, []byte, error) {
+	if len(ivkeyStr) > 0 {
+		return parseIVKey(ivkeyStr)
+	}
+
+	i, err := img3.Parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !i.Encrypted() {
+		return nil, nil, nil
+	}
+	kbags, err := i.KeyBags()
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := getKeyDB(keysFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var devices []string
+	if len(device) > 0 {
+		devices = []string{device}
+	}
+	iv, key, err := lookupFirmwareKey(db, kbagValues(kbags), devices, build, component, filename)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Img3 is encrypted and no key was found (supply one with --iv-key or --device and --build)")
+	}
+	utils.Indent(log.Info, 2)(fmt.Sprintf("Found key %x%x", iv, key))
+
+	return iv, key, nil
+}
+
+// decryptIm4p decrypts (if a key is given) and decompresses an Im4p payload
+func decryptIm4p(data, iv, key []byte) ([]byte, error) {
+	var err error
+	if len(key) > 0 {
+		data, err = img4.DecryptPayload(data, iv, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if bytes.HasPrefix(data, []byte("bvx")) {
+		utils.Indent(log.Debug, 2)("Detected LZFSE compression")
+		data, err = lzfse.NewDecoder(data).DecodeBuffer()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lzfse decompress: %v", err)
+		}
+	}
+
+	return data, nil
+}
+
+// isZipFile returns true if the file is a zip (e.g. an IPSW)
+func isZipFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("PK\x03\x04"))
+}
+
+// decryptIPSW decrypts all the encrypted Im4p components of an IPSW
+func decryptIPSW(ipswPath string, db *info.KeyDB, device, output string) error {
+	zr, err := zip.OpenReader(ipswPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", ipswPath, err)
+	}
+	defer zr.Close()
+
+	// NOTE: older IPSWs have encrypted devicetrees (ParseZipFiles only logs those)
+	i, err := info.ParseZipFiles(zr.File)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", ipswPath, err)
+	}
+
+	build := i.Plists.BuildManifest.ProductBuildVersion
+	if len(output) == 0 {
+		output = build
+	}
+
+	// board config -> product type
+	boards := make(map[string][]string)
+	for _, dtree := range i.DeviceTrees {
+		if dt, err := dtree.Summary(); err == nil {
+			boards[strings.ToLower(dt.BoardConfig)] = append(boards[strings.ToLower(dt.BoardConfig)], dt.ProductType)
+		}
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	done := make(map[string]bool)
+	var decrypted, missing int
+	for _, bi := range i.Plists.BuildIdentities {
+		devices := boards[strings.ToLower(bi.Info.DeviceClass)]
+		if len(devices) == 0 {
+			devices = i.Plists.BuildManifest.SupportedProductTypes
+		}
+		if len(device) > 0 {
+			devices = []string{device}
+		}
+		for name, comp := range bi.Manifest {
+			if len(comp.Info.Path) == 0 || done[comp.Info.Path] {
+				continue
+			}
+			zf, ok := files[comp.Info.Path]
+			if !ok {
+				continue
+			}
+			done[comp.Info.Path] = true
+
+			rc, err := zf.Open()
+			if err != nil {
+				return fmt.Errorf("failed to open %s in zip: %v", zf.Name, err)
+			}
+			head := make([]byte, 16)
+			n, _ := io.ReadFull(rc, head)
+			if n < 16 || !bytes.Contains(head, []byte("\x16\x04IM4P")) {
+				rc.Close()
+				continue
+			}
+			rest, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read %s in zip: %v", zf.Name, err)
+			}
+
+			im4p, err := img4.ParseIm4p(bytes.NewReader(append(head, rest...)))
+			if err != nil {
+				log.Warnf("failed to parse %s: %v", zf.Name, err)
+				continue
+			}
+			if !im4p.Encrypted() {
+				continue
+			}
+			kbags, err := im4p.KeyBags()
+			if err != nil {
+				return fmt.Errorf("failed to parse %s KBAG: %v", zf.Name, err)
+			}
+
+			iv, key, err := lookupFirmwareKey(db, kbagValues(kbags), devices, build, name, filepath.Base(zf.Name))
+			if err != nil {
+				utils.Indent(log.Warn, 2)(fmt.Sprintf("No key found for %s (%s)", zf.Name, name))
+				missing++
+				continue
+			}
+
+			dat, err := decryptIm4p(im4p.Data, iv, key)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt %s: %v", zf.Name, err)
+			}
+
+			outFile := filepath.Join(output, zf.Name+".dec")
+			if err := os.MkdirAll(filepath.Dir(outFile), 0755); err != nil {
+				return fmt.Errorf("failed to create folder %s: %v", filepath.Dir(outFile), err)
+			}
+			utils.Indent(log.Info, 2)(fmt.Sprintf("Decrypting %s to %s", name, outFile))
+			if err := ioutil.WriteFile(outFile, dat, 0644); err != nil {
+				return errors.Wrapf(err, "failed to write file: %s", outFile)
+			}
+			decrypted++
+		}
+	}
+
+	log.Infof("Decrypted %d component(s) (no key found for %d)", decrypted, missing)
+
+	return nil
 }
 
 // decCmd represents the dec command
 var decImg4Cmd = &cobra.Command{
-	Use:   "dec <img4>",
+	Use:   "dec <im4p|IPSW>",
 	Short: "Decrypt img4 payloads",
 	Args:  cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -57,70 +294,75 @@ var decImg4Cmd = &cobra.Command{
 			log.SetLevel(log.DebugLevel)
 		}
 
-		var r io.Reader
 		outputFile, _ := cmd.Flags().GetString("output")
 		ivkeyStr, _ := cmd.Flags().GetString("iv-key")
+		device, _ := cmd.Flags().GetString("device")
+		build, _ := cmd.Flags().GetString("build")
+		keysFile, _ := cmd.Flags().GetString("keys")
 
-		if len(ivkeyStr) == 0 {
-			return errors.New("you must supply an ivkey with the flag --iv-key")
+		if isZipFile(args[0]) {
+			db, err := getKeyDB(keysFile)
+			if err != nil {
+				return err
+			}
+			return decryptIPSW(args[0], db, device, outputFile)
 		}
 
-		ivkey, _ := hex.DecodeString(ivkeyStr)
-		iv := ivkey[:aes.BlockSize]
-		key := ivkey[aes.BlockSize:]
-
 		f, err := os.Open(args[0])
 		if err != nil {
 			return errors.Wrapf(err, "unabled to open file: %s", args[0])
 		}
+		defer f.Close()
 
 		i, err := img4.ParseIm4p(f)
 		if err != nil {
 			return errors.Wrap(err, "unabled to parse Im4p")
 		}
 
-		block, err := aes.NewCipher(key)
-		if err != nil {
-			return errors.Wrap(err, "failed to create new AES cipher")
-		}
-
-		if len(i.Data) < aes.BlockSize {
-			return errors.Errorf("Im4p data too short")
+		var iv, key []byte
+		if len(ivkeyStr) > 0 {
+			iv, key, err = parseIVKey(ivkeyStr)
+			if err != nil {
+				return err
+			}
+		} else {
+			if !i.Encrypted() {
+				return errors.New("Im4p is not encrypted (use 'ipsw img4 extract' to get its payload)")
+			}
+			kbags, err := i.KeyBags()
+			if err != nil {
+				return err
+			}
+			for _, kbag := range kbags {
+				utils.Indent(log.Debug, 2)(fmt.Sprintf("KBAG %s", kbag))
+			}
+			db, err := getKeyDB(keysFile)
+			if err != nil {
+				return err
+			}
+			var devices []string
+			if len(device) > 0 {
+				devices = []string{device}
+			}
+			iv, key, err = lookupFirmwareKey(db, kbagValues(kbags), devices, build, img4.ComponentForType(i.Type), filepath.Base(args[0]))
+			if err != nil {
+				return errors.Wrap(err, "no key found (supply one with --iv-key or --device and --build)")
+			}
+			utils.Indent(log.Info, 2)(fmt.Sprintf("Found key %x%x", iv, key))
 		}
 
-		// CBC mode always works in whole blocks.
-		if len(i.Data)%aes.BlockSize != 0 {
-			return errors.Errorf("Im4p data is not a multiple of the block size")
+		dat, err := decryptIm4p(i.Data, iv, key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decrypt %s", args[0])
 		}
 
-		mode := cipher.NewCBCDecrypter(block, iv)
-
-		mode.CryptBlocks(i.Data, i.Data)
-
 		if len(outputFile) == 0 {
 			outputFile = args[0] + ".dec"
 		}
 
-		of, err := os.Create(outputFile)
-		if err != nil {
-			return errors.Wrapf(err, "failed to create file: ", outputFile)
-		}
-
-		if bytes.Contains(i.Data[:4], []byte("bvx2")) {
-			utils.Indent(log.Debug, 2)("Detected LZFSE compression")
-			dat, err := lzfse.NewDecoder(i.Data).DecodeBuffer()
-			if err != nil {
-				return fmt.Errorf("failed to lzfse decompress %s: %v", args[0], err)
-			}
-			r = bytes.NewReader(dat)
-		} else {
-			r = bytes.NewReader(i.Data)
-		}
-
 		utils.Indent(log.Info, 2)(fmt.Sprintf("Decrypting file to %s", outputFile))
-		_, err = io.Copy(of, r)
-		if err != nil {
-			return errors.Wrapf(err, "failed to decompress to file: ", outputFile)
+		if err := ioutil.WriteFile(outputFile, dat, 0644); err != nil {
+			return errors.Wrapf(err, "failed to write file: %s", outputFile)
 		}
 
 		return nil
@@ -22,15 +22,14 @@ THE SOFTWARE.
 package cmd
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/apex/log"
 	"github.com/blacktop/ipsw/internal/utils"
 	"github.com/blacktop/ipsw/pkg/img4"
-	"github.com/blacktop/ipsw/pkg/lzfse"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -38,6 +37,11 @@ import (
 func init() {
 	img4Cmd.AddCommand(img4ExtractCmd)
 
+	img4ExtractCmd.Flags().StringP("iv-key", "k", "", "AES key (to decrypt an encrypted payload)")
+	img4ExtractCmd.Flags().StringP("device", "d", "", "Device to look up the key for (e.g. iPhone12,3)")
+	img4ExtractCmd.Flags().StringP("build", "b", "", "Build to look up the key for (e.g. 17A577)")
+	img4ExtractCmd.Flags().String("keys", "", "Key database JSON to look up keys in (in addition to the embedded one)")
+
 	img4ExtractCmd.MarkZshCompPositionalArgumentFile(1)
 }
 
@@ -52,37 +56,61 @@ var img4ExtractCmd = &cobra.Command{
 			log.SetLevel(log.DebugLevel)
 		}
 
+		ivkeyStr, _ := cmd.Flags().GetString("iv-key")
+		device, _ := cmd.Flags().GetString("device")
+		build, _ := cmd.Flags().GetString("build")
+		keysFile, _ := cmd.Flags().GetString("keys")
+
 		f, err := os.Open(args[0])
 		if err != nil {
 			return errors.Wrapf(err, "unabled to open file: %s", args[0])
 		}
+		defer f.Close()
 
 		i, err := img4.ParseIm4p(f)
 		if err != nil {
 			return errors.Wrap(err, "unabled to parse Im4p")
 		}
 
-		outFile := args[0] + ".payload"
-		utils.Indent(log.Info, 2)(fmt.Sprintf("Exracting payload to file %s", outFile))
-
-		if bytes.Contains(i.Data[:4], []byte("bvx2")) {
-			utils.Indent(log.Debug, 2)("Detected LZFSE compression")
-			dat, err := lzfse.NewDecoder(i.Data).DecodeBuffer()
+		var iv, key []byte
+		if len(ivkeyStr) > 0 {
+			iv, key, err = parseIVKey(ivkeyStr)
 			if err != nil {
-				return fmt.Errorf("failed to lzfse decompress %s: %v", args[0], err)
+				return err
 			}
-
-			err = ioutil.WriteFile(outFile, dat, 0644)
+		} else if i.Encrypted() {
+			kbags, err := i.KeyBags()
+			if err != nil {
+				return err
+			}
+			db, err := getKeyDB(keysFile)
 			if err != nil {
-				return errors.Wrapf(err, "failed to write file: ", outFile)
+				return err
+			}
+			var devices []string
+			if len(device) > 0 {
+				devices = []string{device}
 			}
-		} else {
-			err = ioutil.WriteFile(outFile, i.Data, 0644)
+			iv, key, err = lookupFirmwareKey(db, kbagValues(kbags), devices, build, img4.ComponentForType(i.Type), filepath.Base(args[0]))
 			if err != nil {
-				return errors.Wrapf(err, "failed to write file: ", outFile)
+				utils.Indent(log.Warn, 2)("Payload is encrypted and no key was found (extracting it as is)")
+			} else {
+				utils.Indent(log.Info, 2)(fmt.Sprintf("Found key %x%x", iv, key))
 			}
 		}
 
+		dat, err := decryptIm4p(i.Data, iv, key)
+		if err != nil {
+			return fmt.Errorf("failed to extract %s payload: %v", args[0], err)
+		}
+
+		outFile := args[0] + ".payload"
+		utils.Indent(log.Info, 2)(fmt.Sprintf("Exracting payload to file %s", outFile))
+
+		if err := ioutil.WriteFile(outFile, dat, 0644); err != nil {
+			return errors.Wrapf(err, "failed to write file: %s", outFile)
+		}
+
 		return nil
 	},
 }
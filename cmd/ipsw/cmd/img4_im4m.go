@@ -0,0 +1,172 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/certs"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/blacktop/ipsw/pkg/shsh"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	img4Cmd.AddCommand(img4Im4mCmd)
+
+	img4Im4mCmd.Flags().Bool("verify", false, "Verify the Im4m signature and certificate chain")
+	img4Im4mCmd.Flags().StringArrayP("root", "r", []string{}, "Trusted root CA certificate (PEM or DER) to verify against (default is the bundled Apple root CAs)")
+	img4Im4mCmd.Flags().StringP("nonce", "n", "", "Expected ApNonce (BNCH) as hex to verify against")
+	img4Im4mCmd.Flags().StringP("boot-nonce", "g", "", "Boot nonce generator to derive the expected ApNonce from (default is the SHSH blob's generator)")
+	img4Im4mCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+
+	img4Im4mCmd.MarkZshCompPositionalArgumentFile(1)
+}
+
+// loadIm4m parses the Im4m of an IM4M, IMG4 or SHSH blob file (and returns the SHSH blob's boot nonce generator)
+func loadIm4m(path string) (*img4.Manifest, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "unabled to read file: %s", path)
+	}
+
+	var generator string
+	if bytes.HasPrefix(data, []byte("<?xml")) || bytes.HasPrefix(data, []byte("bplist")) {
+		blob, err := shsh.Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		data = blob.ApImg4Ticket
+		generator = blob.Generator
+	}
+
+	m, err := img4.ParseManifest(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return m, generator, nil
+}
+
+// img4Im4mCmd represents the im4m command
+var img4Im4mCmd = &cobra.Command{
+	Use:           "im4m <IM4M|IMG4|SHSH>",
+	Short:         "Dump Img4 manifest",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		verify, _ := cmd.Flags().GetBool("verify")
+		rootFiles, _ := cmd.Flags().GetStringArray("root")
+		nonce, _ := cmd.Flags().GetString("nonce")
+		bootNonce, _ := cmd.Flags().GetString("boot-nonce")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		m, generator, err := loadIm4m(args[0])
+		if err != nil {
+			return err
+		}
+
+		if verify {
+			conf := &img4.VerifyConfig{}
+			if len(rootFiles) > 0 {
+				conf.Roots, err = certs.AppleRoots()
+				if err != nil {
+					return err
+				}
+				for _, rootFile := range rootFiles {
+					dat, err := ioutil.ReadFile(rootFile)
+					if err != nil {
+						return errors.Wrapf(err, "unabled to read file: %s", rootFile)
+					}
+					roots, err := certs.ParseCertificates(dat)
+					if err != nil {
+						return errors.Wrapf(err, "failed to parse root certificate %s", rootFile)
+					}
+					conf.Roots = append(conf.Roots, roots...)
+				}
+			}
+			if len(nonce) > 0 {
+				conf.ApNonce, err = hex.DecodeString(strings.TrimPrefix(strings.ToLower(nonce), "0x"))
+				if err != nil {
+					return errors.Wrapf(err, "invalid ApNonce: %s", nonce)
+				}
+			}
+			if len(bootNonce) > 0 {
+				generator = bootNonce
+			}
+			if len(generator) > 0 {
+				gen, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(generator), "0x"), 16, 64)
+				if err != nil {
+					return errors.Wrapf(err, "invalid boot nonce generator: %s", generator)
+				}
+				conf.Generator = img4.GeneratorBytes(gen)
+			}
+
+			v, err := m.Verify(conf)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				dat, err := json.MarshalIndent(v, "", "  ")
+				if err != nil {
+					return fmt.Errorf("failed to marshal Im4m verification as JSON: %v", err)
+				}
+				fmt.Println(string(dat))
+			} else {
+				fmt.Print(v.String())
+			}
+
+			if !v.Valid() {
+				return errors.Errorf("Im4m failed verification (%d problem(s))", len(v.Problems))
+			}
+			return nil
+		}
+
+		if asJSON {
+			dat, err := json.MarshalIndent(m, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal Im4m as JSON: %v", err)
+			}
+			fmt.Println(string(dat))
+			return nil
+		}
+
+		fmt.Print(m.String())
+
+		return nil
+	},
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/ibootim"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	img4Cmd.AddCommand(img4ImageCmd)
+
+	img4ImageCmd.Flags().StringP("type", "t", "logo", "Im4p type of the created image (e.g. logo, recm, chg0, bat1)")
+	img4ImageCmd.Flags().StringP("description", "d", "", "Im4p description of the created image")
+	img4ImageCmd.Flags().StringP("format", "f", ibootim.FormatARGB, "iBootIm pixel format of the created image (argb or grey)")
+	img4ImageCmd.Flags().Bool("raw", false, "Create a raw iBootIm (instead of an Im4p)")
+	img4ImageCmd.Flags().StringP("output", "o", "", "Output file")
+
+	img4ImageCmd.MarkZshCompPositionalArgumentFile(1)
+}
+
+// img4ImageCmd represents the image command
+var img4ImageCmd = &cobra.Command{
+	Use:   "image <im4p|ibootim|png>",
+	Short: "Convert iBootIm images (e.g. AppleLogo) to PNG and back",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		typ, _ := cmd.Flags().GetString("type")
+		desc, _ := cmd.Flags().GetString("description")
+		format, _ := cmd.Flags().GetString("format")
+		raw, _ := cmd.Flags().GetBool("raw")
+		outputFile, _ := cmd.Flags().GetString("output")
+
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return errors.Wrapf(err, "unabled to read file: %s", args[0])
+		}
+		base := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+
+		if bytes.HasPrefix(data, []byte("\x89PNG")) { // PNG -> iBootIm (-> Im4p)
+			img, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				return errors.Wrap(err, "failed to decode PNG")
+			}
+			out, err := ibootim.Create(img, strings.ToLower(format))
+			if err != nil {
+				return err
+			}
+			ext := ".ibootim"
+			if !raw {
+				if len(desc) == 0 {
+					desc = img4.ComponentForType(typ)
+				}
+				if out, err = img4.CreateIm4p(typ, desc, out, nil); err != nil {
+					return err
+				}
+				ext = ".im4p"
+			}
+			if len(outputFile) == 0 {
+				outputFile = base + ext
+			}
+			utils.Indent(log.Info, 2)(fmt.Sprintf("Created %s (%dx%d %s)", outputFile, img.Bounds().Dx(), img.Bounds().Dy(), format))
+			return ioutil.WriteFile(outputFile, out, 0644)
+		}
+
+		if !ibootim.IsIBootIm(data) { // Im4p -> iBootIm
+			im4p, err := img4.ParseIm4p(bytes.NewReader(data))
+			if err != nil {
+				return errors.Wrap(err, "file is not a PNG, iBootIm or Im4p")
+			}
+			if im4p.Encrypted() {
+				return fmt.Errorf("im4p is encrypted (decrypt it first with 'ipsw img4 dec')")
+			}
+			if data, err = decryptIm4p(im4p.Data, nil, nil); err != nil {
+				return err
+			}
+		}
+
+		im, err := ibootim.Parse(data)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse iBootIm")
+		}
+
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, im.Image()); err != nil {
+			return errors.Wrap(err, "failed to encode PNG")
+		}
+		if len(outputFile) == 0 {
+			outputFile = base + ".png"
+		}
+		utils.Indent(log.Info, 2)(fmt.Sprintf("Created %s (%s)", outputFile, im))
+		return ioutil.WriteFile(outputFile, buf.Bytes(), 0644)
+	},
+}
@@ -0,0 +1,286 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/trustcache"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	img4Cmd.AddCommand(img4TrustCacheCmd)
+
+	img4TrustCacheCmd.Flags().StringP("fs", "f", "", "Filesystem folder (e.g. a mounted File System DMG) to map cdhashes to MachO paths")
+	img4TrustCacheCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+
+	img4TrustCacheCmd.MarkZshCompPositionalArgumentFile(1)
+}
+
+type trustCacheEntryResult struct {
+	Entry   trustcache.Entry `json:"entry"`
+	Paths   []string         `json:"paths,omitempty"`
+	Missing bool             `json:"missing,omitempty"`
+}
+
+type trustCacheResult struct {
+	Path    string                  `json:"path"`
+	Version uint32                  `json:"version"`
+	UUID    trustcache.UUID         `json:"uuid"`
+	Entries []trustCacheEntryResult `json:"entries"`
+}
+
+// isMachO returns true if the file starts with a MachO (or universal MachO) magic
+func isMachO(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return utils.IsMachO(magic) || utils.IsUniversalMachO(magic)
+}
+
+// machoCDHashes returns the (trust cache truncated) cdhashes of all the code directories of a MachO
+func machoCDHashes(path string) ([]string, error) {
+	var files []*macho.File
+	if fat, err := macho.OpenFat(path); err == nil {
+		defer fat.Close()
+		for _, arch := range fat.Arches {
+			files = append(files, arch.File)
+		}
+	} else if errors.Is(err, macho.ErrNotFat) {
+		m, err := macho.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer m.Close()
+		files = append(files, m)
+	} else {
+		return nil, err
+	}
+
+	var cdhashes []string
+	for _, m := range files {
+		cs := m.CodeSignature()
+		if cs == nil {
+			continue
+		}
+		for _, cd := range cs.CodeDirectories {
+			if len(cd.CDHash) >= trustcache.CDHashSize*2 {
+				cdhashes = append(cdhashes, cd.CDHash[:trustcache.CDHashSize*2])
+			}
+		}
+	}
+
+	return cdhashes, nil
+}
+
+// fsCDHashes maps the cdhashes of all the MachOs in a folder to their paths
+func fsCDHashes(root string) (map[string][]string, error) {
+	cdhashes := make(map[string][]string)
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !isMachO(path) {
+			return nil
+		}
+		hashes, err := machoCDHashes(path)
+		if err != nil {
+			log.Debugf("failed to get cdhashes of %s: %v", path, err)
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		for _, cdhash := range hashes {
+			cdhashes[cdhash] = append(cdhashes[cdhash], "/"+filepath.ToSlash(rel))
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %v", root, err)
+	}
+	return cdhashes, nil
+}
+
+// loadTrustCaches parses a trust cache file or all the trust caches in an IPSW/folder
+func loadTrustCaches(src string) (map[string]*trustcache.TrustCache, error) {
+	tcs := make(map[string]*trustcache.TrustCache)
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() && !isZipFile(src) {
+		tc, err := trustcache.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		tcs[src] = tc
+		return tcs, nil
+	}
+
+	if err := walkIm4ps(src, func(path string, data []byte) error {
+		if !strings.HasSuffix(path, ".trustcache") {
+			return nil
+		}
+		tc, err := trustcache.ParseImg4Data(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse trust cache %s: %v", path, err)
+		}
+		tcs[path] = tc
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(tcs) == 0 {
+		return nil, fmt.Errorf("no trust caches found in %s", src)
+	}
+
+	return tcs, nil
+}
+
+// img4TrustCacheCmd represents the trustcache command
+var img4TrustCacheCmd = &cobra.Command{
+	Use:           "trustcache <TRUSTCACHE|IPSW|DIR>",
+	Short:         "Dump trust cache entries",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		fsPath, _ := cmd.Flags().GetString("fs")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		tcs, err := loadTrustCaches(filepath.Clean(args[0]))
+		if err != nil {
+			return err
+		}
+
+		var cdhashes map[string][]string
+		if len(fsPath) > 0 {
+			log.Infof("Calculating cdhashes of MachOs in %s", fsPath)
+			cdhashes, err = fsCDHashes(filepath.Clean(fsPath))
+			if err != nil {
+				return err
+			}
+		}
+
+		var paths []string
+		for path := range tcs {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		var results []trustCacheResult
+		var missing int
+		for _, path := range paths {
+			tc := tcs[path]
+			res := trustCacheResult{
+				Path:    path,
+				Version: tc.Version,
+				UUID:    tc.UUID,
+			}
+			for _, e := range tc.Entries {
+				er := trustCacheEntryResult{Entry: e}
+				if cdhashes != nil {
+					er.Paths = cdhashes[hex.EncodeToString(e.CDHash[:])]
+					if len(er.Paths) == 0 {
+						er.Missing = true
+						missing++
+					}
+				}
+				res.Entries = append(res.Entries, er)
+			}
+			results = append(results, res)
+		}
+
+		if asJSON {
+			dat, err := json.MarshalIndent(results, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal trust caches as JSON: %v", err)
+			}
+			fmt.Println(string(dat))
+		} else {
+			for _, res := range results {
+				fmt.Printf("%s\n", res.Path)
+				fmt.Printf("  Version: %d\n", res.Version)
+				fmt.Printf("  UUID:    %s\n", res.UUID)
+				fmt.Printf("  Entries: %d\n\n", len(res.Entries))
+				printTrustCacheEntries(os.Stdout, res.Entries, cdhashes != nil)
+				fmt.Println()
+			}
+		}
+
+		if missing > 0 {
+			log.Warnf("%d trust cache entries have no matching MachO in %s", missing, fsPath)
+		}
+
+		return nil
+	},
+}
+
+func printTrustCacheEntries(out io.Writer, entries []trustCacheEntryResult, withPaths bool) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if withPaths {
+		fmt.Fprintln(w, "CDHASH\tHASH TYPE\tFLAGS\tCATEGORY\tPATH")
+	} else {
+		fmt.Fprintln(w, "CDHASH\tHASH TYPE\tFLAGS\tCATEGORY")
+	}
+	for _, er := range entries {
+		e := er.Entry
+		if !withPaths {
+			fmt.Fprintf(w, "%x\t%s\t%s\t%d\n", e.CDHash, e.HashType, e.Flags, e.ConstraintCategory)
+			continue
+		}
+		path := strings.Join(er.Paths, ", ")
+		if er.Missing {
+			path = "⚠️  no matching MachO"
+		}
+		fmt.Fprintf(w, "%x\t%s\t%s\t%d\t%s\n", e.CDHash, e.HashType, e.Flags, e.ConstraintCategory, path)
+	}
+	w.Flush()
+}
@@ -0,0 +1,237 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/blacktop/ipsw/pkg/plist"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	img4Cmd.AddCommand(img4VerifyCmd)
+
+	img4VerifyCmd.Flags().StringP("im4m", "m", "", "Im4m to verify against (IM4M, IMG4 or SHSH blob; default is the BuildManifest.plist)")
+	img4VerifyCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+
+	img4VerifyCmd.MarkZshCompPositionalArgumentFile(1, "*.ipsw")
+}
+
+const (
+	img4VerifyOK            = "ok"
+	img4VerifyMismatch      = "mismatch"
+	img4VerifyNotInManifest = "not in manifest"
+	img4VerifyMissing       = "missing"
+)
+
+type img4VerifyResult struct {
+	Path   string `json:"path,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Status string `json:"status"`
+}
+
+// readBuildManifest reads the BuildManifest.plist of an IPSW or directory
+func readBuildManifest(src string) (*plist.BuildManifest, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if fi.IsDir() {
+		data, err = ioutil.ReadFile(filepath.Join(src, "BuildManifest.plist"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read BuildManifest.plist: %v", err)
+		}
+	} else {
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", src, err)
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			if zf.Name != "BuildManifest.plist" {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, fmt.Errorf("failed to open BuildManifest.plist in zip: %v", err)
+			}
+			data, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read BuildManifest.plist in zip: %v", err)
+			}
+			break
+		}
+		if data == nil {
+			return nil, fmt.Errorf("BuildManifest.plist not found in %s", src)
+		}
+	}
+
+	return plist.ParseBuildManifest(data)
+}
+
+// img4VerifyCmd represents the verify command
+var img4VerifyCmd = &cobra.Command{
+	Use:           "verify <IPSW|DIR>",
+	Short:         "Verify the Im4p digests of an IPSW against its manifest",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		im4mFile, _ := cmd.Flags().GetString("im4m")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		src := filepath.Clean(args[0])
+
+		var results []img4VerifyResult
+
+		if len(im4mFile) > 0 {
+			m, _, err := loadIm4m(im4mFile)
+			if err != nil {
+				return err
+			}
+			found := make(map[string]bool)
+			if err := walkIm4ps(src, func(path string, data []byte) error {
+				img, err := m.VerifyIm4p(data)
+				switch {
+				case err == nil:
+					found[img.Name] = true
+					results = append(results, img4VerifyResult{Path: path, Name: img.Name, Status: img4VerifyOK})
+				case img != nil:
+					results = append(results, img4VerifyResult{Path: path, Name: img.Name, Status: img4VerifyMismatch})
+				default:
+					results = append(results, img4VerifyResult{Path: path, Status: img4VerifyNotInManifest})
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, img := range m.Images {
+				if len(img.Digest) > 0 && !found[img.Name] {
+					results = append(results, img4VerifyResult{Name: img.Name, Status: img4VerifyMissing})
+				}
+			}
+		} else {
+			bm, err := readBuildManifest(src)
+			if err != nil {
+				return err
+			}
+			type entry struct {
+				name    string
+				digests [][]byte
+			}
+			entries := make(map[string]*entry)
+			for _, bi := range bm.BuildIdentities {
+				for name, comp := range bi.Manifest {
+					if len(comp.Info.Path) == 0 || len(comp.Digest) == 0 {
+						continue
+					}
+					e, ok := entries[comp.Info.Path]
+					if !ok {
+						e = &entry{name: name}
+						entries[comp.Info.Path] = e
+					}
+					e.digests = append(e.digests, comp.Digest)
+				}
+			}
+			found := make(map[string]bool)
+			if err := walkIm4ps(src, func(path string, data []byte) error {
+				e, ok := entries[path]
+				if !ok {
+					results = append(results, img4VerifyResult{Path: path, Status: img4VerifyNotInManifest})
+					return nil
+				}
+				found[path] = true
+				status := img4VerifyMismatch
+				for _, digest := range e.digests {
+					if img4.DigestMatches(data, digest) {
+						status = img4VerifyOK
+						break
+					}
+				}
+				results = append(results, img4VerifyResult{Path: path, Name: e.name, Status: status})
+				return nil
+			}); err != nil {
+				return err
+			}
+			for path, e := range entries {
+				if !found[path] {
+					results = append(results, img4VerifyResult{Path: path, Name: e.name, Status: img4VerifyMissing})
+				}
+			}
+		}
+
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].Path == results[j].Path {
+				return results[i].Name < results[j].Name
+			}
+			return results[i].Path < results[j].Path
+		})
+
+		if asJSON {
+			dat, err := json.MarshalIndent(results, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal results as JSON: %v", err)
+			}
+			fmt.Println(string(dat))
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+			fmt.Fprintf(w, "STATUS\tNAME\tPATH\n")
+			fmt.Fprintf(w, "------\t----\t----\n")
+			for _, r := range results {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(r.Status), r.Name, r.Path)
+			}
+			w.Flush()
+		}
+
+		var bad int
+		for _, r := range results {
+			if r.Status == img4VerifyMismatch {
+				bad++
+			}
+		}
+		if bad > 0 {
+			return errors.Errorf("%d Im4p digest(s) did not match the manifest", bad)
+		}
+
+		return nil
+	},
+}
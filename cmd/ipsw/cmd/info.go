@@ -23,6 +23,7 @@ package cmd
 
 import (
 	"archive/zip"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -42,12 +43,52 @@ func init() {
 	infoCmd.Flags().Bool("insecure", false, "do not verify ssl certs")
 	infoCmd.Flags().BoolP("remote", "r", false, "Extract from URL")
 	infoCmd.Flags().BoolP("list", "l", false, "List files in IPSW/OTA")
+	infoCmd.Flags().BoolP("firmware", "f", false, "Classify every file in the IPSW and map it to its BuildManifest components")
+	infoCmd.Flags().BoolP("json", "j", false, "Print the --firmware classification as JSON")
 	infoCmd.MarkZshCompPositionalArgumentFile(1, "*.ipsw", "*.zip")
 	infoCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"ipsw", "zip"}, cobra.ShellCompDirectiveFilterFileExt
 	}
 }
 
+func printFirmwares(fws []info.Firmware, asJSON bool) error {
+	if asJSON {
+		dat, err := json.MarshalIndent(fws, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(dat))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "PATH\tFORMAT\tTYPE\tCOMPRESSION\tENCRYPTED\tARCH\tDETAILS\tCOMPONENTS\tDEVICES\n")
+	fmt.Fprintf(w, "----\t------\t----\t-----------\t---------\t----\t-------\t----------\t-------\n")
+	for _, fw := range fws {
+		var details []string
+		if len(fw.Version) > 0 {
+			details = append(details, fw.Version)
+		}
+		if len(fw.DMG) > 0 {
+			details = append(details, fw.DMG)
+		}
+		if fw.TrustCache {
+			details = append(details, "trustcache")
+		}
+		encrypted := "no"
+		if fw.Encrypted {
+			encrypted = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			fw.Path, fw.Format, fw.Type, fw.Compression, encrypted, fw.Arch,
+			strings.Join(details, ","), strings.Join(fw.Components, ","), strings.Join(fw.Devices, ","))
+		if Verbose && len(fw.Variants) > 0 {
+			fmt.Fprintf(w, "\t\t\t\t\t\t\tvariants: %s\t\n", strings.Join(fw.Variants, ", "))
+		}
+	}
+	return w.Flush()
+}
+
 // infoCmd represents the info command
 var infoCmd = &cobra.Command{
 	Use:           "info <IPSW>",
@@ -69,6 +110,12 @@ var infoCmd = &cobra.Command{
 		// flags
 		remoteFlag, _ := cmd.Flags().GetBool("remote")
 		listFiles, _ := cmd.Flags().GetBool("list")
+		firmware, _ := cmd.Flags().GetBool("firmware")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		if listFiles && firmware {
+			return fmt.Errorf("--list and --firmware are mutually exclusive")
+		}
 
 		if remoteFlag {
 			zr, err := download.NewRemoteZipReader(args[0], &download.RemoteConfig{
@@ -91,6 +138,13 @@ var infoCmd = &cobra.Command{
 				if err != nil {
 					return fmt.Errorf("failed to parse plists in zip: %w", err)
 				}
+				if firmware {
+					fws, err := i.Firmwares(zr.File)
+					if err != nil {
+						return fmt.Errorf("failed to classify firmwares: %w", err)
+					}
+					return printFirmwares(fws, asJSON)
+				}
 			}
 		} else {
 			fPath := filepath.Clean(args[0])
@@ -117,6 +171,18 @@ var infoCmd = &cobra.Command{
 				if err != nil {
 					return fmt.Errorf("failed to parse plists: %w", err)
 				}
+				if firmware {
+					zr, err := zip.OpenReader(fPath)
+					if err != nil {
+						return fmt.Errorf("failed to open %s: %v", fPath, err)
+					}
+					defer zr.Close()
+					fws, err := i.Firmwares(zr.File)
+					if err != nil {
+						return fmt.Errorf("failed to classify firmwares: %w", err)
+					}
+					return printFirmwares(fws, asJSON)
+				}
 			}
 		}
 
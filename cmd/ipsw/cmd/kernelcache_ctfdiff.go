@@ -0,0 +1,123 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/ipsw/pkg/ctf"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	kernelcacheCmd.AddCommand(ctfdiffCmd)
+
+	ctfdiffCmd.Flags().StringP("arch", "a", "", "Which architecture to use for fat/universal MachO")
+	ctfdiffCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+	ctfdiffCmd.Flags().StringP("output", "o", "", "Output file (default is stdout)")
+	viper.BindPFlag("kernel.ctfdiff.arch", ctfdiffCmd.Flags().Lookup("arch"))
+	viper.BindPFlag("kernel.ctfdiff.json", ctfdiffCmd.Flags().Lookup("json"))
+	viper.BindPFlag("kernel.ctfdiff.output", ctfdiffCmd.Flags().Lookup("output"))
+	ctfdiffCmd.MarkZshCompPositionalArgumentFile(1)
+	ctfdiffCmd.MarkZshCompPositionalArgumentFile(2)
+}
+
+func parseCTF(path, arch string) (*ctf.CTF, error) {
+	fat, err := macho.OpenFat(path)
+	if err != nil && err != macho.ErrNotFat {
+		return nil, err
+	}
+	if err == macho.ErrNotFat {
+		m, err := macho.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return ctf.Parse(m)
+	}
+
+	var archs []string
+	for _, a := range fat.Arches {
+		sub := strings.ToLower(a.SubCPU.String(a.CPU))
+		if len(arch) > 0 && strings.Contains(sub, strings.ToLower(arch)) {
+			return ctf.Parse(a.File)
+		}
+		archs = append(archs, sub)
+	}
+
+	return nil, fmt.Errorf("%s is a universal MachO, please select an architecture with --arch (%s)", path, strings.Join(archs, ", "))
+}
+
+// ctfdiffCmd represents the ctfdiff command
+var ctfdiffCmd = &cobra.Command{
+	Use:           "ctfdiff <old> <new>",
+	Short:         "Diff two kernels' CTF types",
+	Args:          cobra.ExactArgs(2),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		// flags
+		arch := viper.GetString("kernel.ctfdiff.arch")
+		asJSON := viper.GetBool("kernel.ctfdiff.json")
+		output := viper.GetString("kernel.ctfdiff.output")
+
+		old, err := parseCTF(filepath.Clean(args[0]), arch)
+		if err != nil {
+			return fmt.Errorf("failed to parse CTF of %s: %v", args[0], err)
+		}
+		new, err := parseCTF(filepath.Clean(args[1]), arch)
+		if err != nil {
+			return fmt.Errorf("failed to parse CTF of %s: %v", args[1], err)
+		}
+
+		diff := ctf.DiffCTF(old, new)
+
+		var out []byte
+		if asJSON {
+			out, err = json.MarshalIndent(diff, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal CTF diff as JSON: %v", err)
+			}
+		} else {
+			out = []byte(diff.String())
+		}
+
+		if len(output) > 0 {
+			log.Infof("Creating %s", output)
+			return os.WriteFile(output, out, 0644)
+		}
+
+		fmt.Print(string(out))
+
+		return nil
+	},
+}
@@ -44,15 +44,21 @@ func init() {
 	ctfdumpCmd.Flags().StringP("arch", "a", "", "Which architecture to use for fat/universal MachO")
 	ctfdumpCmd.Flags().BoolP("pretty", "", false, "Pretty print JSON")
 	ctfdumpCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+	ctfdumpCmd.Flags().Bool("header", false, "Output as a C header")
+	ctfdumpCmd.Flags().StringP("type", "t", "", "Print the layout of a struct/union (pahole style)")
+	ctfdumpCmd.Flags().StringP("output", "o", "", "Output file (default is stdout)")
 	viper.BindPFlag("kernel.ctfdump.arch", ctfdumpCmd.Flags().Lookup("arch"))
 	viper.BindPFlag("kernel.ctfdump.pretty", ctfdumpCmd.Flags().Lookup("pretty"))
 	viper.BindPFlag("kernel.ctfdump.json", ctfdumpCmd.Flags().Lookup("json"))
+	viper.BindPFlag("kernel.ctfdump.header", ctfdumpCmd.Flags().Lookup("header"))
+	viper.BindPFlag("kernel.ctfdump.type", ctfdumpCmd.Flags().Lookup("type"))
+	viper.BindPFlag("kernel.ctfdump.output", ctfdumpCmd.Flags().Lookup("output"))
 	ctfdumpCmd.MarkZshCompPositionalArgumentFile(1)
 }
 
 // ctfdumpCmd represents the ctfdump command
 var ctfdumpCmd = &cobra.Command{
-	Use:   "ctfdump",
+	Use:   "ctfdump <kernel> [TYPE]",
 	Short: "Dump CTF info",
 	Args:  cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -67,6 +73,13 @@ var ctfdumpCmd = &cobra.Command{
 		selectedArch := viper.GetString("kernel.ctfdump.arch")
 		prettyJSON := viper.GetBool("kernel.ctfdump.pretty")
 		outAsJSON := viper.GetBool("kernel.ctfdump.json")
+		outAsHeader := viper.GetBool("kernel.ctfdump.header")
+		typeName := viper.GetString("kernel.ctfdump.type")
+		output := viper.GetString("kernel.ctfdump.output")
+
+		if outAsJSON && outAsHeader {
+			return fmt.Errorf("--json and --header are mutually exclusive")
+		}
 
 		machoPath := filepath.Clean(args[0])
 
@@ -128,7 +141,24 @@ var ctfdumpCmd = &cobra.Command{
 		}
 		sort.Ints(ids)
 
-		if len(args) > 1 {
+		if outAsHeader {
+			header := c.GenerateHeader()
+			if len(output) > 0 {
+				log.Infof("Creating %s", output)
+				return os.WriteFile(output, []byte(header), 0644)
+			}
+			fmt.Print(header)
+		} else if len(typeName) > 0 {
+			layout, err := c.Layout(typeName)
+			if err != nil {
+				return err
+			}
+			if len(output) > 0 {
+				log.Infof("Creating %s", output)
+				return os.WriteFile(output, []byte(layout), 0644)
+			}
+			fmt.Print(layout)
+		} else if len(args) > 1 {
 			for _, id := range ids {
 				if c.Types[id].Name() == args[1] {
 					fmt.Println(c.Types[id])
@@ -23,10 +23,12 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
 	"github.com/apex/log"
+	"github.com/blacktop/ipsw/pkg/img3"
 	"github.com/blacktop/ipsw/pkg/kernelcache"
 	"github.com/spf13/cobra"
 )
@@ -34,6 +36,11 @@ import (
 func init() {
 	kernelcacheCmd.AddCommand(decCmd)
 
+	decCmd.Flags().StringP("iv-key", "k", "", "AES key (to decrypt an encrypted Img3 kernelcache)")
+	decCmd.Flags().StringP("device", "d", "", "Device to look up the Img3 key for (e.g. iPhone3,1)")
+	decCmd.Flags().StringP("build", "b", "", "Build to look up the Img3 key for (e.g. 8A293)")
+	decCmd.Flags().String("keys", "", "Key database JSON to look up keys in (in addition to the embedded one)")
+
 	decCmd.MarkZshCompPositionalArgumentFile(1, "kernelcache*")
 }
 
@@ -48,12 +55,30 @@ var decCmd = &cobra.Command{
 			log.SetLevel(log.DebugLevel)
 		}
 
+		ivkeyStr, _ := cmd.Flags().GetString("iv-key")
+		device, _ := cmd.Flags().GetString("device")
+		build, _ := cmd.Flags().GetString("build")
+		keysFile, _ := cmd.Flags().GetString("keys")
+
 		kcpath := filepath.Clean(args[0])
 
 		if _, err := os.Stat(kcpath); os.IsNotExist(err) {
 			return fmt.Errorf("file %s does not exist", kcpath)
 		}
 
+		content, err := ioutil.ReadFile(kcpath)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", kcpath, err)
+		}
+		if img3.IsImg3(content) {
+			iv, key, err := getImg3Key(content, ivkeyStr, device, build, keysFile, "KernelCache", filepath.Base(kcpath))
+			if err != nil {
+				return err
+			}
+			log.Info("Decompressing kernelcache")
+			return kernelcache.DecompressWithKey(kcpath, iv, key)
+		}
+
 		log.Info("Decompressing kernelcache")
 		return kernelcache.Decompress(kcpath)
 	},
@@ -0,0 +1,143 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/ipsw/pkg/kernelcache"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	kernelcacheCmd.AddCommand(kextDepsCmd)
+
+	kextDepsCmd.Flags().StringP("kext", "k", "", "Only show the graph reachable from this kext")
+	kextDepsCmd.Flags().BoolP("reverse", "r", false, "Show the kexts that depend on --kext instead")
+	kextDepsCmd.Flags().BoolP("dot", "d", false, "Output as graphviz DOT")
+	kextDepsCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+	kextDepsCmd.Flags().StringP("output", "o", "", "Output file (default is stdout)")
+	viper.BindPFlag("kernel.deps.kext", kextDepsCmd.Flags().Lookup("kext"))
+	viper.BindPFlag("kernel.deps.reverse", kextDepsCmd.Flags().Lookup("reverse"))
+	viper.BindPFlag("kernel.deps.dot", kextDepsCmd.Flags().Lookup("dot"))
+	viper.BindPFlag("kernel.deps.json", kextDepsCmd.Flags().Lookup("json"))
+	viper.BindPFlag("kernel.deps.output", kextDepsCmd.Flags().Lookup("output"))
+	kextDepsCmd.MarkZshCompPositionalArgumentFile(1, "kernelcache*")
+}
+
+// kextDepsCmd represents the deps command
+var kextDepsCmd = &cobra.Command{
+	Use:           "deps <kernelcache>",
+	Short:         "Show the kext dependency graph",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		// flags
+		kextID := viper.GetString("kernel.deps.kext")
+		reverse := viper.GetBool("kernel.deps.reverse")
+		asDOT := viper.GetBool("kernel.deps.dot")
+		asJSON := viper.GetBool("kernel.deps.json")
+		output := viper.GetString("kernel.deps.output")
+
+		if asDOT && asJSON {
+			return fmt.Errorf("--dot and --json are mutually exclusive")
+		}
+		if reverse && len(kextID) == 0 {
+			return fmt.Errorf("--reverse requires --kext")
+		}
+
+		m, err := macho.Open(filepath.Clean(args[0]))
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+
+		deps, err := kernelcache.GetKextDependencies(m)
+		if err != nil {
+			return err
+		}
+
+		if len(kextID) > 0 {
+			if _, ok := deps[kextID]; !ok {
+				return fmt.Errorf("kernelcache does NOT contain kext %s", kextID)
+			}
+			deps = deps.Subgraph(kextID, reverse)
+		}
+
+		var out []byte
+		switch {
+		case asDOT:
+			out = []byte(deps.DOT())
+		case asJSON:
+			if reverse {
+				out, err = json.MarshalIndent(map[string][]string{kextID: deps.Dependents(kextID)}, "", "  ")
+			} else {
+				out, err = json.MarshalIndent(deps, "", "  ")
+			}
+			if err != nil {
+				return fmt.Errorf("failed to marshal dependencies as JSON: %v", err)
+			}
+		default:
+			var kexts []string
+			for kext := range deps {
+				kexts = append(kexts, kext)
+			}
+			sort.Strings(kexts)
+			for _, kext := range kexts {
+				if reverse {
+					if dependents := deps.Dependents(kext); len(dependents) > 0 {
+						out = append(out, fmt.Sprintf("%s (used by)\n", kext)...)
+						for _, dep := range dependents {
+							out = append(out, fmt.Sprintf("    %s\n", dep)...)
+						}
+					}
+				} else {
+					out = append(out, fmt.Sprintf("%s\n", kext)...)
+					for _, lib := range deps[kext] {
+						out = append(out, fmt.Sprintf("    %s\n", lib)...)
+					}
+				}
+			}
+		}
+
+		if len(output) > 0 {
+			log.Infof("Creating %s", output)
+			return os.WriteFile(output, out, 0644)
+		}
+
+		fmt.Print(string(out))
+
+		return nil
+	},
+}
@@ -22,32 +22,73 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/apex/log"
 	"github.com/blacktop/ipsw/pkg/kernelcache"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func init() {
 	kernelcacheCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+	diffCmd.Flags().StringP("output", "o", "", "Output file (default is stdout)")
+	viper.BindPFlag("kernel.diff.json", diffCmd.Flags().Lookup("json"))
+	viper.BindPFlag("kernel.diff.output", diffCmd.Flags().Lookup("output"))
+	diffCmd.MarkZshCompPositionalArgumentFile(1, "kernelcache*")
+	diffCmd.MarkZshCompPositionalArgumentFile(2, "kernelcache*")
 }
 
 // diffCmd represents the diff command
 var diffCmd = &cobra.Command{
-	Use:   "diff",
-	Short: "🚧 diff kernelcache (using assert strings)",
-	// Long:   longDesc,
-	Args:   cobra.MinimumNArgs(1),
-	Hidden: true,
+	Use:           "diff <old> <new>",
+	Short:         "Diff two kernelcaches",
+	Args:          cobra.ExactArgs(2),
+	SilenceUsage:  true,
+	SilenceErrors: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if Verbose {
 			log.SetLevel(log.DebugLevel)
 		}
-		if _, err := os.Stat(args[0]); os.IsNotExist(err) {
-			return fmt.Errorf("file %s does not exist", args[0])
+
+		// flags
+		asJSON := viper.GetBool("kernel.diff.json")
+		output := viper.GetString("kernel.diff.output")
+
+		for _, arg := range args {
+			if _, err := os.Stat(arg); os.IsNotExist(err) {
+				return fmt.Errorf("file %s does not exist", arg)
+			}
+		}
+
+		log.Info("Diffing kernelcaches")
+		diff, err := kernelcache.DiffKernelCaches(filepath.Clean(args[0]), filepath.Clean(args[1]))
+		if err != nil {
+			return err
 		}
-		return kernelcache.ParseMachO(args[0])
+
+		var out []byte
+		if asJSON {
+			out, err = json.MarshalIndent(diff, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal diff as JSON: %v", err)
+			}
+		} else {
+			out = []byte(diff.Markdown())
+		}
+
+		if len(output) > 0 {
+			log.Infof("Creating %s", output)
+			return os.WriteFile(output, out, 0644)
+		}
+
+		fmt.Println(string(out))
+
+		return nil
 	},
 }
@@ -0,0 +1,149 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/ipsw/pkg/kernelcache"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	kernelcacheCmd.AddCommand(kernelEntitlementsCmd)
+
+	kernelEntitlementsCmd.Flags().StringP("kext", "k", "", "Only show checks in this kext")
+	kernelEntitlementsCmd.Flags().StringP("ent", "e", "", "Only show entitlements containing this string")
+	kernelEntitlementsCmd.Flags().String("cache", "", "Path to .a2s addr to sym cache file (to name the functions)")
+	kernelEntitlementsCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+	kernelEntitlementsCmd.Flags().StringP("output", "o", "", "Output file (default is stdout)")
+	viper.BindPFlag("kernel.entitlements.kext", kernelEntitlementsCmd.Flags().Lookup("kext"))
+	viper.BindPFlag("kernel.entitlements.ent", kernelEntitlementsCmd.Flags().Lookup("ent"))
+	viper.BindPFlag("kernel.entitlements.cache", kernelEntitlementsCmd.Flags().Lookup("cache"))
+	viper.BindPFlag("kernel.entitlements.json", kernelEntitlementsCmd.Flags().Lookup("json"))
+	viper.BindPFlag("kernel.entitlements.output", kernelEntitlementsCmd.Flags().Lookup("output"))
+	kernelEntitlementsCmd.MarkZshCompPositionalArgumentFile(1, "kernelcache*")
+}
+
+// kernelEntitlementsCmd represents the entitlements command
+var kernelEntitlementsCmd = &cobra.Command{
+	Use:           "entitlements <kernelcache>",
+	Aliases:       []string{"ents"},
+	Short:         "List the entitlements checked by the kernel and kexts",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		// flags
+		kextID := viper.GetString("kernel.entitlements.kext")
+		entFilter := viper.GetString("kernel.entitlements.ent")
+		cacheFile := viper.GetString("kernel.entitlements.cache")
+		asJSON := viper.GetBool("kernel.entitlements.json")
+		output := viper.GetString("kernel.entitlements.output")
+
+		symbolMap := make(map[uint64]string)
+		if len(cacheFile) > 0 {
+			a2sFile, err := os.Open(cacheFile)
+			if err != nil {
+				return fmt.Errorf("failed to open .a2s cache file: %v", err)
+			}
+			err = gob.NewDecoder(a2sFile).Decode(&symbolMap)
+			a2sFile.Close()
+			if err != nil {
+				return fmt.Errorf("failed to decode .a2s cache file: %v", err)
+			}
+		}
+
+		f, err := os.Open(filepath.Clean(args[0]))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		m, err := macho.NewFile(f)
+		if err != nil {
+			return err
+		}
+
+		checks, err := kernelcache.GetEntitlementChecks(f, m, symbolMap)
+		if err != nil {
+			return err
+		}
+
+		var filtered []kernelcache.EntitlementCheck
+		for _, check := range checks {
+			if len(kextID) > 0 && check.Kext != kextID {
+				continue
+			}
+			if len(entFilter) > 0 && !strings.Contains(check.Entitlement, entFilter) {
+				continue
+			}
+			filtered = append(filtered, check)
+		}
+
+		var out []byte
+		if asJSON {
+			out, err = json.MarshalIndent(filtered, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal entitlement checks as JSON: %v", err)
+			}
+		} else {
+			var prev string
+			for _, check := range filtered {
+				if check.Entitlement != prev {
+					out = append(out, fmt.Sprintf("%s\n", check.Entitlement)...)
+					prev = check.Entitlement
+				}
+				caller := check.Symbol
+				if len(caller) == 0 {
+					caller = fmt.Sprintf("sub_%x", check.Function)
+				}
+				checker := check.CheckerSymbol
+				if len(checker) == 0 {
+					checker = fmt.Sprintf("sub_%x", check.Checker)
+				}
+				out = append(out, fmt.Sprintf("    %#x: %s\t%s -> %s\n", check.Address, check.Kext, caller, checker)...)
+			}
+		}
+
+		if len(output) > 0 {
+			log.Infof("Creating %s", output)
+			return os.WriteFile(output, out, 0644)
+		}
+
+		fmt.Print(string(out))
+
+		return nil
+	},
+}
@@ -0,0 +1,111 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/ipsw/pkg/kernelcache"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	kernelcacheCmd.AddCommand(extractKextCmd)
+
+	extractKextCmd.Flags().BoolP("all", "a", false, "Extract all kexts")
+	extractKextCmd.Flags().StringP("output", "o", "", "Folder to extract kexts to")
+	viper.BindPFlag("kernel.extract-kext.all", extractKextCmd.Flags().Lookup("all"))
+	viper.BindPFlag("kernel.extract-kext.output", extractKextCmd.Flags().Lookup("output"))
+	extractKextCmd.MarkZshCompPositionalArgumentFile(1, "kernelcache*")
+}
+
+// extractKextCmd represents the extract-kext command
+var extractKextCmd = &cobra.Command{
+	Use:           "extract-kext <kernelcache> [KEXT_ID...]",
+	Short:         "Extract kexts as standalone MachOs",
+	Args:          cobra.MinimumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		// flags
+		all := viper.GetBool("kernel.extract-kext.all")
+		output := viper.GetString("kernel.extract-kext.output")
+
+		if all && len(args) > 1 {
+			return fmt.Errorf("you cannot use --all and specify kexts")
+		} else if !all && len(args) < 2 {
+			return fmt.Errorf("please specify the kexts to extract (or use --all)")
+		}
+
+		kcPath := filepath.Clean(args[0])
+		if len(output) == 0 {
+			output = filepath.Join(filepath.Dir(kcPath), filepath.Base(kcPath)+"_kexts")
+		}
+
+		f, err := os.Open(kcPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		m, err := macho.NewFile(f)
+		if err != nil {
+			return err
+		}
+
+		kextIDs := args[1:]
+		if all {
+			kexts, err := kernelcache.GetKexts(f, m)
+			if err != nil {
+				return err
+			}
+			for _, kext := range kexts {
+				if kext.ID != "com.apple.kernel" {
+					kextIDs = append(kextIDs, kext.ID)
+				}
+			}
+		}
+
+		for _, kextID := range kextIDs {
+			fname := filepath.Join(output, kextID)
+			if err := kernelcache.ExportKext(f, m, kextID, fname); err != nil {
+				if !all {
+					return err
+				}
+				log.Errorf("failed to extract %s: %v", kextID, err)
+				continue
+			}
+			log.Infof("Created %s", fname)
+		}
+
+		return nil
+	},
+}
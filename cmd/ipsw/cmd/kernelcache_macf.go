@@ -0,0 +1,161 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/ipsw/pkg/kernelcache"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	kernelcacheCmd.AddCommand(kernelMacfCmd)
+
+	kernelMacfCmd.Flags().StringP("policy", "p", "", "Only show this policy (e.g. Sandbox, AMFI)")
+	kernelMacfCmd.Flags().StringP("xnu-header", "x", "", "Path to XNU's security/mac_policy.h (to name the hooks exactly)")
+	kernelMacfCmd.Flags().String("cache", "", "Path to .a2s addr to sym cache file (to name the handlers)")
+	kernelMacfCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+	kernelMacfCmd.Flags().StringP("output", "o", "", "Output file (default is stdout)")
+	viper.BindPFlag("kernel.macf.policy", kernelMacfCmd.Flags().Lookup("policy"))
+	viper.BindPFlag("kernel.macf.xnu-header", kernelMacfCmd.Flags().Lookup("xnu-header"))
+	viper.BindPFlag("kernel.macf.cache", kernelMacfCmd.Flags().Lookup("cache"))
+	viper.BindPFlag("kernel.macf.json", kernelMacfCmd.Flags().Lookup("json"))
+	viper.BindPFlag("kernel.macf.output", kernelMacfCmd.Flags().Lookup("output"))
+	kernelMacfCmd.MarkZshCompPositionalArgumentFile(1, "kernelcache*")
+}
+
+// kernelMacfCmd represents the macf command
+var kernelMacfCmd = &cobra.Command{
+	Use:           "macf <kernelcache>",
+	Short:         "List the MACF policies and the hooks they implement",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		// flags
+		policyName := viper.GetString("kernel.macf.policy")
+		xnuHeader := viper.GetString("kernel.macf.xnu-header")
+		cacheFile := viper.GetString("kernel.macf.cache")
+		asJSON := viper.GetBool("kernel.macf.json")
+		output := viper.GetString("kernel.macf.output")
+
+		var hookNames []string
+		if len(xnuHeader) > 0 {
+			hf, err := os.Open(xnuHeader)
+			if err != nil {
+				return fmt.Errorf("failed to open XNU header: %v", err)
+			}
+			hookNames, err = kernelcache.ParseMacPolicyOpsHeader(hf)
+			hf.Close()
+			if err != nil {
+				return fmt.Errorf("failed to parse XNU header %s: %v", xnuHeader, err)
+			}
+			log.Debugf("Parsed %d mac_policy_ops hooks from %s", len(hookNames), xnuHeader)
+		}
+
+		symbolMap := make(map[uint64]string)
+		if len(cacheFile) > 0 {
+			a2sFile, err := os.Open(cacheFile)
+			if err != nil {
+				return fmt.Errorf("failed to open .a2s cache file: %v", err)
+			}
+			err = gob.NewDecoder(a2sFile).Decode(&symbolMap)
+			a2sFile.Close()
+			if err != nil {
+				return fmt.Errorf("failed to decode .a2s cache file: %v", err)
+			}
+		}
+
+		f, err := os.Open(filepath.Clean(args[0]))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		m, err := macho.NewFile(f)
+		if err != nil {
+			return err
+		}
+
+		policies, err := kernelcache.GetMacPolicies(f, m, hookNames, symbolMap)
+		if err != nil {
+			return err
+		}
+
+		if len(policyName) > 0 {
+			var filtered []kernelcache.MacPolicy
+			for _, policy := range policies {
+				if policy.Name == policyName {
+					filtered = append(filtered, policy)
+				}
+			}
+			if len(filtered) == 0 {
+				return fmt.Errorf("MACF policy %s not found", policyName)
+			}
+			policies = filtered
+		}
+
+		var out []byte
+		if asJSON {
+			out, err = json.MarshalIndent(policies, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal MACF policies as JSON: %v", err)
+			}
+		} else {
+			for _, policy := range policies {
+				out = append(out, fmt.Sprintf("%s (%s)\n", policy.Name, policy.FullName)...)
+				out = append(out, fmt.Sprintf("  kext:            %s\n", policy.Kext)...)
+				out = append(out, fmt.Sprintf("  mac_policy_conf: %#x\n", policy.Conf)...)
+				out = append(out, fmt.Sprintf("  mac_policy_ops:  %#x\n", policy.Ops)...)
+				if policy.Dynamic {
+					out = append(out, "  (hooks are installed at runtime)\n"...)
+				}
+				out = append(out, fmt.Sprintf("  hooks:           %d\n", len(policy.Hooks))...)
+				for _, hook := range policy.Hooks {
+					out = append(out, fmt.Sprintf("    %s\n", hook)...)
+				}
+				out = append(out, '\n')
+			}
+		}
+
+		if len(output) > 0 {
+			log.Infof("Creating %s", output)
+			return os.WriteFile(output, out, 0644)
+		}
+
+		fmt.Print(string(out))
+
+		return nil
+	},
+}
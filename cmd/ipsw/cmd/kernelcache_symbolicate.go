@@ -0,0 +1,194 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/kernelcache"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	kernelcacheCmd.AddCommand(kernelSymbolicateCmd)
+
+	kernelSymbolicateCmd.Flags().StringP("ref", "r", "", "Symbolicated reference kernel (KDK or a kernelcache with symbols)")
+	kernelSymbolicateCmd.Flags().String("ref-cache", "", "Path to .a2s addr to sym cache file of the reference kernel")
+	kernelSymbolicateCmd.Flags().Float64P("min-confidence", "m", 0.0, "Minimum match confidence (0.0-1.0)")
+	kernelSymbolicateCmd.Flags().StringP("output", "o", "", "Output .a2s addr to sym cache file (default is <kernelcache>.a2s)")
+	kernelSymbolicateCmd.Flags().BoolP("json", "j", false, "Output matches as JSON")
+	kernelSymbolicateCmd.Flags().StringP("symbols", "s", "", "Also export the matches to a symbols file")
+	kernelSymbolicateCmd.Flags().StringP("format", "f", "", "Symbols file format (json, ida or ghidra; default is from the file extension)")
+	kernelSymbolicateCmd.MarkFlagRequired("ref")
+	viper.BindPFlag("kernel.symbolicate.ref", kernelSymbolicateCmd.Flags().Lookup("ref"))
+	viper.BindPFlag("kernel.symbolicate.ref-cache", kernelSymbolicateCmd.Flags().Lookup("ref-cache"))
+	viper.BindPFlag("kernel.symbolicate.min-confidence", kernelSymbolicateCmd.Flags().Lookup("min-confidence"))
+	viper.BindPFlag("kernel.symbolicate.output", kernelSymbolicateCmd.Flags().Lookup("output"))
+	viper.BindPFlag("kernel.symbolicate.json", kernelSymbolicateCmd.Flags().Lookup("json"))
+	viper.BindPFlag("kernel.symbolicate.symbols", kernelSymbolicateCmd.Flags().Lookup("symbols"))
+	viper.BindPFlag("kernel.symbolicate.format", kernelSymbolicateCmd.Flags().Lookup("format"))
+	kernelSymbolicateCmd.MarkZshCompPositionalArgumentFile(1, "kernelcache*")
+}
+
+// kernelSymbolicateCmd represents the kernel symbolicate command
+var kernelSymbolicateCmd = &cobra.Command{
+	Use:           "symbolicate <kernelcache>",
+	Short:         "Symbolicate a stripped kernelcache using a KDK or development kernel",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		// flags
+		refPath := filepath.Clean(viper.GetString("kernel.symbolicate.ref"))
+		refCache := viper.GetString("kernel.symbolicate.ref-cache")
+		minConfidence := viper.GetFloat64("kernel.symbolicate.min-confidence")
+		output := viper.GetString("kernel.symbolicate.output")
+		asJSON := viper.GetBool("kernel.symbolicate.json")
+		symbolsFile := viper.GetString("kernel.symbolicate.symbols")
+		format := viper.GetString("kernel.symbolicate.format")
+
+		kernelPath := filepath.Clean(args[0])
+
+		rf, err := os.Open(refPath)
+		if err != nil {
+			return fmt.Errorf("failed to open reference kernel: %v", err)
+		}
+		defer rf.Close()
+		ref, err := macho.NewFile(rf)
+		if err != nil {
+			return fmt.Errorf("failed to parse reference kernel: %v", err)
+		}
+
+		var refSyms map[uint64]string
+		if len(refCache) > 0 {
+			a2sFile, err := os.Open(refCache)
+			if err != nil {
+				return fmt.Errorf("failed to open reference .a2s cache file: %v", err)
+			}
+			err = gob.NewDecoder(a2sFile).Decode(&refSyms)
+			a2sFile.Close()
+			if err != nil {
+				return fmt.Errorf("failed to decode reference .a2s cache file: %v", err)
+			}
+		}
+
+		tf, err := os.Open(kernelPath)
+		if err != nil {
+			return fmt.Errorf("failed to open kernelcache: %v", err)
+		}
+		defer tf.Close()
+		target, err := macho.NewFile(tf)
+		if err != nil {
+			return fmt.Errorf("failed to parse kernelcache: %v", err)
+		}
+
+		log.Info("Matching functions")
+		matches, err := kernelcache.Symbolicate(rf, ref, refSyms, tf, target)
+		if err != nil {
+			return err
+		}
+
+		var filtered []kernelcache.SymbolMatch
+		for _, m := range matches {
+			if m.Confidence >= minConfidence {
+				filtered = append(filtered, m)
+			}
+		}
+
+		if asJSON {
+			dat, err := json.Marshal(filtered)
+			if err != nil {
+				return fmt.Errorf("failed to marshal matches as JSON: %v", err)
+			}
+			fmt.Println(string(dat))
+		} else {
+			methods := make(map[string][]float64)
+			for _, m := range filtered {
+				methods[m.Method] = append(methods[m.Method], m.Confidence)
+			}
+			var names []string
+			for name := range methods {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			log.WithField("count", len(filtered)).Info("Symbolicated functions")
+			for _, name := range names {
+				var total float64
+				for _, c := range methods[name] {
+					total += c
+				}
+				utils.Indent(log.WithFields(log.Fields{
+					"count":          len(methods[name]),
+					"avg_confidence": fmt.Sprintf("%.2f", total/float64(len(methods[name]))),
+				}).Info, 2)(name)
+			}
+			if Verbose {
+				for _, m := range filtered {
+					fmt.Printf("%#x: %s (%.2f, %s)\n", m.Address, m.Name, m.Confidence, m.Method)
+				}
+			}
+		}
+
+		if len(output) == 0 {
+			output = kernelPath + ".a2s"
+		}
+		buff := new(bytes.Buffer)
+		if err := gob.NewEncoder(buff).Encode(kernelcache.SymbolMap(filtered)); err != nil {
+			return fmt.Errorf("failed to encode addr2sym map to binary: %v", err)
+		}
+		if err := os.WriteFile(output, buff.Bytes(), 0644); err != nil {
+			return fmt.Errorf("failed to write addr2sym map: %v", err)
+		}
+		log.Infof("Created %s (use with: ipsw macho disass --cache %s)", output, output)
+
+		if len(symbolsFile) > 0 {
+			if len(format) == 0 {
+				format = symbolsFormat(symbolsFile)
+			}
+			buf := new(bytes.Buffer)
+			if err := kernelcache.WriteSymbols(buf, filtered, format); err != nil {
+				return err
+			}
+			if err := os.WriteFile(symbolsFile, buf.Bytes(), 0644); err != nil {
+				return fmt.Errorf("failed to write symbols file: %v", err)
+			}
+			log.Infof("Exported %d symbols (%s) to %s", len(filtered), format, symbolsFile)
+		}
+
+		return nil
+	},
+}
@@ -30,6 +30,7 @@ import (
 
 	"github.com/apex/log"
 	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/types"
 	"github.com/blacktop/ipsw/pkg/disass"
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
@@ -49,6 +50,7 @@ func init() {
 	machoDisassCmd.Flags().Bool("color", false, "Syntax highlight assembly output")
 	// machoDisassCmd.Flags().StringP("input", "i", "", "Input function JSON file")
 	machoDisassCmd.Flags().String("cache", "", "Path to .a2s addr to sym cache file (speeds up analysis)")
+	machoDisassCmd.Flags().StringP("fileset-entry", "t", "", "Which fileset entry to analyze")
 
 	viper.BindPFlag("macho.disass.symbol", machoDisassCmd.Flags().Lookup("symbol"))
 	viper.BindPFlag("macho.disass.vaddr", machoDisassCmd.Flags().Lookup("vaddr"))
@@ -59,6 +61,7 @@ func init() {
 	viper.BindPFlag("macho.disass.color", machoDisassCmd.Flags().Lookup("color"))
 	// viper.BindPFlag("macho.disass.input", machoDisassCmd.Flags().Lookup("input"))
 	viper.BindPFlag("macho.disass.cache", machoDisassCmd.Flags().Lookup("cache"))
+	viper.BindPFlag("macho.disass.fileset-entry", machoDisassCmd.Flags().Lookup("fileset-entry"))
 
 	machoDisassCmd.MarkZshCompPositionalArgumentFile(1)
 }
@@ -91,6 +94,7 @@ var machoDisassCmd = &cobra.Command{
 
 		// funcFile := viper.GetString("macho.disass.input")
 		cacheFile := viper.GetString("macho.disass.cache")
+		filesetEntry := viper.GetString("macho.disass.fileset-entry")
 
 		if forceColor {
 			color.NoColor = false
@@ -126,6 +130,16 @@ var machoDisassCmd = &cobra.Command{
 			}
 		}
 
+		if len(filesetEntry) > 0 {
+			if m.FileTOC.FileHeader.Type != types.FileSet {
+				return fmt.Errorf("MachO type is not FileSet")
+			}
+			m, err = m.GetFileSetFileByName(filesetEntry)
+			if err != nil {
+				return fmt.Errorf("failed to parse entry %s: %v", filesetEntry, err)
+			}
+		}
+
 		if !strings.Contains(strings.ToLower(m.FileHeader.SubCPU.String(m.CPU)), "arm64") {
 			log.Errorf("can only disassemble arm64 binaries")
 			return nil
@@ -23,180 +23,70 @@ package cmd
 
 import (
 	"bytes"
-	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/apex/log"
-	"github.com/blacktop/go-macho"
-	"github.com/blacktop/go-macho/types"
 	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/blacktop/ipsw/pkg/info"
+	"github.com/blacktop/ipsw/pkg/sep"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
-// NOTE: https://www.blackhat.com/docs/us-16/materials/us-16-Mandt-Demystifying-The-Secure-Enclave-Processor.pdf
-// NOTE: http://mista.nu/research/sep-paper.pdf
-// NOTE: https://gist.github.com/xerub/0161aacd7258d31c6a27584f90fa2e8c
-// NOTE: https://github.com/matteyeux/sepsplit/blob/master/sepsplit.c
-// NOTE: https://gist.github.com/bazad/fe4e76a0a3b761d9fde7e74654ac14e4
-
-const legionStr = "Built by legion2"
-const appListOffsetFromSEPOS32bit = 0xec8
-
-type sepHeader64 struct {
-	KernelUUID       types.UUID
-	Unknown0         uint64
-	KernelTextOffset uint64
-	KernelDataOffset uint64
-	StartOfText      uint64
-	StartOfData      uint64
-	SepFwSize        uint64 // size of SEP firmware image
-	Unknown1         uint64
-	Unknown2         uint64
-	Unknown3         uint64
-	Unknown4         uint64
-	IsZero1          uint64
-	IsZero2          uint64
-	InitTextOffset   uint64
-	InitTextVaddr    uint64
-	InitVMSize       uint64
-	InitEntry        uint64
-	IsZero3          uint64
-	IsZero4          uint64
-	Unknown5         uint64
-	Unknown6         uint64
-	IsZero5          uint64
-	IsZero6          uint64
-	InitName         [16]byte
-	InitUUID         types.UUID
-	SourceVersion    types.SrcVersion
-	Unknown7         uint64
-	NumApps          uint64
-}
+func init() {
+	rootCmd.AddCommand(sepCmd)
 
-func (h sepHeader64) String() string {
-	return fmt.Sprintf(
-		"KernelUUID       : %s\n"+
-			"Unknown0         : %#x\n"+
-			"KernelTextOffset : %#x\n"+
-			"KernelDataOffset   : %#x\n"+
-			"StartOfText      : %#x\n"+
-			"StartOfData      : %#x\n"+
-			"SepFwSize        : %#x\n"+
-			"Unknown1         : %#x\n"+
-			"Unknown2         : %#x\n"+
-			"Unknown3         : %#x\n"+
-			"Unknown4         : %#x\n"+
-			"IsZero1          : %#x\n"+
-			"IsZero2          : %#x\n"+
-			"InitTextOffset   : %#x\n"+
-			"InitTextVaddr    : %#x\n"+
-			"InitVMSize       : %#x\n"+
-			"InitEntry        : %#x\n"+
-			"IsZero3          : %#x\n"+
-			"IsZero4          : %#x\n"+
-			"Unknown5         : %#x\n"+
-			"Unknown6         : %#x\n"+
-			"IsZero5          : %#x\n"+
-			"IsZero6          : %#x\n"+
-			"InitName         : %s\n"+
-			"InitUUID         : %s\n"+
-			"SourceVersion    : %s\n"+
-			"Unknown7         : %#x\n"+
-			"NumApps          : %d",
-		h.KernelUUID,
-		h.Unknown0,
-		h.KernelTextOffset,
-		h.KernelDataOffset,
-		h.StartOfText,
-		h.StartOfData,
-		h.SepFwSize,
-		h.Unknown1,
-		h.Unknown2,
-		h.Unknown3,
-		h.Unknown4,
-		h.IsZero1,
-		h.IsZero2,
-		h.InitTextOffset,
-		h.InitTextVaddr,
-		h.InitVMSize,
-		h.InitEntry,
-		h.IsZero3,
-		h.IsZero4,
-		h.Unknown5,
-		h.Unknown6,
-		h.IsZero5,
-		h.IsZero6,
-		strings.TrimSpace(string(h.InitName[:])),
-		h.InitUUID,
-		h.SourceVersion,
-		h.Unknown7,
-		h.NumApps,
-	)
+	sepCmd.Flags().BoolP("info", "i", false, "Only print the SEP firmware info (don't dump the MachOs)")
+	sepCmd.Flags().BoolP("json", "j", false, "Print the SEP firmware manifest as JSON")
+	sepCmd.Flags().StringP("output", "o", "", "Folder to dump the MachOs to")
 }
 
-type application struct {
-	Offset     uint64
-	VMAddress  uint32
-	Size       uint32
-	EntryPoint uint32
-	PageSize   uint32
-	VMBase     uint32
-	Unknown1   uint32
+// splitSEPFirmware decrypts (with a key from the key database) and splits an extracted sep-firmware IM4P
+func splitSEPFirmware(im4pPath, output, keysFile string, i *info.Info) error {
+	dat, err := ioutil.ReadFile(im4pPath)
+	if err != nil {
+		return err
+	}
+
+	im4p, err := img4.ParseIm4p(bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+
+	var iv, key []byte
+	if im4p.Encrypted() {
+		kbags, err := im4p.KeyBags()
+		if err != nil {
+			return err
+		}
+		db, err := getKeyDB(keysFile)
+		if err != nil {
+			return err
+		}
+		iv, key, err = lookupFirmwareKey(db, kbagValues(kbags), i.Plists.BuildManifest.SupportedProductTypes,
+			i.Plists.BuildManifest.ProductBuildVersion, "SEP", filepath.Base(im4pPath))
+		if err != nil {
+			return errors.Wrap(err, "sep-firmware is encrypted and no key was found (supply a key database with --keys)")
+		}
+	}
 
-	Unknown2      uint32
-	Magic         uint64
-	Name          [12]byte
-	UUID          types.UUID
-	SourceVersion types.SrcVersion
-}
+	dat, err = decryptIm4p(im4p.Data, iv, key)
+	if err != nil {
+		return err
+	}
 
-type application64 struct {
-	TextOffset    uint64
-	TextSize      uint64
-	DataOffset    uint64
-	DataSize      uint64
-	VMBase        uint64
-	Entry         uint64
-	PageSize      uint64
-	Unknown       uint64
-	IsZero1       uint64
-	IsZero2       uint64
-	Magic         uint64
-	Name          [16]byte
-	UUID          types.UUID
-	SourceVersion types.SrcVersion
-}
+	fw, err := sep.Parse(dat)
+	if err != nil {
+		return err
+	}
 
-func (a application64) String() string {
-	return fmt.Sprintf(
-		"Name:          %s\n"+
-			"UUID:          %s\n"+
-			"Version:       %s\n"+
-			"Text:          %#x -> %#x\n"+
-			"Data:          %#x -> %#x\n"+
-			"VMBase:        %#x\n"+
-			"Entry:         %#x\n"+
-			"PageSize:      %#x\n"+
-			"Unknown:       %#x",
-		strings.TrimSpace(string(a.Name[:])),
-		a.UUID,
-		a.SourceVersion,
-		a.TextOffset, a.TextOffset+a.TextSize,
-		a.DataOffset, a.DataOffset+a.DataSize,
-		a.VMBase,
-		a.Entry,
-		a.PageSize,
-		a.Unknown,
-	)
-}
-
-func init() {
-	rootCmd.AddCommand(sepCmd)
+	utils.Indent(log.Info, 2)(fmt.Sprintf("Splitting %s (%s layout) into %s", filepath.Base(im4pPath), fw.Layout, output))
+	return fw.Export(output)
 }
 
 // sepCmd represents the sep command
@@ -204,186 +94,47 @@ var sepCmd = &cobra.Command{
 	Use:   "sepfw <SEP_FIRMWARE>",
 	Short: "Dump MachOs",
 	Args:  cobra.MinimumNArgs(1),
-	// Hidden: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 
 		if Verbose {
 			log.SetLevel(log.DebugLevel)
 		}
 
-		f, err := os.Open(args[0])
-		if err != nil {
-			return errors.Wrapf(err, "unabled to open file: %s", args[0])
-		}
-		defer f.Close()
-
-		dat, err := ioutil.ReadAll(f)
-		if err != nil {
-			return errors.Wrapf(err, "unabled to read file: %s", args[0])
-		}
-
-		r := bytes.NewReader(dat)
-
-		legion := bytes.Index(dat, []byte(legionStr))
-		if legion < 0 {
-			return fmt.Errorf("failed to find " + legionStr)
-		}
-
-		r.Seek(int64(legion+len(legionStr)), io.SeekStart)
+		infoOnly, _ := cmd.Flags().GetBool("info")
+		asJSON, _ := cmd.Flags().GetBool("json")
+		output, _ := cmd.Flags().GetString("output")
 
-		var hdrPtr uint64
-		err = binary.Read(r, binary.LittleEndian, &hdrPtr)
+		fw, err := sep.Open(args[0])
 		if err != nil {
-			return errors.Wrapf(err, "failed to read sep 64bit header")
+			return errors.Wrapf(err, "failed to parse SEP firmware %s", args[0])
 		}
 
-		// 64-bit SEP
-		if hdrPtr > 0 {
-
-			r.Seek(int64(hdrPtr), io.SeekStart)
-
-			var hdr sepHeader64
-			err = binary.Read(r, binary.LittleEndian, &hdr)
-			if err != nil {
-				return errors.Wrapf(err, "failed to read sep-firmware 64bit header")
+		if !infoOnly {
+			log.Infof("DUMPING: kernel, SEPOS, %d Apps and %d Shared Libraries", len(fw.Apps), len(fw.SharedLibs))
+			if err := fw.Export(filepath.Clean(output)); err != nil {
+				return errors.Wrap(err, "failed to dump SEP firmware MachOs")
 			}
-
-			log.Debugf("Header:\n\n%s\n", hdr)
-
-			appList := make([]application64, hdr.NumApps)
-			err = binary.Read(r, binary.LittleEndian, &appList)
-			if err != nil {
-				return errors.Wrapf(err, "failed to read app-list")
-			}
-
-			for _, app := range appList {
-				log.Debugf("App:\n\n%s\n", app)
-			}
-
-			log.Infof("DUMPING: kernel, SEPOS and %d Apps", hdr.NumApps)
-
-			// KERNEL
-			m, err := macho.NewFile(bytes.NewReader(dat[hdr.KernelTextOffset:]))
-			if err != nil {
-				return errors.Wrapf(err, "failed to create MachO from embedded sep file data")
-			}
-			fname := fmt.Sprintf("%s_%s", "kernel", m.SourceVersion())
-			utils.Indent(log.WithFields(log.Fields{
-				"uuid":   hdr.KernelUUID,
-				"offset": fmt.Sprintf("%#x", hdr.KernelTextOffset),
-			}).Info, 2)("Dumping kernel")
-			if err := m.Export(fname, nil, 0, nil); err != nil {
-				return fmt.Errorf("failed to write %s to disk: %v", fname, err)
-			}
-			if Verbose {
-				fmt.Println(m.FileTOC.LoadsString())
+			for _, img := range fw.Images() {
+				utils.Indent(log.WithFields(log.Fields{
+					"uuid":   img.UUID,
+					"offset": fmt.Sprintf("%#x", img.TextOffset),
+				}).Info, 2)(fmt.Sprintf("Dumped %s", filepath.Join(output, img.File)))
 			}
+		}
 
-			// SEPOS
-			m, err = macho.NewFile(bytes.NewReader(dat[hdr.InitTextOffset:]))
+		if asJSON {
+			dat, err := json.MarshalIndent(fw, "", "    ")
 			if err != nil {
-				return errors.Wrapf(err, "failed to create MachO from embedded sep file data")
-			}
-			fname = fmt.Sprintf("%s_%s", strings.TrimSpace(string(hdr.InitName[:])), m.SourceVersion())
-			utils.Indent(log.WithFields(log.Fields{
-				"uuid":   hdr.InitUUID,
-				"offset": fmt.Sprintf("%#x", hdr.InitTextOffset),
-			}).Info, 2)(fmt.Sprintf("Dumping %s", strings.TrimSpace(string(hdr.InitName[:]))))
-			if err := m.Export(fname, nil, 0, nil); err != nil {
-				return fmt.Errorf("failed to write %s to disk: %v", fname, err)
+				return err
 			}
-			if Verbose {
-				fmt.Println(m.FileTOC.LoadsString())
+			fmt.Println(string(dat))
+		} else if infoOnly || Verbose {
+			fmt.Printf("SEP Firmware (%s layout)\n", fw.Layout)
+			for _, img := range fw.Images() {
+				fmt.Printf("  %s\n", strings.TrimSpace(img.String()))
 			}
-
-			// APPS
-			for _, app := range appList {
-				m, err := macho.NewFile(bytes.NewReader(dat[app.TextOffset:]))
-				if err != nil {
-					return errors.Wrapf(err, "failed to create MachO from embedded sep file data")
-				}
-
-				fname := fmt.Sprintf("%s_%s", strings.TrimSpace(string(app.Name[:])), m.SourceVersion())
-				utils.Indent(log.WithFields(log.Fields{
-					"uuid":   app.UUID,
-					"offset": fmt.Sprintf("%#x-%#x", app.TextOffset, app.TextOffset+app.TextSize),
-				}).Info, 2)(fmt.Sprintf("Dumping %s", strings.TrimSpace(string(app.Name[:]))))
-				if err := m.Export(fname, nil, 0, nil); err != nil {
-					return fmt.Errorf("failed to write %s to disk: %v", fname, err)
-				}
-				if Verbose {
-					fmt.Println(m.FileTOC.LoadsString())
-				}
-			}
-
-			return nil
 		}
 
-		log.Error("32-bit SEP Firmware not yet supported")
-
-		// 32-bit SEP
-
-		// var appList []application
-		// for {
-		// 	var app application
-		// 	err := binary.Read(r, binary.LittleEndian, &app)
-		// 	if err == io.EOF {
-		// 		break
-		// 	}
-		// 	if err != nil {
-		// 		return errors.Wrapf(err, "failed to read string")
-		// 	}
-		// 	if app.Magic != 0xFFFFFFFF {
-		// 		break
-		// 	}
-
-		// 	names = append(names, strings.TrimSpace(string(app.Name[:])))
-		// 	appList = append(appList, app)
-		// }
-
-		// index := 0
-		// machoDat := dat[end:]
-		// for x, d := bytes.Index(machoDat, macho32Magic), 0; x > -1; x, d = bytes.Index(machoDat, macho32Magic), d+x+1 {
-		// 	offset := end + x + d
-		// 	if offset&0xFFF == 0 {
-		// 		if len(machos) > 0 {
-		// 			machos[index-1].End = offset
-		// 		}
-		// 		machos = append(machos, machoInfo{
-		// 			Name:  names[index],
-		// 			Start: offset,
-		// 		})
-		// 		index++
-		// 	}
-		// 	machoDat = machoDat[x+1 : len(machoDat)]
-		// }
-
-		// fmt.Println()
-		// for _, macho := range machos {
-		// 	fmt.Printf("name: %s\tstart: 0x%x(%d)\tend: 0x%x(%d)\tsize: 0x%x(%d)\n", macho.Name, macho.Start, macho.Start, macho.End, macho.End, macho.End-macho.Start, macho.End-macho.Start)
-		// }
-
-		// for _, macho := range machos {
-		// 	var outDat []byte
-		// 	if macho.End == 0 {
-		// 		outDat = dat[macho.Start:]
-		// 	} else {
-		// 		outDat = dat[macho.Start:macho.End]
-		// 	}
-
-		// 	m, err := mo.NewFile(bytes.NewReader(outDat))
-		// 	if err != nil {
-		// 		return errors.Wrapf(err, "failed to create MachO from embedded sep file data")
-		// 	}
-
-		// 	fname := fmt.Sprintf("sepdump_%s_%s", macho.Name, m.SourceVersion())
-		// 	utils.Indent(log.Info, 2)(fmt.Sprintf("Dumping %s", fname))
-		// 	ioutil.WriteFile(fname, outDat, 0644)
-		// 	if err != nil {
-		// 		return errors.Wrapf(err, "unabled to write file: %s", fname)
-		// 	}
-		// }
-
 		return nil
 	},
 }
@@ -0,0 +1,140 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/pkg/plist"
+	"github.com/blacktop/ipsw/pkg/shsh"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// shshECIDRE matches the ECID blobs are named with (e.g. 1249767383957670.dumped.shsh or 1249767383957670_iPhone12,1_...)
+var shshECIDRE = regexp.MustCompile(`^(\d{6,20})[._]`)
+
+func init() {
+	shshCmd.AddCommand(shshVerifyCmd)
+
+	shshVerifyCmd.Flags().String("ecid", "", "Device ECID to check the ticket against (default is the ECID in the blob's filename)")
+	shshVerifyCmd.Flags().BoolP("update", "u", false, "Verify against the Update BuildIdentity (default is Erase)")
+	shshVerifyCmd.Flags().BoolP("json", "j", false, "Output as JSON")
+
+	shshVerifyCmd.MarkZshCompPositionalArgumentFile(1, "*.shsh*")
+	shshVerifyCmd.MarkZshCompPositionalArgumentFile(2, "*.ipsw", "*.plist")
+}
+
+// readShshBuildManifest reads a BuildManifest.plist or the BuildManifest.plist of an IPSW or directory
+func readShshBuildManifest(src string) (*plist.BuildManifest, error) {
+	if strings.EqualFold(filepath.Ext(src), ".plist") {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", src)
+		}
+		return plist.ParseBuildManifest(data)
+	}
+	return readBuildManifest(src)
+}
+
+// shshVerifyCmd represents the shsh verify command
+var shshVerifyCmd = &cobra.Command{
+	Use:           "verify <BLOB> <IPSW|BuildManifest>",
+	Short:         "Verify a shsh blob against an IPSW's BuildManifest",
+	Args:          cobra.ExactArgs(2),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		ecidStr, _ := cmd.Flags().GetString("ecid")
+		update, _ := cmd.Flags().GetBool("update")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		conf := &shsh.VerifyConfig{Behavior: shsh.BehaviorErase}
+		if update {
+			conf.Behavior = shsh.BehaviorUpdate
+		}
+
+		if len(ecidStr) > 0 {
+			ecid, err := strconv.ParseUint(ecidStr, 0, 64)
+			if err != nil {
+				return fmt.Errorf("invalid --ecid %s: %v", ecidStr, err)
+			}
+			conf.ECID = ecid
+		} else if m := shshECIDRE.FindStringSubmatch(filepath.Base(args[0])); m != nil {
+			if ecid, err := strconv.ParseUint(m[1], 10, 64); err == nil {
+				conf.ECID = ecid
+			}
+		}
+
+		f, err := os.Open(filepath.Clean(args[0]))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		blob, err := shsh.Parse(f)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse shsh blob %s", args[0])
+		}
+
+		bm, err := readShshBuildManifest(filepath.Clean(args[1]))
+		if err != nil {
+			return err
+		}
+
+		v, err := blob.Verify(bm, conf)
+		if err != nil {
+			return err
+		}
+
+		if asJSON {
+			dat, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal verification as JSON: %v", err)
+			}
+			fmt.Println(string(dat))
+		} else {
+			fmt.Print(v)
+		}
+
+		if !v.Valid() {
+			return fmt.Errorf("shsh blob is NOT valid for %s", bm.ProductBuildVersion)
+		}
+
+		log.Infof("shsh blob is valid for %s", bm.ProductBuildVersion)
+
+		return nil
+	},
+}
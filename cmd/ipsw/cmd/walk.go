@@ -0,0 +1,108 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/blacktop/ipsw/internal/utils"
+)
+
+// walkHeadSize is the number of bytes walkFiles matches files with
+const walkHeadSize = 0x40
+
+// walkIm4ps calls fn with the path and data of each Im4p in an IPSW or directory
+func walkIm4ps(src string, fn func(path string, data []byte) error) error {
+	return walkFiles(src, utils.IsIm4p, fn)
+}
+
+// walkFiles calls fn with the path and data of each file in an IPSW or directory whose first bytes match
+func walkFiles(src string, match func(head []byte) bool, fn func(path string, data []byte) error) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			head := make([]byte, walkHeadSize)
+			n, _ := io.ReadFull(f, head)
+			f.Close()
+			if !match(head[:n]) {
+				return nil
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			return fn(filepath.ToSlash(rel), data)
+		})
+	}
+
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open %s in zip: %v", zf.Name, err)
+		}
+		head := make([]byte, walkHeadSize)
+		n, _ := io.ReadFull(rc, head)
+		if !match(head[:n]) {
+			rc.Close()
+			continue
+		}
+		rest, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s in zip: %v", zf.Name, err)
+		}
+		if err := fn(zf.Name, append(head[:n], rest...)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
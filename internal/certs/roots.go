@@ -0,0 +1,75 @@
+package certs
+
+import (
+	"crypto/x509"
+	"embed"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed data/roots
+var rootsFS embed.FS
+
+// AppleRoots returns the bundled Apple root CA certificates
+func AppleRoots() ([]*x509.Certificate, error) {
+	var roots []*x509.Certificate
+
+	err := fs.WalkDir(rootsFS, "data/roots", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".pem", ".cer", ".crt", ".der":
+		default:
+			return nil
+		}
+		dat, err := rootsFS.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		certs, err := ParseCertificates(dat)
+		if err != nil {
+			return fmt.Errorf("failed to parse root certificate %s: %v", path, err)
+		}
+		roots = append(roots, certs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return roots, nil
+}
+
+// ParseCertificates parses PEM or DER encoded certificates
+func ParseCertificates(dat []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	if !strings.Contains(string(dat), "-----BEGIN") {
+		return x509.ParseCertificates(dat)
+	}
+
+	for {
+		var block *pem.Block
+		block, dat = pem.Decode(dat)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return certs, nil
+}
@@ -83,7 +83,21 @@ type wikiParseResults struct {
 	Parse wikiParseData `json:"parse"`
 }
 
-type wikiFWKeys struct {
+type wikiSearchResult struct {
+	NS    int    `json:"ns,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+type wikiQueryData struct {
+	Search []wikiSearchResult `json:"search,omitempty"`
+}
+
+type wikiQueryResults struct {
+	Query wikiQueryData `json:"query"`
+}
+
+// WikiFWKeys are the firmware keys of a device's build (from its theiphonewiki.com keys page)
+type WikiFWKeys struct {
 	Version            string
 	Build              string
 	Device             string
@@ -539,9 +553,7 @@ func GetWikiOTAs(proxy string, insecure bool) ([]*WikiOTA, error) {
 	return otas, nil
 }
 
-func GetWikiFirmwareKeys(proxy string, insecure bool) ([]*WikiOTA, error) {
-	var otas []*WikiOTA
-
+func searchWiki(search string, proxy string, insecure bool) (*wikiQueryResults, error) {
 	client := &http.Client{
 		Transport: &http.Transport{
 			Proxy:           GetProxy(proxy),
@@ -556,10 +568,11 @@ func GetWikiFirmwareKeys(proxy string, insecure bool) ([]*WikiOTA, error) {
 
 	q := req.URL.Query()
 	q.Add("format", "json")
-	q.Add("action", "parse")
-	q.Add("page", "OTA Updates")
-	q.Add("prop", "links")
-	q.Add("redirects", "true")
+	q.Add("action", "query")
+	q.Add("list", "search")
+	q.Add("srsearch", search)
+	q.Add("srnamespace", "*") // the keys pages aren't all in the main namespace (e.g. Keys:)
+	q.Add("srlimit", "50")
 	req.URL.RawQuery = q.Encode()
 
 	resp, err := client.Do(req)
@@ -578,35 +591,74 @@ func GetWikiFirmwareKeys(proxy string, insecure bool) ([]*WikiOTA, error) {
 	}
 
 	// parse the response
-	var parseResp wikiParseResults
-	if err := json.Unmarshal(data, &parseResp); err != nil {
+	var queryResp wikiQueryResults
+	if err := json.Unmarshal(data, &queryResp); err != nil {
 		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	for _, link := range parseResp.Parse.Links {
-		// if strings.HasPrefix(link.Link, "OTA Updates/") {
-		if strings.HasPrefix(link.Link, "OTA Updates/iPhone/15") {
+	return &queryResp, nil
+}
 
-			wpage, err := getWikiPage(link.Link, proxy, insecure)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse page %s: %w", link.Link, err)
-			}
+// parse the {{keys}} template of a firmware keys page
+func parseWikiKeys(text string) (*WikiFWKeys, error) {
+	fields := make(map[string]string)
 
-			if utils.StrSliceContains(wpage.Parse.ExternalLinks, ".zip") {
-				wtable, err := getWikiTable(link.Link, proxy, insecure)
-				if err != nil {
-					return nil, fmt.Errorf("failed to parse wikitable for %s: %w", link.Link, err)
-				}
-				// parse the wikitable
-				tableIPSWs, err := parseWikiTable(wtable.Parse.WikiText.Text)
-				if err != nil {
-					return nil, fmt.Errorf("failed to parse wikitable: %w", err)
-				}
-				fmt.Println(tableIPSWs)
-				// otas = append(otas, tableIPSWs...)
-			}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "|") {
+			continue
 		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "|"), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		// the template's field names match the WikiFWKeys fields (e.g. RootFSKey or iBECIV)
+		fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 	}
 
-	return otas, nil
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("failed to find keys template")
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal keys: %w", err)
+	}
+
+	var keys WikiFWKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse keys: %w", err)
+	}
+
+	return &keys, nil
+}
+
+// GetWikiFirmwareKeys queries theiphonewiki.com for the firmware keys of a device's build
+func GetWikiFirmwareKeys(device, build, proxy string, insecure bool) (*WikiFWKeys, error) {
+	results, err := searchWiki(fmt.Sprintf("%s %s", build, device), proxy, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for %s keys: %w", build, err)
+	}
+
+	// keys pages are titled '<Codename> <Build> (<Device>)'
+	suffix := fmt.Sprintf(" %s (%s)", build, device)
+
+	for _, result := range results.Query.Search {
+		if !strings.HasSuffix(result.Title, suffix) {
+			continue
+		}
+		wtable, err := getWikiTable(result.Title, proxy, insecure)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get wikitext for %s: %w", result.Title, err)
+		}
+		keys, err := parseWikiKeys(wtable.Parse.WikiText.Text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse keys of %s: %w", result.Title, err)
+		}
+		return keys, nil
+	}
+
+	return nil, fmt.Errorf("failed to find keys page for %s (%s)", build, device)
 }
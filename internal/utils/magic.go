@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// IsMachO returns true if data starts with a (32 or 64-bit) MachO magic
+func IsMachO(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(data) {
+	case 0xfeedface, 0xfeedfacf:
+		return true
+	}
+	return false
+}
+
+// IsUniversalMachO returns true if data starts with a universal MachO magic (universal headers are big-endian)
+func IsUniversalMachO(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == 0xcafebabe
+}
+
+// IsIm4p returns true if data starts with an Im4p header
+func IsIm4p(data []byte) bool {
+	return isDERTagged(data, "IM4P")
+}
+
+// IsImg4 returns true if data starts with an Img4 header
+func IsImg4(data []byte) bool {
+	return isDERTagged(data, "IMG4")
+}
+
+// isDERTagged returns true if data starts with a DER sequence whose first element is the IA5String tag
+func isDERTagged(data []byte, tag string) bool {
+	if len(data) > 16 {
+		data = data[:16]
+	}
+	return len(data) > 8 && data[0] == 0x30 && bytes.Contains(data, []byte("\x16\x04"+tag))
+}
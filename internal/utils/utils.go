@@ -412,3 +412,11 @@ func IsASCII(s string) bool {
 	}
 	return true
 }
+
+// Min returns the smaller of a and b
+func Min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,251 @@
+// Package bbfw parses baseband firmware bundles (the Firmware/*.bbfw zips in IPSWs)
+package bbfw
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/info"
+	"github.com/pkg/errors"
+)
+
+// Image formats
+const (
+	FormatELF   = "elf"   // Qualcomm ELF (with an MBN hash segment)
+	FormatMBN   = "mbn"   // Qualcomm raw MBN
+	FormatFLS   = "fls"   // Intel/Apple flashless image
+	FormatPlist = "plist" // e.g. Info.plist
+	FormatOther = "other"
+)
+
+var (
+	// bundleVersionRE matches the version in a bundle's name (e.g. Mav20-1.50.00.Release.bbfw)
+	bundleVersionRE = regexp.MustCompile(`^([A-Za-z]+\d*-[\d.]+?)(?:\.(?:Release|Debug|Production))?\.bbfw$`)
+	// qcVersionRE matches the version strings Qualcomm images are built with
+	qcVersionRE = regexp.MustCompile(`((?:QC|OEM)_IMAGE_VERSION_STRING|IMAGE_VARIANT_STRING)=([\x21-\x7e]+)`)
+	// intelVersionRE matches the version strings of Intel images (e.g. ICE19_MODEM_05.02.01_G)
+	intelVersionRE = regexp.MustCompile(`ICE\d+_[A-Z_]+_[\d.]+_[\x21-\x7e]+`)
+)
+
+// maxVersions is the maximum number of version strings kept per image
+const maxVersions = 8
+
+// Image is a file in a baseband firmware bundle
+type Image struct {
+	Name     string   `json:"name"`
+	Size     uint64   `json:"size"`
+	Format   string   `json:"format"`
+	Machine  string   `json:"machine,omitempty"` // ELF machine (e.g. EM_QDSP6)
+	Header   *Header  `json:"header,omitempty"`  // MBN or FLS header
+	Versions []string `json:"versions,omitempty"`
+	Signing  *Signing `json:"signing,omitempty"`
+	Error    string   `json:"error,omitempty"` // the image failed to parse (e.g. a corrupt ELF)
+
+	zf *zip.File
+}
+
+func (i Image) String() string {
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("%-24s %-5s %#9x", i.Name, i.Format, i.Size))
+	if len(i.Machine) > 0 {
+		out.WriteString(fmt.Sprintf(" %s", i.Machine))
+	}
+	if i.Header != nil {
+		out.WriteString(fmt.Sprintf(" %s", i.Header))
+	}
+	for _, v := range i.Versions {
+		out.WriteString(fmt.Sprintf("\n    %s", v))
+	}
+	if i.Signing != nil {
+		out.WriteString(fmt.Sprintf("\n    %s", i.Signing))
+	}
+	if len(i.Error) > 0 {
+		out.WriteString(fmt.Sprintf("\n    error: %s", i.Error))
+	}
+	return out.String()
+}
+
+// Bundle is a parsed baseband firmware bundle
+type Bundle struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version,omitempty"` // from the bundle name (e.g. Mav20-1.50.00)
+	Images  []Image  `json:"images"`
+	ChipIDs []string `json:"bb_chip_ids,omitempty"` // BasebandChipIDs of the bundle (from the HW_IDs it is signed for or a BuildManifest)
+	Devices []string `json:"devices,omitempty"`     // devices with one of the ChipIDs
+}
+
+// Open opens and parses a baseband firmware bundle
+func Open(path string) (*Bundle, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return Parse(filepath.Base(path), data)
+}
+
+// Parse parses a baseband firmware bundle (name is the name of the .bbfw file)
+func Parse(name string, data []byte) (*Bundle, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "bbfw is not a zip")
+	}
+
+	b := &Bundle{Name: name}
+	if m := bundleVersionRE.FindStringSubmatch(filepath.Base(name)); m != nil {
+		b.Version = m[1]
+	}
+
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		img, err := parseImage(zf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", zf.Name)
+		}
+		if img.Signing != nil {
+			if id := img.Signing.ChipID(); len(id) > 0 {
+				b.ChipIDs = append(b.ChipIDs, id)
+			}
+		}
+		b.Images = append(b.Images, *img)
+	}
+
+	b.ChipIDs = utils.Unique(b.ChipIDs)
+	sort.Strings(b.ChipIDs)
+
+	return b, nil
+}
+
+func parseImage(zf *zip.File) (*Image, error) {
+	img := &Image{
+		Name:   zf.Name,
+		Size:   zf.UncompressedSize64,
+		Format: FormatOther,
+		zf:     zf,
+	}
+
+	data, err := img.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("\x7fELF")):
+		img.Format = FormatELF
+		if err := img.parseELF(data); err != nil {
+			// keep the rest of the bundle (and the image's version strings)
+			img.Error = err.Error()
+		}
+	case strings.EqualFold(filepath.Ext(zf.Name), ".mbn"):
+		img.Format = FormatMBN
+		if hdr, err := parseMBNHeader(data); err == nil {
+			img.Header = hdr
+			img.Signing = parseSigning(hdr, data)
+		}
+	case strings.EqualFold(filepath.Ext(zf.Name), ".fls"):
+		img.Format = FormatFLS
+		hdr, sig, err := parseFLSHeader(data)
+		if err != nil {
+			img.Error = err.Error()
+		}
+		if len(sig) == 0 {
+			sig = data // scan the whole image for the certificates
+		}
+		img.Header = hdr
+		img.Signing = parseSigning(nil, sig)
+	case bytes.HasPrefix(data, []byte("<?xml")) || bytes.HasPrefix(data, []byte("bplist")):
+		img.Format = FormatPlist
+		return img, nil
+	}
+
+	img.Versions = findVersions(data)
+
+	return img, nil
+}
+
+// Data returns the contents of the image
+func (i *Image) Data() ([]byte, error) {
+	rc, err := i.zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// findVersions returns the version strings embedded in an image
+func findVersions(data []byte) []string {
+	var versions []string
+	for _, m := range qcVersionRE.FindAllSubmatch(data, -1) {
+		versions = append(versions, fmt.Sprintf("%s=%s", m[1], m[2]))
+	}
+	for _, m := range intelVersionRE.FindAll(data, -1) {
+		versions = append(versions, string(m))
+	}
+	versions = utils.Unique(versions)
+	if len(versions) > maxVersions {
+		versions = versions[:maxVersions]
+	}
+	return versions
+}
+
+// Match sets the devices of the bundle's baseband chip IDs (along with any IDs from a BuildManifest)
+func (b *Bundle) Match(db *info.Devices, chipIDs ...string) {
+	b.ChipIDs = utils.Unique(append(b.ChipIDs, chipIDs...))
+	sort.Strings(b.ChipIDs)
+	b.Devices = nil
+	for _, id := range b.ChipIDs {
+		b.Devices = append(b.Devices, db.LookupBasebandChipID(id)...)
+	}
+	b.Devices = utils.Unique(b.Devices)
+	sort.Strings(b.Devices)
+}
+
+// Extract writes the bundle's images to a folder
+func (b *Bundle) Extract(dir string) ([]string, error) {
+	var files []string
+	for _, img := range b.Images {
+		data, err := img.Data()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", img.Name)
+		}
+		fname := filepath.Join(dir, filepath.Clean("/"+img.Name)) // keep the images inside dir
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+			return nil, errors.Wrapf(err, "failed to write %s", fname)
+		}
+		files = append(files, fname)
+	}
+	return files, nil
+}
+
+func (b *Bundle) String() string {
+	var out strings.Builder
+	out.WriteString(b.Name)
+	if len(b.Version) > 0 {
+		out.WriteString(fmt.Sprintf(" (%s)", b.Version))
+	}
+	out.WriteString("\n")
+	if len(b.ChipIDs) > 0 {
+		out.WriteString(fmt.Sprintf("  BasebandChipID: %s\n", strings.Join(b.ChipIDs, ", ")))
+	}
+	if len(b.Devices) > 0 {
+		out.WriteString(fmt.Sprintf("  Devices:        %s\n", strings.Join(b.Devices, ", ")))
+	}
+	out.WriteString("  Images:\n")
+	for _, img := range b.Images {
+		out.WriteString(fmt.Sprintf("    %s\n", strings.ReplaceAll(img.String(), "\n", "\n    ")))
+	}
+	return out.String()
+}
@@ -0,0 +1,120 @@
+package bbfw
+
+// NOTE: https://github.com/libimobiledevice/idevicerestore/blob/master/src/fls.c
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// FLS element types
+const (
+	flsElementCode      = 0x0c // a region of the load map
+	flsElementSignature = 0x10 // the signature blob (replaced with the one from the BasebandFirmware ticket when restoring)
+	flsElementTicket    = 0x14 // the baseband ticket (inserted when restoring)
+)
+
+// flsElementHeader is the header every FLS element starts with (size includes the header)
+type flsElementHeader struct {
+	Type  uint32
+	Size  uint32
+	Empty uint32
+}
+
+// flsCodeElement is the rest of a code element (its data is elsewhere in the image)
+type flsCodeElement struct {
+	Unknown  [4]uint32 // not understood yet (load address, flags, ...)
+	DataSize uint32
+	Offset   uint32 // file offset of the data
+}
+
+// flsBlobElement is the rest of a signature or ticket element (its data follows)
+type flsBlobElement struct {
+	DataSize uint32
+	Unknown  uint32
+}
+
+const (
+	flsElementHeaderSize = 12
+	flsCodeElementSize   = flsElementHeaderSize + 24
+	flsBlobElementSize   = flsElementHeaderSize + 8
+)
+
+// LoadRegion is a region of an FLS image's load map
+type LoadRegion struct {
+	Offset  uint32    `json:"offset"` // file offset of the data
+	Size    uint32    `json:"size"`
+	Unknown [4]uint32 `json:"unknown"`
+}
+
+// parseFLSHeader parses the elements of an Intel/Apple flashless (FLS) image.
+//
+// An FLS image is a chain of elements (type, size, padding and data) that must end at the end of the image;
+// the code elements make up its load map and the signature (and ticket) elements hold the signature blob.
+func parseFLSHeader(data []byte) (*Header, []byte, error) {
+	h := &Header{}
+	var sig []byte
+
+	for off := uint64(0); off < uint64(len(data)); {
+		if off+flsElementHeaderSize > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("FLS element at %#x is truncated", off)
+		}
+		var e flsElementHeader
+		e.Type = binary.LittleEndian.Uint32(data[off:])
+		e.Size = binary.LittleEndian.Uint32(data[off+4:])
+		e.Empty = binary.LittleEndian.Uint32(data[off+8:])
+		if e.Size < flsElementHeaderSize || off+uint64(e.Size) > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("FLS element %#x at %#x has an invalid size %#x", e.Type, off, e.Size)
+		}
+		elem := data[off : off+uint64(e.Size)]
+
+		switch e.Type {
+		case flsElementCode:
+			if len(elem) < flsCodeElementSize {
+				return nil, nil, fmt.Errorf("FLS code element at %#x is truncated", off)
+			}
+			var c flsCodeElement
+			for idx := range c.Unknown {
+				c.Unknown[idx] = binary.LittleEndian.Uint32(elem[flsElementHeaderSize+4*idx:])
+			}
+			c.DataSize = binary.LittleEndian.Uint32(elem[flsElementHeaderSize+16:])
+			c.Offset = binary.LittleEndian.Uint32(elem[flsElementHeaderSize+20:])
+			if uint64(c.Offset)+uint64(c.DataSize) > uint64(len(data)) {
+				return nil, nil, fmt.Errorf("FLS code element at %#x points outside of the image (%#x-%#x)",
+					off, c.Offset, uint64(c.Offset)+uint64(c.DataSize))
+			}
+			h.LoadMap = append(h.LoadMap, LoadRegion{Offset: c.Offset, Size: c.DataSize, Unknown: c.Unknown})
+			h.CodeSize += c.DataSize
+		case flsElementSignature, flsElementTicket:
+			if len(elem) < flsBlobElementSize {
+				return nil, nil, fmt.Errorf("FLS element %#x at %#x is truncated", e.Type, off)
+			}
+			b := flsBlobElement{
+				DataSize: binary.LittleEndian.Uint32(elem[flsElementHeaderSize:]),
+				Unknown:  binary.LittleEndian.Uint32(elem[flsElementHeaderSize+4:]),
+			}
+			if flsBlobElementSize+uint64(b.DataSize) > uint64(len(elem)) {
+				return nil, nil, fmt.Errorf("FLS element %#x at %#x has an invalid data size %#x", e.Type, off, b.DataSize)
+			}
+			blob := elem[flsBlobElementSize : flsBlobElementSize+uint64(b.DataSize)]
+			if e.Type == flsElementTicket {
+				h.TicketSize = b.DataSize
+			} else {
+				h.SignatureSize = b.DataSize
+				sig = blob
+			}
+		}
+		h.Elements++
+
+		off += uint64(e.Size)
+	}
+
+	if len(h.LoadMap) == 0 {
+		return nil, nil, fmt.Errorf("FLS image has no code elements")
+	}
+	for _, cert := range findCertificates(sig) {
+		h.CertChainSize += uint32(len(cert.Raw))
+	}
+
+	return h, sig, nil
+}
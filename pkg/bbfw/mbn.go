@@ -0,0 +1,235 @@
+package bbfw
+
+import (
+	"bytes"
+	"crypto/x509"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// segmentTypeMask is the Qualcomm segment type in the ELF program header flags
+	segmentTypeMask  = 0x07000000
+	segmentTypeShift = 24
+	segmentTypeHash  = 2 // the MBN hash segment (header, hash table, signature and certificate chain)
+
+	mbnHeaderSize   = 40
+	mbnHeaderSizeV6 = 48 // v6 and later add the metadata sizes
+	maxCertificates = 8
+)
+
+// attestationRE matches the fields Qualcomm encodes in the attestation certificate OUs (e.g. "02 009210E100000000 HW_ID")
+var attestationRE = regexp.MustCompile(`(\d{2}) ([0-9A-Fa-f]{4,16}) ([A-Z][A-Z0-9_]{1,15})`)
+
+// Header is an MBN (or FLS) header
+type Header struct {
+	ImageID       uint32 `json:"image_id,omitempty"`
+	Version       uint32 `json:"version,omitempty"`
+	ImageSize     uint32 `json:"image_size,omitempty"`
+	CodeSize      uint32 `json:"code_size,omitempty"` // the hash table (MBN)
+	SignatureSize uint32 `json:"signature_size,omitempty"`
+	CertChainSize uint32 `json:"cert_chain_size,omitempty"`
+	MetadataSize  uint32 `json:"metadata_size,omitempty"` // v6+
+
+	// FLS only
+	Elements   int          `json:"elements,omitempty"`
+	LoadMap    []LoadRegion `json:"load_map,omitempty"`
+	TicketSize uint32       `json:"ticket_size,omitempty"`
+}
+
+func (h Header) String() string {
+	if len(h.LoadMap) > 0 {
+		s := fmt.Sprintf("FLS elements: %d code: %#x sig: %#x certs: %#x", h.Elements, h.CodeSize, h.SignatureSize, h.CertChainSize)
+		if h.TicketSize > 0 {
+			s += fmt.Sprintf(" ticket: %#x", h.TicketSize)
+		}
+		return s
+	}
+	return fmt.Sprintf("MBN v%d image_id: %d code: %#x sig: %#x certs: %#x", h.Version, h.ImageID, h.CodeSize, h.SignatureSize, h.CertChainSize)
+}
+
+// mbnHeader is the common part of the v3, v5 and v6 MBN headers
+type mbnHeader struct {
+	ImageID       uint32
+	Version       uint32
+	Unknown0      uint32 // image_src (v3) or qti_signature_size (v5+)
+	Unknown1      uint32 // image_dest_ptr (v3) or qti_cert_chain_size (v5+)
+	ImageSize     uint32
+	CodeSize      uint32
+	SignaturePtr  uint32
+	SignatureSize uint32
+	CertChainPtr  uint32
+	CertChainSize uint32
+}
+
+// Signing is an image's signature and attestation certificate info
+type Signing struct {
+	Fields       map[string]string `json:"fields,omitempty"` // attestation OU fields (e.g. HW_ID, SW_ID, OEM_ID, MODEL_ID)
+	Hash         string            `json:"hash,omitempty"`   // e.g. SHA256
+	Certificates []Certificate     `json:"certificates,omitempty"`
+}
+
+// Certificate is a certificate of an image's signing chain
+type Certificate struct {
+	Subject            string `json:"subject"`
+	Issuer             string `json:"issuer"`
+	SignatureAlgorithm string `json:"signature_algorithm"`
+}
+
+// ChipID returns the baseband chip ID the image is signed for (the MSM ID in the HW_ID)
+func (s *Signing) ChipID() string {
+	hwid, ok := s.Fields["HW_ID"]
+	if !ok || len(hwid) < 8 {
+		return ""
+	}
+	id, err := strconv.ParseUint(hwid[:8], 16, 32)
+	if err != nil || id == 0 {
+		return ""
+	}
+	return fmt.Sprintf("0x%08X", id)
+}
+
+func (s *Signing) String() string {
+	var parts []string
+	for _, field := range []string{"HW_ID", "SW_ID", "OEM_ID", "MODEL_ID"} {
+		if v, ok := s.Fields[field]; ok {
+			parts = append(parts, fmt.Sprintf("%s: %s", field, v))
+		}
+	}
+	if len(s.Hash) > 0 {
+		parts = append(parts, s.Hash)
+	}
+	var subjects []string
+	for _, cert := range s.Certificates {
+		subjects = append(subjects, cert.Subject)
+	}
+	if len(subjects) > 0 {
+		parts = append(parts, fmt.Sprintf("certs: [%s]", strings.Join(subjects, " <- ")))
+	}
+	return "signing: " + strings.Join(parts, " ")
+}
+
+// parseELF parses a Qualcomm ELF's machine and its MBN hash segment
+func (i *Image) parseELF(data []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse ELF: %v", err)
+	}
+	defer f.Close()
+
+	i.Machine = f.Machine.String()
+
+	for _, prog := range f.Progs {
+		if (uint32(prog.Flags)&segmentTypeMask)>>segmentTypeShift != segmentTypeHash {
+			continue
+		}
+		seg, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return fmt.Errorf("failed to read hash segment: %v", err)
+		}
+		hdr, err := parseMBNHeader(seg)
+		if err != nil {
+			break // not a (known) MBN hash segment
+		}
+		i.Header = hdr
+		i.Signing = parseSigning(hdr, seg)
+		break
+	}
+
+	return nil
+}
+
+func parseMBNHeader(data []byte) (*Header, error) {
+	var hdr mbnHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to read MBN header: %v", err)
+	}
+	if hdr.Version == 0 || hdr.Version > 8 {
+		return nil, fmt.Errorf("invalid MBN header version %d", hdr.Version)
+	}
+
+	h := &Header{
+		ImageID:       hdr.ImageID,
+		Version:       hdr.Version,
+		ImageSize:     hdr.ImageSize,
+		CodeSize:      hdr.CodeSize,
+		SignatureSize: hdr.SignatureSize,
+		CertChainSize: hdr.CertChainSize,
+	}
+	if hdr.Version >= 6 && len(data) >= mbnHeaderSizeV6 {
+		h.MetadataSize = binary.LittleEndian.Uint32(data[mbnHeaderSize:]) + binary.LittleEndian.Uint32(data[mbnHeaderSize+4:])
+	}
+
+	return h, nil
+}
+
+// parseSigning parses the attestation fields and certificate chain of an image.
+// The certificate chain follows the signature (which follows the hash table) when there is an MBN header,
+// otherwise the whole image is scanned for certificates.
+func parseSigning(hdr *Header, data []byte) *Signing {
+	chain := data
+	if hdr != nil && hdr.CertChainSize > 0 {
+		hdrSize := uint64(mbnHeaderSize)
+		if hdr.Version >= 6 {
+			hdrSize = mbnHeaderSizeV6
+		}
+		start := hdrSize + uint64(hdr.MetadataSize) + uint64(hdr.CodeSize) + uint64(hdr.SignatureSize)
+		if end := start + uint64(hdr.CertChainSize); end <= uint64(len(data)) {
+			chain = data[start:end]
+		}
+	}
+
+	s := &Signing{Fields: make(map[string]string)}
+
+	for _, cert := range findCertificates(chain) {
+		s.Certificates = append(s.Certificates, Certificate{
+			Subject:            cert.Subject.CommonName,
+			Issuer:             cert.Issuer.CommonName,
+			SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		})
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			if m := attestationRE.FindStringSubmatch(ou); m != nil {
+				s.Fields[m[3]] = m[2]
+			}
+		}
+	}
+	if len(s.Certificates) == 0 {
+		return nil
+	}
+
+	// the hash algorithm is a field of its own (e.g. "07 0000 SHA256")
+	for name := range s.Fields {
+		if strings.HasPrefix(name, "SHA") {
+			s.Hash = name
+			delete(s.Fields, name)
+		}
+	}
+
+	return s
+}
+
+// findCertificates returns the DER certificates in data
+func findCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for off := 0; off+4 <= len(data) && len(certs) < maxCertificates; off++ {
+		if data[off] != 0x30 || data[off+1] != 0x82 {
+			continue
+		}
+		size := 4 + int(binary.BigEndian.Uint16(data[off+2:]))
+		if off+size > len(data) {
+			continue
+		}
+		cert, err := x509.ParseCertificate(data[off : off+size])
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+		off += size - 1
+	}
+	return certs
+}
@@ -183,6 +183,7 @@ func (c *CTF) GetDataTypes() error {
 				id:       id,
 				name:     c.getString(uint32(t.Name)),
 				info:     t.Info,
+				size:     size,
 				encoding: enc,
 			}
 		case FLOAT:
@@ -194,6 +195,7 @@ func (c *CTF) GetDataTypes() error {
 				id:       id,
 				name:     c.getString(uint32(t.Name)),
 				info:     t.Info,
+				size:     size,
 				encoding: enc,
 			}
 		case ARRAY:
@@ -305,13 +307,14 @@ func (c *CTF) GetDataTypes() error {
 				id:   id,
 				name: c.getString(uint32(t.Name)),
 				info: t.Info,
+				size: size,
 			}
 			enums := make([]enum, t.Info.VarLen())
 			if err := binary.Read(r, binary.LittleEndian, &enums); err != nil {
 				return fmt.Errorf("failed to read enums: %v", err)
 			}
 			for _, e := range enums {
-				en.Fields = append(en.Fields, enumField{
+				en.Fields = append(en.Fields, EnumField{
 					Name:  c.getString(uint32(e.Name)),
 					Value: e.Value,
 				})
@@ -322,6 +325,7 @@ func (c *CTF) GetDataTypes() error {
 				id:   id,
 				name: c.getString(uint32(t.Name)),
 				info: t.Info,
+				kind: kind(t.SizeOrType), // the forwarded kind (STRUCT, UNION or ENUM)
 			}
 		case POINTER:
 			c.Types[id] = &Pointer{
@@ -0,0 +1,417 @@
+package ctf
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MemberInfo is a struct/union member with its byte offset and size
+type MemberInfo struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Offset uint64 `json:"offset"`
+	Bit    uint64 `json:"bit,omitempty"`
+	Size   uint64 `json:"size"`
+}
+
+// MemberChange is a member whose offset, size or type changed
+type MemberChange struct {
+	Name string     `json:"name"`
+	Old  MemberInfo `json:"old"`
+	New  MemberInfo `json:"new"`
+}
+
+// TypeChange is a struct or union whose layout changed
+type TypeChange struct {
+	Name    string         `json:"name"`
+	OldSize uint64         `json:"old_size"`
+	NewSize uint64         `json:"new_size"`
+	Added   []MemberInfo   `json:"added,omitempty"`
+	Removed []MemberInfo   `json:"removed,omitempty"`
+	Changed []MemberChange `json:"changed,omitempty"`
+	// Members is the new layout (to generate offset tables from)
+	Members []MemberInfo `json:"members"`
+}
+
+// EnumValueChange is an enumerator whose value changed
+type EnumValueChange struct {
+	Name string `json:"name"`
+	Old  int32  `json:"old"`
+	New  int32  `json:"new"`
+}
+
+// EnumChange is an enum whose enumerators changed
+type EnumChange struct {
+	Name    string            `json:"name"`
+	Added   []EnumField       `json:"added,omitempty"`
+	Removed []EnumField       `json:"removed,omitempty"`
+	Changed []EnumValueChange `json:"changed,omitempty"`
+}
+
+// DeclChange is a typedef or function prototype whose declaration changed
+type DeclChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// Diff is the difference between the CTF types of two kernels
+type Diff struct {
+	AddedTypes   []string     `json:"added_types,omitempty"`
+	RemovedTypes []string     `json:"removed_types,omitempty"`
+	Types        []TypeChange `json:"changed_types,omitempty"`
+	Enums        []EnumChange `json:"changed_enums,omitempty"`
+	Typedefs     []DeclChange `json:"changed_typedefs,omitempty"`
+	Functions    struct {
+		Added   []string     `json:"added,omitempty"`
+		Removed []string     `json:"removed,omitempty"`
+		Changed []DeclChange `json:"changed,omitempty"`
+	} `json:"functions"`
+}
+
+// namedTypes returns the IDs of the named structs, unions, enums and typedefs keyed by their C name (e.g. "struct proc")
+func (c *CTF) namedTypes() map[string]int {
+	named := make(map[string]int)
+	for _, id := range c.typeIDs() {
+		var name string
+		switch t := c.Types[id].(type) {
+		case *Struct:
+			if !isAnon(t.name) {
+				name = "struct " + t.name
+			}
+		case *Union:
+			if !isAnon(t.name) {
+				name = "union " + t.name
+			}
+		case *Enum:
+			if !isAnon(t.name) {
+				name = "enum " + t.name
+			}
+		case *Typedef:
+			name = "typedef " + t.name
+		}
+		if _, dup := named[name]; len(name) > 0 && !dup {
+			named[name] = id
+		}
+	}
+	return named
+}
+
+// shortDecl is like declare but doesn't expand anonymous structs, unions and enums
+func (c *CTF) shortDecl(id int, name string) string {
+	switch t := c.lookup(id).(type) {
+	case *Struct:
+		if isAnon(t.name) {
+			return strings.TrimSpace("struct {...} " + name)
+		}
+	case *Union:
+		if isAnon(t.name) {
+			return strings.TrimSpace("union {...} " + name)
+		}
+	case *Enum:
+		if isAnon(t.name) {
+			return strings.TrimSpace("enum {...} " + name)
+		}
+	}
+	return c.declare(id, name, 0)
+}
+
+// members returns the members of a struct or union, flattening anonymous struct and union members
+func (c *CTF) members(fields []Member, base uint64) []MemberInfo {
+	var out []MemberInfo
+	for _, f := range fields {
+		off := base + f.offset
+		if isAnon(f.name) {
+			switch t := c.lookup(int(f.reference)).(type) {
+			case *Struct:
+				out = append(out, c.members(t.Fields, off)...)
+				continue
+			case *Union:
+				out = append(out, c.members(t.Fields, off)...)
+				continue
+			}
+		}
+		mi := MemberInfo{
+			Name:   f.name,
+			Type:   c.shortDecl(int(f.reference), ""),
+			Offset: off / 8,
+			Bit:    off % 8,
+			Size:   c.TypeSize(int(f.reference)),
+		}
+		if _, bits, ok := c.bitfield(f); ok {
+			mi.Type = fmt.Sprintf("%s:%d", mi.Type, bits)
+		}
+		out = append(out, mi)
+	}
+	return out
+}
+
+func (c *CTF) prototypes() map[string]string {
+	protos := make(map[string]string)
+	for _, f := range c.Functions {
+		if _, dup := protos[f.Name]; dup {
+			continue
+		}
+		var args []string
+		for _, arg := range f.Arguments {
+			if arg == nil {
+				args = append(args, "...")
+				continue
+			}
+			args = append(args, c.shortDecl(arg.ID(), ""))
+		}
+		if len(args) == 0 {
+			args = append(args, "void")
+		}
+		var ret int
+		if f.Return != nil {
+			ret = f.Return.ID()
+		}
+		protos[f.Name] = c.shortDecl(ret, fmt.Sprintf("%s(%s)", f.Name, strings.Join(args, ", ")))
+	}
+	return protos
+}
+
+// DiffCTF returns the added and removed types, the structs/unions whose members changed offset, size or type,
+// the enums whose values changed and the function prototypes that changed between two kernels
+func DiffCTF(old, new *CTF) *Diff {
+	d := &Diff{}
+
+	oldTypes := old.namedTypes()
+	newTypes := new.namedTypes()
+
+	for _, name := range sortedKeys(newTypes) {
+		newID := newTypes[name]
+		oldID, ok := oldTypes[name]
+		if !ok {
+			d.AddedTypes = append(d.AddedTypes, name)
+			continue
+		}
+		switch nt := new.Types[newID].(type) {
+		case *Struct:
+			if ot, ok := old.Types[oldID].(*Struct); ok {
+				if tc, changed := diffMembers(name, old.members(ot.Fields, 0), new.members(nt.Fields, 0), ot.size, nt.size); changed {
+					d.Types = append(d.Types, tc)
+				}
+			}
+		case *Union:
+			if ot, ok := old.Types[oldID].(*Union); ok {
+				if tc, changed := diffMembers(name, old.members(ot.Fields, 0), new.members(nt.Fields, 0), ot.size, nt.size); changed {
+					d.Types = append(d.Types, tc)
+				}
+			}
+		case *Enum:
+			if ot, ok := old.Types[oldID].(*Enum); ok {
+				if ec, changed := diffEnums(name, ot, nt); changed {
+					d.Enums = append(d.Enums, ec)
+				}
+			}
+		case *Typedef:
+			if ot, ok := old.Types[oldID].(*Typedef); ok {
+				o := old.shortDecl(int(ot.reference), ot.name)
+				n := new.shortDecl(int(nt.reference), nt.name)
+				if o != n {
+					d.Typedefs = append(d.Typedefs, DeclChange{Name: nt.name, Old: o, New: n})
+				}
+			}
+		}
+	}
+	for _, name := range sortedKeys(oldTypes) {
+		if _, ok := newTypes[name]; !ok {
+			d.RemovedTypes = append(d.RemovedTypes, name)
+		}
+	}
+
+	oldProtos := old.prototypes()
+	newProtos := new.prototypes()
+	for _, name := range sortedKeys(newProtos) {
+		o, ok := oldProtos[name]
+		if !ok {
+			d.Functions.Added = append(d.Functions.Added, newProtos[name])
+		} else if o != newProtos[name] {
+			d.Functions.Changed = append(d.Functions.Changed, DeclChange{Name: name, Old: o, New: newProtos[name]})
+		}
+	}
+	for _, name := range sortedKeys(oldProtos) {
+		if _, ok := newProtos[name]; !ok {
+			d.Functions.Removed = append(d.Functions.Removed, oldProtos[name])
+		}
+	}
+
+	return d
+}
+
+// memberKey identifies a member across kernels (by name or, for unnamed members like bitfield padding, by offset)
+func memberKey(m MemberInfo) string {
+	if !isAnon(m.Name) {
+		return m.Name
+	}
+	return fmt.Sprintf("<unnamed@%#x:%d>", m.Offset, m.Bit)
+}
+
+func diffMembers(name string, old, new []MemberInfo, oldSize, newSize uint64) (TypeChange, bool) {
+	tc := TypeChange{Name: name, OldSize: oldSize, NewSize: newSize, Members: new}
+
+	oldByKey := make(map[string]MemberInfo)
+	for _, m := range old {
+		oldByKey[memberKey(m)] = m
+	}
+	newByKey := make(map[string]MemberInfo)
+	for _, m := range new {
+		newByKey[memberKey(m)] = m
+	}
+
+	for _, m := range new {
+		o, ok := oldByKey[memberKey(m)]
+		if !ok {
+			tc.Added = append(tc.Added, m)
+		} else if o != m {
+			tc.Changed = append(tc.Changed, MemberChange{Name: memberKey(m), Old: o, New: m})
+		}
+	}
+	for _, m := range old {
+		if _, ok := newByKey[memberKey(m)]; !ok {
+			tc.Removed = append(tc.Removed, m)
+		}
+	}
+
+	return tc, oldSize != newSize || len(tc.Added) > 0 || len(tc.Removed) > 0 || len(tc.Changed) > 0
+}
+
+func diffEnums(name string, old, new *Enum) (EnumChange, bool) {
+	ec := EnumChange{Name: name}
+
+	oldVals := make(map[string]int32)
+	for _, f := range old.Fields {
+		oldVals[f.Name] = f.Value
+	}
+	newVals := make(map[string]int32)
+	for _, f := range new.Fields {
+		newVals[f.Name] = f.Value
+	}
+
+	for _, f := range new.Fields {
+		o, ok := oldVals[f.Name]
+		if !ok {
+			ec.Added = append(ec.Added, f)
+		} else if o != f.Value {
+			ec.Changed = append(ec.Changed, EnumValueChange{Name: f.Name, Old: o, New: f.Value})
+		}
+	}
+	for _, f := range old.Fields {
+		if _, ok := newVals[f.Name]; !ok {
+			ec.Removed = append(ec.Removed, f)
+		}
+	}
+
+	return ec, len(ec.Added) > 0 || len(ec.Removed) > 0 || len(ec.Changed) > 0
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m MemberInfo) String() string {
+	if m.Bit != 0 {
+		return fmt.Sprintf("%s %s @ %#x:%d (%d bytes)", m.Type, m.Name, m.Offset, m.Bit, m.Size)
+	}
+	return fmt.Sprintf("%s %s @ %#x (%d bytes)", m.Type, m.Name, m.Offset, m.Size)
+}
+
+func (d *Diff) String() string {
+	buf := bytes.NewBufferString("")
+
+	if len(d.AddedTypes) > 0 {
+		buf.WriteString("Added Types:\n")
+		for _, t := range d.AddedTypes {
+			buf.WriteString(fmt.Sprintf("  + %s\n", t))
+		}
+		buf.WriteString("\n")
+	}
+	if len(d.RemovedTypes) > 0 {
+		buf.WriteString("Removed Types:\n")
+		for _, t := range d.RemovedTypes {
+			buf.WriteString(fmt.Sprintf("  - %s\n", t))
+		}
+		buf.WriteString("\n")
+	}
+	if len(d.Types) > 0 {
+		buf.WriteString("Changed Types:\n")
+		for _, t := range d.Types {
+			if t.OldSize != t.NewSize {
+				buf.WriteString(fmt.Sprintf("  %s (%#x -> %#x bytes)\n", t.Name, t.OldSize, t.NewSize))
+			} else {
+				buf.WriteString(fmt.Sprintf("  %s (%#x bytes)\n", t.Name, t.NewSize))
+			}
+			for _, m := range t.Added {
+				buf.WriteString(fmt.Sprintf("    + %s\n", m))
+			}
+			for _, m := range t.Removed {
+				buf.WriteString(fmt.Sprintf("    - %s\n", m))
+			}
+			for _, m := range t.Changed {
+				var changes []string
+				if m.Old.Offset != m.New.Offset || m.Old.Bit != m.New.Bit {
+					changes = append(changes, fmt.Sprintf("offset %#x -> %#x", m.Old.Offset, m.New.Offset))
+				}
+				if m.Old.Size != m.New.Size {
+					changes = append(changes, fmt.Sprintf("size %d -> %d", m.Old.Size, m.New.Size))
+				}
+				if m.Old.Type != m.New.Type {
+					changes = append(changes, fmt.Sprintf("type %s -> %s", m.Old.Type, m.New.Type))
+				}
+				buf.WriteString(fmt.Sprintf("    ~ %s: %s\n", m.Name, strings.Join(changes, ", ")))
+			}
+		}
+		buf.WriteString("\n")
+	}
+	if len(d.Enums) > 0 {
+		buf.WriteString("Changed Enums:\n")
+		for _, e := range d.Enums {
+			buf.WriteString(fmt.Sprintf("  %s\n", e.Name))
+			for _, f := range e.Added {
+				buf.WriteString(fmt.Sprintf("    + %s = %d\n", f.Name, f.Value))
+			}
+			for _, f := range e.Removed {
+				buf.WriteString(fmt.Sprintf("    - %s = %d\n", f.Name, f.Value))
+			}
+			for _, f := range e.Changed {
+				buf.WriteString(fmt.Sprintf("    ~ %s: %d -> %d\n", f.Name, f.Old, f.New))
+			}
+		}
+		buf.WriteString("\n")
+	}
+	if len(d.Typedefs) > 0 {
+		buf.WriteString("Changed Typedefs:\n")
+		for _, t := range d.Typedefs {
+			buf.WriteString(fmt.Sprintf("  - %s\n  + %s\n", t.Old, t.New))
+		}
+		buf.WriteString("\n")
+	}
+	if len(d.Functions.Added) > 0 || len(d.Functions.Removed) > 0 || len(d.Functions.Changed) > 0 {
+		buf.WriteString("Functions:\n")
+		for _, f := range d.Functions.Added {
+			buf.WriteString(fmt.Sprintf("  + %s\n", f))
+		}
+		for _, f := range d.Functions.Removed {
+			buf.WriteString(fmt.Sprintf("  - %s\n", f))
+		}
+		for _, f := range d.Functions.Changed {
+			buf.WriteString(fmt.Sprintf("  ~ %s\n    -> %s\n", f.Old, f.New))
+		}
+		buf.WriteString("\n")
+	}
+
+	if buf.Len() == 0 {
+		return "No differences found\n"
+	}
+
+	return buf.String()
+}
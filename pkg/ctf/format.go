@@ -23,6 +23,7 @@ type Integer struct {
 	id       int
 	name     string
 	info     info
+	size     uint64
 	encoding intEncoding
 }
 
@@ -35,6 +36,9 @@ func (i *Integer) Name() string {
 func (i *Integer) Info() info {
 	return i.info
 }
+func (i *Integer) Size() uint64 {
+	return i.size
+}
 func (i *Integer) Encoding() string {
 	return i.encoding.Encoding().String()
 }
@@ -81,6 +85,7 @@ type Float struct {
 	id       int
 	name     string
 	info     info
+	size     uint64
 	encoding floatEncoding
 }
 
@@ -93,6 +98,9 @@ func (f *Float) Name() string {
 func (f *Float) Info() info {
 	return f.info
 }
+func (f *Float) Size() uint64 {
+	return f.size
+}
 func (f *Float) Encoding() string {
 	return f.encoding.Encoding().String()
 }
@@ -538,16 +546,18 @@ func (s *Union) MarshalJSON() ([]byte, error) {
 	})
 }
 
-type enumField struct {
+// EnumField is an enumerator of an Enum
+type EnumField struct {
 	Name  string `json:"name,omitempty"`
-	Value int32  `json:"value,omitempty"`
+	Value int32  `json:"value"`
 }
 
 type Enum struct {
 	id     int
 	name   string
 	info   info
-	Fields []enumField
+	size   uint64
+	Fields []EnumField
 }
 
 func (e *Enum) ID() int {
@@ -559,6 +569,9 @@ func (e *Enum) Name() string {
 func (e *Enum) Info() info {
 	return e.info
 }
+func (e *Enum) Size() uint64 {
+	return e.size
+}
 func (e *Enum) ParentID() int {
 	return 0
 }
@@ -594,7 +607,7 @@ func (e *Enum) MarshalJSON() ([]byte, error) {
 		ID     int         `json:"id,omitempty"`
 		Name   string      `json:"name,omitempty"`
 		Info   info        `json:"info,omitempty"`
-		Fields []enumField `json:"fields,omitempty"`
+		Fields []EnumField `json:"fields,omitempty"`
 	}{
 		ID:     e.id,
 		Name:   e.name,
@@ -607,6 +620,7 @@ type Forward struct {
 	id   int
 	name string
 	info info
+	kind kind
 }
 
 func (f *Forward) ID() int {
@@ -0,0 +1,393 @@
+package ctf
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const headerPrologue = `/*
+ * Generated from CTF by ipsw
+ */
+
+#ifndef __has_feature
+#define __has_feature(x) 0
+#endif
+#if !__has_feature(ptrauth_qualifier)
+#define __ptrauth(key, address_discriminated, discriminator)
+#endif
+
+`
+
+func (c *CTF) typeIDs() []int {
+	ids := make([]int, 0, len(c.Types))
+	for id := range c.Types {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// declare returns the C declaration of name as the type with the given ID (name may be empty).
+// Anonymous structs, unions and enums are defined inline.
+func (c *CTF) declare(id int, name string, depth int) string {
+	if id == 0 {
+		return strings.TrimSpace("void " + name)
+	}
+
+	t := c.lookup(id)
+	if t == nil {
+		return strings.TrimSpace(fmt.Sprintf("void /* <type %d not found> */ %s", id, name))
+	}
+
+	switch t := t.(type) {
+	case *Pointer:
+		switch ref := c.lookup(int(t.reference)); ref.(type) {
+		case *Function, *Array:
+			return c.declare(int(t.reference), "(*"+name+")", depth)
+		}
+		return c.declare(int(t.reference), "*"+name, depth)
+	case *PtrAuth:
+		return c.declare(int(t.reference), fmt.Sprintf("__ptrauth(%d, %d, %#x) %s",
+			uint32(t.data&0x00ff0000)>>16, b2i(t.data.Discriminated()), t.data.Discriminator(), name), depth)
+	case *Array:
+		return c.declare(int(t.array.Contents), fmt.Sprintf("%s[%d]", name, t.NumElements), depth)
+	case *Function:
+		var args []string
+		for _, arg := range t.args {
+			if arg == 0 { // varargs
+				args = append(args, "...")
+				continue
+			}
+			args = append(args, c.declare(int(arg), "", depth))
+		}
+		if len(args) == 0 {
+			args = append(args, "void")
+		}
+		return c.declare(int(t.ret), fmt.Sprintf("%s(%s)", name, strings.Join(args, ", ")), depth)
+	case *Const:
+		return c.qualify("const", int(t.reference), name, depth)
+	case *Volatile:
+		return c.qualify("volatile", int(t.reference), name, depth)
+	case *Restrict:
+		return c.qualify("restrict", int(t.reference), name, depth)
+	case *Struct:
+		if isAnon(t.name) {
+			return strings.TrimSpace(c.defineFields("struct", "", t.Fields, t.size, c.isPacked(t), depth) + " " + name)
+		}
+		return strings.TrimSpace("struct " + t.name + " " + name)
+	case *Union:
+		if isAnon(t.name) {
+			return strings.TrimSpace(c.defineFields("union", "", t.Fields, t.size, false, depth) + " " + name)
+		}
+		return strings.TrimSpace("union " + t.name + " " + name)
+	case *Enum:
+		if isAnon(t.name) {
+			return strings.TrimSpace(c.defineEnum(t, depth) + " " + name)
+		}
+		return strings.TrimSpace("enum " + t.name + " " + name)
+	case *Forward:
+		return strings.TrimSpace(forwardKeyword(t) + " " + t.name + " " + name)
+	}
+
+	// integers, floats and typedefs
+	return strings.TrimSpace(t.Name() + " " + name)
+}
+
+// qualify places the qualifier after the '*' of pointers and before anything else
+func (c *CTF) qualify(qualifier string, ref int, name string, depth int) string {
+	switch c.lookup(ref).(type) {
+	case *Pointer, *PtrAuth:
+		return c.declare(ref, qualifier+" "+name, depth)
+	}
+	return qualifier + " " + c.declare(ref, name, depth)
+}
+
+func forwardKeyword(f *Forward) string {
+	switch f.kind {
+	case UNION:
+		return "union"
+	case ENUM:
+		return "enum"
+	}
+	return "struct"
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// defineFields returns the C definition of a struct or union.
+//
+// Explicit padding members are added wherever the natural layout of the
+// members would not match their CTF offsets so the header reproduces them exactly.
+func (c *CTF) defineFields(keyword, name string, fields []Member, size uint64, packed bool, depth int) string {
+	indent := strings.Repeat("\t", depth+1)
+
+	buf := bytes.NewBufferString(keyword)
+	if packed {
+		buf.WriteString(" __attribute__((packed))")
+	}
+	if !isAnon(name) {
+		buf.WriteString(" " + name)
+	}
+	buf.WriteString(" {\n")
+
+	var end uint64 // end of the previous member in bits
+	var pad int
+	for _, f := range fields {
+		fname := f.name
+		if isAnon(fname) {
+			fname = ""
+		}
+
+		if _, bits, ok := c.bitfield(f); ok {
+			buf.WriteString(fmt.Sprintf("%s%s : %d;\n", indent, c.declare(int(f.reference), fname, depth+1), bits))
+			if keyword == "struct" {
+				end = f.offset + uint64(bits)
+			}
+			continue
+		}
+
+		if keyword == "struct" {
+			natural := alignUp(end, 8) / 8
+			if !packed {
+				natural = alignUp(natural, c.typeAlign(int(f.reference)))
+			}
+			if f.offset/8 > natural {
+				buf.WriteString(fmt.Sprintf("%sunsigned char __pad%d[%d];\n", indent, pad, f.offset/8-alignUp(end, 8)/8))
+				pad++
+			}
+			end = f.offset + c.TypeSize(int(f.reference))*8
+		}
+
+		buf.WriteString(fmt.Sprintf("%s%s;\n", indent, c.declare(int(f.reference), fname, depth+1)))
+	}
+
+	if keyword == "struct" {
+		align := uint64(1)
+		if !packed {
+			align = c.fieldsAlign(fields)
+		}
+		if used := alignUp(end, 8) / 8; size > alignUp(used, align) {
+			buf.WriteString(fmt.Sprintf("%sunsigned char __pad%d[%d];\n", indent, pad, size-used))
+		}
+	}
+
+	buf.WriteString(strings.Repeat("\t", depth) + "}")
+
+	return buf.String()
+}
+
+func (c *CTF) defineEnum(e *Enum, depth int) string {
+	buf := bytes.NewBufferString("enum")
+	if !isAnon(e.name) {
+		buf.WriteString(" " + e.name)
+	}
+	buf.WriteString(" {\n")
+	for _, f := range e.Fields {
+		buf.WriteString(fmt.Sprintf("%s%s = %d,\n", strings.Repeat("\t", depth+1), f.Name, f.Value))
+	}
+	buf.WriteString(strings.Repeat("\t", depth) + "}")
+	return buf.String()
+}
+
+type headerWriter struct {
+	c        *CTF
+	buf      *bytes.Buffer
+	state    map[int]int // 1: in progress, 2: done
+	names    map[string]bool
+	typedefs map[string]bool
+}
+
+// GenerateHeader returns a C header with all the CTF types, global variables and function prototypes.
+//
+// Named structs and unions are forward declared first, then every definition is emitted after the
+// types it needs by value (typedefs and enums are emitted before any use).
+func (c *CTF) GenerateHeader() string {
+	hw := &headerWriter{
+		c:        c,
+		buf:      bytes.NewBufferString(headerPrologue),
+		state:    make(map[int]int),
+		names:    make(map[string]bool),
+		typedefs: make(map[string]bool),
+	}
+
+	ids := c.typeIDs()
+
+	/* forward declarations */
+	fwds := make(map[string]bool)
+	for _, id := range ids {
+		var decl string
+		switch t := c.Types[id].(type) {
+		case *Struct:
+			if !isAnon(t.name) {
+				decl = "struct " + t.name
+			}
+		case *Union:
+			if !isAnon(t.name) {
+				decl = "union " + t.name
+			}
+		case *Forward:
+			if forwardKeyword(t) != "enum" {
+				decl = forwardKeyword(t) + " " + t.name
+			}
+		}
+		if len(decl) > 0 && !fwds[decl] {
+			fwds[decl] = true
+			hw.buf.WriteString(decl + ";\n")
+		}
+	}
+	hw.buf.WriteString("\n")
+
+	/* definitions */
+	for _, id := range ids {
+		hw.emit(id)
+	}
+
+	/* globals and functions */
+	seen := make(map[string]bool)
+	for _, g := range c.Globals {
+		if seen[g.Name] || hw.typedefs[g.Name] || g.Reference == 0 || c.lookup(g.Reference) == nil {
+			continue
+		}
+		seen[g.Name] = true
+		hw.deps(g.Reference, false)
+		hw.buf.WriteString(fmt.Sprintf("extern %s;\n", c.declare(g.Reference, g.Name, 0)))
+	}
+	if len(c.Globals) > 0 {
+		hw.buf.WriteString("\n")
+	}
+	for _, f := range c.Functions {
+		if seen[f.Name] || hw.typedefs[f.Name] {
+			continue
+		}
+		seen[f.Name] = true
+		var args []string
+		for _, arg := range f.Arguments {
+			if arg == nil {
+				args = append(args, "...")
+				continue
+			}
+			hw.deps(arg.ID(), false)
+			args = append(args, c.declare(arg.ID(), "", 0))
+		}
+		if len(args) == 0 {
+			args = append(args, "void")
+		}
+		var ret int // void
+		if f.Return != nil {
+			ret = f.Return.ID()
+		}
+		hw.deps(ret, false)
+		hw.buf.WriteString(fmt.Sprintf("%s;\n", c.declare(ret, fmt.Sprintf("%s(%s)", f.Name, strings.Join(args, ", ")), 0)))
+	}
+
+	return hw.buf.String()
+}
+
+// emit writes the definition of a named struct, union, enum or typedef (after its dependencies)
+func (hw *headerWriter) emit(id int) {
+	if hw.state[id] != 0 {
+		return
+	}
+	hw.state[id] = 1
+	defer func() { hw.state[id] = 2 }()
+
+	switch t := hw.c.lookup(id).(type) {
+	case *Struct:
+		if isAnon(t.name) || hw.names["struct "+t.name] {
+			return
+		}
+		hw.names["struct "+t.name] = true
+		for _, f := range t.Fields {
+			hw.deps(int(f.reference), true)
+		}
+		hw.buf.WriteString(hw.c.defineFields("struct", t.name, t.Fields, t.size, hw.c.isPacked(t), 0) + ";\n\n")
+	case *Union:
+		if isAnon(t.name) || hw.names["union "+t.name] {
+			return
+		}
+		hw.names["union "+t.name] = true
+		for _, f := range t.Fields {
+			hw.deps(int(f.reference), true)
+		}
+		hw.buf.WriteString(hw.c.defineFields("union", t.name, t.Fields, t.size, false, 0) + ";\n\n")
+	case *Enum:
+		if isAnon(t.name) || hw.names["enum "+t.name] {
+			return
+		}
+		hw.names["enum "+t.name] = true
+		hw.buf.WriteString(hw.c.defineEnum(t, 0) + ";\n\n")
+	case *Typedef:
+		if hw.typedefs[t.name] {
+			return
+		}
+		if ref, ok := hw.c.lookup(int(t.reference)).(*Integer); ok && ref.name == t.name {
+			return // e.g. typedef _Bool _Bool
+		}
+		hw.typedefs[t.name] = true
+		hw.deps(int(t.reference), false)
+		hw.buf.WriteString(fmt.Sprintf("typedef %s;\n\n", hw.c.declare(int(t.reference), t.name, 0)))
+	}
+}
+
+// deps emits the types needed to declare something as the type with the given ID;
+// named structs and unions are only needed if they are used by value
+func (hw *headerWriter) deps(id int, byValue bool) {
+	for i := 0; i < 64; i++ {
+		switch t := hw.c.lookup(id).(type) {
+		case *Pointer:
+			id, byValue = int(t.reference), false
+		case *PtrAuth:
+			id, byValue = int(t.reference), false
+		case *Array:
+			id = int(t.array.Contents)
+		case *Const:
+			id = int(t.reference)
+		case *Volatile:
+			id = int(t.reference)
+		case *Restrict:
+			id = int(t.reference)
+		case *Function:
+			hw.deps(int(t.ret), false)
+			for _, arg := range t.args {
+				hw.deps(int(arg), false)
+			}
+			return
+		case *Typedef:
+			hw.emit(id)
+			if !byValue {
+				return
+			}
+			id = int(t.reference)
+		case *Struct:
+			if isAnon(t.name) {
+				for _, f := range t.Fields {
+					hw.deps(int(f.reference), true)
+				}
+			} else if byValue {
+				hw.emit(id)
+			}
+			return
+		case *Union:
+			if isAnon(t.name) {
+				for _, f := range t.Fields {
+					hw.deps(int(f.reference), true)
+				}
+			} else if byValue {
+				hw.emit(id)
+			}
+			return
+		case *Enum:
+			hw.emit(id)
+			return
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package ctf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	pointerSize   = 8
+	cacheLineSize = 64
+)
+
+func isAnon(name string) bool {
+	return len(name) == 0 || name == "(anon)"
+}
+
+// resolve follows typedefs and qualifiers to the underlying type
+func (c *CTF) resolve(id int) Type {
+	for i := 0; i < 64; i++ { // guard against reference loops
+		t := c.lookup(id)
+		if t == nil {
+			return nil
+		}
+		switch t := t.(type) {
+		case *Typedef:
+			id = int(t.reference)
+		case *Const:
+			id = int(t.reference)
+		case *Volatile:
+			id = int(t.reference)
+		case *Restrict:
+			id = int(t.reference)
+		default:
+			return t
+		}
+	}
+	return nil
+}
+
+// TypeSize returns the size in bytes of the type with the given ID
+func (c *CTF) TypeSize(id int) uint64 {
+	switch t := c.resolve(id).(type) {
+	case *Integer:
+		return t.size
+	case *Float:
+		return t.size
+	case *Enum:
+		return t.size
+	case *Struct:
+		return t.size
+	case *Union:
+		return t.size
+	case *Pointer, *PtrAuth:
+		return pointerSize
+	case *Array:
+		return c.TypeSize(int(t.array.Contents)) * uint64(t.NumElements)
+	}
+	return 0
+}
+
+// typeAlign returns the natural alignment in bytes of the type with the given ID
+func (c *CTF) typeAlign(id int) uint64 {
+	switch t := c.resolve(id).(type) {
+	case *Integer, *Float, *Enum:
+		size := c.TypeSize(id)
+		if size == 0 {
+			return 1
+		}
+		if size > 16 {
+			return 16
+		}
+		return size
+	case *Pointer, *PtrAuth:
+		return pointerSize
+	case *Array:
+		return c.typeAlign(int(t.array.Contents))
+	case *Struct:
+		return c.fieldsAlign(t.Fields)
+	case *Union:
+		return c.fieldsAlign(t.Fields)
+	}
+	return 1
+}
+
+func (c *CTF) fieldsAlign(fields []Member) uint64 {
+	align := uint64(1)
+	for _, f := range fields {
+		if _, bits, ok := c.bitfield(f); ok && bits == 0 {
+			continue
+		}
+		if a := c.typeAlign(int(f.reference)); a > align {
+			align = a
+		}
+	}
+	return align
+}
+
+// bitfield returns the storage size and width in bits if the member is a bitfield
+func (c *CTF) bitfield(f Member) (uint64, uint32, bool) {
+	var bits uint32
+	var size uint64
+	if t, ok := c.resolve(int(f.reference)).(*Integer); ok {
+		bits, size = t.Bits(), t.size
+	} else {
+		return 0, 0, false
+	}
+	if uint64(bits) != size*8 {
+		return size, bits, true
+	}
+	return 0, 0, false
+}
+
+func alignUp(v, align uint64) uint64 {
+	if align == 0 {
+		return v
+	}
+	return (v + align - 1) / align * align
+}
+
+// isPacked returns true if the struct's members are not naturally aligned
+func (c *CTF) isPacked(s *Struct) bool {
+	for _, f := range s.Fields {
+		if _, _, ok := c.bitfield(f); ok {
+			continue
+		}
+		if (f.offset/8)%c.typeAlign(int(f.reference)) != 0 {
+			return true
+		}
+	}
+	return s.size%c.fieldsAlign(s.Fields) != 0
+}
+
+// Layout returns the pahole style layout of the struct or union with the given name
+// (e.g. "proc", "struct proc" or a typedef of one) with nested structs and unions expanded
+func (c *CTF) Layout(name string) (string, error) {
+	t, err := c.Find(name)
+	if err != nil {
+		return "", err
+	}
+
+	buf := bytes.NewBufferString("")
+	switch s := c.resolve(t.ID()).(type) {
+	case *Struct:
+		c.layoutFields(buf, "struct", s.name, s.size, s.Fields, 0, 1)
+	case *Union:
+		c.layoutFields(buf, "union", s.name, s.size, s.Fields, 0, 1)
+	default:
+		return "", fmt.Errorf("%s is not a struct or union", name)
+	}
+
+	return buf.String(), nil
+}
+
+// Find returns the type with the given name, a "struct", "union" or "enum" prefix restricts the kind
+func (c *CTF) Find(name string) (Type, error) {
+	var want kind
+	switch {
+	case strings.HasPrefix(name, "struct "):
+		want = STRUCT
+	case strings.HasPrefix(name, "union "):
+		want = UNION
+	case strings.HasPrefix(name, "enum "):
+		want = ENUM
+	}
+	if want != UNKNOWN {
+		name = strings.TrimSpace(name[strings.Index(name, " "):])
+	}
+
+	var found Type
+	for _, id := range c.typeIDs() {
+		t := c.Types[id]
+		if t.Info().Kind() == FORWARD || t.Info().Kind() == POINTER {
+			continue
+		}
+		if want != UNKNOWN && t.Info().Kind() != want {
+			continue
+		}
+		tname := t.Name()
+		if a, ok := t.(*Array); ok {
+			tname = a.name
+		}
+		if tname != name {
+			continue
+		}
+		// prefer struct/union/enum definitions over typedefs of the same name
+		if found == nil || found.Info().Kind() == TYPEDEF {
+			found = t
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("type %s not found", name)
+	}
+
+	return found, nil
+}
+
+func (c *CTF) layoutFields(buf *bytes.Buffer, keyword, name string, size uint64, fields []Member, base uint64, depth int) {
+	indent := strings.Repeat("\t", depth)
+
+	if isAnon(name) {
+		buf.WriteString(keyword + " {\n")
+	} else {
+		buf.WriteString(keyword + " " + name + " {\n")
+	}
+
+	end := base * 8 // end of the previous member in bits
+	var holes, holeBytes, sumMembers uint64
+	for _, f := range fields {
+		off := base*8 + f.offset
+
+		if keyword == "struct" && off/8 > alignUp(end, 8)/8 {
+			gap := off/8 - alignUp(end, 8)/8
+			holes++
+			holeBytes += gap
+			buf.WriteString(fmt.Sprintf("\n%s/* XXX %d byte%s hole, try to pack */\n\n", indent, gap, plural(gap)))
+		}
+
+		fname := f.name
+		if isAnon(fname) {
+			fname = ""
+		}
+		suffix := fname + ";"
+		if len(fname) > 0 {
+			suffix = " " + suffix
+		}
+
+		if storage, bits, ok := c.bitfield(f); ok {
+			decl := c.declare(int(f.reference), fname, depth)
+			buf.WriteString(fmt.Sprintf("%s%-40s /* %5d:%2d %4d */\n", indent, fmt.Sprintf("%s:%d;", decl, bits), off/8, off%8, storage))
+			if keyword == "struct" && off+uint64(bits) > end {
+				sumMembers += alignUp(off+uint64(bits), 8)/8 - alignUp(end, 8)/8
+				end = off + uint64(bits)
+			}
+			continue
+		}
+
+		fsize := c.TypeSize(int(f.reference))
+		switch t := c.resolve(int(f.reference)).(type) {
+		case *Struct:
+			buf.WriteString(indent)
+			c.layoutFields(buf, "struct", t.name, t.size, t.Fields, off/8, depth+1)
+			buf.WriteString(fmt.Sprintf("%-40s /* %5d %4d */\n", suffix, off/8, fsize))
+		case *Union:
+			buf.WriteString(indent)
+			c.layoutFields(buf, "union", t.name, t.size, t.Fields, off/8, depth+1)
+			buf.WriteString(fmt.Sprintf("%-40s /* %5d %4d */\n", suffix, off/8, fsize))
+		default:
+			buf.WriteString(fmt.Sprintf("%s%-40s /* %5d %4d */\n", indent, c.declare(int(f.reference), fname, depth)+";", off/8, fsize))
+		}
+
+		if keyword == "struct" {
+			sumMembers += fsize
+			end = off + fsize*8
+		} else if fsize > sumMembers {
+			sumMembers = fsize
+		}
+
+		if depth == 1 && fsize > 0 && (off/8)/cacheLineSize != (off/8+fsize-1)/cacheLineSize {
+			boundary := (off/8 + fsize - 1) / cacheLineSize * cacheLineSize
+			buf.WriteString(fmt.Sprintf("%s/* --- cacheline %d boundary (%d bytes) was %d bytes ago --- */\n",
+				indent, boundary/cacheLineSize, boundary, off/8+fsize-boundary))
+		}
+	}
+
+	if depth > 1 {
+		buf.WriteString(strings.Repeat("\t", depth-1) + "}")
+		return
+	}
+
+	buf.WriteString(fmt.Sprintf("\n%s/* size: %d, cachelines: %d, members: %d */\n", indent, size, alignUp(size, cacheLineSize)/cacheLineSize, len(fields)))
+	if holes > 0 {
+		buf.WriteString(fmt.Sprintf("%s/* sum members: %d, holes: %d, sum holes: %d */\n", indent, sumMembers, holes, holeBytes))
+	}
+	if used := alignUp(end, 8) / 8; keyword == "struct" && size > used {
+		buf.WriteString(fmt.Sprintf("%s/* padding: %d */\n", indent, size-used))
+	}
+	if size%cacheLineSize != 0 {
+		buf.WriteString(fmt.Sprintf("%s/* last cacheline: %d bytes */\n", indent, size%cacheLineSize))
+	}
+	buf.WriteString("};\n")
+}
+
+func plural(n uint64) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
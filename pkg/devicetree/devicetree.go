@@ -9,7 +9,6 @@ import (
 
 	"fmt"
 	"io"
-	"math"
 	"path/filepath"
 	"reflect"
 	"regexp"
@@ -199,138 +198,49 @@ func parseNode(buffer io.Reader) (Node, error) {
 	return node, nil
 }
 
-func parseNodeProperty(buffer io.Reader) (string, interface{}, error) {
-	var nProp NodeProperty
-	// Read a NodeProperty from the buffer
-	if err := binary.Read(buffer, binary.LittleEndian, &nProp); err != nil {
-		return "", nil, err
-	}
-	// 4 byte align the length
-	nProp.Length &= math.MaxInt32
-	if (nProp.Length % 4) != 0 {
-		nProp.Length = nProp.Length + (4 - (nProp.Length % 4))
-	}
-	// Read property value from the buffer
-	dat := make([]byte, nProp.Length)
-	if err := binary.Read(buffer, binary.LittleEndian, &dat); err != nil {
-		return "", nil, err
-	}
-
-	key := string(bytes.TrimRight(nProp.Name[:], "\x00"))
-	value := parseValue(dat)
-
-	return key, value, nil
-}
-
-func getProperties(buffer io.Reader, node Node) (string, DeviceTree, error) {
-
-	var nodeName string
-	props := Properties{}
-
-	for index := 0; index < int(node.NumProperties); index++ {
-		key, value, err := parseNodeProperty(buffer)
-		if err != nil {
-			return "", DeviceTree{}, err
-		}
-		// log.WithFields(log.Fields{"key": key, "value": value}).Debug("extracted property")
-		if strings.EqualFold("name", key) {
-			if str, ok := value.(string); ok {
-				nodeName = str
-			} else {
-				return "", DeviceTree{}, fmt.Errorf("failed to assigned nodeName to: %#v", value)
-			}
-		} else {
-			props[key] = value
-		}
-	}
-
-	return nodeName, DeviceTree{nodeName: props}, nil
-}
-
-func parseProperties(r io.Reader, node Node, parent DeviceTree) (DeviceTree, error) {
-
-	name, parent, err := getProperties(r, node)
+// Parse parses plist files in a local ipsw file
+func Parse(ipswPath string) (map[string]*DeviceTree, error) {
+	zr, err := zip.OpenReader(ipswPath)
 	if err != nil {
-		return DeviceTree{}, err
-	}
-
-	children := []DeviceTree{}
-	for index := 0; index < int(node.NumChildren); index++ {
-		cNode, err := parseNode(r)
-		if err != nil {
-			return DeviceTree{}, err
-		}
-
-		cProps, err := parseProperties(r, cNode, DeviceTree{})
-		if err != nil {
-			return DeviceTree{}, err
-		}
-		children = append(children, cProps)
+		return nil, fmt.Errorf("failed to open zip: %s", err)
 	}
-	parent[name]["children"] = children
+	defer zr.Close()
 
-	return parent, nil
+	return ParseZipFiles(zr.File)
 }
 
-func parseDeviceTree(r io.Reader) (*DeviceTree, error) {
-
-	// Read a Node from the buffer
-	node, err := parseNode(r)
+// ParseZipFiles parses DeviceTree in remote ipsw zip
+func ParseZipFiles(files []*zip.File) (map[string]*DeviceTree, error) {
+	trees, err := ParseZipFilesTrees(files)
 	if err != nil {
 		return nil, err
 	}
 
-	dtree, err := parseProperties(r, node, DeviceTree{})
-	if err != nil {
-		return nil, err
+	dt := make(map[string]*DeviceTree)
+	for name, t := range trees {
+		dt[name] = t.DeviceTree()
 	}
 
-	return &dtree, nil
+	return dt, nil
 }
 
-// Parse parses plist files in a local ipsw file
-func Parse(ipswPath string) (map[string]*DeviceTree, error) {
-	dt := make(map[string]*DeviceTree)
-
+// ParseTrees parses the raw Trees of the DeviceTrees in a local ipsw file
+func ParseTrees(ipswPath string) (map[string]*Tree, error) {
 	zr, err := zip.OpenReader(ipswPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open zip: %s", err)
 	}
 	defer zr.Close()
 
-	for _, f := range zr.File {
-		if regexp.MustCompile(`.*DeviceTree.*im4p$`).MatchString(f.Name) {
-			dtData := make([]byte, f.UncompressedSize64)
-			rc, _ := f.Open()
-			io.ReadFull(rc, dtData)
-			rc.Close()
-
-			dt[filepath.Base(f.Name)], err = ParseImg4Data(dtData)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse Img4 DeviceTree: %v", err)
-			}
-		} else if regexp.MustCompile(`.*DeviceTree.*img3$`).MatchString(f.Name) {
-			dtData := make([]byte, f.UncompressedSize64)
-			rc, _ := f.Open()
-			io.ReadFull(rc, dtData)
-			rc.Close()
-
-			dt[filepath.Base(f.Name)], err = ParseImg3Data(dtData)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse Img3 DeviceTree: %w", err)
-			}
-		}
-	}
-
-	return dt, nil
+	return ParseZipFilesTrees(zr.File)
 }
 
-// ParseZipFiles parses DeviceTree in remote ipsw zip
-func ParseZipFiles(files []*zip.File) (map[string]*DeviceTree, error) {
+// ParseZipFilesTrees parses the raw Trees of the DeviceTrees in a (remote) ipsw zip
+func ParseZipFilesTrees(files []*zip.File) (map[string]*Tree, error) {
 
 	var err error
 
-	dt := make(map[string]*DeviceTree)
+	dt := make(map[string]*Tree)
 
 	for _, f := range files {
 		if regexp.MustCompile(`.*DeviceTree.*im4p$`).MatchString(f.Name) {
@@ -339,7 +249,7 @@ func ParseZipFiles(files []*zip.File) (map[string]*DeviceTree, error) {
 			io.ReadFull(rc, dtData)
 			rc.Close()
 
-			dt[filepath.Base(f.Name)], err = ParseImg4Data(dtData)
+			dt[filepath.Base(f.Name)], err = ParseImg4Tree(dtData)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse Img4 DeviceTree: %v", err)
 			}
@@ -349,7 +259,7 @@ func ParseZipFiles(files []*zip.File) (map[string]*DeviceTree, error) {
 			io.ReadFull(rc, dtData)
 			rc.Close()
 
-			dt[filepath.Base(f.Name)], err = ParseImg3Data(dtData)
+			dt[filepath.Base(f.Name)], err = ParseImg3TreeWithKey(dtData, nil, nil)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse Img3 DeviceTree: %w", err)
 			}
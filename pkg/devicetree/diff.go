@@ -0,0 +1,191 @@
+package devicetree
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Difference kinds
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// VolatileProperties are the properties ignored by default when diffing (they change with every build)
+var VolatileProperties = []string{
+	"time-stamp",
+	"AAPL,phandle",
+}
+
+// Difference is a difference between two DeviceTrees
+type Difference struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	Property string `json:"property,omitempty"` // empty for node differences
+	Old      string `json:"old,omitempty"`
+	New      string `json:"new,omitempty"`
+}
+
+func (d Difference) String() string {
+	switch {
+	case len(d.Property) == 0:
+		return fmt.Sprintf("%s %s", d.Kind, d.Path)
+	case d.Kind == DiffChanged:
+		return fmt.Sprintf("%s %s %s: %s -> %s", d.Kind, d.Path, d.Property, d.Old, d.New)
+	case d.Kind == DiffAdded:
+		return fmt.Sprintf("%s %s %s: %s", d.Kind, d.Path, d.Property, d.New)
+	default:
+		return fmt.Sprintf("%s %s %s: %s", d.Kind, d.Path, d.Property, d.Old)
+	}
+}
+
+// DiffConfig is the configuration for Diff
+type DiffConfig struct {
+	Ignore []string // property names to ignore (default is VolatileProperties)
+}
+
+type treeDiffer struct {
+	a, b     *Tree
+	ignore   map[string]bool
+	phandleA map[uint32]*TreeNode
+	phandleB map[uint32]*TreeNode
+	diffs    []Difference
+}
+
+func phandleMap(t *Tree) map[uint32]*TreeNode {
+	phandles := make(map[uint32]*TreeNode)
+	t.Root.Walk(func(n *TreeNode) error {
+		if ph, ok := n.Phandle(); ok {
+			phandles[ph] = n
+		}
+		return nil
+	})
+	return phandles
+}
+
+// Diff compares two DeviceTrees node by node and property by property.
+// Properties are compared by their typed values and phandle references by the path of the node they reference.
+func Diff(a, b *Tree, conf *DiffConfig) []Difference {
+	if conf == nil {
+		conf = &DiffConfig{Ignore: VolatileProperties}
+	}
+	d := &treeDiffer{
+		a:        a,
+		b:        b,
+		ignore:   make(map[string]bool),
+		phandleA: phandleMap(a),
+		phandleB: phandleMap(b),
+	}
+	for _, name := range conf.Ignore {
+		d.ignore[name] = true
+	}
+	d.diffNode(a.Root, b.Root)
+	return d.diffs
+}
+
+// childKeys returns a unique key for each child (the name, plus its occurrence for duplicate names)
+func childKeys(n *TreeNode) ([]string, map[string]*TreeNode) {
+	var keys []string
+	children := make(map[string]*TreeNode)
+	seen := make(map[string]int)
+	for _, child := range n.Children {
+		key := child.Name
+		if seen[child.Name] > 0 {
+			key = fmt.Sprintf("%s#%d", child.Name, seen[child.Name])
+		}
+		seen[child.Name]++
+		keys = append(keys, key)
+		children[key] = child
+	}
+	return keys, children
+}
+
+func (d *treeDiffer) diffNode(a, b *TreeNode) {
+	for _, pa := range a.Properties {
+		if d.ignore[pa.Name] || pa.Name == "name" {
+			continue
+		}
+		pb := b.Property(pa.Name)
+		if pb == nil {
+			d.diffs = append(d.diffs, Difference{Kind: DiffRemoved, Path: a.Path(), Property: pa.Name, Old: d.format(a, pa, d.phandleA)})
+			continue
+		}
+		// placeholders are filled in at boot (e.g. serial numbers)
+		if pa.Placeholder && pb.Placeholder {
+			continue
+		}
+		oldVal, newVal := d.format(a, pa, d.phandleA), d.format(b, pb, d.phandleB)
+		if oldVal != newVal {
+			d.diffs = append(d.diffs, Difference{Kind: DiffChanged, Path: a.Path(), Property: pa.Name, Old: oldVal, New: newVal})
+		}
+	}
+	for _, pb := range b.Properties {
+		if d.ignore[pb.Name] || pb.Name == "name" || a.Property(pb.Name) != nil {
+			continue
+		}
+		d.diffs = append(d.diffs, Difference{Kind: DiffAdded, Path: b.Path(), Property: pb.Name, New: d.format(b, pb, d.phandleB)})
+	}
+
+	keysA, childrenA := childKeys(a)
+	keysB, childrenB := childKeys(b)
+	for _, key := range keysA {
+		if cb, ok := childrenB[key]; ok {
+			d.diffNode(childrenA[key], cb)
+		} else {
+			d.diffs = append(d.diffs, Difference{Kind: DiffRemoved, Path: childrenA[key].Path()})
+		}
+	}
+	for _, key := range keysB {
+		if _, ok := childrenA[key]; !ok {
+			d.diffs = append(d.diffs, Difference{Kind: DiffAdded, Path: childrenB[key].Path()})
+		}
+	}
+}
+
+func isPhandleRef(name string) bool {
+	return name == "interrupt-parent"
+}
+
+// format returns the typed value of a property as a string (phandle references are resolved to node paths)
+func (d *treeDiffer) format(n *TreeNode, prop *TreeProperty, phandles map[uint32]*TreeNode) string {
+	if isPhandleRef(prop.Name) {
+		if ph, ok := prop.Uint32(); ok {
+			if ref, ok := phandles[ph]; ok {
+				return ref.Path()
+			}
+		}
+	}
+	return FormatValue(n.Value(prop))
+}
+
+// FormatValue formats a typed property value (as returned by (*TreeNode).Value)
+func FormatValue(val interface{}) string {
+	switch v := val.(type) {
+	case []Reg:
+		var regs []string
+		for _, r := range v {
+			regs = append(regs, r.String())
+		}
+		return "[" + strings.Join(regs, ", ") + "]"
+	case []Range:
+		var ranges []string
+		for _, r := range v {
+			ranges = append(ranges, fmt.Sprintf("%#x->%#x (%#x)", r.ChildAddress, r.ParentAddress, r.Size))
+		}
+		return "[" + strings.Join(ranges, ", ") + "]"
+	case []uint32:
+		var cells []string
+		for _, c := range v {
+			cells = append(cells, fmt.Sprintf("%#x", c))
+		}
+		return "[" + strings.Join(cells, " ") + "]"
+	case uint32:
+		return fmt.Sprintf("%#x", v)
+	case []string:
+		return fmt.Sprintf("%q", v)
+	case string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprintf("%v", val)
+}
@@ -0,0 +1,200 @@
+package devicetree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/blacktop/ipsw/pkg/img4"
+)
+
+// maxPropNameLen is the maximum length of a property name (NUL terminated in 32 bytes)
+const maxPropNameLen = 31
+
+// Property value types for EncodeValue
+const (
+	ValueString  = "string"  // NUL terminated string
+	ValueStrings = "strings" // comma separated list of NUL terminated strings (e.g. compatible)
+	ValueU32     = "u32"     // 32-bit little-endian integer
+	ValueU64     = "u64"     // 64-bit little-endian integer
+	ValueCells   = "cells"   // comma separated list of 32-bit cells
+	ValueHex     = "hex"     // raw hex encoded bytes
+	ValueEmpty   = "empty"   // no value (boolean property)
+)
+
+// EncodeValue encodes a property value of the given type (see the Value* types)
+func EncodeValue(typ, value string) ([]byte, error) {
+	switch strings.ToLower(typ) {
+	case ValueString, "":
+		return append([]byte(value), 0), nil
+	case ValueStrings:
+		var out []byte
+		for _, s := range strings.Split(value, ",") {
+			out = append(append(out, strings.TrimSpace(s)...), 0)
+		}
+		return out, nil
+	case ValueU32:
+		v, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid u32 value %s: %v", value, err)
+		}
+		out := make([]byte, 4)
+		binary.LittleEndian.PutUint32(out, uint32(v))
+		return out, nil
+	case ValueU64:
+		v, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid u64 value %s: %v", value, err)
+		}
+		out := make([]byte, 8)
+		binary.LittleEndian.PutUint64(out, v)
+		return out, nil
+	case ValueCells:
+		var out []byte
+		for _, c := range strings.Split(value, ",") {
+			v, err := strconv.ParseUint(strings.TrimSpace(c), 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cell value %s: %v", c, err)
+			}
+			cell := make([]byte, 4)
+			binary.LittleEndian.PutUint32(cell, uint32(v))
+			out = append(out, cell...)
+		}
+		return out, nil
+	case ValueHex:
+		out, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex value %s: %v", value, err)
+		}
+		return out, nil
+	case ValueEmpty:
+		return []byte{}, nil
+	}
+	return nil, fmt.Errorf("invalid value type %s (must be one of: %s, %s, %s, %s, %s, %s or %s)",
+		typ, ValueString, ValueStrings, ValueU32, ValueU64, ValueCells, ValueHex, ValueEmpty)
+}
+
+// SetProperty sets the value of the node's property (adding it if it does not exist)
+func (n *TreeNode) SetProperty(name string, value []byte) error {
+	if len(name) == 0 || len(name) > maxPropNameLen {
+		return fmt.Errorf("invalid property name %q (must be 1 to %d characters)", name, maxPropNameLen)
+	}
+	if name == "name" {
+		n.Name = string(bytes.TrimRight(value, "\x00"))
+	}
+	if prop := n.Property(name); prop != nil {
+		prop.Value = value
+		prop.Placeholder = false
+		return nil
+	}
+	n.Properties = append(n.Properties, &TreeProperty{Name: name, Value: value})
+	return nil
+}
+
+// DeleteProperty removes the node's property
+func (n *TreeNode) DeleteProperty(name string) error {
+	if name == "name" {
+		return fmt.Errorf("can't delete the name property of %s", n.Path())
+	}
+	for idx, prop := range n.Properties {
+		if prop.Name == name {
+			n.Properties = append(n.Properties[:idx], n.Properties[idx+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("property %s not found in %s", name, n.Path())
+}
+
+// AddChild adds a new (empty) child node
+func (n *TreeNode) AddChild(name string) (*TreeNode, error) {
+	if len(name) == 0 || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid node name %q", name)
+	}
+	if n.Child(name) != nil {
+		return nil, fmt.Errorf("node %s already exists in %s", name, n.Path())
+	}
+	child := &TreeNode{
+		Name:       name,
+		Properties: []*TreeProperty{{Name: "name", Value: append([]byte(name), 0)}},
+		parent:     n,
+	}
+	n.Children = append(n.Children, child)
+	return child, nil
+}
+
+// DeleteChild removes the node's child (and all its descendants)
+func (n *TreeNode) DeleteChild(name string) error {
+	for idx, child := range n.Children {
+		if child.Name == name {
+			n.Children = append(n.Children[:idx], n.Children[idx+1:]...)
+			child.parent = nil
+			return nil
+		}
+	}
+	return fmt.Errorf("node %s not found in %s", name, n.Path())
+}
+
+// Delete removes the node at a path
+func (t *Tree) Delete(path string) error {
+	node, err := t.Find(path)
+	if err != nil {
+		return err
+	}
+	if node.parent == nil {
+		return fmt.Errorf("can't delete the root node")
+	}
+	return node.parent.DeleteChild(node.Name)
+}
+
+// Marshal serializes the tree into Apple's flattened DeviceTree format
+func (t *Tree) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := t.Root.marshal(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *TreeNode) marshal(buf *bytes.Buffer) error {
+	binary.Write(buf, binary.LittleEndian, Node{
+		NumProperties: uint32(len(n.Properties)),
+		NumChildren:   uint32(len(n.Children)),
+	})
+
+	for _, prop := range n.Properties {
+		if len(prop.Name) > maxPropNameLen {
+			return fmt.Errorf("property name %s of %s is too long", prop.Name, n.Path())
+		}
+		nProp := NodeProperty{Length: uint32(len(prop.Value))}
+		copy(nProp.Name[:], prop.Name)
+		if prop.Placeholder {
+			nProp.Length |= propPlaceholder
+		}
+		binary.Write(buf, binary.LittleEndian, nProp)
+		buf.Write(prop.Value)
+		// values are padded to 4 byte alignment
+		if pad := len(prop.Value) % 4; pad != 0 {
+			buf.Write(make([]byte, 4-pad))
+		}
+	}
+
+	for _, child := range n.Children {
+		if err := child.marshal(buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MarshalIm4p serializes the tree and wraps it into an IM4P (e.g. type dtre)
+func (t *Tree) MarshalIm4p(typ, description string) ([]byte, error) {
+	data, err := t.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return img4.CreateIm4p(typ, description, data, nil)
+}
@@ -3,83 +3,81 @@ package devicetree
 import (
 	"bytes"
 	"encoding/asn1"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 
 	// lzfse "github.com/blacktop/go-lzfse"
 
-	"github.com/blacktop/ipsw/internal/utils"
 	"github.com/blacktop/ipsw/pkg/img3"
 	"github.com/blacktop/ipsw/pkg/lzfse"
 )
 
 var ErrEncryptedDeviceTree = errors.New("encrypted device tree")
 
-// ParseImg3Data parses a img4 data containing a DeviceTree
+// ParseImg3Data parses a img3 data containing a DeviceTree
 func ParseImg3Data(data []byte) (*DeviceTree, error) {
+	return ParseImg3DataWithKey(data, nil, nil)
+}
 
-	var i img3.Img3
-
-	r := bytes.NewReader(data)
-
-	if err := binary.Read(r, binary.LittleEndian, &i.Header); err != nil {
+// ParseImg3DataWithKey parses a img3 data containing a DeviceTree, decrypting it with the (GID decrypted) IV and key
+func ParseImg3DataWithKey(data, iv, key []byte) (*DeviceTree, error) {
+	t, err := ParseImg3TreeWithKey(data, iv, key)
+	if err != nil {
 		return nil, err
 	}
+	return t.DeviceTree(), nil
+}
 
-	for {
-		var tag img3.Tag
-
-		err := binary.Read(r, binary.LittleEndian, &tag.TagHeader)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to read img3 tag header: %v", err)
-		}
+// ParseImg3TreeWithKey parses the raw Tree of a img3 data containing a DeviceTree, decrypting it with the (GID decrypted) IV and key
+func ParseImg3TreeWithKey(data, iv, key []byte) (*Tree, error) {
 
-		tag.Data = make([]byte, tag.DataLength)
-		tag.Pad = make([]byte, tag.TotalLength-tag.DataLength-12)
+	i, err := img3.Parse(data)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := binary.Read(r, binary.LittleEndian, &tag.Data); err != nil {
-			return nil, fmt.Errorf("failed to read img3 tag data: %v", err)
-		}
-		if err := binary.Read(r, binary.LittleEndian, &tag.Pad); err != nil {
-			return nil, fmt.Errorf("failed to read img3 tag pad: %v", err)
+	dat, err := i.Payload(iv, key)
+	if err != nil {
+		if errors.Is(err, img3.ErrEncrypted) {
+			// some images have a KBAG but aren't actually encrypted
+			if t, err := ParseTree(bytes.NewReader(i.Data())); err == nil {
+				return t, nil
+			}
+			return nil, ErrEncryptedDeviceTree
 		}
-
-		i.Tags = append(i.Tags, tag)
+		return nil, err
 	}
 
-	var dr io.Reader
-	if bytes.Contains(i.Tags[1].Data[:4], []byte("bvx2")) {
-		dat, err := lzfse.NewDecoder(i.Tags[1].Data).DecodeBuffer()
+	if bytes.HasPrefix(dat, []byte("bvx2")) {
+		dat, err = lzfse.NewDecoder(dat).DecodeBuffer()
 		if err != nil {
 			return nil, fmt.Errorf("failed to lzfse decompress DeviceTree: %v", err)
 		}
-		// dr = bytes.NewReader(lzfse.DecodeBuffer(i.Tags[1].Data))
-		dr = bytes.NewReader(dat)
-	} else {
-		dr = bytes.NewReader(i.Tags[1].Data)
 	}
 
-	dtree, err := parseDeviceTree(dr)
+	t, err := ParseTree(bytes.NewReader(dat))
 	if err != nil {
-		for _, tag := range i.Tags {
-			magic := string(utils.ReverseBytes(tag.Magic[:]))
-			if magic == "KBAG" {
-				return nil, ErrEncryptedDeviceTree
-			}
+		if i.Encrypted() {
+			return nil, fmt.Errorf("failed to parse Img3 device tree data (wrong key?): %v", err)
 		}
 		return nil, fmt.Errorf("failed to parse Img3 device tree data: %v", err)
 	}
 
-	return dtree, nil
+	return t, nil
 }
 
 // ParseImg4Data parses a img4 data containing a DeviceTree
 func ParseImg4Data(data []byte) (*DeviceTree, error) {
+	t, err := ParseImg4Tree(data)
+	if err != nil {
+		return nil, err
+	}
+	return t.DeviceTree(), nil
+}
+
+// ParseImg4Tree parses the raw Tree of a img4 data containing a DeviceTree
+func ParseImg4Tree(data []byte) (*Tree, error) {
 
 	var i Img4
 	// NOTE: openssl asn1parse -i -inform DER -in DEVICETREE.im4p
@@ -99,10 +97,10 @@ func ParseImg4Data(data []byte) (*DeviceTree, error) {
 		r = bytes.NewReader(i.Data)
 	}
 
-	dtree, err := parseDeviceTree(r)
+	t, err := ParseTree(r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse Img4 device tree data: %v", err)
 	}
 
-	return dtree, nil
+	return t, nil
 }
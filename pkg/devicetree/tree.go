@@ -0,0 +1,172 @@
+package devicetree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// propPlaceholder is the NodeProperty length bit marking a placeholder property (filled in by iBoot)
+const propPlaceholder = 0x80000000
+
+// Tree is a DeviceTree that keeps the raw property values of its nodes
+type Tree struct {
+	Root *TreeNode
+}
+
+// TreeNode is a DeviceTree node
+type TreeNode struct {
+	Name       string
+	Properties []*TreeProperty
+	Children   []*TreeNode
+
+	parent *TreeNode
+}
+
+// TreeProperty is a DeviceTree node property
+type TreeProperty struct {
+	Name        string
+	Value       []byte
+	Placeholder bool
+}
+
+// ParseTree parses a raw DeviceTree
+func ParseTree(r io.Reader) (*Tree, error) {
+	root, err := parseTreeNode(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Tree{Root: root}, nil
+}
+
+func parseTreeNode(r io.Reader, parent *TreeNode) (*TreeNode, error) {
+	node, err := parseNode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &TreeNode{parent: parent}
+
+	for index := 0; index < int(node.NumProperties); index++ {
+		var nProp NodeProperty
+		if err := binary.Read(r, binary.LittleEndian, &nProp); err != nil {
+			return nil, err
+		}
+		prop := &TreeProperty{
+			Name:        string(bytes.TrimRight(nProp.Name[:], "\x00")),
+			Placeholder: nProp.Length&propPlaceholder != 0,
+		}
+		length := nProp.Length &^ propPlaceholder
+		// values are padded to 4 byte alignment
+		padded := (length + 3) &^ 3
+		dat := make([]byte, padded)
+		if _, err := io.ReadFull(r, dat); err != nil {
+			return nil, err
+		}
+		prop.Value = dat[:length]
+		if prop.Name == "name" {
+			n.Name = string(bytes.TrimRight(prop.Value, "\x00"))
+		}
+		n.Properties = append(n.Properties, prop)
+	}
+
+	for index := 0; index < int(node.NumChildren); index++ {
+		child, err := parseTreeNode(r, n)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = append(n.Children, child)
+	}
+
+	return n, nil
+}
+
+// Parent returns the node's parent (nil for the root node)
+func (n *TreeNode) Parent() *TreeNode {
+	return n.parent
+}
+
+// Path returns the node's path (e.g. /device-tree/arm-io/uart0)
+func (n *TreeNode) Path() string {
+	if n.parent == nil {
+		return "/" + n.Name
+	}
+	return n.parent.Path() + "/" + n.Name
+}
+
+// Property returns the node's property with the given name
+func (n *TreeNode) Property(name string) *TreeProperty {
+	for _, prop := range n.Properties {
+		if prop.Name == name {
+			return prop
+		}
+	}
+	return nil
+}
+
+// Child returns the node's child with the given name
+func (n *TreeNode) Child(name string) *TreeNode {
+	for _, child := range n.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for the node and all its descendants (depth first)
+func (n *TreeNode) Walk(fn func(*TreeNode) error) error {
+	if err := fn(n); err != nil {
+		return err
+	}
+	for _, child := range n.Children {
+		if err := child.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find returns the node at a path; the root node's name is optional (e.g. /arm-io/uart0 or /device-tree/arm-io/uart0)
+func (t *Tree) Find(path string) (*TreeNode, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 0 && parts[0] == t.Root.Name {
+		parts = parts[1:]
+	}
+	node := t.Root
+	for _, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		child := node.Child(part)
+		if child == nil {
+			return nil, fmt.Errorf("node %s not found in %s", part, node.Path())
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// DeviceTree returns the DeviceTree with the decoded property values
+func (t *Tree) DeviceTree() *DeviceTree {
+	dtree := t.Root.deviceTree()
+	return &dtree
+}
+
+func (n *TreeNode) deviceTree() DeviceTree {
+	props := Properties{}
+	for _, prop := range n.Properties {
+		if prop.Name == "name" {
+			continue
+		}
+		props[prop.Name] = n.Value(prop)
+	}
+	children := []DeviceTree{}
+	for _, child := range n.Children {
+		children = append(children, child.deviceTree())
+	}
+	props["children"] = children
+	return DeviceTree{n.Name: props}
+}
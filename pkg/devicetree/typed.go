@@ -0,0 +1,344 @@
+package devicetree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// default cell counts when a bus node does not specify them (Devicetree Specification 2.3.5)
+const (
+	defaultAddressCells = 2
+	defaultSizeCells    = 1
+)
+
+// Reg is an address range of a node's reg property
+type Reg struct {
+	Address uint64 `json:"address"`
+	Size    uint64 `json:"size"`
+}
+
+func (r Reg) String() string {
+	return fmt.Sprintf("%#x-%#x (%#x)", r.Address, r.Address+r.Size, r.Size)
+}
+
+// Range is an entry of a bus node's ranges property (mapping a child address range to the parent's address space)
+type Range struct {
+	ChildAddress  uint64 `json:"child_address"`
+	ParentAddress uint64 `json:"parent_address"`
+	Size          uint64 `json:"size"`
+}
+
+// Uint32 returns the property value as a uint32
+func (p *TreeProperty) Uint32() (uint32, bool) {
+	if len(p.Value) != 4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(p.Value), true
+}
+
+// Cells returns the property value as a list of 32-bit cells
+func (p *TreeProperty) Cells() ([]uint32, error) {
+	if len(p.Value)%4 != 0 {
+		return nil, fmt.Errorf("property %s length %d is not a multiple of the cell size", p.Name, len(p.Value))
+	}
+	cells := make([]uint32, len(p.Value)/4)
+	for i := range cells {
+		cells[i] = binary.LittleEndian.Uint32(p.Value[i*4:])
+	}
+	return cells, nil
+}
+
+// Strings returns the property value as a list of NUL separated strings
+func (p *TreeProperty) Strings() []string {
+	var strs []string
+	for _, s := range bytes.Split(bytes.TrimRight(p.Value, "\x00"), []byte("\x00")) {
+		if len(s) > 0 {
+			strs = append(strs, string(s))
+		}
+	}
+	return strs
+}
+
+// cellsValue combines n cells into a number (Apple DeviceTrees store them little-endian, least significant cell first)
+func cellsValue(cells []uint32) uint64 {
+	var val uint64
+	for i := len(cells) - 1; i >= 0; i-- {
+		val = val<<32 | uint64(cells[i])
+	}
+	return val
+}
+
+// Uint32 returns the value of the node's uint32 property
+func (n *TreeNode) Uint32(name string) (uint32, bool) {
+	if prop := n.Property(name); prop != nil {
+		return prop.Uint32()
+	}
+	return 0, false
+}
+
+// AddressCells returns the number of cells of the addresses of the node's children
+func (n *TreeNode) AddressCells() int {
+	if cells, ok := n.Uint32("#address-cells"); ok {
+		return int(cells)
+	}
+	return defaultAddressCells
+}
+
+// SizeCells returns the number of cells of the sizes of the node's children
+func (n *TreeNode) SizeCells() int {
+	if cells, ok := n.Uint32("#size-cells"); ok {
+		return int(cells)
+	}
+	return defaultSizeCells
+}
+
+// Compatible returns the node's compatible strings
+func (n *TreeNode) Compatible() []string {
+	if prop := n.Property("compatible"); prop != nil {
+		return prop.Strings()
+	}
+	return nil
+}
+
+// Phandle returns the node's AAPL,phandle
+func (n *TreeNode) Phandle() (uint32, bool) {
+	return n.Uint32("AAPL,phandle")
+}
+
+// Interrupts returns the node's interrupt specifiers
+func (n *TreeNode) Interrupts() ([]uint32, error) {
+	if prop := n.Property("interrupts"); prop != nil {
+		return prop.Cells()
+	}
+	return nil, nil
+}
+
+// InterruptParentPhandle returns the phandle of the node's interrupt controller (inherited from its ancestors)
+func (n *TreeNode) InterruptParentPhandle() (uint32, bool) {
+	for node := n; node != nil; node = node.parent {
+		if ph, ok := node.Uint32("interrupt-parent"); ok {
+			return ph, true
+		}
+	}
+	return 0, false
+}
+
+// Reg returns the node's reg address ranges (in its parent's address space)
+func (n *TreeNode) Reg() ([]Reg, error) {
+	prop := n.Property("reg")
+	if prop == nil {
+		return nil, nil
+	}
+
+	addrCells, sizeCells := defaultAddressCells, defaultSizeCells
+	if n.parent != nil {
+		addrCells, sizeCells = n.parent.AddressCells(), n.parent.SizeCells()
+	}
+
+	cells, err := prop.Cells()
+	if err != nil {
+		return nil, err
+	}
+	stride := addrCells + sizeCells
+	if stride == 0 || len(cells)%stride != 0 {
+		return nil, fmt.Errorf("%s reg has %d cells (not a multiple of %d address + %d size cells)", n.Path(), len(cells), addrCells, sizeCells)
+	}
+
+	var regs []Reg
+	for i := 0; i < len(cells); i += stride {
+		regs = append(regs, Reg{
+			Address: cellsValue(cells[i : i+addrCells]),
+			Size:    cellsValue(cells[i+addrCells : i+stride]),
+		})
+	}
+
+	return regs, nil
+}
+
+// Ranges returns the node's ranges; a nil slice with a nil error means the node has no ranges property
+func (n *TreeNode) Ranges() ([]Range, error) {
+	prop := n.Property("ranges")
+	if prop == nil {
+		return nil, nil
+	}
+
+	childCells, sizeCells := n.AddressCells(), n.SizeCells()
+	parentCells := defaultAddressCells
+	if n.parent != nil {
+		parentCells = n.parent.AddressCells()
+	}
+
+	cells, err := prop.Cells()
+	if err != nil {
+		return nil, err
+	}
+	stride := childCells + parentCells + sizeCells
+	if stride == 0 || len(cells)%stride != 0 {
+		return nil, fmt.Errorf("%s ranges has %d cells (not a multiple of %d child + %d parent + %d size cells)",
+			n.Path(), len(cells), childCells, parentCells, sizeCells)
+	}
+
+	ranges := []Range{}
+	for i := 0; i < len(cells); i += stride {
+		ranges = append(ranges, Range{
+			ChildAddress:  cellsValue(cells[i : i+childCells]),
+			ParentAddress: cellsValue(cells[i+childCells : i+childCells+parentCells]),
+			Size:          cellsValue(cells[i+childCells+parentCells : i+stride]),
+		})
+	}
+
+	return ranges, nil
+}
+
+// TranslateAddress translates an address in the node's address space (the address space of its children)
+// through the ranges of the node and its ancestors into a physical address.
+// Bus nodes without a ranges property (or an empty one) are treated as identity mapped.
+func (n *TreeNode) TranslateAddress(addr uint64) (uint64, error) {
+	for bus := n; bus != nil && bus.parent != nil; bus = bus.parent {
+		ranges, err := bus.Ranges()
+		if err != nil {
+			return 0, err
+		}
+		if len(ranges) == 0 {
+			continue
+		}
+		found := false
+		for _, r := range ranges {
+			if addr >= r.ChildAddress && addr-r.ChildAddress < r.Size {
+				addr = addr - r.ChildAddress + r.ParentAddress
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("address %#x is not mapped by the ranges of %s", addr, bus.Path())
+		}
+	}
+	return addr, nil
+}
+
+// PhysicalReg returns the node's reg address ranges translated into physical addresses
+func (n *TreeNode) PhysicalReg() ([]Reg, error) {
+	regs, err := n.Reg()
+	if err != nil || n.parent == nil {
+		return regs, err
+	}
+	for idx, reg := range regs {
+		regs[idx].Address, err = n.parent.TranslateAddress(reg.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to translate %s reg[%d]: %v", n.Path(), idx, err)
+		}
+	}
+	return regs, nil
+}
+
+// NodeByPhandle returns the node with the given AAPL,phandle
+func (t *Tree) NodeByPhandle(phandle uint32) *TreeNode {
+	var found *TreeNode
+	t.Root.Walk(func(n *TreeNode) error {
+		if ph, ok := n.Phandle(); ok && ph == phandle {
+			found = n
+			return errFound
+		}
+		return nil
+	})
+	return found
+}
+
+var errFound = errors.New("found")
+
+// Value returns the typed value of one of the node's properties.
+// Well known properties are decoded by their type, the rest is guessed from the data.
+func (n *TreeNode) Value(prop *TreeProperty) interface{} {
+	switch prop.Name {
+	case "compatible":
+		return prop.Strings()
+	case "#address-cells", "#size-cells", "#interrupt-cells", "AAPL,phandle", "interrupt-parent":
+		if v, ok := prop.Uint32(); ok {
+			return v
+		}
+	case "reg":
+		if regs, err := n.Reg(); err == nil {
+			return regs
+		}
+	case "ranges":
+		if ranges, err := n.Ranges(); err == nil {
+			return ranges
+		}
+	case "interrupts":
+		if cells, err := prop.Cells(); err == nil {
+			return cells
+		}
+	}
+	return parseValue(prop.Value)
+}
+
+// MMIODevice is a device's physical MMIO ranges and interrupts
+type MMIODevice struct {
+	Path            string   `json:"path"`
+	Compatible      []string `json:"compatible,omitempty"`
+	Regs            []Reg    `json:"regs,omitempty"`
+	Interrupts      []uint32 `json:"interrupts,omitempty"`
+	InterruptParent string   `json:"interrupt_parent,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// MMIO returns the physical MMIO ranges and interrupts of every device in the tree
+func (t *Tree) MMIO() []MMIODevice {
+	var devs []MMIODevice
+
+	phandles := make(map[uint32]*TreeNode)
+	t.Root.Walk(func(n *TreeNode) error {
+		if ph, ok := n.Phandle(); ok {
+			phandles[ph] = n
+		}
+		return nil
+	})
+
+	t.Root.Walk(func(n *TreeNode) error {
+		if n.parent == nil || (n.Property("reg") == nil && n.Property("interrupts") == nil) {
+			return nil
+		}
+
+		dev := MMIODevice{
+			Path:       n.Path(),
+			Compatible: n.Compatible(),
+		}
+
+		var errs []string
+		// reg is only a MMIO range on buses with sizes (e.g. not the cpus)
+		if n.Property("reg") != nil && n.parent.SizeCells() > 0 {
+			regs, err := n.PhysicalReg()
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			dev.Regs = regs
+		}
+
+		irqs, err := n.Interrupts()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		dev.Interrupts = irqs
+		if len(irqs) > 0 {
+			if ph, ok := n.InterruptParentPhandle(); ok {
+				if ic, ok := phandles[ph]; ok {
+					dev.InterruptParent = ic.Path()
+				} else {
+					dev.InterruptParent = fmt.Sprintf("phandle %#x", ph)
+				}
+			}
+		}
+
+		dev.Error = strings.Join(errs, "; ")
+		if len(dev.Regs) > 0 || len(dev.Interrupts) > 0 || len(dev.Error) > 0 {
+			devs = append(devs, dev)
+		}
+		return nil
+	})
+
+	return devs
+}
@@ -194,13 +194,29 @@ func (d MachoDisass) GetCString(addr uint64) (string, error) {
 }
 
 func (d MachoDisass) Analyze() error {
+	// names already in the map (e.g. from a .a2s cache) take precedence
+	cached := make(map[uint64]string, len(d.a2s))
+	for addr, name := range d.a2s {
+		cached[addr] = name
+	}
+	defer func() {
+		for addr, name := range cached {
+			d.a2s[addr] = name
+		}
+	}()
 
 	for _, fn := range d.f.GetFunctions() {
-		d.a2s[fn.StartAddr] = fmt.Sprintf("sub_%x", fn.StartAddr)
+		if _, ok := cached[fn.StartAddr]; !ok {
+			d.a2s[fn.StartAddr] = fmt.Sprintf("sub_%x", fn.StartAddr)
+		}
 	}
 
-	for _, sym := range d.f.Symtab.Syms {
-		d.a2s[sym.Value] = sym.Name
+	if d.f.Symtab != nil {
+		for _, sym := range d.f.Symtab.Syms {
+			if _, ok := cached[sym.Value]; !ok {
+				d.a2s[sym.Value] = sym.Name
+			}
+		}
 	}
 
 	if err := d.parseImports(); err != nil {
@@ -0,0 +1,145 @@
+// Package ftab parses ftab firmware containers (used by coprocessor firmwares and accessories)
+package ftab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Magic is the ftab magic (at offset 0x24)
+const Magic = "ftab"
+
+const magicOffset = 0x24
+
+// maxEntries is the maximum number of entries of a sane ftab
+const maxEntries = 1024
+
+// header is the ftab header
+type header struct {
+	Unknown0     uint32 // always 1
+	Unknown1     uint32 // always 0xffffffff
+	Unknown2     [2]uint32
+	TicketOffset uint32 // offset of the IM4M ticket (0 if there is none)
+	TicketSize   uint32
+	Unknown3     [2]uint32
+	Tag          [4]byte // e.g. rkos
+	Magic        [4]byte // ftab
+	NumEntries   uint32
+	Unknown4     uint32
+}
+
+// entry is an ftab segment entry
+type entry struct {
+	Tag    [4]byte
+	Offset uint32
+	Size   uint32
+	_      uint32
+}
+
+// Entry is an ftab segment
+type Entry struct {
+	Tag    string `json:"tag"`
+	Offset uint32 `json:"offset"`
+	Size   uint32 `json:"size"`
+
+	data []byte
+}
+
+// Data returns the segment data
+func (e Entry) Data() []byte {
+	return e.data
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%-4s offset: %#08x size: %#x", e.Tag, e.Offset, e.Size)
+}
+
+// Ftab is a parsed ftab
+type Ftab struct {
+	Tag     string  `json:"tag"`
+	Entries []Entry `json:"entries"`
+	Ticket  []byte  `json:"-"` // IM4M
+}
+
+// IsFtab returns true if data is an ftab
+func IsFtab(data []byte) bool {
+	return len(data) >= magicOffset+len(Magic) && string(data[magicOffset:magicOffset+len(Magic)]) == Magic
+}
+
+// Parse parses an ftab
+func Parse(data []byte) (*Ftab, error) {
+	if !IsFtab(data) {
+		return nil, fmt.Errorf("invalid ftab magic")
+	}
+
+	r := bytes.NewReader(data)
+
+	var hdr header
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "failed to read ftab header")
+	}
+	if hdr.NumEntries > maxEntries {
+		return nil, fmt.Errorf("invalid ftab entry count %d", hdr.NumEntries)
+	}
+
+	ft := &Ftab{Tag: strings.TrimRight(string(hdr.Tag[:]), "\x00")}
+
+	for i := uint32(0); i < hdr.NumEntries; i++ {
+		var e entry
+		if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+			return nil, errors.Wrapf(err, "failed to read ftab entry %d", i)
+		}
+		if uint64(e.Offset)+uint64(e.Size) > uint64(len(data)) {
+			return nil, fmt.Errorf("ftab entry %s (%#x-%#x) is outside of the file", string(e.Tag[:]), e.Offset, uint64(e.Offset)+uint64(e.Size))
+		}
+		ft.Entries = append(ft.Entries, Entry{
+			Tag:    strings.TrimRight(string(e.Tag[:]), "\x00"),
+			Offset: e.Offset,
+			Size:   e.Size,
+			data:   data[e.Offset : e.Offset+e.Size],
+		})
+	}
+
+	if hdr.TicketOffset > 0 && uint64(hdr.TicketOffset)+uint64(hdr.TicketSize) <= uint64(len(data)) {
+		ft.Ticket = data[hdr.TicketOffset : hdr.TicketOffset+hdr.TicketSize]
+	}
+
+	return ft, nil
+}
+
+// Open opens and parses an ftab file
+func Open(path string) (*Ftab, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return Parse(data)
+}
+
+// Entry returns the segment with the given tag
+func (f *Ftab) Entry(tag string) *Entry {
+	for idx, e := range f.Entries {
+		if e.Tag == tag {
+			return &f.Entries[idx]
+		}
+	}
+	return nil
+}
+
+func (f *Ftab) String() string {
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("ftab (%s) %d entries", f.Tag, len(f.Entries)))
+	if len(f.Ticket) > 0 {
+		out.WriteString(fmt.Sprintf(" (ticket: %#x bytes)", len(f.Ticket)))
+	}
+	out.WriteString("\n")
+	for _, e := range f.Entries {
+		out.WriteString(fmt.Sprintf("  %s\n", e))
+	}
+	return out.String()
+}
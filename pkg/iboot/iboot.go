@@ -0,0 +1,297 @@
+// Package iboot parses decrypted iBoot images (iBoot, iBEC, iBSS, LLB, SecureROM, etc.)
+package iboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/lzfse"
+	"github.com/pkg/errors"
+)
+
+// offsets of the strings in the header of an iBoot image
+const (
+	bannerOffset  = 0x200 // e.g. "iBoot for n104ap, Copyright 2007-2019, Apple Inc."
+	styleOffset   = 0x240 // e.g. "RELEASE"
+	versionOffset = 0x280 // e.g. "iBoot-5540.0.129"
+	headerSize    = 0x400
+)
+
+var (
+	bannerRE  = regexp.MustCompile(`([A-Za-z]+) for ([\w.-]+), Copyright (\d{4}-\d{4}), Apple Inc\.`)
+	versionRE = regexp.MustCompile(`iBoot-[\d.]+`)
+	styleRE   = regexp.MustCompile(`^(RELEASE|DEVELOPMENT|DEBUG|RESEARCH)$`)
+)
+
+// IBoot is a parsed iBoot image
+type IBoot struct {
+	Variant   string     `json:"variant"`         // iBoot, iBEC, iBSS, LLB, SecureROM, AVPBooter, ...
+	Platform  string     `json:"platform"`        // e.g. n104ap or t8030si
+	Copyright string     `json:"copyright"`       // e.g. 2007-2019
+	Style     string     `json:"style,omitempty"` // RELEASE, DEVELOPMENT, DEBUG or RESEARCH
+	Version   string     `json:"version"`
+	Arch      string     `json:"arch"`
+	Base      uint64     `json:"base"`
+	Payloads  []Payload  `json:"payloads,omitempty"`
+	Functions []Function `json:"functions,omitempty"`
+
+	data []byte
+}
+
+// Open opens and parses a decrypted iBoot image
+func Open(path string) (*IBoot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return Parse(data)
+}
+
+// Parse parses a decrypted iBoot image
+func Parse(data []byte) (*IBoot, error) {
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("data is too small to be an iBoot image (%d bytes)", len(data))
+	}
+
+	i := &IBoot{data: data}
+
+	if err := i.parseHeader(); err != nil {
+		// the image's payloads can still be found without its banner
+		log.Warn(err.Error())
+	}
+
+	i.Arch = detectArch(data)
+	i.Base = i.findBase()
+
+	i.Payloads = findPayloads(data)
+
+	return i, nil
+}
+
+// Data returns the raw iBoot image
+func (i *IBoot) Data() []byte {
+	return i.data
+}
+
+func cstring(data []byte, off int) string {
+	if off >= len(data) {
+		return ""
+	}
+	if end := bytes.IndexByte(data[off:], 0); end >= 0 {
+		return string(data[off : off+end])
+	}
+	return ""
+}
+
+func (i *IBoot) parseHeader() error {
+	banner := cstring(i.data, bannerOffset)
+	m := bannerRE.FindStringSubmatch(banner)
+	if m == nil {
+		// older images (and SecureROMs) don't always keep the banner at the same offset
+		m = bannerRE.FindStringSubmatch(string(i.data[:utils.Min(len(i.data), 0x1000)]))
+	}
+	if m != nil {
+		i.Variant, i.Platform, i.Copyright = m[1], m[2], m[3]
+	}
+
+	if style := cstring(i.data, styleOffset); styleRE.MatchString(style) {
+		i.Style = style
+	}
+
+	if version := versionRE.FindString(cstring(i.data, versionOffset)); len(version) > 0 {
+		i.Version = version
+	} else {
+		i.Version = versionRE.FindString(string(i.data[:utils.Min(len(i.data), 0x1000)]))
+	}
+
+	if m == nil {
+		return fmt.Errorf("failed to find the iBoot banner (is the image decrypted?)")
+	}
+
+	return nil
+}
+
+// detectArch guesses the architecture from the reset vector
+func detectArch(data []byte) string {
+	insn := binary.LittleEndian.Uint32(data)
+	switch {
+	case insn>>24 == 0xea: // ARM b
+		return "armv7"
+	case insn>>26 == 0x5: // ARM64 b
+		return "arm64"
+	case insn&0x9f000000 == 0x90000000 || insn&0x9f000000 == 0x10000000: // ARM64 adrp/adr
+		return "arm64"
+	}
+	return "arm64"
+}
+
+func (i *IBoot) is64() bool {
+	return i.Arch == "arm64"
+}
+
+// findBase finds the load address of the image.
+//
+// Code references are PC relative, so the candidates (page aligned addresses found in the image's header)
+// are scored by the number of absolute pointers in the image that point to the start of a string.
+func (i *IBoot) findBase() uint64 {
+	ptrSize := 4
+	if i.is64() {
+		ptrSize = 8
+	}
+
+	var candidates []uint64
+	seen := make(map[uint64]bool)
+	for off := bannerOffset; off+ptrSize <= headerSize; off += ptrSize {
+		var val uint64
+		if i.is64() {
+			val = binary.LittleEndian.Uint64(i.data[off:])
+		} else {
+			val = uint64(binary.LittleEndian.Uint32(i.data[off:]))
+		}
+		if val == 0 || val&0xfff != 0 || val < 0x100000 || val >= 1<<40 || seen[val] {
+			continue
+		}
+		seen[val] = true
+		candidates = append(candidates, val)
+	}
+
+	var base uint64
+	best := 0
+	for _, candidate := range candidates {
+		if score := i.scoreBase(candidate, ptrSize); score > best {
+			base, best = candidate, score
+		}
+	}
+
+	return base
+}
+
+func (i *IBoot) scoreBase(base uint64, ptrSize int) int {
+	score := 0
+	end := base + uint64(len(i.data))
+	for off := 0; off+ptrSize <= len(i.data); off += ptrSize {
+		var ptr uint64
+		if ptrSize == 8 {
+			ptr = binary.LittleEndian.Uint64(i.data[off:])
+		} else {
+			ptr = uint64(binary.LittleEndian.Uint32(i.data[off:]))
+		}
+		if ptr <= base || ptr >= end {
+			continue
+		}
+		if strOff := int(ptr - base); i.data[strOff-1] == 0 && len(printableString(i.data, strOff)) >= 4 {
+			score++
+		}
+	}
+	return score
+}
+
+// stringAt returns the printable NUL terminated string at an address (or an empty string)
+func (i *IBoot) stringAt(addr uint64) string {
+	if addr < i.Base || addr-i.Base >= uint64(len(i.data)) {
+		return ""
+	}
+	return printableString(i.data, int(addr-i.Base))
+}
+
+// printableString returns the printable NUL terminated string at an offset (or an empty string)
+func printableString(data []byte, off int) string {
+	end := bytes.IndexByte(data[off:utils.Min(len(data), off+512)], 0)
+	if end <= 0 {
+		return ""
+	}
+	for _, c := range data[off : off+end] {
+		if (c < 0x20 || c > 0x7e) && c != '\n' && c != '\t' {
+			return ""
+		}
+	}
+	return string(data[off : off+end])
+}
+
+func (i *IBoot) String() string {
+	var out strings.Builder
+	if len(i.Variant) > 0 {
+		out.WriteString(fmt.Sprintf("%s for %s (%s)\n", i.Variant, i.Platform, i.Arch))
+	} else {
+		out.WriteString(fmt.Sprintf("Unknown image (%s)\n", i.Arch))
+	}
+	out.WriteString(fmt.Sprintf("  Version:   %s\n", i.Version))
+	if len(i.Style) > 0 {
+		out.WriteString(fmt.Sprintf("  Style:     %s\n", i.Style))
+	}
+	if len(i.Copyright) > 0 {
+		out.WriteString(fmt.Sprintf("  Copyright: %s\n", i.Copyright))
+	}
+	out.WriteString(fmt.Sprintf("  Base:      %#x\n", i.Base))
+	if len(i.Payloads) > 0 {
+		out.WriteString("  Payloads:\n")
+		for _, p := range i.Payloads {
+			out.WriteString(fmt.Sprintf("    %s\n", p))
+		}
+	}
+	if len(i.Functions) > 0 {
+		out.WriteString(fmt.Sprintf("  Functions: %d\n", len(i.Functions)))
+	}
+	return out.String()
+}
+
+// lzfse block magics
+var (
+	lzfseStartMagics = [][]byte{[]byte("bvx2"), []byte("bvxn"), []byte("bvx1"), []byte("bvx-")}
+	lzfseEndMagic    = []byte("bvx$")
+)
+
+func nextLzfseStart(data []byte) int {
+	first := -1
+	for _, magic := range lzfseStartMagics {
+		if idx := bytes.Index(data, magic); idx >= 0 && (first < 0 || idx < first) {
+			first = idx
+		}
+	}
+	return first
+}
+
+// findPayloads finds and decompresses the LZFSE compressed firmwares embedded in the image
+func findPayloads(data []byte) []Payload {
+	var payloads []Payload
+
+	pos := 0
+	for {
+		start := nextLzfseStart(data[pos:])
+		if start < 0 {
+			break
+		}
+		start += pos
+		end := bytes.Index(data[start:], lzfseEndMagic)
+		if end < 0 {
+			break
+		}
+		end += start + len(lzfseEndMagic)
+
+		dec, err := lzfse.NewDecoder(data[start:end]).DecodeBuffer()
+		if err != nil || len(dec) == 0 {
+			// the block magic was just a coincidence in code or data
+			pos = start + len(lzfseEndMagic)
+			continue
+		}
+
+		p := Payload{
+			Offset:         uint64(start),
+			CompressedSize: uint64(end - start),
+			Size:           uint64(len(dec)),
+			data:           dec,
+		}
+		p.Type, p.Name = identify(dec, len(payloads))
+		payloads = append(payloads, p)
+
+		pos = end
+	}
+
+	return payloads
+}
@@ -0,0 +1,60 @@
+package iboot
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Payload is a firmware embedded in an iBoot image
+type Payload struct {
+	Type           string `json:"type"` // SMC, ANS, ISP, PMU, ... or unknown
+	Name           string `json:"name"`
+	Offset         uint64 `json:"offset"`
+	CompressedSize uint64 `json:"compressed_size"`
+	Size           uint64 `json:"size"`
+
+	data []byte
+}
+
+// Data returns the decompressed payload
+func (p Payload) Data() []byte {
+	return p.data
+}
+
+func (p Payload) String() string {
+	return fmt.Sprintf("%-7s %s (offset: %#x, compressed: %#x, size: %#x)", p.Type, p.Name, p.Offset, p.CompressedSize, p.Size)
+}
+
+// signature identifies an embedded firmware by the version string it contains
+type signature struct {
+	Type    string
+	Pattern *regexp.Regexp
+}
+
+// signatures are tried in order (the first match names the payload)
+var signatures = []signature{
+	{"SMC", regexp.MustCompile(`AppleSMCFirmware-[\w.~+-]+`)},
+	{"ANS", regexp.MustCompile(`AppleStorageProcessorANS\w*-[\w.~+-]+`)},
+	{"ISP", regexp.MustCompile(`(?:AppleISP|ISPFirmware|ISPCPU)\w*-[\w.~+-]+`)},
+	{"PMU", regexp.MustCompile(`(?:AppleSPMIPMU|ApplePMU|PMUFirmware)\w*-[\w.~+-]+`)},
+	{"AOP", regexp.MustCompile(`AppleAlwaysOnProcessor\w*-[\w.~+-]+`)},
+	{"DCP", regexp.MustCompile(`(?:AppleDCP|DCPFirmware)\w*-[\w.~+-]+`)},
+	{"SIO", regexp.MustCompile(`AppleSmartIO\w*-[\w.~+-]+`)},
+	{"GFX", regexp.MustCompile(`(?:AppleAGX|AGXFirmware)\w*-[\w.~+-]+`)},
+	{"RTKit", regexp.MustCompile(`RTKit\w*-[\w.~+-]+`)}, // any other RTKit based firmware
+}
+
+// identify returns the type and file name of an embedded firmware
+func identify(data []byte, index int) (string, string) {
+	for _, sig := range signatures {
+		if match := sig.Pattern.Find(data); match != nil {
+			name := strings.TrimRight(string(match), ".-")
+			if sig.Type == "RTKit" {
+				name = fmt.Sprintf("firmware%d_%s", index, name)
+			}
+			return sig.Type, name + ".bin"
+		}
+	}
+	return "unknown", fmt.Sprintf("firmware%d.bin", index)
+}
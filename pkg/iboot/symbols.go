@@ -0,0 +1,287 @@
+package iboot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/blacktop/arm64-cgo/disassemble"
+)
+
+// Function sources
+const (
+	SourcePanic  = "panic"  // the name was passed to panic (e.g. panic(__func__, "fmt", ...))
+	SourceLog    = "log"    // the name was passed to a log function (e.g. dprintf(level, "%s: ...", __func__))
+	SourceCaller = "caller" // the function was named after the way it is called (e.g. panic)
+)
+
+// Symbol file formats for WriteSymbols
+const (
+	FormatJSON   = "json"
+	FormatIDA    = "ida"    // IDAPython script
+	FormatGhidra = "ghidra" // ImportSymbolsScript.py input (name address type)
+)
+
+// minPanicCalls is the number of panic style calls needed to name their target panic
+const minPanicCalls = 3
+
+var identifierRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{2,63}$`)
+
+// Function is a function whose name was recovered from its panic or log strings
+type Function struct {
+	Address uint64 `json:"address"`
+	Name    string `json:"name"`
+	Source  string `json:"source"`
+}
+
+func isFormat(s string) bool {
+	return strings.Contains(s, "%")
+}
+
+// nameVotes counts the names referenced by a function's call sites
+type nameVotes struct {
+	counts map[string]int
+	source map[string]string
+}
+
+func (v *nameVotes) add(name, source string) {
+	if v.counts == nil {
+		v.counts = make(map[string]int)
+		v.source = make(map[string]string)
+	}
+	v.counts[name]++
+	if _, ok := v.source[name]; !ok || source == SourcePanic {
+		v.source[name] = source
+	}
+}
+
+func (v *nameVotes) best() (string, string) {
+	var name string
+	for n, count := range v.counts {
+		if count > v.counts[name] || (count == v.counts[name] && n < name) {
+			name = n
+		}
+	}
+	return name, v.source[name]
+}
+
+func xreg(r disassemble.Register) (int, bool) {
+	if r >= disassemble.REG_X0 && r <= disassemble.REG_X30 {
+		return int(r - disassemble.REG_X0), true
+	}
+	return 0, false
+}
+
+func isTerminator(inst *disassemble.Instruction) bool {
+	switch inst.Operation {
+	case disassemble.ARM64_RET, disassemble.ARM64_RETAA, disassemble.ARM64_RETAB,
+		disassemble.ARM64_B, disassemble.ARM64_BR, disassemble.ARM64_BRK, disassemble.ARM64_UDF:
+		return true
+	}
+	return false
+}
+
+// isPrologue returns true for the instructions functions start with (pacibsp or a pre-indexed push onto the stack)
+func isPrologue(inst *disassemble.Instruction) bool {
+	switch inst.Operation {
+	case disassemble.ARM64_PACIBSP:
+		return true
+	case disassemble.ARM64_STP:
+		if len(inst.Operands) == 3 && inst.Operands[2].Class == disassemble.MEM_PRE_IDX &&
+			len(inst.Operands[2].Registers) > 0 && inst.Operands[2].Registers[0] == disassemble.REG_SP {
+			return true
+		}
+	}
+	return false
+}
+
+// blTargets returns the addresses called by the image's BL instructions
+func (i *IBoot) blTargets() map[uint64]bool {
+	targets := make(map[uint64]bool)
+	for off := 0; off+4 <= len(i.data); off += 4 {
+		insn := binary.LittleEndian.Uint32(i.data[off:])
+		if insn&0xfc000000 != 0x94000000 { // BL
+			continue
+		}
+		target := int64(i.Base) + int64(off) + int64(int32(insn<<6)>>4) // imm26 * 4
+		if target >= int64(i.Base) && target < int64(i.Base)+int64(len(i.data)) {
+			targets[uint64(target)] = true
+		}
+	}
+	return targets
+}
+
+// Symbolicate recovers function names from the panic and log strings referenced by the (arm64) code.
+//
+// iBoot passes __func__ to panic and to most of its log messages, so the function containing such a call site
+// is named after the identifier string passed along with the format string.
+// The function called the most with (__func__, format) is named panic.
+func (i *IBoot) Symbolicate() ([]Function, error) {
+	if !i.is64() {
+		return nil, fmt.Errorf("symbolication is only supported for arm64 iBoot images (image is %s)", i.Arch)
+	}
+	if i.Base == 0 {
+		return nil, fmt.Errorf("failed to determine the base address of the image")
+	}
+
+	var results [1024]byte
+	var regs [31]uint64
+	var prev *disassemble.Instruction
+
+	votes := make(map[uint64]*nameVotes)
+	panicCalls := make(map[uint64]int)
+	funcStart := i.Base
+	calls := i.blTargets()
+
+	for off := 0; off+4 <= len(i.data); off += 4 {
+		addr := i.Base + uint64(off)
+		inst, err := disassemble.Decompose(addr, binary.LittleEndian.Uint32(i.data[off:]), &results)
+		if err != nil {
+			regs = [31]uint64{}
+			prev = nil
+			continue
+		}
+
+		// functions start at a call target or a prologue (code following a branch may just be another block of the function)
+		if calls[addr] || (isPrologue(inst) && (prev == nil || !isPrologue(prev))) {
+			funcStart = addr
+		}
+
+		switch inst.Operation {
+		case disassemble.ARM64_ADRP, disassemble.ARM64_ADR:
+			if len(inst.Operands) == 2 && len(inst.Operands[0].Registers) > 0 {
+				if rd, ok := xreg(inst.Operands[0].Registers[0]); ok {
+					regs[rd] = inst.Operands[1].Immediate
+				}
+			}
+		case disassemble.ARM64_ADD:
+			if len(inst.Operands) == 3 && len(inst.Operands[1].Registers) > 0 && len(inst.Operands[2].Registers) == 0 {
+				rd, okd := xreg(inst.Operands[0].Registers[0])
+				rn, okn := xreg(inst.Operands[1].Registers[0])
+				if okd && okn && regs[rn] != 0 {
+					regs[rd] = regs[rn] + inst.Operands[2].GetImmediate() // e.g. add x0, x0, #0x1, lsl #12
+				} else if okd {
+					regs[rd] = 0
+				}
+			}
+		case disassemble.ARM64_MOV:
+			if len(inst.Operands) == 2 && len(inst.Operands[0].Registers) > 0 && len(inst.Operands[1].Registers) > 0 {
+				rd, okd := xreg(inst.Operands[0].Registers[0])
+				rn, okn := xreg(inst.Operands[1].Registers[0])
+				if okd && okn {
+					regs[rd] = regs[rn]
+				} else if okd {
+					regs[rd] = 0
+				}
+			}
+		case disassemble.ARM64_BL:
+			var args [4]string
+			for idx := range args {
+				args[idx] = i.stringAt(regs[idx])
+			}
+			if name, source := callSiteName(args); len(name) > 0 {
+				if votes[funcStart] == nil {
+					votes[funcStart] = &nameVotes{}
+				}
+				votes[funcStart].add(name, source)
+				if source == SourcePanic && len(inst.Operands) > 0 {
+					panicCalls[inst.Operands[0].Immediate]++
+				}
+			}
+			regs = [31]uint64{}
+		default:
+			if isTerminator(inst) || inst.Operation == disassemble.ARM64_BLR {
+				regs = [31]uint64{}
+			} else if len(inst.Operands) > 0 && len(inst.Operands[0].Registers) > 0 &&
+				inst.Operands[0].Class == disassemble.REG {
+				// most instructions write their first operand
+				if rd, ok := xreg(inst.Operands[0].Registers[0]); ok {
+					regs[rd] = 0
+				}
+			}
+		}
+
+		prev = inst
+	}
+
+	var funcs []Function
+	for addr, v := range votes {
+		name, source := v.best()
+		funcs = append(funcs, Function{Address: addr, Name: name, Source: source})
+	}
+
+	var panicAddr uint64
+	for target, count := range panicCalls {
+		if count >= minPanicCalls && (panicAddr == 0 || count > panicCalls[panicAddr]) {
+			panicAddr = target
+		}
+	}
+	if panicAddr != 0 {
+		if v, ok := votes[panicAddr]; !ok || len(v.counts) == 0 {
+			funcs = append(funcs, Function{Address: panicAddr, Name: "panic", Source: SourceCaller})
+		}
+	}
+
+	sort.Slice(funcs, func(a, b int) bool { return funcs[a].Address < funcs[b].Address })
+
+	// names must be unique in a disassembler
+	used := make(map[string]int)
+	for idx, f := range funcs {
+		if n := used[f.Name]; n > 0 {
+			funcs[idx].Name = fmt.Sprintf("%s_%d", f.Name, n)
+		}
+		used[f.Name]++
+	}
+
+	i.Functions = funcs
+
+	return funcs, nil
+}
+
+// callSiteName returns the function name passed to a call (along with a format string) and the kind of call
+func callSiteName(args [4]string) (string, string) {
+	// panic(__func__, "fmt", ...)
+	if identifierRE.MatchString(args[0]) && isFormat(args[1]) {
+		return args[0], SourcePanic
+	}
+	// printf("%s: ...", __func__, ...) or dprintf(level, "%s: ...", __func__, ...)
+	for idx := 0; idx < len(args)-1; idx++ {
+		if strings.HasPrefix(args[idx], "%s") && identifierRE.MatchString(args[idx+1]) {
+			return args[idx+1], SourceLog
+		}
+	}
+	return "", ""
+}
+
+// WriteSymbols writes the recovered function names in a format a disassembler can import
+func (i *IBoot) WriteSymbols(w io.Writer, format string) error {
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(i.Functions)
+	case FormatIDA:
+		if _, err := fmt.Fprintf(w, "# %s %s (%s) base: %#x\nimport idc\n\n", i.Variant, i.Version, i.Platform, i.Base); err != nil {
+			return err
+		}
+		for _, f := range i.Functions {
+			if _, err := fmt.Fprintf(w, "idc.create_insn(%#x)\nidc.add_func(%#x)\nidc.set_name(%#x, %q, idc.SN_NOWARN)\n",
+				f.Address, f.Address, f.Address, f.Name); err != nil {
+				return err
+			}
+		}
+	case FormatGhidra:
+		for _, f := range i.Functions {
+			if _, err := fmt.Fprintf(w, "%s %#x f\n", f.Name, f.Address); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid symbols format %s (must be one of: %s, %s or %s)", format, FormatJSON, FormatIDA, FormatGhidra)
+	}
+	return nil
+}
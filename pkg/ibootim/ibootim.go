@@ -0,0 +1,174 @@
+// Package ibootim decodes and encodes iBootIm images (the boot logo, battery and recovery mode images)
+package ibootim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/blacktop/ipsw/pkg/kernelcache"
+	"github.com/blacktop/lzss"
+	"github.com/pkg/errors"
+)
+
+// Magic is the iBootIm magic
+const Magic = "iBootIm"
+
+// Pixel formats
+const (
+	FormatARGB = "argb" // 32-bit ARGB (stored as little-endian words, i.e. BGRA bytes)
+	FormatGrey = "grey" // 8-bit grey and 8-bit alpha
+)
+
+const compressionLZSS = "lzss"
+
+// header is the iBootIm header (the fourccs are stored little-endian, e.g. "sszl")
+type header struct {
+	Magic       [8]byte
+	Checksum    uint32 // adler32 of the compressed pixels
+	Compression [4]byte
+	Format      [4]byte
+	Width       uint16
+	Height      uint16
+	Padding     [0x28]byte
+}
+
+// Image is a decoded iBootIm
+type Image struct {
+	Format string
+	Width  int
+	Height int
+
+	pixels []byte
+}
+
+func (i *Image) String() string {
+	return fmt.Sprintf("iBootIm %dx%d %s", i.Width, i.Height, i.Format)
+}
+
+// fourCC reverses a little-endian fourcc
+func fourCC(b [4]byte) string {
+	return string([]byte{b[3], b[2], b[1], b[0]})
+}
+
+func toFourCC(s string) [4]byte {
+	return [4]byte{s[3], s[2], s[1], s[0]}
+}
+
+func bytesPerPixel(format string) (int, error) {
+	switch format {
+	case FormatARGB:
+		return 4, nil
+	case FormatGrey:
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unsupported iBootIm format %s (must be %s or %s)", format, FormatARGB, FormatGrey)
+}
+
+// IsIBootIm returns true if data is an iBootIm
+func IsIBootIm(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic+"\x00"))
+}
+
+// Parse decodes an iBootIm
+func Parse(data []byte) (*Image, error) {
+	if !IsIBootIm(data) {
+		return nil, fmt.Errorf("invalid iBootIm magic")
+	}
+
+	var hdr header
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "failed to read iBootIm header")
+	}
+	if comp := fourCC(hdr.Compression); comp != compressionLZSS {
+		return nil, fmt.Errorf("unsupported iBootIm compression %s", comp)
+	}
+
+	img := &Image{
+		Format: fourCC(hdr.Format),
+		Width:  int(hdr.Width),
+		Height: int(hdr.Height),
+	}
+	bpp, err := bytesPerPixel(img.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	img.pixels = lzss.Decompress(data[binary.Size(hdr):])
+	if size := img.Width * img.Height * bpp; len(img.pixels) < size {
+		return nil, fmt.Errorf("iBootIm pixels are truncated (%#x bytes, expected %#x)", len(img.pixels), size)
+	}
+
+	return img, nil
+}
+
+// Image returns the decoded image
+func (i *Image) Image() image.Image {
+	out := image.NewNRGBA(image.Rect(0, 0, i.Width, i.Height))
+	for y := 0; y < i.Height; y++ {
+		for x := 0; x < i.Width; x++ {
+			idx := y*i.Width + x
+			var c color.NRGBA
+			switch i.Format {
+			case FormatARGB:
+				p := i.pixels[idx*4:]
+				c = color.NRGBA{R: p[2], G: p[1], B: p[0], A: p[3]}
+			case FormatGrey:
+				p := i.pixels[idx*2:]
+				c = color.NRGBA{R: p[0], G: p[0], B: p[0], A: p[1]}
+			}
+			out.SetNRGBA(x, y, c)
+		}
+	}
+	return out
+}
+
+// Create encodes an image as an iBootIm
+func Create(img image.Image, format string) ([]byte, error) {
+	bpp, err := bytesPerPixel(format)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() > math.MaxUint16 || bounds.Dy() > math.MaxUint16 {
+		return nil, fmt.Errorf("image is too large (%dx%d)", bounds.Dx(), bounds.Dy())
+	}
+
+	pixels := make([]byte, 0, bounds.Dx()*bounds.Dy()*bpp)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			switch format {
+			case FormatARGB:
+				pixels = append(pixels, c.B, c.G, c.R, c.A)
+			case FormatGrey:
+				grey := color.GrayModel.Convert(color.NRGBA{R: c.R, G: c.G, B: c.B, A: 0xff}).(color.Gray)
+				pixels = append(pixels, grey.Y, c.A)
+			}
+		}
+	}
+
+	comp := kernelcache.CompressLZSS(pixels)
+
+	hdr := header{
+		Checksum:    adler32.Checksum(comp),
+		Compression: toFourCC(compressionLZSS),
+		Format:      toFourCC(format),
+		Width:       uint16(bounds.Dx()),
+		Height:      uint16(bounds.Dy()),
+	}
+	copy(hdr.Magic[:], Magic)
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, hdr); err != nil {
+		return nil, errors.Wrap(err, "failed to write iBootIm header")
+	}
+	buf.Write(comp)
+
+	return buf.Bytes(), nil
+}
@@ -1,12 +1,28 @@
 package img3
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 
-	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/lzss"
 )
 
+const (
+	// Magic is the on-disk (little-endian) Img3 magic
+	Magic = "3gmI"
+
+	headerSize    = 20
+	tagHeaderSize = 12
+)
+
+// ErrEncrypted is returned when an encrypted payload is accessed without a key
+var ErrEncrypted = errors.New("img3 payload is encrypted")
+
 // Img3 object
 type Img3 struct {
 	Header
@@ -60,6 +76,291 @@ RAND:
 SALT:
 */
 
+// KeyBag types
+const (
+	KeyBagProduction  = 1 // encrypted with the production GID key
+	KeyBagDevelopment = 2 // encrypted with the development GID key
+)
+
+// KeyBag is a KBAG tag (the DATA IV and key encrypted with the GID key)
+type KeyBag struct {
+	Type    uint32
+	AESType uint32 // key size in bits (0x80, 0xc0 or 0x100)
+	IV      []byte
+	Key     []byte
+}
+
+// Value returns the encrypted IV followed by the encrypted key (the KBAG value keys are looked up by)
+func (k KeyBag) Value() []byte {
+	return append(append([]byte{}, k.IV...), k.Key...)
+}
+
+func (k KeyBag) String() string {
+	typ := "unknown"
+	switch k.Type {
+	case KeyBagProduction:
+		typ = "PRODUCTION"
+	case KeyBagDevelopment:
+		typ = "DEVELOPMENT"
+	}
+	return fmt.Sprintf("%s: AES-%d iv=%x key=%x", typ, k.AESType, k.IV, k.Key)
+}
+
+func reverse(b []byte) string {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return string(out)
+}
+
+func tagUint(data []byte) uint64 {
+	switch {
+	case len(data) >= 8:
+		return binary.LittleEndian.Uint64(data)
+	case len(data) >= 4:
+		return uint64(binary.LittleEndian.Uint32(data))
+	}
+	return 0
+}
+
+func tagMagic(name string) [4]byte {
+	var magic [4]byte
+	copy(magic[:], reverse([]byte(name)))
+	return magic
+}
+
+// Name returns the tag's name (e.g. DATA)
+func (t Tag) Name() string {
+	return reverse(t.Magic[:])
+}
+
+// IsImg3 returns true if the data starts with the Img3 magic
+func IsImg3(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// Parse parses an Img3
+func Parse(data []byte) (*Img3, error) {
+	var i Img3
+
+	r := bytes.NewReader(data)
+
+	if err := binary.Read(r, binary.LittleEndian, &i.Header); err != nil {
+		return nil, fmt.Errorf("failed to read img3 header: %v", err)
+	}
+	if string(i.Magic[:]) != Magic {
+		return nil, fmt.Errorf("invalid img3 magic %q", i.Magic[:])
+	}
+
+	for {
+		var tag Tag
+
+		err := binary.Read(r, binary.LittleEndian, &tag.TagHeader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read img3 tag header: %v", err)
+		}
+		// compare as uint64 so crafted lengths can't wrap around
+		if uint64(tag.TotalLength) < tagHeaderSize+uint64(tag.DataLength) ||
+			uint64(tag.DataLength) > uint64(r.Len()) || uint64(tag.TotalLength)-tagHeaderSize > uint64(r.Len()) {
+			return nil, fmt.Errorf("invalid img3 %s tag length %d (data length %d)", tag.Name(), tag.TotalLength, tag.DataLength)
+		}
+
+		tag.Data = make([]byte, tag.DataLength)
+		tag.Pad = make([]byte, tag.TotalLength-tag.DataLength-tagHeaderSize)
+
+		if _, err := io.ReadFull(r, tag.Data); err != nil {
+			return nil, fmt.Errorf("failed to read img3 tag data: %v", err)
+		}
+		if _, err := io.ReadFull(r, tag.Pad); err != nil {
+			return nil, fmt.Errorf("failed to read img3 tag pad: %v", err)
+		}
+
+		i.Tags = append(i.Tags, tag)
+	}
+
+	return &i, nil
+}
+
+// Ident returns the image identifier (e.g. krnl)
+func (i *Img3) Ident() string {
+	return reverse(i.Header.Ident[:])
+}
+
+// Tag returns the first tag with the given name
+func (i *Img3) Tag(name string) *Tag {
+	for idx := range i.Tags {
+		if i.Tags[idx].Name() == name {
+			return &i.Tags[idx]
+		}
+	}
+	return nil
+}
+
+// SetTag sets the data of the first tag with the given name (or appends a new tag)
+func (i *Img3) SetTag(name string, data []byte) {
+	if tag := i.Tag(name); tag != nil {
+		tag.Data = data
+		tag.Pad = nil
+		return
+	}
+	i.Tags = append(i.Tags, Tag{TagHeader: TagHeader{Magic: tagMagic(name)}, Data: data})
+}
+
+// RemoveTag removes all the tags with the given name
+func (i *Img3) RemoveTag(name string) {
+	tags := i.Tags[:0]
+	for _, tag := range i.Tags {
+		if tag.Name() != name {
+			tags = append(tags, tag)
+		}
+	}
+	i.Tags = tags
+}
+
+// Data returns the DATA tag's data
+func (i *Img3) Data() []byte {
+	if tag := i.Tag("DATA"); tag != nil {
+		return tag.Data
+	}
+	return nil
+}
+
+// Encrypted returns true if the DATA is encrypted (the image has a KBAG)
+func (i *Img3) Encrypted() bool {
+	return i.Tag("KBAG") != nil
+}
+
+// KeyBags returns the image's parsed KBAG tags
+func (i *Img3) KeyBags() ([]KeyBag, error) {
+	var kbags []KeyBag
+	for _, tag := range i.Tags {
+		if tag.Name() != "KBAG" {
+			continue
+		}
+		if len(tag.Data) < 8+aes.BlockSize {
+			return nil, fmt.Errorf("img3 KBAG too short")
+		}
+		kbag := KeyBag{
+			Type:    binary.LittleEndian.Uint32(tag.Data[0:]),
+			AESType: binary.LittleEndian.Uint32(tag.Data[4:]),
+		}
+		keySize := int(kbag.AESType / 8)
+		if len(tag.Data) < 8+aes.BlockSize+keySize {
+			return nil, fmt.Errorf("img3 KBAG too short for AES-%d key", kbag.AESType)
+		}
+		kbag.IV = tag.Data[8 : 8+aes.BlockSize]
+		kbag.Key = tag.Data[8+aes.BlockSize : 8+aes.BlockSize+keySize]
+		kbags = append(kbags, kbag)
+	}
+	return kbags, nil
+}
+
+// Decrypt AES-CBC decrypts the DATA with its (GID decrypted) IV and key.
+// Only the whole blocks are encrypted, a trailing partial block is left as is.
+func (i *Img3) Decrypt(iv, key []byte) ([]byte, error) {
+	data := i.Data()
+	if data == nil {
+		return nil, fmt.Errorf("img3 has no DATA tag")
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV size %d (expected %d)", len(iv), aes.BlockSize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new AES cipher: %v", err)
+	}
+
+	dec := make([]byte, len(data))
+	copy(dec, data)
+	n := len(dec) - len(dec)%aes.BlockSize
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(dec[:n], dec[:n])
+
+	return dec, nil
+}
+
+// Payload returns the DATA decrypted (when a key is given) and decompressed (when it is a complzss kernelcache)
+func (i *Img3) Payload(iv, key []byte) ([]byte, error) {
+	var data []byte
+	if len(key) > 0 {
+		var err error
+		if data, err = i.Decrypt(iv, key); err != nil {
+			return nil, err
+		}
+	} else {
+		if i.Encrypted() {
+			return nil, ErrEncrypted
+		}
+		data = i.Data()
+	}
+
+	if bytes.HasPrefix(data, []byte("complzss")) {
+		return DecompressLZSS(data)
+	}
+
+	return data, nil
+}
+
+// DecompressLZSS decompresses a complzss compressed payload
+func DecompressLZSS(data []byte) ([]byte, error) {
+	var hdr lzss.Header
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to read complzss header: %v", err)
+	}
+	hdrSize := binary.Size(hdr)
+	if int(hdr.CompressedSize) > len(data)-hdrSize {
+		return nil, fmt.Errorf("complzss compressed size %d is greater than the data size %d", hdr.CompressedSize, len(data)-hdrSize)
+	}
+	dec := lzss.Decompress(data[hdrSize : hdrSize+int(hdr.CompressedSize)])
+	if len(dec) > int(hdr.UncompressedSize) {
+		dec = dec[:hdr.UncompressedSize]
+	}
+	return dec, nil
+}
+
+// Marshal re-encodes the Img3 (recomputing the tag and header sizes)
+func (i *Img3) Marshal() ([]byte, error) {
+	var tags bytes.Buffer
+
+	sigCheckArea := -1
+	for idx := range i.Tags {
+		tag := &i.Tags[idx]
+		if tag.Name() == "SHSH" && sigCheckArea < 0 {
+			sigCheckArea = tags.Len()
+		}
+		if pad := (4 - len(tag.Data)%4) % 4; len(tag.Pad) < pad {
+			tag.Pad = make([]byte, pad)
+		}
+		tag.DataLength = uint32(len(tag.Data))
+		tag.TotalLength = uint32(tagHeaderSize + len(tag.Data) + len(tag.Pad))
+		if err := binary.Write(&tags, binary.LittleEndian, tag.TagHeader); err != nil {
+			return nil, fmt.Errorf("failed to write img3 tag header: %v", err)
+		}
+		tags.Write(tag.Data)
+		tags.Write(tag.Pad)
+	}
+	if sigCheckArea < 0 {
+		sigCheckArea = tags.Len()
+	}
+
+	copy(i.Magic[:], Magic)
+	i.FullSize = uint32(headerSize + tags.Len())
+	i.SizeNoPack = uint32(tags.Len())
+	i.SigCheckArea = uint32(sigCheckArea)
+
+	var out bytes.Buffer
+	if err := binary.Write(&out, binary.LittleEndian, i.Header); err != nil {
+		return nil, fmt.Errorf("failed to write img3 header: %v", err)
+	}
+	out.Write(tags.Bytes())
+
+	return out.Bytes(), nil
+}
+
 func (i Img3) String() string {
 	iStr := fmt.Sprintf(
 		"[Img3 Info]\n"+
@@ -68,24 +369,38 @@ func (i Img3) String() string {
 			"Identifier   = %s\n\n"+
 			"TAGS\n"+
 			"----\n",
-		utils.ReverseBytes(i.Magic[:]),
-		utils.ReverseBytes(i.Ident[:]),
+		reverse(i.Magic[:]),
+		i.Ident(),
 	)
 	for _, tag := range i.Tags {
-		magic := string(utils.ReverseBytes(tag.Magic[:]))
+		magic := tag.Name()
 		switch magic {
 		case "TYPE":
-			iStr += fmt.Sprintf("%s: %s\n", magic, utils.ReverseBytes(tag.Data[:]))
+			iStr += fmt.Sprintf("%s: %s\n", magic, reverse(tag.Data))
 		case "DATA":
-			iStr += fmt.Sprintf("%s: %v (length: %d)\n", magic, tag.Data[0:15], len(tag.Data))
+			n := len(tag.Data)
+			if n > 16 {
+				n = 16
+			}
+			iStr += fmt.Sprintf("%s: %v (length: %d)\n", magic, tag.Data[:n], len(tag.Data))
 		case "VERS":
-			iStr += fmt.Sprintf("%s: %s\n", magic, tag.Data)
-		case "SEPO":
-			iStr += fmt.Sprintf("%s: %d\n", magic, binary.LittleEndian.Uint32(tag.Data))
-		case "CHIP":
-			iStr += fmt.Sprintf("%s: 0x%x\n", magic, binary.LittleEndian.Uint32(tag.Data))
-		case "BORD":
-			iStr += fmt.Sprintf("%s: 0x%x\n", magic, binary.LittleEndian.Uint32(tag.Data))
+			if len(tag.Data) > 4 {
+				iStr += fmt.Sprintf("%s: %s\n", magic, bytes.TrimRight(tag.Data[4:], "\x00"))
+			} else {
+				iStr += fmt.Sprintf("%s: %s\n", magic, tag.Data)
+			}
+		case "SEPO", "SDOM", "PROD", "CEPO":
+			iStr += fmt.Sprintf("%s: %d\n", magic, tagUint(tag.Data))
+		case "CHIP", "BORD", "ECID":
+			iStr += fmt.Sprintf("%s: 0x%x\n", magic, tagUint(tag.Data))
+		case "KBAG":
+			if kbags, err := (&Img3{Tags: []Tag{tag}}).KeyBags(); err == nil && len(kbags) == 1 {
+				iStr += fmt.Sprintf("%s: %s\n", magic, kbags[0])
+			} else {
+				iStr += fmt.Sprintf("%s: %x\n", magic, tag.Data)
+			}
+		case "SHSH", "CERT":
+			iStr += fmt.Sprintf("%s: (length: %d)\n", magic, len(tag.Data))
 		default:
 			iStr += fmt.Sprintf("%s: %v\n", magic, tag.Data)
 		}
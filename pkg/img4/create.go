@@ -0,0 +1,111 @@
+package img4
+
+import (
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+)
+
+type im4pCreate struct {
+	Name        string `asn1:"ia5"` // IM4P
+	Type        string `asn1:"ia5"`
+	Description string `asn1:"ia5"`
+	Data        []byte
+	Kbag        []byte `asn1:"optional"`
+}
+
+type dataPropCreate struct {
+	Name string `asn1:"ia5"`
+	Data []byte
+}
+
+type img4RestoreInfoCreate struct {
+	Name      string `asn1:"ia5"` // IM4R
+	Generator asn1.RawValue
+}
+
+type img4Create struct {
+	Name        string `asn1:"ia5"` // IMG4
+	IM4P        asn1.RawValue
+	Manifest    asn1.RawValue `asn1:"optional"`
+	RestoreInfo asn1.RawValue `asn1:"optional"`
+}
+
+// CreateIm4p returns an ASN.1 encoded IM4P with the given type (e.g. krnl), description and payload.
+// The payload should already be compressed (and encrypted if kbag is given).
+func CreateIm4p(typ, description string, data, kbag []byte) ([]byte, error) {
+	if len(typ) != 4 {
+		return nil, errors.Errorf("im4p type must be 4 characters: %s", typ)
+	}
+
+	dat, err := asn1.Marshal(im4pCreate{
+		Name:        "IM4P",
+		Type:        typ,
+		Description: description,
+		Data:        data,
+		Kbag:        kbag,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 marshal Im4p")
+	}
+
+	return dat, nil
+}
+
+// CreateIm4r returns an ASN.1 encoded IM4R with a BNCN (the boot nonce generator)
+func CreateIm4r(bootNonce []byte) ([]byte, error) {
+	bncn, err := asn1.MarshalWithParams([]dataPropCreate{{Name: "BNCN", Data: bootNonce}}, typeBNCN)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 marshal BNCN")
+	}
+
+	dat, err := asn1.Marshal(img4RestoreInfoCreate{
+		Name: "IM4R",
+		Generator: asn1.RawValue{
+			Class:      asn1.ClassUniversal,
+			Tag:        asn1.TagSet,
+			IsCompound: true,
+			Bytes:      bncn,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 marshal Im4r")
+	}
+
+	return dat, nil
+}
+
+// CreateImg4 returns an ASN.1 encoded IMG4 with the given IM4P, IM4M (e.g. the ApImg4Ticket of a SHSH blob)
+// and IM4R (see CreateIm4r); the IM4M and IM4R are optional
+func CreateImg4(payload, manifest, restoreInfo []byte) ([]byte, error) {
+	var i im4p
+	if _, err := asn1.Unmarshal(payload, &i); err != nil || i.Name != "IM4P" {
+		return nil, errors.New("invalid Im4p")
+	}
+
+	img := img4Create{
+		Name: "IMG4",
+		IM4P: asn1.RawValue{FullBytes: payload},
+	}
+	if len(manifest) > 0 {
+		var m img4Manifest
+		if _, err := asn1.Unmarshal(manifest, &m); err != nil || m.Name != "IM4M" {
+			return nil, errors.New("invalid Im4m")
+		}
+		img.Manifest = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: manifest}
+	}
+	if len(restoreInfo) > 0 {
+		var r img4RestoreInfo
+		if _, err := asn1.Unmarshal(restoreInfo, &r); err != nil || r.Name != "IM4R" {
+			return nil, errors.New("invalid Im4r")
+		}
+		img.RestoreInfo = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: restoreInfo}
+	}
+
+	dat, err := asn1.Marshal(img)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 marshal Img4")
+	}
+
+	return dat, nil
+}
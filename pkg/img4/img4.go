@@ -14,16 +14,10 @@ import (
 type Img4 struct {
 	Name        string
 	Description string
-	Manifest    manifest
+	Manifest    Manifest
 	RestoreInfo restoreInfo
 }
 
-type manifest struct {
-	Properties   ManifestProperties
-	ApImg4Ticket asn1.RawValue
-	img4Manifest
-}
-
 type restoreInfo struct {
 	Generator dataProp
 	img4RestoreInfo
@@ -33,8 +27,8 @@ type img4 struct {
 	Raw         asn1.RawContent
 	Name        string // IMG4
 	IM4P        im4p
-	Manifest    asn1.RawValue   `asn1:"explicit,tag:0"`
-	RestoreInfo img4RestoreInfo `asn1:"explicit,tag:1"`
+	Manifest    asn1.RawValue   `asn1:"explicit,tag:0,optional"`
+	RestoreInfo img4RestoreInfo `asn1:"explicit,tag:1,optional"`
 }
 
 type im4p struct {
@@ -55,11 +49,12 @@ type img4RestoreInfo struct {
 }
 
 type img4Manifest struct {
-	Raw     asn1.RawContent
-	Name    string // IM4M
-	Version int
-	Body    asn1.RawValue
-	Data    []byte
+	Raw          asn1.RawContent
+	Name         string // IM4M
+	Version      int
+	Body         asn1.RawValue
+	Data         []byte        // signature
+	Certificates asn1.RawValue `asn1:"optional"`
 }
 
 const typeMANB = "private,tag:1296125506"
@@ -167,90 +162,6 @@ func parseDataProp(data []byte, pType string) (*dataProp, []byte, error) {
 	return &d[0], rest, nil
 }
 
-func parseIDProp(data []byte, pType string) (*idProp, []byte, error) {
-	var i []idProp
-	rest, err := asn1.UnmarshalWithParams(data, &i, pType)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to ASN.1 parse id property")
-	}
-	return &i[0], rest, nil
-}
-
-func parseBoolProp(data []byte, pType string) (*boolProp, []byte, error) {
-	var b []boolProp
-	rest, err := asn1.UnmarshalWithParams(data, &b, pType)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to ASN.1 parse bool property")
-	}
-	return &b[0], rest, nil
-}
-
-func parseManifestProperties(data []byte) (*ManifestProperties, error) {
-	mProps := make(ManifestProperties)
-	// parse BNCH
-	dProp, rest, err := parseDataProp(data, typeBNCH)
-	if err != nil {
-		return nil, err
-	}
-	mProps[dProp.Name] = dProp.Data
-	// parse BORD
-	iProp, rest, err := parseIDProp(rest, typeBORD)
-	if err != nil {
-		return nil, err
-	}
-	mProps[iProp.Name] = iProp.ID
-	// parse CEPO
-	iProp, rest, err = parseIDProp(rest, typeCEPO)
-	if err != nil {
-		return nil, err
-	}
-	mProps[iProp.Name] = iProp.ID
-	// parse CHIP
-	iProp, rest, err = parseIDProp(rest, typeCHIP)
-	if err != nil {
-		return nil, err
-	}
-	mProps[iProp.Name] = iProp.ID
-	// parse CPRO
-	bProp, rest, err := parseBoolProp(rest, typeCPRO)
-	if err != nil {
-		return nil, err
-	}
-	mProps[bProp.Name] = bProp.Bool
-	// parse CSEC
-	bProp, rest, err = parseBoolProp(rest, typeCSEC)
-	if err != nil {
-		return nil, err
-	}
-	mProps[bProp.Name] = bProp.Bool
-	// parse ECID
-	iProp, rest, err = parseIDProp(rest, typeECID)
-	if err != nil {
-		return nil, err
-	}
-	mProps[iProp.Name] = iProp.ID
-	// parse SDOM
-	iProp, rest, err = parseIDProp(rest, typeSDOM)
-	if err != nil {
-		return nil, err
-	}
-	mProps[iProp.Name] = iProp.ID
-	// parse snon
-	dProp, rest, err = parseDataProp(rest, typeSnon)
-	if err != nil {
-		return nil, err
-	}
-	mProps[dProp.Name] = dProp.Data
-	// parse srvn
-	dProp, rest, err = parseDataProp(rest, typeSrvn)
-	if err != nil {
-		return nil, err
-	}
-	mProps[dProp.Name] = dProp.Data
-
-	return &mProps, nil
-}
-
 // Parse parses a Img4
 func Parse(r io.Reader) (*Img4, error) {
 	utils.Indent(log.Info, 2)("Parsing IMG4")
@@ -265,42 +176,30 @@ func Parse(r io.Reader) (*Img4, error) {
 		return nil, errors.Wrap(err, "failed to ASN.1 parse Img4")
 	}
 
-	var m img4Manifest
-	_, err = asn1.Unmarshal(i.Manifest.Bytes, &m)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to ASN.1 parse Img4 manifest")
-	}
-
-	var mb []manifestBody
-	_, err = asn1.UnmarshalWithParams(m.Body.Bytes, &mb, typeMANB)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to ASN.1 parse Img4 manifest body")
+	if len(i.Manifest.Bytes) == 0 {
+		return nil, errors.New("Img4 has no manifest")
 	}
 
-	var mProps []manifestProperties
-	_, err = asn1.UnmarshalWithParams(mb[0].Properties.Bytes, &mProps, typeMANP)
+	m, err := ParseIm4m(i.Manifest.Bytes)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to ASN.1 parse Img4 manifest properties")
-	}
-
-	props, err := parseManifestProperties(mProps[0].Properties.Bytes)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to ASN.1 parse Img4 manifest property")
+		return nil, err
 	}
+	m.ApImg4Ticket = i.Manifest
 
-	gen, _, err := parseDataProp(i.RestoreInfo.Generator.Bytes, typeBNCN)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to ASN.1 parse Generator")
+	var gen *dataProp
+	if len(i.RestoreInfo.Generator.Bytes) > 0 {
+		gen, _, err = parseDataProp(i.RestoreInfo.Generator.Bytes, typeBNCN)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to ASN.1 parse Generator")
+		}
+	} else {
+		gen = &dataProp{}
 	}
 
 	return &Img4{
 		Name:        i.IM4P.Name,
 		Description: i.IM4P.Description,
-		Manifest: manifest{
-			Properties:   *props,
-			ApImg4Ticket: i.Manifest,
-			img4Manifest: m,
-		},
+		Manifest:    *m,
 		RestoreInfo: restoreInfo{
 			Generator:       *gen,
 			img4RestoreInfo: i.RestoreInfo,
@@ -323,3 +222,21 @@ func ParseIm4p(r io.Reader) (*im4p, error) {
 
 	return &i, nil
 }
+
+// UnmarshalIm4p parses an Im4p (or the Im4p of an Img4) without logging, for when many files are inspected
+func UnmarshalIm4p(data []byte) (*im4p, error) {
+	var i img4
+	if _, err := asn1.Unmarshal(data, &i); err == nil && i.Name == "IMG4" {
+		return &i.IM4P, nil
+	}
+
+	var p im4p
+	if _, err := asn1.Unmarshal(data, &p); err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 parse Im4p")
+	}
+	if p.Name != "IM4P" {
+		return nil, errors.Errorf("invalid Im4p name %s", p.Name)
+	}
+
+	return &p, nil
+}
@@ -0,0 +1,127 @@
+package img4
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// KeyBag types
+const (
+	KeyBagProduction  = 1
+	KeyBagDevelopment = 2
+)
+
+// KeyBag is an IM4P KBAG entry (the payload IV and key encrypted with the GID key)
+type KeyBag struct {
+	Type int
+	IV   []byte
+	Key  []byte
+}
+
+// Value returns the encrypted IV followed by the encrypted key (the KBAG value keys are looked up by)
+func (k KeyBag) Value() []byte {
+	return append(append([]byte{}, k.IV...), k.Key...)
+}
+
+func (k KeyBag) String() string {
+	typ := "unknown"
+	switch k.Type {
+	case KeyBagProduction:
+		typ = "PRODUCTION"
+	case KeyBagDevelopment:
+		typ = "DEVELOPMENT"
+	}
+	return fmt.Sprintf("%s: iv=%x key=%x", typ, k.IV, k.Key)
+}
+
+// ParseKeyBags parses the KBAG of an IM4P
+func ParseKeyBags(data []byte) ([]KeyBag, error) {
+	var kbags []KeyBag
+	if _, err := asn1.Unmarshal(data, &kbags); err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 parse Im4p KBAG")
+	}
+	return kbags, nil
+}
+
+// Encrypted returns true if the IM4P payload is encrypted (it has a KBAG)
+func (i *im4p) Encrypted() bool {
+	return len(i.Kbag) > 0
+}
+
+// KeyBags returns the IM4P's parsed KBAG entries
+func (i *im4p) KeyBags() ([]KeyBag, error) {
+	if !i.Encrypted() {
+		return nil, nil
+	}
+	return ParseKeyBags(i.Kbag)
+}
+
+// DecryptPayload AES-CBC decrypts an IM4P payload with its (GID decrypted) IV and key.
+// A trailing partial block is left as is.
+func DecryptPayload(data, iv, key []byte) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, errors.Errorf("invalid IV size %d (expected %d)", len(iv), aes.BlockSize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new AES cipher")
+	}
+
+	if len(data) < aes.BlockSize {
+		return nil, errors.Errorf("Im4p data too short")
+	}
+
+	dec := make([]byte, len(data))
+	copy(dec, data)
+	// CBC mode always works in whole blocks.
+	n := len(dec) - len(dec)%aes.BlockSize
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(dec[:n], dec[:n])
+
+	return dec, nil
+}
+
+// ComponentForType returns the BuildManifest component name of an IM4P type (e.g. ibot -> iBoot)
+func ComponentForType(typ string) string {
+	switch typ {
+	case "ibot":
+		return "iBoot"
+	case "ibec":
+		return "iBEC"
+	case "ibss":
+		return "iBSS"
+	case "illb":
+		return "LLB"
+	case "ibd1":
+		return "iBootData"
+	case "krnl":
+		return "KernelCache"
+	case "dtre":
+		return "DeviceTree"
+	case "rdsk":
+		return "RestoreRamDisk"
+	case "logo":
+		return "AppleLogo"
+	case "recm":
+		return "RecoveryMode"
+	case "glyP":
+		return "GlyphPlugin"
+	case "chg0":
+		return "BatteryCharging0"
+	case "chg1":
+		return "BatteryCharging1"
+	case "batF":
+		return "BatteryFull"
+	case "bat0":
+		return "BatteryLow0"
+	case "bat1":
+		return "BatteryLow1"
+	case "sepi":
+		return "SEP"
+	}
+	return typ
+}
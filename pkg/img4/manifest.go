@@ -0,0 +1,318 @@
+package img4
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Manifest is a decoded IM4M (the ApImg4Ticket of a SHSH blob)
+type Manifest struct {
+	Version      int                 `json:"version"`
+	Properties   ManifestProperties  `json:"properties"` // MANP
+	Images       []ManifestImage     `json:"images"`
+	Signature    []byte              `json:"signature"`
+	Certificates []*x509.Certificate `json:"-"`
+	ApImg4Ticket asn1.RawValue       `json:"-"`
+
+	raw img4Manifest
+}
+
+// ManifestImage is the MANB entry of an image (e.g. krnl, ibot, rdsk)
+type ManifestImage struct {
+	Name       string             `json:"name"`
+	Digest     []byte             `json:"digest,omitempty"` // DGST
+	EKEY       bool               `json:"ekey"`             // effective encryption (the image must be decrypted with the device's keys)
+	EPRO       bool               `json:"epro"`             // effective production status
+	ESEC       bool               `json:"esec"`             // effective security mode
+	Trusted    bool               `json:"trusted"`          // trst
+	Properties ManifestProperties `json:"properties"`
+}
+
+type manifestProperty struct {
+	Raw   asn1.RawContent
+	Name  string
+	Value asn1.RawValue
+}
+
+// ParseIm4m parses an ASN.1 encoded IM4M
+func ParseIm4m(data []byte) (*Manifest, error) {
+	var m img4Manifest
+	if _, err := asn1.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 parse Img4 manifest")
+	}
+	if m.Name != "IM4M" {
+		return nil, errors.Errorf("invalid Img4 manifest name %s (expected IM4M)", m.Name)
+	}
+
+	body, err := parseManifestProperties(m.Body.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 parse Img4 manifest body")
+	}
+	manb, ok := body["MANB"].(ManifestProperties)
+	if !ok {
+		return nil, errors.New("failed to find Img4 manifest body (MANB)")
+	}
+
+	manifest := &Manifest{
+		Version:   m.Version,
+		Signature: m.Data,
+		raw:       m,
+	}
+
+	for name, value := range manb {
+		props, ok := value.(ManifestProperties)
+		if !ok {
+			continue
+		}
+		if name == "MANP" {
+			manifest.Properties = props
+			continue
+		}
+		img := ManifestImage{Name: name, Properties: props}
+		img.Digest, _ = props["DGST"].([]byte)
+		img.EKEY, _ = props["EKEY"].(bool)
+		img.EPRO, _ = props["EPRO"].(bool)
+		img.ESEC, _ = props["ESEC"].(bool)
+		img.Trusted, _ = props["trst"].(bool)
+		manifest.Images = append(manifest.Images, img)
+	}
+	if manifest.Properties == nil {
+		return nil, errors.New("failed to find Img4 manifest properties (MANP)")
+	}
+	sort.Slice(manifest.Images, func(i, j int) bool {
+		return manifest.Images[i].Name < manifest.Images[j].Name
+	})
+
+	if len(m.Certificates.Bytes) > 0 {
+		manifest.Certificates, err = x509.ParseCertificates(m.Certificates.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse Img4 manifest certificate chain")
+		}
+	}
+
+	return manifest, nil
+}
+
+// ParseManifest parses an IM4M or the IM4M of an IMG4
+func ParseManifest(data []byte) (*Manifest, error) {
+	var i img4
+	if _, err := asn1.Unmarshal(data, &i); err == nil && i.Name == "IMG4" {
+		if len(i.Manifest.Bytes) == 0 {
+			return nil, errors.New("Img4 has no manifest")
+		}
+		m, err := ParseIm4m(i.Manifest.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		m.ApImg4Ticket = i.Manifest
+		return m, nil
+	}
+
+	return ParseIm4m(data)
+}
+
+// parseManifestProperties parses a SET of properties, each a [PRIVATE fourcc] SEQUENCE { IA5String name, value }
+func parseManifestProperties(data []byte) (ManifestProperties, error) {
+	props := make(ManifestProperties)
+
+	for rest := data; len(rest) > 0; {
+		var tagged asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &tagged)
+		if err != nil {
+			return nil, err
+		}
+		if tagged.Class != asn1.ClassPrivate {
+			return nil, fmt.Errorf("unexpected ASN.1 class %d (expected private)", tagged.Class)
+		}
+		var prop manifestProperty
+		if _, err := asn1.Unmarshal(tagged.Bytes, &prop); err != nil {
+			return nil, errors.Wrapf(err, "failed to ASN.1 parse property %s", fourCC(tagged.Tag))
+		}
+		value, err := manifestPropertyValue(prop.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to ASN.1 parse property %s value", prop.Name)
+		}
+		props[prop.Name] = value
+	}
+
+	return props, nil
+}
+
+func manifestPropertyValue(v asn1.RawValue) (interface{}, error) {
+	if v.Class != asn1.ClassUniversal {
+		return v.Bytes, nil
+	}
+
+	switch v.Tag {
+	case asn1.TagInteger:
+		var i *big.Int
+		if _, err := asn1.Unmarshal(v.FullBytes, &i); err != nil {
+			return nil, err
+		}
+		if i.IsInt64() {
+			return int(i.Int64()), nil
+		}
+		if i.IsUint64() {
+			return i.Uint64(), nil
+		}
+		return i, nil
+	case asn1.TagBoolean:
+		var b bool
+		if _, err := asn1.Unmarshal(v.FullBytes, &b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	case asn1.TagIA5String, asn1.TagUTF8String, asn1.TagPrintableString:
+		return string(v.Bytes), nil
+	case asn1.TagSet, asn1.TagSequence:
+		return parseManifestProperties(v.Bytes)
+	}
+
+	return v.Bytes, nil // OCTET STRING, etc.
+}
+
+func fourCC(tag int) string {
+	return string([]byte{byte(tag >> 24), byte(tag >> 16), byte(tag >> 8), byte(tag)})
+}
+
+// Image returns the manifest entry of the image with the given name (the IM4P type)
+func (m *Manifest) Image(name string) *ManifestImage {
+	for idx := range m.Images {
+		if m.Images[idx].Name == name {
+			return &m.Images[idx]
+		}
+	}
+	return nil
+}
+
+// DigestMatches returns true if the IM4P data hashes to the digest
+// (the hash algorithm is picked from the digest's size: SHA-1, SHA-256 or SHA-384)
+func DigestMatches(data, digest []byte) bool {
+	var sum []byte
+	switch len(digest) {
+	case sha1.Size:
+		s := sha1.Sum(data)
+		sum = s[:]
+	case sha256.Size:
+		s := sha256.Sum256(data)
+		sum = s[:]
+	case sha512.Size384:
+		s := sha512.Sum384(data)
+		sum = s[:]
+	default:
+		return false
+	}
+	return bytes.Equal(sum, digest)
+}
+
+// VerifyIm4p checks the IM4P data against the digest of the manifest entry for its type
+// and returns the entry that matched
+func (m *Manifest) VerifyIm4p(data []byte) (*ManifestImage, error) {
+	var i im4p
+	if _, err := asn1.Unmarshal(data, &i); err != nil || i.Name != "IM4P" {
+		return nil, errors.New("invalid Im4p")
+	}
+
+	img := m.Image(i.Type)
+	if img != nil && DigestMatches(data, img.Digest) {
+		return img, nil
+	}
+	// some images are listed under a different name than their IM4P type
+	for idx := range m.Images {
+		if len(m.Images[idx].Digest) > 0 && DigestMatches(data, m.Images[idx].Digest) {
+			return &m.Images[idx], nil
+		}
+	}
+	if img == nil {
+		return nil, errors.Errorf("%s is not in the manifest", i.Type)
+	}
+
+	return img, errors.Errorf("%s digest mismatch", i.Type)
+}
+
+func formatManifestValue(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return hex.EncodeToString(v)
+	case int:
+		return fmt.Sprintf("%#x", v)
+	case uint64:
+		return fmt.Sprintf("%#x", v)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func (p ManifestProperties) String(indent string) string {
+	var names []string
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		if props, ok := p[name].(ManifestProperties); ok {
+			out.WriteString(fmt.Sprintf("%s%s:\n%s", indent, name, props.String(indent+"  ")))
+			continue
+		}
+		out.WriteString(fmt.Sprintf("%s%s: %s\n", indent, name, formatManifestValue(p[name])))
+	}
+	return out.String()
+}
+
+func (m *Manifest) String() string {
+	var out strings.Builder
+
+	out.WriteString(fmt.Sprintf("IM4M (version %d)\n", m.Version))
+	out.WriteString("  Properties (MANP):\n")
+	out.WriteString(m.Properties.String("    "))
+	out.WriteString("  Images (MANB):\n")
+	for _, img := range m.Images {
+		var flags []string
+		for flag, set := range map[string]bool{"EKEY": img.EKEY, "EPRO": img.EPRO, "ESEC": img.ESEC, "trst": img.Trusted} {
+			if set {
+				flags = append(flags, flag)
+			}
+		}
+		sort.Strings(flags)
+		out.WriteString(fmt.Sprintf("    %s: %s", img.Name, hex.EncodeToString(img.Digest)))
+		if len(flags) > 0 {
+			out.WriteString(fmt.Sprintf(" [%s]", strings.Join(flags, ", ")))
+		}
+		out.WriteString("\n")
+		props := make(ManifestProperties)
+		for name, value := range img.Properties {
+			switch name {
+			case "DGST", "EKEY", "EPRO", "ESEC", "trst":
+				continue
+			}
+			props[name] = value
+		}
+		out.WriteString(props.String("      "))
+	}
+	if len(m.Certificates) > 0 {
+		out.WriteString("  Certificates:\n")
+		for idx, cert := range m.Certificates {
+			out.WriteString(fmt.Sprintf("    [%d] %s (issuer: %s, valid: %s - %s)\n", idx,
+				cert.Subject.CommonName,
+				cert.Issuer.CommonName,
+				cert.NotBefore.Format("2006-01-02"),
+				cert.NotAfter.Format("2006-01-02"),
+			))
+		}
+	}
+
+	return out.String()
+}
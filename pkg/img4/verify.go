@@ -0,0 +1,257 @@
+package img4
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blacktop/ipsw/internal/certs"
+	"github.com/pkg/errors"
+)
+
+// VerifyConfig is the configuration for (*Manifest).Verify
+type VerifyConfig struct {
+	Roots     []*x509.Certificate // trusted root CAs (default is the bundled Apple root CAs)
+	Time      time.Time           // the time to check the certificates' validity at (default is now)
+	ApNonce   []byte              // the expected BNCH (optional)
+	Generator []byte              // the boot nonce generator (8 bytes little-endian) to derive the expected BNCH from (optional)
+}
+
+// CertificateStatus is the validation result of a certificate of the manifest's chain
+type CertificateStatus struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Expired   bool      `json:"expired"`
+	Error     string    `json:"error,omitempty"` // bad signature by the issuer
+}
+
+// ManifestVerification is the result of (*Manifest).Verify
+type ManifestVerification struct {
+	SignatureValid bool                `json:"signature_valid"`
+	SignatureHash  string              `json:"signature_hash,omitempty"`
+	Chain          []CertificateStatus `json:"chain"`
+	TrustedRoot    string              `json:"trusted_root,omitempty"`
+	NonceChecked   bool                `json:"nonce_checked"`
+	NonceExpected  []byte              `json:"nonce_expected,omitempty"`
+	Nonce          []byte              `json:"nonce,omitempty"`
+	Problems       []string            `json:"problems,omitempty"`
+}
+
+// Valid returns true if all the checks passed
+func (v *ManifestVerification) Valid() bool {
+	return len(v.Problems) == 0
+}
+
+func (v *ManifestVerification) String() string {
+	var out strings.Builder
+
+	status := func(ok bool) string {
+		if ok {
+			return "OK"
+		}
+		return "FAIL"
+	}
+
+	if v.SignatureValid {
+		out.WriteString(fmt.Sprintf("Signature:    OK (%s)\n", v.SignatureHash))
+	} else {
+		out.WriteString("Signature:    FAIL\n")
+	}
+	out.WriteString("Certificates:\n")
+	for idx, c := range v.Chain {
+		out.WriteString(fmt.Sprintf("  [%d] %s\n", idx, c.Subject))
+		out.WriteString(fmt.Sprintf("      Issuer:   %s (%s)\n", c.Issuer, status(len(c.Error) == 0)))
+		out.WriteString(fmt.Sprintf("      Validity: %s thru %s (%s)\n",
+			c.NotBefore.Format("2006-01-02"),
+			c.NotAfter.Format("2006-01-02"),
+			status(!c.Expired)))
+	}
+	if len(v.TrustedRoot) > 0 {
+		out.WriteString(fmt.Sprintf("Root:         OK (%s)\n", v.TrustedRoot))
+	} else {
+		out.WriteString("Root:         FAIL\n")
+	}
+	if v.NonceChecked {
+		out.WriteString(fmt.Sprintf("Nonce:        %s (BNCH %s)\n", status(bytes.Equal(v.Nonce, v.NonceExpected)), hex.EncodeToString(v.Nonce)))
+	}
+	if len(v.Problems) > 0 {
+		out.WriteString("Problems:\n")
+		for _, p := range v.Problems {
+			out.WriteString(fmt.Sprintf("  - %s\n", p))
+		}
+	}
+
+	return out.String()
+}
+
+// ApNonceFromGenerator returns the boot nonce (BNCH) that a boot nonce generator produces.
+// Devices with 20 byte nonces use SHA-1, newer devices use the first 32 bytes of SHA-384.
+func ApNonceFromGenerator(generator []byte, size int) []byte {
+	switch size {
+	case sha1.Size:
+		sum := sha1.Sum(generator)
+		return sum[:]
+	default:
+		sum := sha512.Sum384(generator)
+		return sum[:32]
+	}
+}
+
+// GeneratorBytes returns the 8 byte little-endian encoding of a boot nonce generator
+func GeneratorBytes(generator uint64) []byte {
+	gen := make([]byte, 8)
+	binary.LittleEndian.PutUint64(gen, generator)
+	return gen
+}
+
+func checkSignature(pub interface{}, signed, sig []byte) (string, error) {
+	for _, h := range []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		hh := h.New()
+		hh.Write(signed)
+		digest := hh.Sum(nil)
+		switch key := pub.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, h, digest, sig) == nil {
+				return h.String(), nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, digest, sig) {
+				return h.String(), nil
+			}
+		default:
+			return "", errors.Errorf("unsupported public key type %T", pub)
+		}
+	}
+	return "", errors.New("signature does not match the manifest body")
+}
+
+// checkCertSignature checks that cert is signed by parent
+// (x509.CheckSignatureFrom refuses the SHA-1 signatures of older Apple chains, so those are checked here)
+func checkCertSignature(cert, parent *x509.Certificate) error {
+	switch cert.SignatureAlgorithm {
+	case x509.SHA1WithRSA, x509.ECDSAWithSHA1:
+		if !parent.IsCA && parent.Version == 3 {
+			return errors.New("parent certificate is not a CA")
+		}
+		digest := sha1.Sum(cert.RawTBSCertificate)
+		switch key := parent.PublicKey.(type) {
+		case *rsa.PublicKey:
+			return rsa.VerifyPKCS1v15(key, crypto.SHA1, digest[:], cert.Signature)
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(key, digest[:], cert.Signature) {
+				return errors.New("ECDSA verification failure")
+			}
+			return nil
+		}
+		return errors.Errorf("unsupported public key type %T", parent.PublicKey)
+	}
+	return cert.CheckSignatureFrom(parent)
+}
+
+func certName(cert *x509.Certificate) string {
+	if len(cert.Subject.CommonName) > 0 {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
+
+// Verify validates the manifest's signature over MANB with the leaf of its certificate chain,
+// the chain itself against the root CAs and optionally the boot nonce
+func (m *Manifest) Verify(conf *VerifyConfig) (*ManifestVerification, error) {
+	if conf == nil {
+		conf = &VerifyConfig{}
+	}
+	if conf.Time.IsZero() {
+		conf.Time = time.Now()
+	}
+	roots := conf.Roots
+	if roots == nil {
+		var err error
+		roots, err = certs.AppleRoots()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load Apple root CAs")
+		}
+	}
+
+	v := &ManifestVerification{}
+
+	if len(m.Certificates) == 0 {
+		v.Problems = append(v.Problems, "bad signature: manifest has no certificate chain")
+	} else {
+		hash, err := checkSignature(m.Certificates[0].PublicKey, m.raw.Body.FullBytes, m.Signature)
+		if err != nil {
+			v.Problems = append(v.Problems, fmt.Sprintf("bad signature: %v", err))
+		} else {
+			v.SignatureValid = true
+			v.SignatureHash = hash
+		}
+	}
+
+	for idx, cert := range m.Certificates {
+		status := CertificateStatus{
+			Subject:   certName(cert),
+			Issuer:    cert.Issuer.CommonName,
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+			Expired:   conf.Time.After(cert.NotAfter) || conf.Time.Before(cert.NotBefore),
+		}
+		if status.Expired {
+			v.Problems = append(v.Problems, fmt.Sprintf("expired: %s is only valid from %s thru %s",
+				status.Subject, cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02")))
+		}
+		if idx+1 < len(m.Certificates) {
+			if err := checkCertSignature(cert, m.Certificates[idx+1]); err != nil {
+				status.Error = err.Error()
+				v.Problems = append(v.Problems, fmt.Sprintf("bad signature: %s is not signed by %s: %v",
+					status.Subject, certName(m.Certificates[idx+1]), err))
+			}
+		}
+		v.Chain = append(v.Chain, status)
+	}
+
+	if len(m.Certificates) > 0 {
+		last := m.Certificates[len(m.Certificates)-1]
+		for _, root := range roots {
+			if bytes.Equal(last.Raw, root.Raw) || checkCertSignature(last, root) == nil {
+				v.TrustedRoot = certName(root)
+				break
+			}
+		}
+		if len(v.TrustedRoot) == 0 {
+			if len(roots) == 0 {
+				v.Problems = append(v.Problems, "wrong root: no trusted root CAs to validate the chain against")
+			} else {
+				v.Problems = append(v.Problems, fmt.Sprintf("wrong root: %s is not issued by a trusted root CA", certName(last)))
+			}
+		}
+	}
+
+	expected := conf.ApNonce
+	if len(expected) == 0 && len(conf.Generator) > 0 {
+		if bnch, ok := m.Properties["BNCH"].([]byte); ok {
+			expected = ApNonceFromGenerator(conf.Generator, len(bnch))
+		}
+	}
+	if len(expected) > 0 {
+		v.NonceChecked = true
+		v.NonceExpected = expected
+		v.Nonce, _ = m.Properties["BNCH"].([]byte)
+		if !bytes.Equal(v.Nonce, expected) {
+			v.Problems = append(v.Problems, fmt.Sprintf("nonce mismatch: BNCH is %s (expected %s)",
+				hex.EncodeToString(v.Nonce), hex.EncodeToString(expected)))
+		}
+	}
+
+	return v, nil
+}
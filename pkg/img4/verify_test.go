@@ -0,0 +1,209 @@
+package img4
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blacktop/ipsw/internal/certs"
+)
+
+// appleRootCAFingerprint is the SHA-256 fingerprint of Apple Root CA (https://www.apple.com/certificateauthority/)
+const appleRootCAFingerprint = "b0b1730ecbc7ff4505142c49f1295e6eda6bcaed7e2c68c5be91b5a11001f024"
+
+func mustMarshal(t *testing.T, v interface{}, params string) []byte {
+	t.Helper()
+	dat, err := asn1.MarshalWithParams(v, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dat
+}
+
+func rawValue(t *testing.T, class, tag int, inner ...[]byte) []byte {
+	t.Helper()
+	var body []byte
+	for _, b := range inner {
+		body = append(body, b...)
+	}
+	return mustMarshal(t, asn1.RawValue{Class: class, Tag: tag, IsCompound: true, Bytes: body}, "")
+}
+
+// encodeProperty encodes a [PRIVATE fourcc] SEQUENCE { IA5String name, value }
+func encodeProperty(t *testing.T, name string, value []byte) []byte {
+	t.Helper()
+	tag := int(name[0])<<24 | int(name[1])<<16 | int(name[2])<<8 | int(name[3])
+	return rawValue(t, asn1.ClassPrivate, tag, rawValue(t, asn1.ClassUniversal, asn1.TagSequence, mustMarshal(t, name, "ia5"), value))
+}
+
+func propertySet(t *testing.T, props ...[]byte) []byte {
+	return rawValue(t, asn1.ClassUniversal, asn1.TagSet, props...)
+}
+
+// createIm4m builds an IM4M whose MANB is signed by key with the given certificate chain
+func createIm4m(t *testing.T, key *ecdsa.PrivateKey, chain []*x509.Certificate, bnch []byte) []byte {
+	t.Helper()
+
+	krnl := sha512.Sum384([]byte("kernelcache"))
+	manp := encodeProperty(t, "MANP", propertySet(t,
+		encodeProperty(t, "BNCH", mustMarshal(t, bnch, "")),
+		encodeProperty(t, "CHIP", mustMarshal(t, 0x8030, "")),
+		encodeProperty(t, "ECID", mustMarshal(t, int64(0x1234567890), "")),
+	))
+	img := encodeProperty(t, "krnl", propertySet(t,
+		encodeProperty(t, "DGST", mustMarshal(t, krnl[:], "")),
+		encodeProperty(t, "EPRO", mustMarshal(t, true, "")),
+	))
+	body := propertySet(t, encodeProperty(t, "MANB", propertySet(t, manp, img)))
+
+	var sig []byte
+	if key != nil {
+		digest := sha512.Sum384(body)
+		var err error
+		if sig, err = ecdsa.SignASN1(rand.Reader, key, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		sig = []byte("not a signature")
+	}
+
+	var raw [][]byte
+	for _, cert := range chain {
+		raw = append(raw, cert.Raw)
+	}
+
+	return rawValue(t, asn1.ClassUniversal, asn1.TagSequence,
+		mustMarshal(t, "IM4M", "ia5"),
+		mustMarshal(t, 0, ""),
+		body,
+		mustMarshal(t, sig, ""),
+		rawValue(t, asn1.ClassUniversal, asn1.TagSequence, raw...),
+	)
+}
+
+func createCert(t *testing.T, name string, pub, signer interface{}, parent *x509.Certificate) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAppleRootsBundled(t *testing.T) {
+	roots, err := certs.AppleRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range roots {
+		sum := sha256.Sum256(root.Raw)
+		if hex.EncodeToString(sum[:]) == appleRootCAFingerprint {
+			return
+		}
+	}
+	t.Fatalf("Apple Root CA (%s) is not bundled (%d roots)", appleRootCAFingerprint, len(roots))
+}
+
+func TestManifestVerify(t *testing.T) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := createCert(t, "Test Root CA", &rootKey.PublicKey, rootKey, nil)
+	leaf := createCert(t, "TssLive ManifestKey-Test", &leafKey.PublicKey, rootKey, root)
+
+	generator := GeneratorBytes(0x1111111111111111)
+	bnch := ApNonceFromGenerator(generator, 32)
+
+	m, err := ParseIm4m(createIm4m(t, leafKey, []*x509.Certificate{leaf}, bnch))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := m.Verify(&VerifyConfig{Roots: []*x509.Certificate{root}, Generator: generator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Valid() || !v.SignatureValid || v.TrustedRoot != "Test Root CA" || !v.NonceChecked {
+		t.Fatalf("expected a valid manifest:\n%s", v)
+	}
+
+	// the same manifest isn't trusted by the bundled Apple roots
+	if v, err = m.Verify(&VerifyConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if v.Valid() || len(v.TrustedRoot) > 0 {
+		t.Fatalf("expected an untrusted root:\n%s", v)
+	}
+
+	// a nonce from another generator doesn't match
+	if v, err = m.Verify(&VerifyConfig{Roots: []*x509.Certificate{root}, Generator: GeneratorBytes(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if v.Valid() {
+		t.Fatalf("expected a nonce mismatch:\n%s", v)
+	}
+}
+
+func TestManifestVerifyAppleChain(t *testing.T) {
+	// a CA issued by Apple Root CA (extracted from a Developer ID code signature)
+	dat, err := os.ReadFile("testdata/DeveloperIDCA.cer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ParseIm4m(createIm4m(t, nil, []*x509.Certificate{ca}, make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := m.Verify(&VerifyConfig{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.TrustedRoot != "Apple Root CA" {
+		t.Fatalf("expected the chain to be trusted by the bundled Apple Root CA:\n%s", v)
+	}
+	if len(v.Chain) != 1 || v.Chain[0].Expired || len(v.Chain[0].Error) > 0 {
+		t.Fatalf("expected a valid chain:\n%s", v)
+	}
+	// there's no Apple signed manifest without Apple's private key, so only the signature fails
+	if len(v.Problems) != 1 || !strings.HasPrefix(v.Problems[0], "bad signature") {
+		t.Fatalf("expected only a bad signature: %v", v.Problems)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -53,6 +54,27 @@ func (ds Devices) LookupDevice(prod string) (Device, error) {
 	return Device{}, fmt.Errorf("device %s not found", prod)
 }
 
+// LookupBasebandChipID returns the devices (and boards) with a baseband chip ID (e.g. 0x00000068 -> iPhone12,1 (N104AP))
+func (ds Devices) LookupBasebandChipID(bbid string) []string {
+	want, err := strconv.ParseUint(bbid, 0, 64)
+	if err != nil {
+		return nil
+	}
+	var devices []string
+	for prod, dev := range ds {
+		for name, board := range dev.Boards {
+			if len(board.BasebandChipID) == 0 {
+				continue
+			}
+			if id, err := strconv.ParseUint(board.BasebandChipID, 0, 64); err == nil && id == want {
+				devices = append(devices, fmt.Sprintf("%s (%s)", prod, name))
+			}
+		}
+	}
+	sort.Strings(devices)
+	return devices
+}
+
 func (i *Info) GetDevices(devs *Devices) error {
 	if i.DeviceTrees != nil && len(i.DeviceTrees) > 0 {
 		for _, dtree := range i.DeviceTrees {
@@ -0,0 +1,354 @@
+package info
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/ftab"
+	"github.com/blacktop/ipsw/pkg/img3"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/blacktop/ipsw/pkg/lzfse"
+	"github.com/blacktop/ipsw/pkg/rtkit"
+	"github.com/pkg/errors"
+)
+
+// Firmware formats
+const (
+	FormatIMG4       = "IMG4"
+	FormatIM4P       = "IM4P"
+	FormatFtab       = "ftab"
+	FormatMachO      = "Mach-O"
+	FormatTrustCache = "trustcache"
+	FormatDMG        = "DMG"
+	FormatPlist      = "plist"
+	FormatOther      = "other"
+)
+
+// Payload compressions
+const (
+	CompressionNone  = "none"
+	CompressionLZSS  = "LZSS"
+	CompressionLZFSE = "LZFSE"
+)
+
+const (
+	// headSize is the number of bytes a zip entry is classified with
+	headSize = 0x1000
+	// maxFirmwareSize is the largest zip entry that is read entirely to be classified (the OS DMGs aren't)
+	maxFirmwareSize = 512 << 20
+	// udifTrailerSize is the size of the UDIF (koly) trailer at the end of a DMG
+	udifTrailerSize = 512
+)
+
+// trustCacheTypes are the IM4P types of trust caches
+var trustCacheTypes = []string{"trst", "rtsc", "ltrs", "dtrs"}
+
+// Firmware is a classified IPSW zip entry
+type Firmware struct {
+	Path        string   `json:"path"`
+	Size        uint64   `json:"size"`
+	Format      string   `json:"format"`
+	Type        string   `json:"type,omitempty"` // IM4P type tag
+	Compression string   `json:"compression,omitempty"`
+	Encrypted   bool     `json:"encrypted"`
+	Arch        string   `json:"arch,omitempty"`
+	Version     string   `json:"version,omitempty"` // RTKit version
+	DMG         string   `json:"dmg,omitempty"`     // DMG type (UDIF, APFS, HFS+, AEA or encrcdsa)
+	TrustCache  bool     `json:"trustcache,omitempty"`
+	Components  []string `json:"components,omitempty"` // BuildManifest components
+	Devices     []string `json:"devices,omitempty"`
+	Variants    []string `json:"variants,omitempty"`
+}
+
+func (f Firmware) String() string {
+	var details []string
+	if len(f.Type) > 0 {
+		details = append(details, f.Type)
+	}
+	if len(f.Compression) > 0 && f.Compression != CompressionNone {
+		details = append(details, f.Compression)
+	}
+	if f.Encrypted {
+		details = append(details, "encrypted")
+	}
+	for _, detail := range []string{f.Arch, f.Version, f.DMG} {
+		if len(detail) > 0 {
+			details = append(details, detail)
+		}
+	}
+	return fmt.Sprintf("%s %s (%s) %s", f.Path, f.Format, strings.Join(details, ", "), strings.Join(f.Components, ","))
+}
+
+// componentUse is a BuildManifest component that uses a file
+type componentUse struct {
+	Component   string
+	DeviceClass string
+	Variant     string
+}
+
+// getComponentUses returns the BuildManifest components that use each file (by path)
+func (i *Info) getComponentUses() map[string][]componentUse {
+	uses := make(map[string][]componentUse)
+	if i == nil || i.Plists == nil || i.Plists.BuildManifest == nil {
+		return uses
+	}
+	for _, bID := range i.Plists.BuildIdentities {
+		for name, manifest := range bID.Manifest {
+			if len(manifest.Info.Path) > 0 {
+				uses[manifest.Info.Path] = append(uses[manifest.Info.Path], componentUse{
+					Component:   name,
+					DeviceClass: bID.Info.DeviceClass,
+					Variant:     bID.Info.Variant,
+				})
+			}
+		}
+	}
+	return uses
+}
+
+// getProductTypes returns the product types of each board config (e.g. d53pap -> iPhone14,2)
+func (i *Info) getProductTypes() map[string]string {
+	products := make(map[string]string)
+	if i == nil {
+		return products
+	}
+	for _, dtree := range i.DeviceTrees {
+		if dt, err := dtree.Summary(); err == nil {
+			products[strings.ToLower(dt.BoardConfig)] = dt.ProductType
+		}
+	}
+	return products
+}
+
+// Firmwares classifies every file in an IPSW's zip and maps it to the BuildManifest components and devices that use it
+func (i *Info) Firmwares(files []*zip.File) ([]Firmware, error) {
+	uses := i.getComponentUses()
+	products := i.getProductTypes()
+
+	var fws []Firmware
+	for _, zf := range files {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+
+		fw, err := classifyZipFile(zf)
+		if err != nil {
+			if fw == nil {
+				return nil, errors.Wrapf(err, "failed to read %s", zf.Name)
+			}
+			// a malformed payload is still listed (with what could be classified)
+			log.Warnf("failed to classify %s: %v", zf.Name, err)
+		}
+
+		// devices are listed by product type (or by board config if there is no devicetree for it)
+		var components, devices, boardConfigs, variants []string
+		for _, use := range uses[zf.Name] {
+			components = append(components, use.Component)
+			if product, ok := products[strings.ToLower(use.DeviceClass)]; ok {
+				devices = append(devices, product)
+			} else if len(use.DeviceClass) > 0 {
+				boardConfigs = append(boardConfigs, use.DeviceClass)
+			}
+			if len(use.Variant) > 0 {
+				variants = append(variants, use.Variant)
+			}
+		}
+		fw.Components = utils.Unique(components)
+		fw.Variants = utils.Unique(variants)
+		boardConfigs = utils.Unique(boardConfigs)
+		sort.Strings(fw.Components)
+		sort.Strings(fw.Variants)
+		sort.Strings(boardConfigs)
+		if len(devices) > 0 {
+			fw.Devices = utils.SortDevices(utils.Unique(devices))
+		}
+		fw.Devices = append(fw.Devices, boardConfigs...)
+
+		fws = append(fws, *fw)
+	}
+
+	return fws, nil
+}
+
+// classifyZipFile classifies a zip entry
+func classifyZipFile(zf *zip.File) (*Firmware, error) {
+	fw := &Firmware{
+		Path:   zf.Name,
+		Size:   zf.UncompressedSize64,
+		Format: FormatOther,
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// read errors are returned without a Firmware, classification errors with the partial Firmware
+	head := make([]byte, headSize)
+	n, err := io.ReadFull(rc, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	switch {
+	case utils.IsIm4p(head) || utils.IsImg4(head):
+		if zf.UncompressedSize64 > maxFirmwareSize {
+			fw.Format = FormatIM4P
+			return fw, nil
+		}
+		rest, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		return fw, fw.classifyIm4p(append(head, rest...))
+	case ftab.IsFtab(head):
+		rest, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		fw.Format = FormatFtab
+		fw.classifyPayload(append(head, rest...))
+	case utils.IsMachO(head) || utils.IsUniversalMachO(head):
+		fw.Format = FormatMachO
+		if zf.UncompressedSize64 <= maxFirmwareSize {
+			rest, err := ioutil.ReadAll(rc)
+			if err != nil {
+				return nil, err
+			}
+			fw.Arch = rtkit.MachOArch(append(head, rest...))
+		}
+	case strings.EqualFold(filepath.Ext(zf.Name), ".dmg") || strings.HasSuffix(strings.ToLower(zf.Name), ".dmg.aea"):
+		fw.Format = FormatDMG
+		fw.DMG = dmgType(head, zipTail(zf, udifTrailerSize))
+		fw.Encrypted = fw.DMG == "AEA" || fw.DMG == "encrcdsa"
+	case strings.EqualFold(filepath.Ext(zf.Name), ".trustcache"):
+		fw.Format = FormatTrustCache
+		fw.TrustCache = true
+	case bytes.HasPrefix(head, []byte("<?xml")) || bytes.HasPrefix(head, []byte("bplist")):
+		fw.Format = FormatPlist
+	}
+
+	return fw, nil
+}
+
+// classifyIm4p classifies an Im4p (or Img4) and its payload
+func (f *Firmware) classifyIm4p(data []byte) error {
+	f.Format = FormatIM4P
+	if bytes.Contains(data[:utils.Min(len(data), 16)], []byte("IMG4")) {
+		f.Format = FormatIMG4
+	}
+
+	im4p, err := img4.UnmarshalIm4p(data)
+	if err != nil {
+		return err
+	}
+	f.Type = im4p.Type
+	f.Encrypted = im4p.Encrypted()
+	f.TrustCache = utils.StrSliceHas(trustCacheTypes, im4p.Type)
+
+	switch {
+	case bytes.HasPrefix(im4p.Data, []byte("bvx")):
+		f.Compression = CompressionLZFSE
+	case bytes.HasPrefix(im4p.Data, []byte("complzss")):
+		f.Compression = CompressionLZSS
+	default:
+		f.Compression = CompressionNone
+	}
+
+	if f.Encrypted {
+		// the compression of an encrypted payload isn't known until it is decrypted
+		f.Compression = ""
+		return nil
+	}
+
+	payload := im4p.Data
+	switch f.Compression {
+	case CompressionLZFSE:
+		if payload, err = lzfse.NewDecoder(im4p.Data).DecodeBuffer(); err != nil {
+			return errors.Wrap(err, "failed to lzfse decompress payload")
+		}
+	case CompressionLZSS:
+		if payload, err = img3.DecompressLZSS(im4p.Data); err != nil {
+			return err
+		}
+	}
+	f.classifyPayload(payload)
+
+	return nil
+}
+
+// classifyPayload identifies the code (or disk image) in a decoded firmware
+func (f *Firmware) classifyPayload(data []byte) {
+	f.Version = rtkit.Version(data)
+	if ftab.IsFtab(data) {
+		if ft, err := ftab.Parse(data); err == nil {
+			var archs []string
+			for _, e := range ft.Entries {
+				if arch := rtkit.MachOArch(e.Data()); len(arch) > 0 {
+					archs = append(archs, arch)
+				}
+			}
+			f.Arch = strings.Join(utils.Unique(archs), ",")
+		}
+		return
+	}
+	if arch := rtkit.MachOArch(data); len(arch) > 0 {
+		f.Arch = arch
+		return
+	}
+	if len(f.Version) > 0 {
+		// raw RTKit firmware
+		f.Arch = rtkit.Arch(data)
+		return
+	}
+	if len(data) >= udifTrailerSize {
+		f.DMG = dmgType(data, data[len(data)-udifTrailerSize:])
+	}
+}
+
+// dmgType returns the type of a disk image from its first bytes and its last 512 bytes
+func dmgType(head, tail []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("AEA1")):
+		return "AEA"
+	case bytes.HasPrefix(head, []byte("encrcdsa")):
+		return "encrcdsa"
+	case bytes.HasPrefix(tail, []byte("koly")):
+		return "UDIF"
+	case len(head) >= 0x24 && string(head[0x20:0x24]) == "NXSB":
+		return "APFS"
+	case len(head) >= 0x402 && (string(head[0x400:0x402]) == "H+" || string(head[0x400:0x402]) == "HX"):
+		return "HFS+"
+	}
+	return ""
+}
+
+// zipTail returns the last size bytes of a stored (uncompressed) zip entry (nil if the entry is compressed)
+func zipTail(zf *zip.File, size int64) []byte {
+	if zf.Method != zip.Store || zf.UncompressedSize64 < uint64(size) {
+		return nil
+	}
+	r, err := zf.OpenRaw()
+	if err != nil {
+		return nil
+	}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	tail := make([]byte, size)
+	if _, err := ra.ReadAt(tail, int64(zf.UncompressedSize64)-size); err != nil {
+		return nil
+	}
+	return tail
+}
@@ -343,7 +343,11 @@ func Parse(ipswPath string) (*Info, error) {
 	}
 	i.DeviceTrees, err = devicetree.Parse(ipswPath)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse devicetree")
+		if errors.Is(err, devicetree.ErrEncryptedDeviceTree) {
+			log.Error(err.Error())
+		} else {
+			return nil, errors.Wrap(err, "failed to parse devicetree")
+		}
 	}
 
 	return i, nil
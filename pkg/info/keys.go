@@ -0,0 +1,144 @@
+package info
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// FirmwareKey is the (GID decrypted) IV and key of a firmware component
+type FirmwareKey struct {
+	Device   string `json:"device"`
+	Build    string `json:"build"`
+	Type     string `json:"type"` // the BuildManifest component (e.g. iBoot)
+	Filename string `json:"filename,omitempty"`
+	KBag     string `json:"kbag,omitempty"` // the encrypted IV and key
+	Key      string `json:"key"`            // the IV and key
+}
+
+// IVKey returns the decoded IV and key
+func (k FirmwareKey) IVKey() ([]byte, []byte, error) {
+	ivkey, err := hex.DecodeString(k.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key %s: %v", k.Key, err)
+	}
+	if len(ivkey) <= 16 {
+		return nil, nil, fmt.Errorf("invalid key size %d", len(ivkey))
+	}
+	return ivkey[:16], ivkey[16:], nil
+}
+
+// KeyDB is a database of firmware keys
+type KeyDB struct {
+	Keys []FirmwareKey
+}
+
+// GetKeyDB returns the embedded firmware key database
+func GetKeyDB() (*KeyDB, error) {
+	db := &KeyDB{}
+	for _, data := range [][]byte{keysJSONData, t8030APKeysJSONData, t8101APKeysJSONData} {
+		if err := db.Load(data); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// LoadFile adds the keys of a JSON key database file to the database
+func (db *KeyDB) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read key database %s: %v", path, err)
+	}
+	if err := db.Load(data); err != nil {
+		return fmt.Errorf("failed to load key database %s: %v", path, err)
+	}
+	return nil
+}
+
+// Load adds the keys of a JSON key database to the database.
+//
+// The database is either a list of keys (like the AP key files) or a map of device to
+// build to '<component>-iv' and '<component>-key' (like firmware_keys.json); components
+// without an IV (e.g. 'RootFileSystem-key') only have a key.
+func (db *KeyDB) Load(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var keys []FirmwareKey
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return fmt.Errorf("failed to parse keys: %v", err)
+		}
+		db.Keys = append(db.Keys, keys...)
+		return nil
+	}
+
+	var keys map[string]map[string]map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to parse keys: %v", err)
+	}
+	for device, builds := range keys {
+		for build, comps := range builds {
+			for name, val := range comps {
+				var comp, key string
+				switch {
+				case strings.HasSuffix(name, "-iv"):
+					comp = strings.TrimSuffix(name, "-iv")
+					k, ok := comps[comp+"-key"]
+					if !ok {
+						continue
+					}
+					key = val + k
+				case strings.HasSuffix(name, "-key"):
+					// keys without an IV (e.g. the VFDecrypt key of a RootFileSystem)
+					comp = strings.TrimSuffix(name, "-key")
+					if _, ok := comps[comp+"-iv"]; ok {
+						continue
+					}
+					key = val
+				default:
+					continue
+				}
+				db.Keys = append(db.Keys, FirmwareKey{
+					Device: device,
+					Build:  build,
+					Type:   comp,
+					Key:    key,
+				})
+			}
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns the key of a firmware component matching one of its KBAG values (the
+// encrypted IV and key), else its device, build and filename or component
+func (db *KeyDB) Lookup(device, build, component, filename string, kbags ...[]byte) (*FirmwareKey, error) {
+	for _, kbag := range kbags {
+		for idx, key := range db.Keys {
+			if len(key.KBag) > 0 && strings.EqualFold(key.KBag, hex.EncodeToString(kbag)) {
+				return &db.Keys[idx], nil
+			}
+		}
+	}
+
+	if len(filename) > 0 {
+		for idx, key := range db.Keys {
+			if key.Device == device && key.Build == build && key.Filename == filename {
+				return &db.Keys[idx], nil
+			}
+		}
+	}
+
+	if len(component) > 0 {
+		for idx, key := range db.Keys {
+			if key.Device == device && key.Build == build && strings.EqualFold(key.Type, component) {
+				return &db.Keys[idx], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("failed to find key for device: %s, build: %s, component: %s, filename: %s", device, build, component, filename)
+}
@@ -0,0 +1,139 @@
+package kernelcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/lzfse"
+	"github.com/blacktop/lzss"
+)
+
+const (
+	lzssN         = 4096 // size of the ring buffer
+	lzssF         = 18   // upper limit for the match length
+	lzssThreshold = 2    // matches longer than this are encoded as a position and length
+
+	lzssHashSize  = 1 << 14
+	lzssMaxChains = 256 // max number of candidates to try per position
+)
+
+// CompressData compresses a kernelcache with LZSS (with the complzss header) or LZFSE
+func CompressData(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "lzss":
+		utils.Indent(log.Debug, 2)("Compressing Kernelcache with LZSS")
+		comp := compressLZSS(data)
+		buf := new(bytes.Buffer)
+		if err := binary.Write(buf, binary.BigEndian, lzss.Header{
+			CompressionType:  0x636f6d70, // comp
+			Signature:        0x6c7a7373, // lzss
+			CheckSum:         adler32.Checksum(data),
+			UncompressedSize: uint32(len(data)),
+			CompressedSize:   uint32(len(comp)),
+		}); err != nil {
+			return nil, fmt.Errorf("failed to write LZSS header: %v", err)
+		}
+		buf.Write(comp)
+		return buf.Bytes(), nil
+	case "lzfse":
+		utils.Indent(log.Debug, 2)("Compressing Kernelcache with LZFSE")
+		return lzfse.EncodeBuffer(data), nil
+	case "", "none":
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression %s (supported: lzss, lzfse, none)", compression)
+}
+
+// CompressLZSS compresses data with LZSS (without the complzss header, e.g. for iBootIm images)
+func CompressLZSS(data []byte) []byte {
+	return compressLZSS(data)
+}
+
+func lzssHash(b []byte) int {
+	return (int(b[0])<<8 ^ int(b[1])<<4 ^ int(b[2])) & (lzssHashSize - 1)
+}
+
+// compressLZSS compresses data in the Okumura LZSS format used by complzss.
+//
+// Matches never reach back before the start of the data, so the output doesn't depend
+// on how a decompressor initializes its ring buffer.
+func compressLZSS(src []byte) []byte {
+	dst := bytes.NewBuffer(make([]byte, 0, len(src)/2))
+
+	head := make([]int, lzssHashSize)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int, len(src))
+
+	insert := func(pos int) {
+		if pos+lzssThreshold < len(src) {
+			h := lzssHash(src[pos:])
+			prev[pos] = head[h]
+			head[h] = pos
+		}
+	}
+
+	var flags byte
+	var bit uint
+	var group []byte // the (up to 8) items described by flags
+
+	flush := func() {
+		dst.WriteByte(flags)
+		dst.Write(group)
+		flags, bit, group = 0, 0, group[:0]
+	}
+
+	for pos := 0; pos < len(src); {
+		var bestLen, bestPos int
+		if pos+lzssThreshold < len(src) {
+			max := len(src) - pos
+			if max > lzssF {
+				max = lzssF
+			}
+			chains := 0
+			for cand := head[lzssHash(src[pos:])]; cand >= 0 && pos-cand <= lzssN-lzssF && chains < lzssMaxChains; cand = prev[cand] {
+				chains++
+				l := 0
+				for l < max && src[cand+l] == src[pos+l] {
+					l++
+				}
+				if l > bestLen {
+					bestLen, bestPos = l, cand
+					if l == max {
+						break
+					}
+				}
+			}
+		}
+
+		if bestLen > lzssThreshold {
+			// the decompressor's ring buffer starts writing at N-F
+			r := (bestPos + lzssN - lzssF) & (lzssN - 1)
+			group = append(group, byte(r), byte((r>>4)&0xf0)|byte(bestLen-lzssThreshold-1))
+			for i := 0; i < bestLen; i++ {
+				insert(pos + i)
+			}
+			pos += bestLen
+		} else {
+			flags |= 1 << bit
+			group = append(group, src[pos])
+			insert(pos)
+			pos++
+		}
+
+		if bit++; bit == 8 {
+			flush()
+		}
+	}
+	if bit > 0 {
+		flush()
+	}
+
+	return dst.Bytes()
+}
@@ -0,0 +1,81 @@
+package kernelcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"math/rand"
+	"testing"
+
+	"github.com/blacktop/ipsw/pkg/lzfse"
+	"github.com/blacktop/lzss"
+)
+
+func compressTestInputs() map[string][]byte {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("__TEXT __DATA_CONST __LINKEDIT "), 5000)
+
+	return map[string][]byte{
+		"empty":                {},
+		"smaller than a block": []byte("kernelcache"),
+		"text":                 text,
+		"zeros":                make([]byte, 70000),
+		"incompressible":       random,
+	}
+}
+
+func TestCompressDataLZSS(t *testing.T) {
+	for name, src := range compressTestInputs() {
+		t.Run(name, func(t *testing.T) {
+			comp, err := CompressData(src, "lzss")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var hdr lzss.Header
+			if err := binary.Read(bytes.NewReader(comp), binary.BigEndian, &hdr); err != nil {
+				t.Fatalf("failed to read header: %v", err)
+			}
+			if hdr.UncompressedSize != uint32(len(src)) || hdr.CheckSum != adler32.Checksum(src) {
+				t.Fatalf("bad header: %+v", hdr)
+			}
+			data := comp[binary.Size(hdr):]
+			if int(hdr.CompressedSize) != len(data) {
+				t.Fatalf("compressed size %d doesn't match the payload size %d", hdr.CompressedSize, len(data))
+			}
+
+			dec := lzss.Decompress(data)
+			if len(dec) > len(src) {
+				dec = dec[:len(src)]
+			}
+			if !bytes.Equal(dec, src) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d", len(dec), len(src))
+			}
+		})
+	}
+}
+
+func TestCompressDataLZFSE(t *testing.T) {
+	for name, src := range compressTestInputs() {
+		t.Run(name, func(t *testing.T) {
+			comp, err := CompressData(src, "lzfse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec, err := lzfse.NewDecoder(comp).DecodeBuffer()
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if !bytes.Equal(dec, src) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d", len(dec), len(src))
+			}
+		})
+	}
+}
+
+func TestCompressDataUnsupported(t *testing.T) {
+	if _, err := CompressData([]byte("data"), "zstd"); err == nil {
+		t.Fatal("expected an error for an unsupported compression")
+	}
+}
@@ -1,119 +1,480 @@
 package kernelcache
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
-	"testing/iotest"
 
+	"github.com/apex/log"
 	"github.com/blacktop/go-macho"
+	"github.com/blacktop/ipsw/internal/utils"
 )
 
-// ParseMachO parses the kernelcache as a mach-o
-func ParseMachO(name string) error {
-	f, err := macho.Open(name)
+// KextSummary is the diffable summary of a single kernelcache entry
+type KextSummary struct {
+	ID            string          `json:"id"`
+	Version       string          `json:"version,omitempty"`
+	Functions     int             `json:"functions"`
+	FunctionsSize uint64          `json:"functions_size"`
+	Strings       map[string]bool `json:"-"`
+}
+
+// Summary is the diffable summary of a kernelcache
+type Summary struct {
+	Version           string                  `json:"version,omitempty"`
+	Kexts             map[string]*KextSummary `json:"kexts,omitempty"`
+	SymbolSets        map[string][]string     `json:"symbolsets,omitempty"`
+	SandboxOperations []string                `json:"sandbox_operations,omitempty"`
+	Syscalls          []Syscall               `json:"syscalls,omitempty"`
+	IOKitClasses      []IOKitClass            `json:"iokit_classes,omitempty"`
+}
+
+// Summarize parses a kernelcache and collects everything needed to diff it against another kernelcache
+func Summarize(kernel string) (*Summary, error) {
+	f, err := os.Open(kernel)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 
-	fmt.Println(f.FileHeader)
+	m, err := macho.NewFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kernelcache %s: %v", kernel, err)
+	}
 
-	err = os.Mkdir("diff", os.ModePerm)
+	kexts, err := GetKexts(f, m)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to get kexts: %v", err)
 	}
 
-	for _, sec := range f.Sections {
-		if strings.EqualFold(sec.Name, "__cstring") && strings.EqualFold(sec.Seg, "__TEXT") {
-			r := bufio.NewReader(sec.Open())
-			for {
-				s, err := r.ReadString('\x00')
-				if err == io.EOF {
+	base := getKernelCacheBase(m)
+
+	s := &Summary{
+		Kexts:      make(map[string]*KextSummary),
+		SymbolSets: make(map[string][]string),
+	}
+
+	for _, kext := range kexts {
+		utils.Indent(log.Debug, 2)(fmt.Sprintf("Summarizing %s", kext.ID))
+
+		ks := &KextSummary{
+			ID:      kext.ID,
+			Version: kext.Version,
+			Strings: make(map[string]bool),
+		}
+		for _, fn := range kext.GetFunctions() {
+			ks.Functions++
+			ks.FunctionsSize += fn.EndAddr - fn.StartAddr
+		}
+		strs, err := getCStringMap(kext.File)
+		if err != nil {
+			log.Debugf("failed to get cstrings for %s: %v", kext.ID, err)
+		}
+		for _, str := range strs {
+			ks.Strings[str] = true
+		}
+		s.Kexts[kext.ID] = ks
+
+		if kext.ID == "com.apple.kernel" {
+			for _, str := range strs {
+				if strings.HasPrefix(str, "Darwin Kernel Version") {
+					s.Version = str
 					break
 				}
+			}
+			if s.Syscalls, err = GetSyscalls(kext.File, base); err != nil {
+				log.Debugf("failed to get syscalls: %v", err)
+			}
+		}
+	}
 
-				if err != nil && err != iotest.ErrTimeout {
-					panic("GetLines: " + err.Error())
+	if ssets, err := GetSymbolSets(m); err == nil {
+		for _, sset := range ssets.SymbolsSetsDictionary {
+			for _, sym := range sset.Symbols {
+				s.SymbolSets[sset.ID] = append(s.SymbolSets[sset.ID], sym.Prefix+sym.Name)
+			}
+		}
+	} else {
+		log.Debugf("failed to get symbolsets: %v", err)
+	}
+
+	if s.SandboxOperations, err = GetSandboxOpts(m); err != nil || len(s.SandboxOperations) == 0 {
+		for _, kext := range kexts {
+			if kext.ID == "com.apple.security.sandbox" {
+				if s.SandboxOperations, err = GetSandboxOpts(kext.File); err != nil {
+					log.Debugf("failed to get sandbox operations: %v", err)
 				}
+			}
+		}
+	}
+
+	if s.IOKitClasses, err = getIOKitClasses(kexts, base); err != nil {
+		log.Debugf("failed to get IOKit classes: %v", err)
+	}
 
-				if strings.Contains(s, "@/BuildRoot/") {
-					var assertStr string
-					parts := strings.Split(strings.TrimSpace(s), "@/BuildRoot/")
-					if len(parts) > 1 {
-						assertStr = parts[0]
-						fileAndLineNum := parts[1]
-						parts = strings.Split(fileAndLineNum, ":")
-					} else {
-						fmt.Println("WHAT?? ", s)
-					}
-					if len(parts) > 1 {
-						filePath := parts[0]
-						lineNum := parts[1]
-						fmt.Printf("%s on line %s ==> %s\n", filePath, lineNum, assertStr)
-
-						err = os.MkdirAll(filepath.Dir(filepath.Join("diff", filePath)), os.ModePerm)
-						if err != nil {
-							return err
-						}
-
-						f, err := os.Create(filepath.Join("diff", filePath))
-						if err != nil {
-							return err
-						}
-						f.Close()
-					} else {
-						fmt.Println("WHAT?? ", s)
-					}
+	return s, nil
+}
+
+// getCStringMap returns the MachO's cstrings by their virtual address
+func getCStringMap(m *macho.File) (map[uint64]string, error) {
+	strs := make(map[uint64]string)
+
+	for _, sec := range m.Sections {
+		if strings.HasPrefix(sec.Seg, "__PLK_") || strings.HasPrefix(sec.Seg, "__PRELINK_") {
+			continue
+		}
+		if sec.Flags.IsCstringLiterals() || strings.Contains(sec.Name, "cstring") {
+			dat := make([]byte, sec.Size)
+			if _, err := m.ReadAt(dat, int64(sec.Offset)); err != nil {
+				return nil, fmt.Errorf("failed to read cstrings in %s.%s: %v", sec.Seg, sec.Name, err)
+			}
+			var off uint64
+			for _, s := range bytes.Split(dat, []byte("\x00")) {
+				if len(s) > 0 {
+					strs[sec.Addr+off] = string(s)
 				}
+				off += uint64(len(s)) + 1
 			}
 		}
 	}
 
-	return nil
+	return strs, nil
+}
+
+// StringsDiff is the set difference of two string lists
+type StringsDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
 }
 
-func File2lines(filePath string) ([]string, error) {
-	f, err := os.Open(filePath)
+func (d StringsDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+func diffStrings(old, new []string) StringsDiff {
+	var d StringsDiff
+
+	inOld := make(map[string]bool)
+	for _, s := range old {
+		inOld[s] = true
+	}
+	inNew := make(map[string]bool)
+	for _, s := range new {
+		inNew[s] = true
+		if !inOld[s] {
+			d.Added = append(d.Added, s)
+		}
+	}
+	for _, s := range old {
+		if !inNew[s] {
+			d.Removed = append(d.Removed, s)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+
+	return d
+}
+
+// KextDiff describes how a kext changed between two kernelcaches
+type KextDiff struct {
+	ID               string      `json:"id"`
+	OldVersion       string      `json:"old_version,omitempty"`
+	NewVersion       string      `json:"new_version,omitempty"`
+	OldFunctions     int         `json:"old_functions"`
+	NewFunctions     int         `json:"new_functions"`
+	OldFunctionsSize uint64      `json:"old_functions_size"`
+	NewFunctionsSize uint64      `json:"new_functions_size"`
+	Strings          StringsDiff `json:"strings,omitempty"`
+}
+
+// SyscallDiff describes a syscall whose signature changed
+type SyscallDiff struct {
+	Old Syscall `json:"old"`
+	New Syscall `json:"new"`
+}
+
+// IOKitClassDiff describes an IOKit class whose size or superclass changed
+type IOKitClassDiff struct {
+	Old IOKitClass `json:"old"`
+	New IOKitClass `json:"new"`
+}
+
+// Diff is the semantic difference between two kernelcaches
+type Diff struct {
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+	Kexts struct {
+		Added   []string   `json:"added,omitempty"`
+		Removed []string   `json:"removed,omitempty"`
+		Changed []KextDiff `json:"changed,omitempty"`
+	} `json:"kexts"`
+	SymbolSets        map[string]StringsDiff `json:"symbolsets,omitempty"`
+	SandboxOperations StringsDiff            `json:"sandbox_operations"`
+	Syscalls          struct {
+		Added   []Syscall     `json:"added,omitempty"`
+		Removed []Syscall     `json:"removed,omitempty"`
+		Changed []SyscallDiff `json:"changed,omitempty"`
+	} `json:"syscalls"`
+	IOKitClasses struct {
+		Added   []IOKitClass     `json:"added,omitempty"`
+		Removed []IOKitClass     `json:"removed,omitempty"`
+		Changed []IOKitClassDiff `json:"changed,omitempty"`
+	} `json:"iokit_classes"`
+}
+
+// DiffKernelCaches diffs two kernelcaches (comparing fileset entries/kexts one by one)
+func DiffKernelCaches(oldKernel, newKernel string) (*Diff, error) {
+	utils.Indent(log.Info, 2)(fmt.Sprintf("Parsing %s", oldKernel))
+	old, err := Summarize(oldKernel)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	return LinesFromReader(f)
+	utils.Indent(log.Info, 2)(fmt.Sprintf("Parsing %s", newKernel))
+	new, err := Summarize(newKernel)
+	if err != nil {
+		return nil, err
+	}
+	return DiffSummaries(old, new), nil
 }
 
-func LinesFromReader(r io.Reader) ([]string, error) {
-	var lines []string
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+// DiffSummaries diffs two kernelcache summaries
+func DiffSummaries(old, new *Summary) *Diff {
+	d := &Diff{
+		Old:        old.Version,
+		New:        new.Version,
+		SymbolSets: make(map[string]StringsDiff),
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+
+	/* KEXTS */
+	for id, nk := range new.Kexts {
+		ok, found := old.Kexts[id]
+		if !found {
+			d.Kexts.Added = append(d.Kexts.Added, id)
+			continue
+		}
+		kd := KextDiff{
+			ID:               id,
+			OldVersion:       ok.Version,
+			NewVersion:       nk.Version,
+			OldFunctions:     ok.Functions,
+			NewFunctions:     nk.Functions,
+			OldFunctionsSize: ok.FunctionsSize,
+			NewFunctionsSize: nk.FunctionsSize,
+			Strings:          diffStrings(keys(ok.Strings), keys(nk.Strings)),
+		}
+		if kd.OldVersion != kd.NewVersion || kd.OldFunctions != kd.NewFunctions ||
+			kd.OldFunctionsSize != kd.NewFunctionsSize || !kd.Strings.empty() {
+			d.Kexts.Changed = append(d.Kexts.Changed, kd)
+		}
+	}
+	for id := range old.Kexts {
+		if _, found := new.Kexts[id]; !found {
+			d.Kexts.Removed = append(d.Kexts.Removed, id)
+		}
+	}
+	sort.Strings(d.Kexts.Added)
+	sort.Strings(d.Kexts.Removed)
+	sort.Slice(d.Kexts.Changed, func(i, j int) bool {
+		return d.Kexts.Changed[i].ID < d.Kexts.Changed[j].ID
+	})
+
+	/* SYMBOLSETS */
+	var ssetIDs []string
+	for id := range old.SymbolSets {
+		ssetIDs = append(ssetIDs, id)
+	}
+	for id := range new.SymbolSets {
+		if _, ok := old.SymbolSets[id]; !ok {
+			ssetIDs = append(ssetIDs, id)
+		}
+	}
+	for _, id := range ssetIDs {
+		if sd := diffStrings(old.SymbolSets[id], new.SymbolSets[id]); !sd.empty() {
+			d.SymbolSets[id] = sd
+		}
+	}
+
+	/* SANDBOX */
+	d.SandboxOperations = diffStrings(old.SandboxOperations, new.SandboxOperations)
+
+	/* SYSCALLS */
+	oldSyscalls := make(map[int]Syscall)
+	for _, s := range old.Syscalls {
+		oldSyscalls[s.Number] = s
+	}
+	newSyscalls := make(map[int]Syscall)
+	for _, s := range new.Syscalls {
+		newSyscalls[s.Number] = s
+		if prev, ok := oldSyscalls[s.Number]; !ok {
+			d.Syscalls.Added = append(d.Syscalls.Added, s)
+		} else if prev.NumArgs != s.NumArgs || prev.ArgBytes != s.ArgBytes || prev.ReturnType != s.ReturnType {
+			d.Syscalls.Changed = append(d.Syscalls.Changed, SyscallDiff{Old: prev, New: s})
+		}
 	}
+	for _, s := range old.Syscalls {
+		if _, ok := newSyscalls[s.Number]; !ok {
+			d.Syscalls.Removed = append(d.Syscalls.Removed, s)
+		}
+	}
+	sort.Slice(d.Syscalls.Added, func(i, j int) bool {
+		return d.Syscalls.Added[i].Number < d.Syscalls.Added[j].Number
+	})
+	sort.Slice(d.Syscalls.Removed, func(i, j int) bool {
+		return d.Syscalls.Removed[i].Number < d.Syscalls.Removed[j].Number
+	})
+	sort.Slice(d.Syscalls.Changed, func(i, j int) bool {
+		return d.Syscalls.Changed[i].New.Number < d.Syscalls.Changed[j].New.Number
+	})
 
-	return lines, nil
+	/* IOKIT */
+	oldClasses := make(map[string]IOKitClass)
+	for _, c := range old.IOKitClasses {
+		oldClasses[c.Name] = c
+	}
+	newClasses := make(map[string]IOKitClass)
+	for _, c := range new.IOKitClasses {
+		newClasses[c.Name] = c
+		if oc, ok := oldClasses[c.Name]; !ok {
+			d.IOKitClasses.Added = append(d.IOKitClasses.Added, c)
+		} else if oc.Size != c.Size || oc.Super != c.Super || oc.Kext != c.Kext {
+			d.IOKitClasses.Changed = append(d.IOKitClasses.Changed, IOKitClassDiff{Old: oc, New: c})
+		}
+	}
+	for _, c := range old.IOKitClasses {
+		if _, ok := newClasses[c.Name]; !ok {
+			d.IOKitClasses.Removed = append(d.IOKitClasses.Removed, c)
+		}
+	}
+	sort.Slice(d.IOKitClasses.Added, func(i, j int) bool {
+		return d.IOKitClasses.Added[i].Name < d.IOKitClasses.Added[j].Name
+	})
+	sort.Slice(d.IOKitClasses.Removed, func(i, j int) bool {
+		return d.IOKitClasses.Removed[i].Name < d.IOKitClasses.Removed[j].Name
+	})
+	sort.Slice(d.IOKitClasses.Changed, func(i, j int) bool {
+		return d.IOKitClasses.Changed[i].New.Name < d.IOKitClasses.Changed[j].New.Name
+	})
+
+	return d
 }
 
-// InsertStringToFile inserts sting to n-th line of file.
-// If you want to insert a line, append newline '\n' to the end of the string.
-func InsertStringToFile(path, str string, index int) error {
-	lines, err := File2lines(path)
-	if err != nil {
-		return err
+func keys(m map[string]bool) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
 	}
+	return out
+}
+
+// Markdown renders the diff as a Markdown report
+func (d *Diff) Markdown() string {
+	var sb strings.Builder
 
-	fileContent := ""
-	for i, line := range lines {
-		if i == index {
-			fileContent += str
+	sb.WriteString("# Kernelcache Diff\n\n")
+	if len(d.Old) > 0 || len(d.New) > 0 {
+		sb.WriteString(fmt.Sprintf("- **Old:** `%s`\n- **New:** `%s`\n\n", d.Old, d.New))
+	}
+
+	sb.WriteString("## Kexts\n\n")
+	if len(d.Kexts.Added) > 0 {
+		sb.WriteString(fmt.Sprintf("### 🆕 Added (%d)\n\n", len(d.Kexts.Added)))
+		for _, k := range d.Kexts.Added {
+			sb.WriteString(fmt.Sprintf("- `%s`\n", k))
+		}
+		sb.WriteString("\n")
+	}
+	if len(d.Kexts.Removed) > 0 {
+		sb.WriteString(fmt.Sprintf("### ❌ Removed (%d)\n\n", len(d.Kexts.Removed)))
+		for _, k := range d.Kexts.Removed {
+			sb.WriteString(fmt.Sprintf("- `%s`\n", k))
 		}
-		fileContent += line
-		fileContent += "\n"
+		sb.WriteString("\n")
+	}
+	if len(d.Kexts.Changed) > 0 {
+		sb.WriteString(fmt.Sprintf("### ⬆️ Changed (%d)\n\n", len(d.Kexts.Changed)))
+		sb.WriteString("| Kext | Version | Functions | Size |\n")
+		sb.WriteString("|------|---------|-----------|------|\n")
+		for _, k := range d.Kexts.Changed {
+			version := k.NewVersion
+			if k.OldVersion != k.NewVersion {
+				version = fmt.Sprintf("%s -> %s", k.OldVersion, k.NewVersion)
+			}
+			sb.WriteString(fmt.Sprintf("| `%s` | %s | %d (%+d) | %#x (%+d) |\n",
+				k.ID,
+				version,
+				k.NewFunctions, k.NewFunctions-k.OldFunctions,
+				k.NewFunctionsSize, int64(k.NewFunctionsSize)-int64(k.OldFunctionsSize)))
+		}
+		sb.WriteString("\n")
+		for _, k := range d.Kexts.Changed {
+			if k.Strings.empty() {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("#### `%s` strings\n\n", k.ID))
+			writeStringsDiff(&sb, k.Strings)
+		}
+	}
+
+	if len(d.SymbolSets) > 0 {
+		sb.WriteString("## Symbol Sets\n\n")
+		var ids []string
+		for id := range d.SymbolSets {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			sb.WriteString(fmt.Sprintf("### `%s`\n\n", id))
+			writeStringsDiff(&sb, d.SymbolSets[id])
+		}
+	}
+
+	if !d.SandboxOperations.empty() {
+		sb.WriteString("## Sandbox Operations\n\n")
+		writeStringsDiff(&sb, d.SandboxOperations)
 	}
 
-	return ioutil.WriteFile(path, []byte(fileContent), 0644)
+	if len(d.Syscalls.Added)+len(d.Syscalls.Removed)+len(d.Syscalls.Changed) > 0 {
+		sb.WriteString("## Syscalls\n\n")
+		for _, s := range d.Syscalls.Added {
+			sb.WriteString(fmt.Sprintf("- 🆕 `%s`\n", s))
+		}
+		for _, s := range d.Syscalls.Removed {
+			sb.WriteString(fmt.Sprintf("- ❌ `%s`\n", s))
+		}
+		for _, s := range d.Syscalls.Changed {
+			sb.WriteString(fmt.Sprintf("- ⬆️ `%s` -> `%s`\n", s.Old, s.New))
+		}
+		sb.WriteString("\n")
+	}
+
+	if len(d.IOKitClasses.Added)+len(d.IOKitClasses.Removed)+len(d.IOKitClasses.Changed) > 0 {
+		sb.WriteString("## IOKit Classes\n\n")
+		for _, c := range d.IOKitClasses.Added {
+			sb.WriteString(fmt.Sprintf("- 🆕 `%s` (size: %#x, super: %s, kext: %s)\n", c.Name, c.Size, c.Super, c.Kext))
+		}
+		for _, c := range d.IOKitClasses.Removed {
+			sb.WriteString(fmt.Sprintf("- ❌ `%s` (size: %#x, kext: %s)\n", c.Name, c.Size, c.Kext))
+		}
+		for _, c := range d.IOKitClasses.Changed {
+			sb.WriteString(fmt.Sprintf("- ⬆️ `%s` size: %#x -> %#x, super: %s -> %s, kext: %s -> %s\n",
+				c.New.Name, c.Old.Size, c.New.Size, c.Old.Super, c.New.Super, c.Old.Kext, c.New.Kext))
+		}
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+func writeStringsDiff(sb *strings.Builder, d StringsDiff) {
+	sb.WriteString("```diff\n")
+	for _, s := range d.Added {
+		sb.WriteString(fmt.Sprintf("+ %q\n", s))
+	}
+	for _, s := range d.Removed {
+		sb.WriteString(fmt.Sprintf("- %q\n", s))
+	}
+	sb.WriteString("```\n\n")
 }
@@ -0,0 +1,150 @@
+package kernelcache
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+)
+
+// EntitlementCheck is a call to an entitlement check function with a constant entitlement
+type EntitlementCheck struct {
+	Entitlement   string `json:"entitlement"`
+	Kext          string `json:"kext"`
+	Function      uint64 `json:"function"`
+	Symbol        string `json:"symbol,omitempty"`
+	Address       uint64 `json:"address"`
+	Checker       uint64 `json:"checker"`
+	CheckerSymbol string `json:"checker_symbol,omitempty"`
+}
+
+// symbols of known entitlement check functions (IOTaskHasEntitlement, IOCurrentTaskHasEntitlement,
+// IOUserClient::copyClientEntitlement, IOVnodeHasEntitlement, etc.)
+var entCheckerSymRE = regexp.MustCompile(`(?i)(Has|Get|Copy\w*)_?Entitlement|entitlement_(check|get|copy)|check_entitlement`)
+
+// reverse-DNS entitlements (com.apple.private.xyz) and well-known unprefixed ones
+var (
+	entitlementRE       = regexp.MustCompile(`^[a-z][a-z0-9\-]*(\.[A-Za-z0-9_\-]+){2,}$`)
+	legacyEntitlementRE = regexp.MustCompile(`^(get-task-allow|task_for_pid-allow|run-unsigned-code|dynamic-codesigning|platform-application|[a-z\-]+-allow)$`)
+)
+
+const (
+	minEntCheckerCalls = 3   // minimum number of entitlement-like string arguments for an unnamed checker
+	minEntCheckerRatio = 0.5 // minimum ratio of entitlement-like to any string arguments for an unnamed checker
+)
+
+func isEntitlement(s string) bool {
+	return entitlementRE.MatchString(s) || legacyEntitlementRE.MatchString(s)
+}
+
+// GetEntitlementChecks finds all the calls to entitlement check functions in the kernelcache
+// and recovers their constant entitlement string argument.
+//
+// Checkers are identified by name when symbols are available (the kernelcache's own or
+// a .a2s cache) and otherwise by being called mostly with entitlement-like strings.
+func GetEntitlementChecks(r io.ReaderAt, m *macho.File, symbols map[uint64]string) ([]EntitlementCheck, error) {
+	kexts, err := GetKexts(r, m)
+	if err != nil {
+		return nil, err
+	}
+	base := getKernelCacheBase(m)
+	syms := getSymbolMap(kexts, symbols)
+
+	type strCall struct {
+		kext string
+		call CallSite
+		strs []string // constant string arguments (in argument order)
+	}
+
+	var calls []strCall
+	entCount := make(map[uint64]int)
+	strCount := make(map[uint64]int)
+
+	for _, kext := range kexts {
+		cstrs, err := getCStringMap(kext.File)
+		if err != nil {
+			log.Debugf("failed to get cstrings for %s: %v", kext.ID, err)
+			continue
+		}
+		sites, err := getCallSites(kext.File, base)
+		if err != nil {
+			log.Debugf("failed to get call sites for %s: %v", kext.ID, err)
+			continue
+		}
+		for _, call := range sites {
+			var strs []string
+			for i := 0; i < len(call.Args); i++ {
+				if !call.Known[i] {
+					continue
+				}
+				if s, ok := cstrs[call.Args[i]]; ok {
+					strs = append(strs, s)
+				}
+			}
+			if len(strs) == 0 {
+				continue
+			}
+			strCount[call.Target]++
+			for _, s := range strs {
+				if isEntitlement(s) {
+					entCount[call.Target]++
+					break
+				}
+			}
+			calls = append(calls, strCall{kext: kext.ID, call: call, strs: strs})
+		}
+	}
+
+	checkers := make(map[uint64]bool)
+	for target, count := range strCount {
+		if sym, ok := syms[target]; ok && entCheckerSymRE.MatchString(sym) {
+			checkers[target] = true
+		} else if entCount[target] >= minEntCheckerCalls && float64(entCount[target])/float64(count) >= minEntCheckerRatio {
+			checkers[target] = true
+		}
+	}
+	if len(checkers) == 0 {
+		return nil, fmt.Errorf("failed to find any entitlement check functions")
+	}
+	for target := range checkers {
+		log.Debugf("entitlement checker %#x %s (%d calls)", target, syms[target], strCount[target])
+	}
+
+	var checks []EntitlementCheck
+	for _, sc := range calls {
+		if !checkers[sc.call.Target] {
+			continue
+		}
+		var ent string
+		for _, s := range sc.strs {
+			if isEntitlement(s) {
+				ent = s
+				break
+			}
+		}
+		if len(ent) == 0 {
+			continue // not called with an entitlement (e.g. a checker's other string arguments)
+		}
+		checks = append(checks, EntitlementCheck{
+			Entitlement:   ent,
+			Kext:          sc.kext,
+			Function:      sc.call.Function,
+			Symbol:        syms[sc.call.Function],
+			Address:       sc.call.Address,
+			Checker:       sc.call.Target,
+			CheckerSymbol: syms[sc.call.Target],
+		})
+	}
+
+	sort.Slice(checks, func(i, j int) bool {
+		if checks[i].Entitlement != checks[j].Entitlement {
+			return checks[i].Entitlement < checks[j].Entitlement
+		}
+		return checks[i].Address < checks[j].Address
+	})
+
+	return checks, nil
+}
@@ -0,0 +1,236 @@
+package kernelcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/pkg/fixupchains"
+	"github.com/blacktop/go-macho/types"
+	"github.com/blacktop/ipsw/internal/utils"
+)
+
+const (
+	machHeader64Size = 32
+	segment64Size    = 72
+	section64Size    = 80
+	kextSegAlign     = 0x4000
+)
+
+type segmentLayout struct {
+	oldOff  uint64
+	newOff  uint64
+	size    uint64
+	isData  bool
+	cmdOff  int // offset of the LC_SEGMENT_64 in the load commands
+	nsects  uint32
+	segname string
+}
+
+// ExportKext writes the kext as a standalone MachO.
+//
+// Prelinked kexts have their segments laid out for the whole kernelcache, so the segments
+// are copied one after another (page aligned) and every file offset in the load commands is fixed up.
+// Tagged pointers in the kext's data segments are untagged; vmaddrs are left untouched.
+func ExportKext(r io.ReaderAt, m *macho.File, kextID, dest string) error {
+	if m.FileTOC.FileHeader.Type == types.FileSet {
+		var dcf *fixupchains.DyldChainedFixups
+		var err error
+		if m.HasFixups() {
+			dcf, err = m.DyldChainedFixups()
+			if err != nil {
+				return fmt.Errorf("failed to parse fixups: %v", err)
+			}
+		}
+		for _, fs := range m.FileSets() {
+			if fs.EntryID == kextID {
+				entry, err := getFileSetEntry(r, fs)
+				if err != nil {
+					return fmt.Errorf("failed to parse entry %s: %v", kextID, err)
+				}
+				return entry.Export(dest, dcf, m.GetBaseAddress(), nil)
+			}
+		}
+		return fmt.Errorf("fileset does NOT contain %s", kextID)
+	}
+
+	kexts, err := GetKexts(r, m)
+	if err != nil {
+		return err
+	}
+	for _, kext := range kexts {
+		if kext.ID == kextID && kext.File != m {
+			return exportPrelinkedKext(r, kext.File, dest)
+		}
+	}
+
+	return fmt.Errorf("kernelcache does NOT contain a kext with code named %s", kextID)
+}
+
+func exportPrelinkedKext(r io.ReaderAt, k *macho.File, dest string) error {
+	text := k.Segment("__TEXT")
+	if text == nil {
+		return fmt.Errorf("kext has no __TEXT segment")
+	}
+	hdrOff := text.Offset
+
+	hdr := make([]byte, machHeader64Size+k.FileHeader.SizeCommands)
+	if _, err := r.ReadAt(hdr, int64(hdrOff)); err != nil {
+		return fmt.Errorf("failed to read kext header: %v", err)
+	}
+	if types.Magic(binary.LittleEndian.Uint32(hdr)) != types.Magic64 {
+		return fmt.Errorf("kext header at %#x is not a 64-bit MachO", hdrOff)
+	}
+
+	/* collect segments */
+	var segs []*segmentLayout
+	ncmds := binary.LittleEndian.Uint32(hdr[16:])
+	cmdOff := machHeader64Size
+	for i := uint32(0); i < ncmds; i++ {
+		cmd := types.LoadCmd(binary.LittleEndian.Uint32(hdr[cmdOff:]))
+		cmdSize := int(binary.LittleEndian.Uint32(hdr[cmdOff+4:]))
+		if cmd == types.LC_SEGMENT_64 {
+			segname := string(bytes.TrimRight(hdr[cmdOff+8:cmdOff+24], "\x00"))
+			segs = append(segs, &segmentLayout{
+				oldOff:  binary.LittleEndian.Uint64(hdr[cmdOff+40:]),
+				size:    binary.LittleEndian.Uint64(hdr[cmdOff+48:]),
+				isData:  bytes.Contains([]byte(segname), []byte("DATA")),
+				cmdOff:  cmdOff,
+				nsects:  binary.LittleEndian.Uint32(hdr[cmdOff+64:]),
+				segname: segname,
+			})
+		}
+		cmdOff += cmdSize
+	}
+
+	/* lay them out back to back (__TEXT first as it contains the header) */
+	sort.SliceStable(segs, func(i, j int) bool {
+		if segs[i].oldOff == hdrOff {
+			return true
+		}
+		if segs[j].oldOff == hdrOff {
+			return false
+		}
+		return segs[i].oldOff < segs[j].oldOff
+	})
+	var cursor uint64
+	for _, seg := range segs {
+		if seg.size == 0 {
+			seg.newOff = 0
+			continue
+		}
+		seg.newOff = cursor
+		cursor += seg.size
+		if seg.segname != "__LINKEDIT" {
+			cursor = (cursor + kextSegAlign - 1) &^ (kextSegAlign - 1)
+		}
+	}
+
+	// translate an old (kernelcache) file offset into the new file
+	fixOff := func(off uint64) (uint64, bool) {
+		for _, seg := range segs {
+			if seg.size > 0 && off >= seg.oldOff && off < seg.oldOff+seg.size {
+				return off - seg.oldOff + seg.newOff, true
+			}
+		}
+		return 0, false
+	}
+
+	/* fix up the load commands */
+	cmdOff = machHeader64Size
+	for i := uint32(0); i < ncmds; i++ {
+		cmd := types.LoadCmd(binary.LittleEndian.Uint32(hdr[cmdOff:]))
+		cmdSize := int(binary.LittleEndian.Uint32(hdr[cmdOff+4:]))
+		lc := hdr[cmdOff : cmdOff+cmdSize]
+
+		switch cmd {
+		case types.LC_SEGMENT_64:
+			for _, seg := range segs {
+				if seg.cmdOff != cmdOff {
+					continue
+				}
+				binary.LittleEndian.PutUint64(lc[40:], seg.newOff)
+				for s := 0; s < int(seg.nsects); s++ {
+					sect := lc[segment64Size+s*section64Size:]
+					if off := binary.LittleEndian.Uint32(sect[48:]); off != 0 {
+						binary.LittleEndian.PutUint32(sect[48:], uint32(uint64(off)-seg.oldOff+seg.newOff))
+					}
+					binary.LittleEndian.PutUint32(sect[56:], 0) // reloff
+					binary.LittleEndian.PutUint32(sect[60:], 0) // nreloc
+				}
+			}
+		case types.LC_SYMTAB:
+			symOff, ok1 := fixOff(uint64(binary.LittleEndian.Uint32(lc[8:])))
+			strOff, ok2 := fixOff(uint64(binary.LittleEndian.Uint32(lc[16:])))
+			if ok1 && ok2 {
+				binary.LittleEndian.PutUint32(lc[8:], uint32(symOff))
+				binary.LittleEndian.PutUint32(lc[16:], uint32(strOff))
+			} else { // symbols live in the kernel's __LINKEDIT
+				for o := 8; o < 24; o += 4 {
+					binary.LittleEndian.PutUint32(lc[o:], 0)
+				}
+			}
+		case types.LC_DYSYMTAB:
+			for o := 32; o+8 <= 80; o += 8 { // (offset, count) pairs
+				if off, ok := fixOff(uint64(binary.LittleEndian.Uint32(lc[o:]))); ok {
+					binary.LittleEndian.PutUint32(lc[o:], uint32(off))
+				} else {
+					binary.LittleEndian.PutUint32(lc[o:], 0)
+					binary.LittleEndian.PutUint32(lc[o+4:], 0)
+				}
+			}
+		case types.LC_FUNCTION_STARTS, types.LC_DATA_IN_CODE, types.LC_CODE_SIGNATURE, types.LC_SEGMENT_SPLIT_INFO,
+			types.LC_DYLD_CHAINED_FIXUPS, types.LC_DYLD_EXPORTS_TRIE, types.LC_LINKER_OPTIMIZATION_HINT:
+			if off, ok := fixOff(uint64(binary.LittleEndian.Uint32(lc[8:]))); ok {
+				binary.LittleEndian.PutUint32(lc[8:], uint32(off))
+			} else {
+				binary.LittleEndian.PutUint32(lc[8:], 0)
+				binary.LittleEndian.PutUint32(lc[12:], 0)
+			}
+		}
+
+		cmdOff += cmdSize
+	}
+
+	/* write out the new MachO */
+	out := make([]byte, cursor)
+	for _, seg := range segs {
+		if seg.size == 0 {
+			continue
+		}
+		dat := out[seg.newOff : seg.newOff+seg.size]
+		if _, err := r.ReadAt(dat, int64(seg.oldOff)); err != nil {
+			return fmt.Errorf("failed to read segment %s: %v", seg.segname, err)
+		}
+		if seg.isData {
+			untagPointers(dat)
+		}
+	}
+	copy(out, hdr)
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dest, out, 0644); err != nil {
+		return fmt.Errorf("failed to write kext: %v", err)
+	}
+	utils.Indent(log.Debug, 2)(fmt.Sprintf("Wrote %d segments (%#x bytes)", len(segs), len(out)))
+
+	return nil
+}
+
+// untagPointers replaces the tagged pointers (iOS 12+ prelinked kernelcaches) in a data segment with their kernel vmaddrs
+func untagPointers(dat []byte) {
+	for off := 0; off+8 <= len(dat); off += 8 {
+		ptr := binary.LittleEndian.Uint64(dat[off:])
+		if tag := getTag(ptr); tag != 0 && tag != 0xffff && (ptr>>32)&0xffff >= 0xfff0 {
+			binary.LittleEndian.PutUint64(dat[off:], unTag(ptr))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package kernelcache
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/blacktop/go-macho"
+)
+
+// IOKitClass is a C++ class registered with the IOKit runtime via OSMetaClass::OSMetaClass
+type IOKitClass struct {
+	Name       string `json:"name"`
+	Super      string `json:"super,omitempty"`
+	Size       uint64 `json:"size"`
+	Kext       string `json:"kext"`
+	MetaClass  uint64 `json:"meta_class"`
+	superClass uint64
+}
+
+var classNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{1,127}$`)
+
+// GetIOKitClasses finds all calls to OSMetaClass::OSMetaClass(this, className, superMetaClass, classSize)
+// in the kernelcache and returns the classes they register
+func GetIOKitClasses(r io.ReaderAt, m *macho.File) ([]IOKitClass, error) {
+	kexts, err := GetKexts(r, m)
+	if err != nil {
+		return nil, err
+	}
+	return getIOKitClasses(kexts, getKernelCacheBase(m))
+}
+
+func getIOKitClasses(kexts []Kext, base uint64) ([]IOKitClass, error) {
+	type candidate struct {
+		target uint64
+		class  IOKitClass
+	}
+
+	var candidates []candidate
+	counts := make(map[uint64]int)
+
+	for _, kext := range kexts {
+		calls, err := getCallSites(kext.File, base)
+		if err != nil {
+			log.Debugf("failed to get call sites for %s: %v", kext.ID, err)
+			continue
+		}
+		for _, call := range calls {
+			if !call.Known[0] || !call.Known[1] || !call.Known[3] || call.Args[3] == 0 || call.Args[3] > 0x100000 {
+				continue
+			}
+			name, err := kext.GetCString(call.Args[1])
+			if err != nil || !classNameRE.MatchString(name) {
+				continue
+			}
+			class := IOKitClass{
+				Name:      name,
+				Size:      call.Args[3],
+				Kext:      kext.ID,
+				MetaClass: call.Args[0],
+			}
+			if call.Known[2] {
+				class.superClass = call.Args[2]
+			}
+			candidates = append(candidates, candidate{target: call.Target, class: class})
+			counts[call.Target]++
+		}
+	}
+
+	// OSMetaClass::OSMetaClass is by far the most common callee with this argument pattern
+	var ctor uint64
+	for target, count := range counts {
+		if count > counts[ctor] {
+			ctor = target
+		}
+	}
+	if ctor == 0 {
+		return nil, fmt.Errorf("failed to locate OSMetaClass::OSMetaClass")
+	}
+	log.Debugf("OSMetaClass::OSMetaClass found at %#x (%d calls)", ctor, counts[ctor])
+
+	var classes []IOKitClass
+	metaClasses := make(map[uint64]string)
+	for _, c := range candidates {
+		if c.target == ctor {
+			classes = append(classes, c.class)
+			metaClasses[c.class.MetaClass] = c.class.Name
+		}
+	}
+	for idx, class := range classes {
+		if super, ok := metaClasses[class.superClass]; ok {
+			classes[idx].Super = super
+		}
+	}
+
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i].Name < classes[j].Name
+	})
+
+	return classes, nil
+}
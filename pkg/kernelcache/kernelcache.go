@@ -17,6 +17,7 @@ import (
 	"github.com/blacktop/go-macho"
 	"github.com/blacktop/go-macho/types"
 	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/img3"
 	"github.com/blacktop/ipsw/pkg/info"
 	"github.com/blacktop/ipsw/pkg/lzfse"
 	"github.com/blacktop/lzss"
@@ -39,8 +40,12 @@ type CompressedCache struct {
 	Data   []byte
 }
 
-// ParseImg4Data parses a img4 data containing a compressed kernelcache.
+// ParseImg4Data parses a img4 (or img3) data containing a compressed kernelcache.
 func ParseImg4Data(data []byte) (*CompressedCache, error) {
+	if img3.IsImg3(data) {
+		return ParseImg3Data(data, nil, nil)
+	}
+
 	utils.Indent(log.Debug, 2)("Parsing Kernelcache IMG4")
 
 	// NOTE: openssl asn1parse -i -inform DER -in kernelcache.iphone10 | less (to get offset)
@@ -65,6 +70,49 @@ func ParseImg4Data(data []byte) (*CompressedCache, error) {
 	return &cc, nil
 }
 
+// ParseImg3Data parses a img3 data containing a compressed kernelcache, decrypting it with the (GID decrypted) IV and key
+func ParseImg3Data(data, iv, key []byte) (*CompressedCache, error) {
+	utils.Indent(log.Debug, 2)("Parsing Kernelcache IMG3")
+
+	i, err := img3.Parse(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse kernelcache Img3")
+	}
+
+	dat := i.Data()
+	if len(key) > 0 {
+		dat, err = i.Decrypt(iv, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decrypt kernelcache Img3")
+		}
+	} else if i.Encrypted() && !bytes.HasPrefix(dat, []byte("complzss")) {
+		return nil, img3.ErrEncrypted
+	}
+	if len(dat) < 8 {
+		return nil, errors.New("kernelcache Img3 DATA too short")
+	}
+
+	return &CompressedCache{
+		Magic: dat[:4],
+		Size:  len(dat),
+		Data:  dat,
+	}, nil
+}
+
+// lookupImg3Key looks up the key of an encrypted Img3 kernelcache in the firmware key database
+func lookupImg3Key(devices []string, build string) ([]byte, []byte, error) {
+	db, err := info.GetKeyDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, device := range devices {
+		if key, err := db.Lookup(device, build, "KernelCache", ""); err == nil {
+			return key.IVKey()
+		}
+	}
+	return nil, nil, fmt.Errorf("failed to find kernelcache key for devices: %s, build: %s", strings.Join(devices, ", "), build)
+}
+
 // Extract extracts and decompresses a kernelcache from ipsw
 func Extract(ipsw, destPath string) error {
 	log.Debug("Extracting Kernelcache from IPSW")
@@ -91,6 +139,17 @@ func Extract(ipsw, destPath string) error {
 		}
 
 		kc, err := ParseImg4Data(content)
+		if errors.Is(err, img3.ErrEncrypted) {
+			devices := i.GetDevicesForKernelCache(filepath.Base(kcache))
+			if len(devices) == 0 {
+				devices = i.Plists.BuildManifest.SupportedProductTypes
+			}
+			iv, key, kerr := lookupImg3Key(devices, i.Plists.BuildManifest.ProductBuildVersion)
+			if kerr != nil {
+				return errors.Wrap(kerr, "kernelcache Img3 is encrypted")
+			}
+			kc, err = ParseImg3Data(content, iv, key)
+		}
 		if err != nil {
 			return errors.Wrap(err, "failed parse compressed kernelcache Img4")
 		}
@@ -115,12 +174,22 @@ func Extract(ipsw, destPath string) error {
 
 // Decompress decompresses a compressed kernelcache
 func Decompress(kcache string) error {
+	return DecompressWithKey(kcache, nil, nil)
+}
+
+// DecompressWithKey decompresses a kernelcache, decrypting it first with the (GID decrypted) IV and key if it is an encrypted Img3
+func DecompressWithKey(kcache string, iv, key []byte) error {
 	content, err := ioutil.ReadFile(kcache)
 	if err != nil {
 		return errors.Wrap(err, "failed to read Kernelcache")
 	}
 
-	kc, err := ParseImg4Data(content)
+	var kc *CompressedCache
+	if len(key) > 0 && img3.IsImg3(content) {
+		kc, err = ParseImg3Data(content, iv, key)
+	} else {
+		kc, err = ParseImg4Data(content)
+	}
 	if err != nil {
 		return errors.Wrap(err, "failed parse compressed kernelcache Img4")
 	}
@@ -144,7 +213,7 @@ func Decompress(kcache string) error {
 func DecompressData(cc *CompressedCache) ([]byte, error) {
 	utils.Indent(log.Debug, 2)("Decompressing Kernelcache")
 
-	if bytes.Contains(cc.Magic, []byte("bvx2")) { // LZFSE
+	if bytes.HasPrefix(cc.Magic, []byte("bvx")) { // LZFSE
 		utils.Indent(log.Debug, 3)("Kernelcache is LZFSE compressed")
 
 		// dat := lzfse.DecodeBuffer(cc.Data)
@@ -203,7 +272,7 @@ func DecompressData(cc *CompressedCache) ([]byte, error) {
 		cc.Data = buffer.Next(int(lzssHeader.CompressedSize))
 		dec := lzss.Decompress(cc.Data)
 		return dec[:], nil
-	} else if types.Magic(binary.LittleEndian.Uint64(cc.Data[0:8])) == types.Magic64 { // uncompressed
+	} else if magic := types.Magic(binary.LittleEndian.Uint32(cc.Data[0:4])); magic == types.Magic64 || magic == types.Magic32 { // uncompressed
 		return cc.Data, nil
 	}
 
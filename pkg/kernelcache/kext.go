@@ -11,6 +11,7 @@ import (
 	"github.com/apex/log"
 	"github.com/blacktop/go-macho"
 	"github.com/blacktop/go-macho/pkg/fixupchains"
+	"github.com/blacktop/go-macho/types"
 	"github.com/blacktop/go-plist"
 )
 
@@ -183,6 +184,123 @@ func findCStringVMaddr(m *macho.File, cstr string) (uint64, error) {
 	return 0, fmt.Errorf("string not found in MachO")
 }
 
+// GetPrelinkInfo returns the parsed __PRELINK_INFO.__info plist of the kernelcache
+func GetPrelinkInfo(m *macho.File) (*PrelinkInfo, error) {
+	infoSec := m.Section("__PRELINK_INFO", "__info")
+	if infoSec == nil {
+		return nil, fmt.Errorf("section __PRELINK_INFO.__info not found")
+	}
+
+	data, err := infoSec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read __PRELINK_INFO.__info section: %v", err)
+	}
+
+	var prelink PrelinkInfo
+	decoder := plist.NewDecoder(bytes.NewReader(bytes.Trim([]byte(data), "\x00")))
+	if err := decoder.Decode(&prelink); err != nil {
+		return nil, fmt.Errorf("failed to decode __PRELINK_INFO.__info section: %v", err)
+	}
+
+	return &prelink, nil
+}
+
+// Kext is a kernel extension (or the kernel itself) contained in a kernelcache
+type Kext struct {
+	ID      string
+	Version string
+	Bundle  *CFBundle
+	*macho.File
+}
+
+// GetKexts returns the kernel and every kext in the kernelcache parsed as their own MachO.
+//
+// For fileset kernelcaches each LC_FILESET_ENTRY is returned, for older prelinked
+// kernelcaches the embedded kext MachO headers are located via __PRELINK_INFO.
+func GetKexts(r io.ReaderAt, m *macho.File) ([]Kext, error) {
+	var kexts []Kext
+
+	bundles := make(map[string]*CFBundle)
+	prelink, err := GetPrelinkInfo(m)
+	if err != nil {
+		log.Debugf("failed to get prelink info: %v", err)
+	} else {
+		for idx, bundle := range prelink.PrelinkInfoDictionary {
+			bundles[bundle.ID] = &prelink.PrelinkInfoDictionary[idx]
+		}
+	}
+
+	if m.FileTOC.FileHeader.Type == types.FileSet {
+		for _, fs := range m.FileSets() {
+			entry, err := getFileSetEntry(r, fs)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse fileset entry %s: %v", fs.EntryID, err)
+			}
+			kext := Kext{ID: fs.EntryID, File: entry}
+			if bundle, ok := bundles[fs.EntryID]; ok {
+				kext.Version = bundle.Version
+				kext.Bundle = bundle
+			}
+			kexts = append(kexts, kext)
+		}
+		return kexts, nil
+	}
+
+	kexts = append(kexts, Kext{ID: "com.apple.kernel", File: m})
+
+	if prelink == nil {
+		return kexts, nil
+	}
+
+	kextStartAdddrs, err := getKextStartVMAddrs(m)
+	if err != nil {
+		log.Debugf("failed to get kext start addresses: %v", err)
+	}
+
+	for idx, bundle := range prelink.PrelinkInfoDictionary {
+		var addr uint64
+		if bundle.ExecutableLoadAddr != 0 {
+			addr = bundle.ExecutableLoadAddr
+		} else if !bundle.OSKernelResource && int(bundle.ModuleIndex) < len(kextStartAdddrs) {
+			addr = kextStartAdddrs[bundle.ModuleIndex] | tagPtrMask
+		} else {
+			continue // codeless kext
+		}
+		off, err := m.GetOffset(addr)
+		if err != nil {
+			log.Debugf("failed to get offset for kext %s at %#x: %v", bundle.ID, addr, err)
+			continue
+		}
+		kf, err := getEmbeddedMachO(r, off)
+		if err != nil {
+			log.Debugf("failed to parse kext %s at %#x: %v", bundle.ID, addr, err)
+			continue
+		}
+		kexts = append(kexts, Kext{
+			ID:      bundle.ID,
+			Version: bundle.Version,
+			Bundle:  &prelink.PrelinkInfoDictionary[idx],
+			File:    kf,
+		})
+	}
+
+	return kexts, nil
+}
+
+// getFileSetEntry parses the fileset entry as a MachO (matching the exact entry ID unlike macho.GetFileSetFileByName)
+func getFileSetEntry(r io.ReaderAt, fs *macho.FilesetEntry) (*macho.File, error) {
+	return getEmbeddedMachO(r, fs.Offset)
+}
+
+// getEmbeddedMachO parses a MachO whose load commands use file offsets relative to the start of the kernelcache
+func getEmbeddedMachO(r io.ReaderAt, offset uint64) (*macho.File, error) {
+	var vma types.VMAddrConverter
+	return macho.NewFile(io.NewSectionReader(r, int64(offset), 1<<63-1), macho.FileConfig{
+		Offset:        int64(offset),
+		SectionReader: types.NewCustomSectionReader(r, &vma, 0, 1<<63-1),
+	})
+}
+
 // KextList lists all the kernel extensions in the kernelcache
 func KextList(kernel string, diffable bool) ([]string, error) {
 	var out []string
@@ -198,18 +316,11 @@ func KextList(kernel string, diffable bool) ([]string, error) {
 		log.Debugf("failed to get kext start addresses: %v", err)
 	}
 
-	if infoSec := m.Section("__PRELINK_INFO", "__info"); infoSec != nil {
-
-		data, err := infoSec.Data()
-		if err != nil {
-			return nil, fmt.Errorf("failed to read __PRELINK_INFO.__info section: %v", err)
-		}
+	if m.Section("__PRELINK_INFO", "__info") != nil {
 
-		var prelink PrelinkInfo
-		decoder := plist.NewDecoder(bytes.NewReader(bytes.Trim([]byte(data), "\x00")))
-		err = decoder.Decode(&prelink)
+		prelink, err := GetPrelinkInfo(m)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode __PRELINK_INFO.__info section: %v", err)
+			return nil, err
 		}
 
 		if diffable {
@@ -231,3 +342,99 @@ func KextList(kernel string, diffable bool) ([]string, error) {
 
 	return out, nil
 }
+
+// KextDependencies is the kext dependency graph (bundle ID -> OSBundleLibraries bundle IDs)
+type KextDependencies map[string][]string
+
+// GetKextDependencies builds the kext dependency graph from the __PRELINK_INFO OSBundleLibraries
+func GetKextDependencies(m *macho.File) (KextDependencies, error) {
+	prelink, err := GetPrelinkInfo(m)
+	if err != nil {
+		return nil, err
+	}
+
+	deps := make(KextDependencies)
+	for _, bundle := range prelink.PrelinkInfoDictionary {
+		var libs []string
+		for lib := range bundle.OSBundleLibraries {
+			libs = append(libs, lib)
+		}
+		sort.Strings(libs)
+		deps[bundle.ID] = libs
+	}
+
+	return deps, nil
+}
+
+// Dependents returns the kexts that directly depend on the given kext
+func (d KextDependencies) Dependents(id string) []string {
+	var out []string
+	for kext, libs := range d {
+		for _, lib := range libs {
+			if lib == id {
+				out = append(out, kext)
+				break
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Subgraph returns the part of the graph reachable from the given kext,
+// following its dependencies or (if reverse is set) its dependents
+func (d KextDependencies) Subgraph(id string, reverse bool) KextDependencies {
+	sub := make(KextDependencies)
+	queue := []string{id}
+	for len(queue) > 0 {
+		kext := queue[0]
+		queue = queue[1:]
+		if _, seen := sub[kext]; seen {
+			continue
+		}
+		if reverse {
+			sub[kext] = nil
+			for _, dep := range d.Dependents(kext) {
+				queue = append(queue, dep)
+			}
+		} else {
+			sub[kext] = d[kext]
+			queue = append(queue, d[kext]...)
+		}
+	}
+	if reverse { // re-add the edges between the collected dependents
+		for kext := range sub {
+			for _, lib := range d[kext] {
+				if _, ok := sub[lib]; ok {
+					sub[kext] = append(sub[kext], lib)
+				}
+			}
+		}
+	}
+	return sub
+}
+
+// DOT renders the dependency graph in the graphviz DOT language
+func (d KextDependencies) DOT() string {
+	var kexts []string
+	for kext := range d {
+		kexts = append(kexts, kext)
+	}
+	sort.Strings(kexts)
+
+	var sb strings.Builder
+	sb.WriteString("digraph kexts {\n")
+	sb.WriteString("\trankdir=LR;\n")
+	sb.WriteString("\tnode [shape=box];\n")
+	for _, kext := range kexts {
+		if len(d[kext]) == 0 {
+			sb.WriteString(fmt.Sprintf("\t%q;\n", kext))
+		}
+		for _, lib := range d[kext] {
+			sb.WriteString(fmt.Sprintf("\t%q -> %q;\n", kext, lib))
+		}
+	}
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
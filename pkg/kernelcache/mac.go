@@ -0,0 +1,395 @@
+package kernelcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/arm64-cgo/disassemble"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/types"
+)
+
+const (
+	macPolicyConfSize = 80
+	maxMacPolicyOps   = 512 // upper bound on the mac_policy_ops slots when no header is given
+)
+
+// MacPolicyHook is an implemented mac_policy_ops hook
+type MacPolicyHook struct {
+	Index   int    `json:"index"`
+	Name    string `json:"name,omitempty"`
+	Handler uint64 `json:"handler"`
+	Symbol  string `json:"symbol,omitempty"`
+}
+
+func (h MacPolicyHook) String() string {
+	name := h.Name
+	if len(name) == 0 {
+		name = fmt.Sprintf("ops[%d]", h.Index)
+	}
+	if len(h.Symbol) > 0 {
+		return fmt.Sprintf("%-50s %#x (%s)", name, h.Handler, h.Symbol)
+	}
+	return fmt.Sprintf("%-50s %#x", name, h.Handler)
+}
+
+// MacPolicy is a MACF policy registered with mac_policy_register(struct mac_policy_conf *, ...)
+type MacPolicy struct {
+	Name          string          `json:"name"`
+	FullName      string          `json:"full_name"`
+	Kext          string          `json:"kext"`
+	Conf          uint64          `json:"mac_policy_conf"`
+	Ops           uint64          `json:"mac_policy_ops"`
+	LoadTimeFlags uint32          `json:"load_time_flags"`
+	LabelNames    []string        `json:"label_names,omitempty"`
+	Hooks         []MacPolicyHook `json:"hooks"`
+	// Dynamic is set when the ops were filled in at runtime and recovered from the kext's stores
+	Dynamic bool `json:"dynamic,omitempty"`
+}
+
+var (
+	macPolicyNameRE   = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,64}$`)
+	macPolicyOpsRE    = regexp.MustCompile(`^\s*struct\s+mac_policy_ops\s*{`)
+	macPolicyOpsMbrRE = regexp.MustCompile(`^\s*\w+\s*\*\s*(mpo_\w+)\s*;`)
+)
+
+// ParseMacPolicyOpsHeader returns the hook names of struct mac_policy_ops (in slot order)
+// from XNU's security/mac_policy.h. The struct changes between XNU releases, so use the
+// header that matches the kernelcache.
+func ParseMacPolicyOpsHeader(r io.Reader) ([]string, error) {
+	var names []string
+
+	inOps := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !inOps {
+			inOps = macPolicyOpsRE.MatchString(line)
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "}") {
+			break
+		}
+		if matches := macPolicyOpsMbrRE.FindStringSubmatch(line); len(matches) == 2 {
+			names = append(names, matches[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("failed to find struct mac_policy_ops")
+	}
+
+	return names, nil
+}
+
+// GetMacPolicies finds every mac_policy_register call in the kernelcache and returns
+// the registered policies along with the hooks they implement.
+//
+// hookNames (see ParseMacPolicyOpsHeader) and symbols (e.g. a .a2s cache) are optional
+// and are used to name the hooks and their handlers; without hookNames the hooks are
+// named after a recent XNU's struct mac_policy_ops.
+func GetMacPolicies(r io.ReaderAt, m *macho.File, hookNames []string, symbols map[uint64]string) ([]MacPolicy, error) {
+	kexts, err := GetKexts(r, m)
+	if err != nil {
+		return nil, err
+	}
+	base := getKernelCacheBase(m)
+
+	syms := getSymbolMap(kexts, symbols)
+
+	names := hookNames
+	if len(names) == 0 {
+		names = defaultMacPolicyOps
+	}
+
+	type register struct {
+		kext   *macho.File
+		call   CallSite
+		policy MacPolicy
+	}
+
+	var regs []register
+	seen := make(map[uint64]bool)
+
+	for _, kext := range kexts {
+		calls, err := getCallSites(kext.File, base)
+		if err != nil {
+			log.Debugf("failed to get call sites for %s: %v", kext.ID, err)
+			continue
+		}
+		for _, call := range calls {
+			if !call.Known[0] || seen[call.Args[0]] {
+				continue
+			}
+			policy, ok := parseMacPolicyConf(kexts, call.Args[0], base)
+			if !ok {
+				continue
+			}
+			seen[call.Args[0]] = true
+			policy.Kext = kext.ID
+			regs = append(regs, register{kext: kext.File, call: call, policy: policy})
+		}
+	}
+
+	if len(regs) == 0 {
+		return nil, fmt.Errorf("failed to find any mac_policy_register calls")
+	}
+
+	// only keep the calls to mac_policy_register; without its symbol that's the function
+	// that is passed the most valid mac_policy_conf structs
+	var target uint64
+	counts := make(map[uint64]int)
+	for _, reg := range regs {
+		if sym := strings.TrimPrefix(syms[reg.call.Target], "_"); sym == "mac_policy_register" {
+			target = reg.call.Target
+			break
+		}
+		counts[reg.call.Target]++
+	}
+	if target == 0 {
+		for addr, count := range counts {
+			if count > counts[target] || (count == counts[target] && addr < target) {
+				target = addr
+			}
+		}
+	}
+	log.Debugf("mac_policy_register is at %#x", target)
+
+	var policies []MacPolicy
+	for _, reg := range regs {
+		if reg.call.Target != target {
+			log.Debugf("skipping call to %#x with a mac_policy_conf at %#x in %s", reg.call.Target, reg.call.Address, reg.policy.Kext)
+			continue
+		}
+		policy := reg.policy
+		log.Debugf("found mac_policy_register(%#x) call at %#x in %s", reg.call.Args[0], reg.call.Address, policy.Kext)
+
+		handlers := readMacPolicyOps(kexts, policy.Ops, policy.Conf, len(hookNames), base)
+		if len(handlers) == 0 { // ops are filled in at runtime
+			handlers, err = getMacPolicyOpsStores(reg.kext, policy.Ops, len(hookNames))
+			if err != nil {
+				log.Debugf("failed to recover %s's runtime mac_policy_ops: %v", policy.Name, err)
+			} else {
+				policy.Dynamic = true
+			}
+		}
+
+		for idx, handler := range handlers {
+			if handler == 0 {
+				continue
+			}
+			hook := MacPolicyHook{Index: idx, Handler: handler, Symbol: syms[handler]}
+			if idx < len(names) {
+				hook.Name = names[idx]
+			}
+			policy.Hooks = append(policy.Hooks, hook)
+		}
+
+		policies = append(policies, policy)
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	return policies, nil
+}
+
+// readKextsAt reads from the virtual address in whichever kext maps it
+func readKextsAt(kexts []Kext, addr uint64, size int) ([]byte, error) {
+	for _, kext := range kexts {
+		off, err := kext.GetOffset(addr)
+		if err != nil {
+			continue
+		}
+		dat := make([]byte, size)
+		if _, err := kext.ReadAt(dat, int64(off)); err != nil {
+			return nil, err
+		}
+		return dat, nil
+	}
+	return nil, fmt.Errorf("address %#x is not mapped", addr)
+}
+
+func readKextsCString(kexts []Kext, addr uint64) (string, error) {
+	for _, kext := range kexts {
+		if _, err := kext.GetOffset(addr); err == nil {
+			return kext.GetCString(addr)
+		}
+	}
+	return "", fmt.Errorf("address %#x is not mapped", addr)
+}
+
+// isCodeAddr returns true if the address is inside an executable section
+func isCodeAddr(kexts []Kext, addr uint64) bool {
+	for _, kext := range kexts {
+		for _, sec := range kext.Sections {
+			if addr >= sec.Addr && addr < sec.Addr+sec.Size {
+				return sec.Flags.IsPureInstructions() || sec.Flags.IsSomeInstructions()
+			}
+		}
+	}
+	return false
+}
+
+// parseMacPolicyConf validates and parses a struct mac_policy_conf
+func parseMacPolicyConf(kexts []Kext, addr, base uint64) (MacPolicy, bool) {
+	policy := MacPolicy{Conf: addr}
+
+	dat, err := readKextsAt(kexts, addr, macPolicyConfSize)
+	if err != nil {
+		return policy, false
+	}
+
+	policy.Name, err = readKextsCString(kexts, resolvePointer(binary.LittleEndian.Uint64(dat[0:]), base))
+	if err != nil || !macPolicyNameRE.MatchString(policy.Name) {
+		return policy, false
+	}
+	policy.FullName, err = readKextsCString(kexts, resolvePointer(binary.LittleEndian.Uint64(dat[8:]), base))
+	if err != nil || len(policy.FullName) == 0 || len(policy.FullName) > 256 {
+		return policy, false
+	}
+	labelNames := resolvePointer(binary.LittleEndian.Uint64(dat[16:]), base)
+	labelCount := binary.LittleEndian.Uint32(dat[24:])
+	if labelCount > 16 {
+		return policy, false
+	}
+	policy.Ops = resolvePointer(binary.LittleEndian.Uint64(dat[32:]), base)
+	if policy.Ops == 0 {
+		return policy, false
+	}
+	if _, err := readKextsAt(kexts, policy.Ops, 8); err != nil {
+		return policy, false
+	}
+	policy.LoadTimeFlags = binary.LittleEndian.Uint32(dat[40:])
+
+	if labelNames != 0 {
+		for i := uint32(0); i < labelCount; i++ {
+			ptr, err := readKextsAt(kexts, labelNames+uint64(i)*8, 8)
+			if err != nil {
+				break
+			}
+			if label, err := readKextsCString(kexts, resolvePointer(binary.LittleEndian.Uint64(ptr), base)); err == nil {
+				policy.LabelNames = append(policy.LabelNames, label)
+			}
+		}
+	}
+
+	return policy, true
+}
+
+// readMacPolicyOps reads the handlers of a static mac_policy_ops struct.
+// Without the number of slots it reads until it hits something that isn't a code pointer.
+func readMacPolicyOps(kexts []Kext, ops, conf uint64, count int, base uint64) []uint64 {
+	var handlers []uint64
+
+	max := count
+	if max == 0 {
+		max = maxMacPolicyOps
+	}
+
+	found := false
+	for idx := 0; idx < max; idx++ {
+		addr := ops + uint64(idx)*8
+		if count == 0 && addr == conf { // the conf usually follows the ops
+			break
+		}
+		dat, err := readKextsAt(kexts, addr, 8)
+		if err != nil {
+			break
+		}
+		handler := resolvePointer(binary.LittleEndian.Uint64(dat), base)
+		if handler != 0 && !isCodeAddr(kexts, handler) {
+			if count == 0 {
+				break
+			}
+			handler = 0
+		}
+		if handler != 0 {
+			found = true
+		}
+		handlers = append(handlers, handler)
+	}
+
+	if !found {
+		return nil
+	}
+
+	return handlers
+}
+
+// getMacPolicyOpsStores recovers a mac_policy_ops struct that is filled in at runtime
+// by looking for stores of constant code addresses into it
+func getMacPolicyOpsStores(m *macho.File, ops uint64, count int) ([]uint64, error) {
+	max := count
+	if max == 0 {
+		max = maxMacPolicyOps
+	}
+	end := ops + uint64(max)*8
+
+	stores := make(map[int]uint64)
+	if err := walkFunctions(m, func(fn types.Function, inst *disassemble.Instruction, regs *registers) {
+		var srcs []disassemble.Register
+		var mem disassemble.Operand
+		switch inst.Operation {
+		case disassemble.ARM64_STR:
+			if len(inst.Operands) != 2 {
+				return
+			}
+			srcs = inst.Operands[0].Registers
+			mem = inst.Operands[1]
+		case disassemble.ARM64_STP:
+			if len(inst.Operands) != 3 || len(inst.Operands[0].Registers) == 0 || len(inst.Operands[1].Registers) == 0 {
+				return
+			}
+			srcs = []disassemble.Register{inst.Operands[0].Registers[0], inst.Operands[1].Registers[0]}
+			mem = inst.Operands[2]
+		default:
+			return
+		}
+		if mem.Class != disassemble.MEM_OFFSET || len(mem.Registers) == 0 {
+			return
+		}
+		dst, ok := regs.Get(mem.Registers[0])
+		if !ok {
+			return
+		}
+		dst += mem.Immediate
+		for i, src := range srcs {
+			addr := dst + uint64(i)*8
+			if addr < ops || addr >= end || (addr-ops)%8 != 0 {
+				continue
+			}
+			if handler, ok := regs.Get(src); ok && handler != 0 {
+				stores[int((addr-ops)/8)] = handler
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("no stores to mac_policy_ops at %#x found", ops)
+	}
+
+	var last int
+	for idx := range stores {
+		if idx > last {
+			last = idx
+		}
+	}
+	handlers := make([]uint64, last+1)
+	for idx, handler := range stores {
+		handlers[idx] = handler
+	}
+
+	return handlers, nil
+}
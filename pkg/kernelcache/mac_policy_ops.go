@@ -0,0 +1,388 @@
+package kernelcache
+
+// defaultMacPolicyOps are the struct mac_policy_ops hook names (in slot order) of xnu-7195
+// (iOS 14/macOS 11). They are used when no security/mac_policy.h is given; newer releases
+// only append hooks or reuse reserved slots, but pass the matching header for exact names.
+var defaultMacPolicyOps = []string{
+	"mpo_audit_check_postselect",
+	"mpo_audit_check_preselect",
+
+	"mpo_reserved01",
+	"mpo_reserved02",
+	"mpo_reserved03",
+	"mpo_reserved04",
+
+	"mpo_cred_check_label_update_execve",
+	"mpo_cred_check_label_update",
+	"mpo_cred_check_visible",
+	"mpo_cred_label_associate_fork",
+	"mpo_cred_label_associate_kernel",
+	"mpo_cred_label_associate",
+	"mpo_cred_label_associate_user",
+	"mpo_cred_label_destroy",
+	"mpo_cred_label_externalize_audit",
+	"mpo_cred_label_externalize",
+	"mpo_cred_label_init",
+	"mpo_cred_label_internalize",
+	"mpo_cred_label_update_execve",
+	"mpo_cred_label_update",
+
+	"mpo_devfs_label_associate_device",
+	"mpo_devfs_label_associate_directory",
+	"mpo_devfs_label_copy",
+	"mpo_devfs_label_destroy",
+	"mpo_devfs_label_init",
+	"mpo_devfs_label_update",
+
+	"mpo_file_check_change_offset",
+	"mpo_file_check_create",
+	"mpo_file_check_dup",
+	"mpo_file_check_fcntl",
+	"mpo_file_check_get_offset",
+	"mpo_file_check_get",
+	"mpo_file_check_inherit",
+	"mpo_file_check_ioctl",
+	"mpo_file_check_lock",
+	"mpo_file_check_mmap_downgrade",
+	"mpo_file_check_mmap",
+	"mpo_file_check_receive",
+	"mpo_file_check_set",
+	"mpo_file_label_init",
+	"mpo_file_label_destroy",
+	"mpo_file_label_associate",
+	"mpo_file_notify_close",
+
+	"mpo_reserved06",
+	"mpo_reserved07",
+	"mpo_reserved08",
+	"mpo_reserved09",
+	"mpo_reserved10",
+	"mpo_reserved11",
+	"mpo_reserved12",
+	"mpo_reserved13",
+	"mpo_reserved14",
+	"mpo_reserved15",
+	"mpo_reserved16",
+	"mpo_reserved17",
+	"mpo_reserved18",
+	"mpo_reserved19",
+	"mpo_reserved20",
+	"mpo_reserved21",
+	"mpo_reserved22",
+	"mpo_reserved23",
+	"mpo_reserved24",
+
+	"mpo_necp_check_open",
+	"mpo_necp_check_client_action",
+
+	"mpo_file_check_library_validation",
+
+	"mpo_vnode_notify_setacl",
+	"mpo_vnode_notify_setattrlist",
+	"mpo_vnode_notify_setextattr",
+	"mpo_vnode_notify_setflags",
+	"mpo_vnode_notify_setmode",
+	"mpo_vnode_notify_setowner",
+	"mpo_vnode_notify_setutimes",
+	"mpo_vnode_notify_truncate",
+	"mpo_vnode_check_getattrlistbulk",
+
+	"mpo_reserved25",
+	"mpo_reserved26",
+	"mpo_reserved27",
+	"mpo_reserved28",
+	"mpo_reserved29",
+	"mpo_reserved30",
+
+	"mpo_mount_check_quotactl",
+	"mpo_mount_check_fsctl",
+	"mpo_mount_check_getattr",
+	"mpo_mount_check_label_update",
+	"mpo_mount_check_mount",
+	"mpo_mount_check_remount",
+	"mpo_mount_check_setattr",
+	"mpo_mount_check_stat",
+	"mpo_mount_check_umount",
+	"mpo_mount_label_associate",
+	"mpo_mount_label_destroy",
+	"mpo_mount_label_externalize",
+	"mpo_mount_label_init",
+	"mpo_mount_label_internalize",
+
+	"mpo_reserved38",
+	"mpo_reserved39",
+	"mpo_reserved40",
+
+	"mpo_pipe_check_ioctl",
+	"mpo_pipe_check_kqfilter",
+	"mpo_reserved41",
+	"mpo_pipe_check_read",
+	"mpo_pipe_check_select",
+	"mpo_pipe_check_stat",
+	"mpo_pipe_check_write",
+	"mpo_pipe_label_associate",
+	"mpo_reserved42",
+	"mpo_pipe_label_destroy",
+	"mpo_reserved43",
+	"mpo_pipe_label_init",
+	"mpo_reserved44",
+	"mpo_proc_check_syscall_mac",
+
+	"mpo_policy_destroy",
+	"mpo_policy_init",
+	"mpo_policy_initbsd",
+	"mpo_policy_syscall",
+
+	"mpo_system_check_sysctlbyname",
+	"mpo_proc_check_inherit_ipc_ports",
+	"mpo_vnode_check_rename",
+	"mpo_kext_check_query",
+	"mpo_proc_notify_exec_complete",
+	"mpo_proc_notify_cs_invalidated",
+	"mpo_proc_check_syscall_unix",
+	"mpo_reserved45",
+	"mpo_proc_check_set_host_special_port",
+	"mpo_proc_check_set_host_exception_port",
+	"mpo_exc_action_check_exception_send",
+	"mpo_exc_action_label_associate",
+	"mpo_exc_action_label_populate",
+	"mpo_exc_action_label_destroy",
+	"mpo_exc_action_label_init",
+	"mpo_exc_action_label_update",
+
+	"mpo_vnode_check_trigger_resolve",
+	"mpo_mount_check_mount_late",
+	"mpo_mount_check_snapshot_mount",
+	"mpo_vnode_notify_reclaim",
+	"mpo_skywalk_flow_check_connect",
+	"mpo_skywalk_flow_check_listen",
+
+	"mpo_posixsem_check_create",
+	"mpo_posixsem_check_open",
+	"mpo_posixsem_check_post",
+	"mpo_posixsem_check_unlink",
+	"mpo_posixsem_check_wait",
+	"mpo_posixsem_label_associate",
+	"mpo_posixsem_label_destroy",
+	"mpo_posixsem_label_init",
+	"mpo_posixshm_check_create",
+	"mpo_posixshm_check_mmap",
+	"mpo_posixshm_check_open",
+	"mpo_posixshm_check_stat",
+	"mpo_posixshm_check_truncate",
+	"mpo_posixshm_check_unlink",
+	"mpo_posixshm_label_associate",
+	"mpo_posixshm_label_destroy",
+	"mpo_posixshm_label_init",
+
+	"mpo_proc_check_debug",
+	"mpo_proc_check_fork",
+	"mpo_proc_check_get_task_name",
+	"mpo_proc_check_get_task",
+	"mpo_proc_check_getaudit",
+	"mpo_proc_check_getauid",
+	"mpo_proc_check_getlcid",
+	"mpo_proc_check_mprotect",
+	"mpo_proc_check_sched",
+	"mpo_proc_check_setaudit",
+	"mpo_proc_check_setauid",
+	"mpo_proc_check_setlcid",
+	"mpo_proc_check_signal",
+	"mpo_proc_check_wait",
+	"mpo_proc_check_dump_core",
+	"mpo_proc_check_remote_thread_create",
+
+	"mpo_socket_check_accept",
+	"mpo_socket_check_accepted",
+	"mpo_socket_check_bind",
+	"mpo_socket_check_connect",
+	"mpo_socket_check_create",
+	"mpo_socket_check_deliver",
+	"mpo_socket_check_kqfilter",
+	"mpo_socket_check_label_update",
+	"mpo_socket_check_listen",
+	"mpo_socket_check_receive",
+	"mpo_socket_check_received",
+	"mpo_socket_check_select",
+	"mpo_socket_check_send",
+	"mpo_socket_check_stat",
+	"mpo_socket_check_setsockopt",
+	"mpo_socket_check_getsockopt",
+	"mpo_socket_label_associate_accept",
+	"mpo_socket_label_associate",
+	"mpo_socket_label_copy",
+	"mpo_socket_label_destroy",
+	"mpo_socket_label_externalize",
+	"mpo_socket_label_init",
+	"mpo_socket_label_internalize",
+	"mpo_socket_label_update",
+
+	"mpo_socketpeer_label_associate_mbuf",
+	"mpo_socketpeer_label_associate_socket",
+	"mpo_socketpeer_label_destroy",
+	"mpo_socketpeer_label_externalize",
+	"mpo_socketpeer_label_init",
+	"mpo_socketpeer_label_internalize",
+	"mpo_socketpeer_label_update",
+
+	"mpo_system_check_acct",
+	"mpo_system_check_audit",
+	"mpo_system_check_auditctl",
+	"mpo_system_check_auditon",
+	"mpo_system_check_host_priv",
+	"mpo_system_check_nfsd",
+	"mpo_system_check_reboot",
+	"mpo_system_check_settime",
+	"mpo_system_check_swapoff",
+	"mpo_system_check_swapon",
+	"mpo_socket_check_ioctl",
+
+	"mpo_sysvmsg_label_associate",
+	"mpo_sysvmsg_label_destroy",
+	"mpo_sysvmsg_label_init",
+	"mpo_sysvmsg_label_recycle",
+	"mpo_sysvmsq_check_enqueue",
+	"mpo_sysvmsq_check_msgrcv",
+	"mpo_sysvmsq_check_msgrmid",
+	"mpo_sysvmsq_check_msqctl",
+	"mpo_sysvmsq_check_msqget",
+	"mpo_sysvmsq_check_msqrcv",
+	"mpo_sysvmsq_check_msqsnd",
+	"mpo_sysvmsq_label_associate",
+	"mpo_sysvmsq_label_destroy",
+	"mpo_sysvmsq_label_init",
+	"mpo_sysvmsq_label_recycle",
+	"mpo_sysvsem_check_semctl",
+	"mpo_sysvsem_check_semget",
+	"mpo_sysvsem_check_semop",
+	"mpo_sysvsem_label_associate",
+	"mpo_sysvsem_label_destroy",
+	"mpo_sysvsem_label_init",
+	"mpo_sysvsem_label_recycle",
+	"mpo_sysvshm_check_shmat",
+	"mpo_sysvshm_check_shmctl",
+	"mpo_sysvshm_check_shmdt",
+	"mpo_sysvshm_check_shmget",
+	"mpo_sysvshm_label_associate",
+	"mpo_sysvshm_label_destroy",
+	"mpo_sysvshm_label_init",
+	"mpo_sysvshm_label_recycle",
+
+	"mpo_proc_notify_exit",
+	"mpo_mount_check_snapshot_revert",
+	"mpo_vnode_check_getattr",
+	"mpo_mount_check_snapshot_create",
+	"mpo_mount_check_snapshot_delete",
+	"mpo_vnode_check_clone",
+	"mpo_proc_check_get_cs_info",
+	"mpo_proc_check_set_cs_info",
+
+	"mpo_iokit_check_hid_control",
+
+	"mpo_vnode_check_access",
+	"mpo_vnode_check_chdir",
+	"mpo_vnode_check_chroot",
+	"mpo_vnode_check_create",
+	"mpo_vnode_check_deleteextattr",
+	"mpo_vnode_check_exchangedata",
+	"mpo_vnode_check_exec",
+	"mpo_vnode_check_getattrlist",
+	"mpo_vnode_check_getextattr",
+	"mpo_vnode_check_ioctl",
+	"mpo_vnode_check_kqfilter",
+	"mpo_vnode_check_label_update",
+	"mpo_vnode_check_link",
+	"mpo_vnode_check_listextattr",
+	"mpo_vnode_check_lookup",
+	"mpo_vnode_check_open",
+	"mpo_vnode_check_read",
+	"mpo_vnode_check_readdir",
+	"mpo_vnode_check_readlink",
+	"mpo_vnode_check_rename_from",
+	"mpo_vnode_check_rename_to",
+	"mpo_vnode_check_revoke",
+	"mpo_vnode_check_select",
+	"mpo_vnode_check_setattrlist",
+	"mpo_vnode_check_setextattr",
+	"mpo_vnode_check_setflags",
+	"mpo_vnode_check_setmode",
+	"mpo_vnode_check_setowner",
+	"mpo_vnode_check_setutimes",
+	"mpo_vnode_check_stat",
+	"mpo_vnode_check_truncate",
+	"mpo_vnode_check_unlink",
+	"mpo_vnode_check_write",
+	"mpo_vnode_label_associate_devfs",
+	"mpo_vnode_label_associate_extattr",
+	"mpo_vnode_label_associate_file",
+	"mpo_vnode_label_associate_pipe",
+	"mpo_vnode_label_associate_posixsem",
+	"mpo_vnode_label_associate_posixshm",
+	"mpo_vnode_label_associate_singlelabel",
+	"mpo_vnode_label_associate_socket",
+	"mpo_vnode_label_copy",
+	"mpo_vnode_label_destroy",
+	"mpo_vnode_label_externalize_audit",
+	"mpo_vnode_label_externalize",
+	"mpo_vnode_label_init",
+	"mpo_vnode_label_internalize",
+	"mpo_vnode_label_recycle",
+	"mpo_vnode_label_store",
+	"mpo_vnode_label_update_extattr",
+	"mpo_vnode_label_update",
+	"mpo_vnode_notify_create",
+	"mpo_vnode_check_signature",
+	"mpo_vnode_check_uipc_bind",
+	"mpo_vnode_check_uipc_connect",
+
+	"mpo_proc_check_run_cs_invalid",
+	"mpo_proc_check_suspend_resume",
+
+	"mpo_thread_userret",
+
+	"mpo_iokit_check_set_properties",
+
+	"mpo_vnode_check_supplemental_signature",
+
+	"mpo_vnode_check_searchfs",
+
+	"mpo_priv_check",
+	"mpo_priv_grant",
+
+	"mpo_proc_check_map_anon",
+
+	"mpo_vnode_check_fsgetpath",
+
+	"mpo_iokit_check_open",
+
+	"mpo_proc_check_ledger",
+
+	"mpo_vnode_notify_rename",
+
+	"mpo_vnode_check_setacl",
+
+	"mpo_vnode_notify_deleteextattr",
+
+	"mpo_system_check_kas_info",
+
+	"mpo_vnode_check_lookup_preflight",
+
+	"mpo_vnode_notify_open",
+
+	"mpo_system_check_info",
+
+	"mpo_pty_notify_grant",
+	"mpo_pty_notify_close",
+
+	"mpo_vnode_find_sigs",
+
+	"mpo_kext_check_load",
+	"mpo_kext_check_unload",
+
+	"mpo_proc_check_proc_info",
+
+	"mpo_vnode_notify_link",
+
+	"mpo_iokit_check_filter_properties",
+	"mpo_iokit_check_get_property",
+}
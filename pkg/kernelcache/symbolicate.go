@@ -0,0 +1,433 @@
+package kernelcache
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/blacktop/arm64-cgo/disassemble"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/types"
+	"github.com/blacktop/ipsw/internal/utils"
+)
+
+const (
+	// MatchHash is a match made by a unique instruction hash
+	MatchHash = "hash"
+	// MatchStrings is a match made by unique string xrefs
+	MatchStrings = "strings"
+	// MatchCallGraph is a match made by the position in the call graph of an already matched function
+	MatchCallGraph = "callgraph"
+)
+
+// Symbol file formats for WriteSymbols
+const (
+	SymbolsJSON   = "json"
+	SymbolsIDA    = "ida"    // IDAPython script
+	SymbolsGhidra = "ghidra" // ImportSymbolsScript.py input (name address type)
+)
+
+// minHashedFuncSize ignores tiny functions (thunks, getters etc.) that hash identically all over the kernel
+const minHashedFuncSize = 0x20
+
+// SymbolMatch is a symbol transferred from the reference kernel to the target kernel
+type SymbolMatch struct {
+	Kext       string  `json:"kext"`
+	Name       string  `json:"name"`
+	Address    uint64  `json:"address"`
+	RefAddress uint64  `json:"ref_address"`
+	Confidence float64 `json:"confidence"`
+	Method     string  `json:"method"`
+}
+
+// funcInfo is the set of features used to match a function across kernels
+type funcInfo struct {
+	fn      types.Function
+	name    string
+	hash    uint64
+	strs    []string
+	calls   []uint64
+	matched bool
+}
+
+func (f funcInfo) size() uint64 {
+	return f.fn.EndAddr - f.fn.StartAddr
+}
+
+// Symbolicate transfers symbol names from a symbolicated reference kernel (KDK or a kernel with symbols)
+// to a stripped target kernel by matching functions via instruction hashes, string xrefs and call-graph position.
+//
+// refSyms is an optional address to symbol map for the reference (i.e. a .a2s cache) used in addition to its symtab.
+func Symbolicate(refR io.ReaderAt, ref *macho.File, refSyms map[uint64]string, targetR io.ReaderAt, target *macho.File) ([]SymbolMatch, error) {
+	var matches []SymbolMatch
+
+	refKexts, err := GetKexts(refR, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reference kexts: %v", err)
+	}
+	targetKexts, err := GetKexts(targetR, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target kexts: %v", err)
+	}
+
+	refBase := getKernelCacheBase(ref)
+	targetBase := getKernelCacheBase(target)
+
+	refByID := make(map[string]Kext)
+	for _, kext := range refKexts {
+		refByID[kext.ID] = kext
+	}
+
+	for _, tkext := range targetKexts {
+		rkext, ok := refByID[tkext.ID]
+		if !ok {
+			continue
+		}
+
+		utils.Indent(log.Info, 2)(fmt.Sprintf("Matching %s", tkext.ID))
+
+		syms := make(map[uint64]string)
+		if rkext.Symtab != nil {
+			for _, sym := range rkext.Symtab.Syms {
+				if sym.Value != 0 && len(sym.Name) > 0 {
+					syms[sym.Value] = sym.Name
+				}
+			}
+		}
+		for addr, name := range refSyms {
+			if _, ok := syms[addr]; !ok {
+				syms[addr] = name
+			}
+		}
+		if len(syms) == 0 {
+			utils.Indent(log.Warn, 3)(fmt.Sprintf("reference %s has no symbols", rkext.ID))
+			continue
+		}
+
+		refFuncs, err := getFuncInfos(rkext.File, refBase, syms)
+		if err != nil {
+			return nil, fmt.Errorf("failed to analyze reference %s: %v", rkext.ID, err)
+		}
+		targetFuncs, err := getFuncInfos(tkext.File, targetBase, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to analyze target %s: %v", tkext.ID, err)
+		}
+
+		kmatches := matchFunctions(refFuncs, targetFuncs)
+		for idx := range kmatches {
+			kmatches[idx].Kext = tkext.ID
+		}
+		utils.Indent(log.Info, 3)(fmt.Sprintf("Matched %d of %d functions", len(kmatches), len(targetFuncs)))
+
+		matches = append(matches, kmatches...)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Address < matches[j].Address
+	})
+
+	return matches, nil
+}
+
+// WriteSymbols writes the matches in a format a disassembler can import
+// (json, an IDAPython script or a Ghidra ImportSymbolsScript.py input file)
+func WriteSymbols(w io.Writer, matches []SymbolMatch, format string) error {
+	switch strings.ToLower(format) {
+	case SymbolsJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(matches)
+	case SymbolsIDA:
+		if _, err := fmt.Fprintf(w, "import idc\n\n"); err != nil {
+			return err
+		}
+		for _, m := range matches {
+			if _, err := fmt.Fprintf(w, "idc.set_name(%#x, %q, idc.SN_NOWARN) # %s %.2f\n", m.Address, m.Name, m.Method, m.Confidence); err != nil {
+				return err
+			}
+		}
+	case SymbolsGhidra:
+		for _, m := range matches {
+			if _, err := fmt.Fprintf(w, "%s %#x f\n", m.Name, m.Address); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid symbols format %s (must be one of: %s, %s or %s)", format, SymbolsJSON, SymbolsIDA, SymbolsGhidra)
+	}
+	return nil
+}
+
+// SymbolMap converts matches into an address to symbol map (the same format as the .a2s disassembly cache)
+func SymbolMap(matches []SymbolMatch) map[uint64]string {
+	a2s := make(map[uint64]string)
+	for _, m := range matches {
+		a2s[m.Address] = m.Name
+	}
+	return a2s
+}
+
+// getFuncInfos disassembles every function and collects its matching features
+func getFuncInfos(m *macho.File, base uint64, syms map[uint64]string) (map[uint64]*funcInfo, error) {
+	funcs := make(map[uint64]*funcInfo)
+
+	var cstrs []*macho.Section
+	for _, sec := range m.Sections {
+		if sec.Flags.IsCstringLiterals() {
+			cstrs = append(cstrs, sec)
+		}
+	}
+	isCString := func(addr uint64) bool {
+		for _, sec := range cstrs {
+			if addr >= sec.Addr && addr < sec.Addr+sec.Size {
+				return true
+			}
+		}
+		return false
+	}
+
+	var cur *funcInfo
+	h := fnv.New64a()
+	word := make([]byte, 4)
+	stubs := make(map[uint64]uint64)
+
+	finish := func() {
+		if cur != nil {
+			cur.hash = h.Sum64()
+			funcs[cur.fn.StartAddr] = cur
+		}
+	}
+
+	if err := walkFunctions(m, func(fn types.Function, inst *disassemble.Instruction, regs *registers) {
+		if cur == nil || cur.fn.StartAddr != fn.StartAddr {
+			finish()
+			cur = &funcInfo{fn: fn, name: syms[fn.StartAddr]}
+			h.Reset()
+		}
+
+		binary.LittleEndian.PutUint32(word, maskInstruction(inst, regs))
+		h.Write(word)
+
+		ops := inst.Operands
+		switch inst.Operation {
+		case disassemble.ARM64_BL:
+			target := ops[0].Immediate
+			if resolved, ok := stubs[target]; ok {
+				target = resolved
+			} else if resolved, err := resolveStub(m, target, base); err == nil {
+				stubs[target] = resolved
+				target = resolved
+			} else {
+				stubs[target] = target
+			}
+			cur.calls = append(cur.calls, target)
+		case disassemble.ARM64_ADR, disassemble.ARM64_ADD:
+			tmp := *regs
+			emulate(inst, &tmp)
+			if addr, ok := tmp.Get(ops[0].Registers[0]); ok && isCString(addr) {
+				if str, err := m.GetCString(addr); err == nil && len(str) > 3 {
+					cur.strs = append(cur.strs, str)
+				}
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+	finish()
+
+	return funcs, nil
+}
+
+// maskInstruction removes the address dependent parts of an instruction so it hashes the same across builds
+func maskInstruction(inst *disassemble.Instruction, regs *registers) uint32 {
+	raw := inst.Raw
+	switch {
+	case raw&0x1f000000 == 0x10000000: // ADR/ADRP
+		return raw & 0x9f00001f
+	case raw&0x7c000000 == 0x14000000: // B/BL
+		return raw & 0xfc000000
+	case raw&0xff000010 == 0x54000000: // B.cond
+		return raw & 0xff00001f
+	case raw&0x7e000000 == 0x34000000: // CBZ/CBNZ
+		return raw & 0xff00001f
+	case raw&0x7e000000 == 0x36000000: // TBZ/TBNZ
+		return raw & 0xfff8001f
+	case raw&0x3b000000 == 0x18000000: // LDR (literal)
+		return raw & 0xff00001f
+	}
+	// page offsets added to an ADRP result
+	if len(inst.Operands) > 1 {
+		for _, op := range inst.Operands[1:] {
+			if (op.Class == disassemble.REG || op.Class == disassemble.MEM_OFFSET) && len(op.Registers) > 0 {
+				if val, ok := regs.Get(op.Registers[0]); ok && val&0xfff == 0 && val>>48 != 0 {
+					return raw & 0xffc003ff
+				}
+			}
+		}
+	}
+	return raw
+}
+
+// matchFunctions pairs reference and target functions and names the target functions
+func matchFunctions(ref, target map[uint64]*funcInfo) []SymbolMatch {
+	var matches []SymbolMatch
+
+	type pair struct {
+		ref, target *funcInfo
+		confidence  float64
+	}
+	var queue []pair
+
+	match := func(r, t *funcInfo, confidence float64, method string) {
+		r.matched = true
+		t.matched = true
+		queue = append(queue, pair{ref: r, target: t, confidence: confidence})
+		if len(r.name) > 0 {
+			matches = append(matches, SymbolMatch{
+				Name:       r.name,
+				Address:    t.fn.StartAddr,
+				RefAddress: r.fn.StartAddr,
+				Confidence: confidence,
+				Method:     method,
+			})
+		}
+	}
+
+	/* 1) unique instruction hashes */
+	refHashes := make(map[uint64][]*funcInfo)
+	for _, f := range ref {
+		if f.size() >= minHashedFuncSize {
+			refHashes[f.hash] = append(refHashes[f.hash], f)
+		}
+	}
+	targetHashes := make(map[uint64][]*funcInfo)
+	for _, f := range target {
+		if f.size() >= minHashedFuncSize {
+			targetHashes[f.hash] = append(targetHashes[f.hash], f)
+		}
+	}
+	for _, hash := range sortedKeys(targetHashes) {
+		ts := targetHashes[hash]
+		if rs, ok := refHashes[hash]; ok && len(rs) == 1 && len(ts) == 1 {
+			confidence := 0.9
+			if len(rs[0].strs) > 0 && jaccard(rs[0].strs, ts[0].strs) == 1 {
+				confidence = 1.0
+			}
+			match(rs[0], ts[0], confidence, MatchHash)
+		}
+	}
+
+	/* 2) unique string xrefs */
+	refStrs := make(map[string][]*funcInfo)
+	for _, f := range ref {
+		for _, s := range uniq(f.strs) {
+			refStrs[s] = append(refStrs[s], f)
+		}
+	}
+	targetStrs := make(map[string][]*funcInfo)
+	for _, f := range target {
+		for _, s := range uniq(f.strs) {
+			targetStrs[s] = append(targetStrs[s], f)
+		}
+	}
+	votes := make(map[*funcInfo]map[*funcInfo]int)
+	for s, ts := range targetStrs {
+		if rs, ok := refStrs[s]; ok && len(rs) == 1 && len(ts) == 1 && !rs[0].matched && !ts[0].matched {
+			if votes[ts[0]] == nil {
+				votes[ts[0]] = make(map[*funcInfo]int)
+			}
+			votes[ts[0]][rs[0]]++
+		}
+	}
+	for _, t := range sortedFuncs(votes) {
+		var best *funcInfo
+		for r, n := range votes[t] {
+			if best == nil || n > votes[t][best] || (n == votes[t][best] && r.fn.StartAddr < best.fn.StartAddr) {
+				best = r
+			}
+		}
+		if best == nil || best.matched {
+			continue
+		}
+		if sim := jaccard(best.strs, t.strs); sim >= 0.5 || votes[t][best] > 1 {
+			match(best, t, 0.5+0.4*sim, MatchStrings)
+		}
+	}
+
+	/* 3) propagate through the call graph */
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if len(p.ref.calls) != len(p.target.calls) {
+			continue
+		}
+		for idx := range p.ref.calls {
+			r, rok := ref[p.ref.calls[idx]]
+			t, tok := target[p.target.calls[idx]]
+			if !rok || !tok || r.matched || t.matched {
+				continue
+			}
+			if r.size() > 2*t.size() || t.size() > 2*r.size() {
+				continue
+			}
+			match(r, t, p.confidence*0.9, MatchCallGraph)
+		}
+	}
+
+	return matches
+}
+
+func jaccard(a, b []string) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	set := make(map[string]int)
+	for _, s := range uniq(a) {
+		set[s] |= 1
+	}
+	for _, s := range uniq(b) {
+		set[s] |= 2
+	}
+	var both int
+	for _, v := range set {
+		if v == 3 {
+			both++
+		}
+	}
+	return float64(both) / float64(len(set))
+}
+
+func uniq(strs []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, s := range strs {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[uint64][]*funcInfo) []uint64 {
+	var keys []uint64
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedFuncs(m map[*funcInfo]map[*funcInfo]int) []*funcInfo {
+	var funcs []*funcInfo
+	for f := range m {
+		funcs = append(funcs, f)
+	}
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].fn.StartAddr < funcs[j].fn.StartAddr })
+	return funcs
+}
@@ -0,0 +1,58 @@
+package kernelcache
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/types"
+	"github.com/blacktop/go-plist"
+)
+
+// SymbolSets is the __LINKINFO.__symbolsets plist
+type SymbolSets struct {
+	SymbolsSetsDictionary []SymbolSet `plist:"SymbolsSets,omitempty"`
+}
+
+// SymbolSet is a set of kernel symbols exported to kexts under a bundle ID
+type SymbolSet struct {
+	ID                string   `plist:"CFBundleIdentifier,omitempty"`
+	CompatibleVersion string   `plist:"OSBundleCompatibleVersion,omitempty"`
+	Version           string   `plist:"CFBundleVersion,omitempty"`
+	Symbols           []Symbol `plist:"Symbols,omitempty"`
+}
+
+// Symbol is a symbolset symbol
+type Symbol struct {
+	Name   string `plist:"SymbolName,omitempty"`
+	Prefix string `plist:"SymbolPrefix,omitempty"`
+}
+
+// GetSymbolSets parses the kernel's __LINKINFO.__symbolsets
+func GetSymbolSets(m *macho.File) (*SymbolSets, error) {
+	var err error
+
+	if m.FileTOC.FileHeader.Type == types.FileSet {
+		m, err = m.GetFileSetFileByName("com.apple.kernel")
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse entry com.apple.kernel; %v", err)
+		}
+	}
+
+	symbolsets := m.Section("__LINKINFO", "__symbolsets")
+	if symbolsets == nil {
+		return nil, fmt.Errorf("kernelcache does NOT contain __LINKINFO.__symbolsets")
+	}
+
+	dat := make([]byte, symbolsets.Size)
+	if _, err := m.ReadAt(dat, int64(symbolsets.Offset)); err != nil {
+		return nil, fmt.Errorf("failed to read __LINKINFO.__symbolsets: %v", err)
+	}
+
+	var ssets SymbolSets
+	if err := plist.NewDecoder(bytes.NewReader(dat)).Decode(&ssets); err != nil {
+		return nil, fmt.Errorf("failed to parse __symbolsets bplist data: %v", err)
+	}
+
+	return &ssets, nil
+}
@@ -0,0 +1,110 @@
+package kernelcache
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/blacktop/go-macho"
+)
+
+// Syscall is a BSD syscall table (sysent) entry
+type Syscall struct {
+	Number     int    `json:"number"`
+	Call       uint64 `json:"call"`
+	Munge      uint64 `json:"munge,omitempty"`
+	ReturnType int32  `json:"return_type"`
+	NumArgs    int16  `json:"num_args"`
+	ArgBytes   uint16 `json:"arg_bytes"`
+}
+
+func (s Syscall) String() string {
+	return fmt.Sprintf("%3d: call=%#x, ret_type=%d, nargs=%d, arg_bytes=%d", s.Number, s.Call, s.ReturnType, s.NumArgs, s.ArgBytes)
+}
+
+// sysent entries start with the indirect syscall followed by exit, fork, read, write, open and close
+var sysentSignature = []int16{0, 1, 0, 3, 3, 3, 1}
+
+const maxSyscalls = 1024
+
+// GetSyscalls locates and parses the kernel's BSD sysent table.
+// Entries that point to the same handler as syscall 0 (nosys) are omitted.
+func GetSyscalls(m *macho.File, base uint64) ([]Syscall, error) {
+	var syscalls []Syscall
+
+	for _, seg := range []string{"__DATA_CONST", "__CONST", "__DATA"} {
+		sec := m.Section(seg, "__const")
+		if sec == nil {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s.%s: %v", sec.Seg, sec.Name, err)
+		}
+
+		for _, stride := range []int{16, 24} { // with or without sy_arg_munge32
+			start, ok := findSysent(data, stride)
+			if !ok {
+				continue
+			}
+			var nosys uint64
+			for idx := 0; idx < maxSyscalls; idx++ {
+				off := start + idx*stride
+				if off+stride > len(data) {
+					break
+				}
+				s, ok := parseSysent(data[off:off+stride], stride)
+				if !ok {
+					break
+				}
+				s.Number = idx
+				s.Call = resolvePointer(s.Call, base)
+				s.Munge = resolvePointer(s.Munge, base)
+				if idx == 0 {
+					nosys = s.Call
+					continue
+				}
+				if s.Call == nosys {
+					continue
+				}
+				syscalls = append(syscalls, s)
+			}
+			return syscalls, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to find sysent table")
+}
+
+func parseSysent(dat []byte, stride int) (Syscall, bool) {
+	var s Syscall
+	s.Call = binary.LittleEndian.Uint64(dat[0:])
+	rest := dat[8:]
+	if stride == 24 {
+		s.Munge = binary.LittleEndian.Uint64(dat[8:])
+		rest = dat[16:]
+	}
+	s.ReturnType = int32(binary.LittleEndian.Uint32(rest[0:]))
+	s.NumArgs = int16(binary.LittleEndian.Uint16(rest[4:]))
+	s.ArgBytes = binary.LittleEndian.Uint16(rest[6:])
+	if s.Call == 0 || s.ReturnType < 0 || s.ReturnType > 7 || s.NumArgs < 0 || s.NumArgs > 8 || s.ArgBytes > 64 || s.ArgBytes%4 != 0 {
+		return s, false
+	}
+	return s, true
+}
+
+func findSysent(data []byte, stride int) (int, bool) {
+	for start := 0; start+len(sysentSignature)*stride <= len(data); start += 8 {
+		found := true
+		for idx, nargs := range sysentSignature {
+			s, ok := parseSysent(data[start+idx*stride:start+(idx+1)*stride], stride)
+			if !ok || s.NumArgs != nargs || int(s.ArgBytes) != int(nargs)*4 {
+				found = false
+				break
+			}
+		}
+		if found {
+			return start, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,351 @@
+package kernelcache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/blacktop/arm64-cgo/disassemble"
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/pkg/fixupchains"
+	"github.com/blacktop/go-macho/types"
+)
+
+// registers is the (very) simple constant propagation state of the general purpose registers
+type registers struct {
+	val   [31]uint64
+	known [31]bool
+}
+
+// Get returns the value of register reg if it is known
+func (r *registers) Get(reg disassemble.Register) (uint64, bool) {
+	idx := regIndex(reg)
+	if idx < 0 || !r.known[idx] {
+		return 0, false
+	}
+	return r.val[idx], true
+}
+
+func (r *registers) set(reg disassemble.Register, val uint64) {
+	if idx := regIndex(reg); idx >= 0 {
+		if reg <= disassemble.REG_W30 {
+			val &= 0xffffffff
+		}
+		r.val[idx] = val
+		r.known[idx] = true
+	}
+}
+
+func (r *registers) clobber(reg disassemble.Register) {
+	if idx := regIndex(reg); idx >= 0 {
+		r.known[idx] = false
+	}
+}
+
+func (r *registers) reset() {
+	r.known = [31]bool{}
+}
+
+// resetCallerSaved forgets x0-x18 (the registers that do not survive a function call)
+func (r *registers) resetCallerSaved() {
+	for i := 0; i <= 18; i++ {
+		r.known[i] = false
+	}
+}
+
+func regIndex(reg disassemble.Register) int {
+	switch {
+	case reg >= disassemble.REG_W0 && reg <= disassemble.REG_W30:
+		return int(reg - disassemble.REG_W0)
+	case reg >= disassemble.REG_X0 && reg <= disassemble.REG_X30:
+		return int(reg - disassemble.REG_X0)
+	}
+	return -1
+}
+
+// argReg returns the X register used to pass argument number idx
+func argReg(idx int) disassemble.Register {
+	return disassemble.REG_X0 + disassemble.Register(idx)
+}
+
+// instrVisitor is called for every instruction with the register state BEFORE the instruction executes
+type instrVisitor func(fn types.Function, inst *disassemble.Instruction, regs *registers)
+
+// walkFunctions linearly disassembles every function in the MachO and tracks
+// constant register values built up by ADRP/ADD/ADR/MOV/MOVK sequences
+func walkFunctions(m *macho.File, visit instrVisitor) error {
+	var results [1024]byte
+
+	funcs := m.GetFunctions()
+
+	for _, sec := range m.Sections {
+		if !sec.Flags.IsPureInstructions() && !sec.Flags.IsSomeInstructions() {
+			continue
+		}
+		if sec.Size == 0 || strings.Contains(sec.Name, "stubs") {
+			continue
+		}
+		if strings.HasPrefix(sec.Seg, "__PLK_") || strings.HasPrefix(sec.Seg, "__PRELINK_") {
+			continue // prelinked kexts are walked on their own
+		}
+
+		data := make([]byte, sec.Size)
+		if _, err := m.ReadAt(data, int64(sec.Offset)); err != nil {
+			return fmt.Errorf("failed to read %s.%s: %v", sec.Seg, sec.Name, err)
+		}
+
+		var secFuncs []types.Function
+		for _, fn := range funcs {
+			if fn.StartAddr >= sec.Addr && fn.StartAddr < sec.Addr+sec.Size {
+				if fn.EndAddr > sec.Addr+sec.Size {
+					fn.EndAddr = sec.Addr + sec.Size
+				}
+				secFuncs = append(secFuncs, fn)
+			}
+		}
+		if len(secFuncs) == 0 { // no LC_FUNCTION_STARTS so treat the whole section as one function
+			secFuncs = append(secFuncs, types.Function{StartAddr: sec.Addr, EndAddr: sec.Addr + sec.Size})
+		}
+
+		for _, fn := range secFuncs {
+			var regs registers
+			for addr := fn.StartAddr; addr+4 <= fn.EndAddr; addr += 4 {
+				instrValue := binary.LittleEndian.Uint32(data[addr-sec.Addr:])
+				inst, err := disassemble.Decompose(addr, instrValue, &results)
+				if err != nil {
+					regs.reset()
+					continue
+				}
+				visit(fn, inst, &regs)
+				emulate(inst, &regs)
+			}
+		}
+	}
+
+	return nil
+}
+
+// emulate updates the register state with the effects of the instruction
+func emulate(inst *disassemble.Instruction, regs *registers) {
+	ops := inst.Operands
+
+	switch inst.Operation {
+	case disassemble.ARM64_ADRP, disassemble.ARM64_ADR:
+		regs.set(ops[0].Registers[0], ops[1].Immediate)
+		return
+	case disassemble.ARM64_ADD, disassemble.ARM64_SUB:
+		if len(ops) == 3 && ops[1].Class == disassemble.REG && (ops[2].Class == disassemble.IMM32 || ops[2].Class == disassemble.IMM64) {
+			if src, ok := regs.Get(ops[1].Registers[0]); ok {
+				imm := ops[2].Immediate
+				if ops[2].ShiftValueUsed {
+					imm <<= uint64(ops[2].ShiftValue)
+				}
+				if inst.Operation == disassemble.ARM64_ADD {
+					regs.set(ops[0].Registers[0], src+imm)
+				} else {
+					regs.set(ops[0].Registers[0], src-imm)
+				}
+				return
+			}
+		}
+	case disassemble.ARM64_MOV, disassemble.ARM64_MOVZ:
+		if len(ops) == 2 {
+			switch ops[1].Class {
+			case disassemble.IMM32, disassemble.IMM64:
+				imm := ops[1].Immediate
+				if ops[1].ShiftValueUsed {
+					imm <<= uint64(ops[1].ShiftValue)
+				}
+				regs.set(ops[0].Registers[0], imm)
+				return
+			case disassemble.REG:
+				if src, ok := regs.Get(ops[1].Registers[0]); ok {
+					regs.set(ops[0].Registers[0], src)
+					return
+				}
+			}
+		}
+	case disassemble.ARM64_MOVK:
+		if len(ops) == 2 {
+			if dst, ok := regs.Get(ops[0].Registers[0]); ok {
+				shift := uint64(0)
+				if ops[1].ShiftValueUsed {
+					shift = uint64(ops[1].ShiftValue)
+				}
+				regs.set(ops[0].Registers[0], dst&^(0xffff<<shift)|ops[1].Immediate<<shift)
+				return
+			}
+		}
+	case disassemble.ARM64_BL, disassemble.ARM64_BLR, disassemble.ARM64_BLRAA, disassemble.ARM64_BLRAAZ,
+		disassemble.ARM64_BLRAB, disassemble.ARM64_BLRABZ:
+		regs.resetCallerSaved()
+		return
+	case disassemble.ARM64_B, disassemble.ARM64_BR, disassemble.ARM64_BRAA, disassemble.ARM64_BRAAZ,
+		disassemble.ARM64_BRAB, disassemble.ARM64_BRABZ, disassemble.ARM64_RET, disassemble.ARM64_RETAA,
+		disassemble.ARM64_RETAB:
+		regs.reset() // end of a basic block
+		return
+	}
+
+	if len(ops) == 0 || ops[0].Class != disassemble.REG || len(ops[0].Registers) == 0 {
+		return
+	}
+
+	op := inst.Operation.String()
+	switch {
+	case strings.HasPrefix(op, "st") && !strings.HasPrefix(op, "stxr") && !strings.HasPrefix(op, "stlxr"):
+		return // stores do not write their first operand
+	case strings.HasPrefix(op, "cmp"), strings.HasPrefix(op, "cmn"), strings.HasPrefix(op, "tst"),
+		strings.HasPrefix(op, "ccm"), strings.HasPrefix(op, "cb"), strings.HasPrefix(op, "tb"),
+		strings.HasPrefix(op, "prfm"), strings.HasPrefix(op, "msr"):
+		return
+	case strings.HasPrefix(op, "ldp"), strings.HasPrefix(op, "ldnp"), strings.HasPrefix(op, "ldaxp"), strings.HasPrefix(op, "ldxp"):
+		if len(ops) > 1 && ops[1].Class == disassemble.REG && len(ops[1].Registers) > 0 {
+			regs.clobber(ops[1].Registers[0])
+		}
+	}
+
+	regs.clobber(ops[0].Registers[0])
+}
+
+// CallSite is a direct call along with the constant argument registers at the time of the call
+type CallSite struct {
+	Function uint64 // start address of the calling function
+	Address  uint64 // address of the BL instruction
+	Target   uint64 // call target (stubs are followed to their final target)
+	Args     [8]uint64
+	Known    [8]bool
+}
+
+// getCallSites returns every direct BL call in the MachO
+func getCallSites(m *macho.File, base uint64) ([]CallSite, error) {
+	var calls []CallSite
+
+	stubs := make(map[uint64]uint64)
+
+	if err := walkFunctions(m, func(fn types.Function, inst *disassemble.Instruction, regs *registers) {
+		if inst.Operation != disassemble.ARM64_BL || len(inst.Operands) == 0 {
+			return
+		}
+		target := inst.Operands[0].Immediate
+		if resolved, ok := stubs[target]; ok {
+			target = resolved
+		} else {
+			if resolved, err := resolveStub(m, target, base); err == nil {
+				stubs[target] = resolved
+				target = resolved
+			} else {
+				stubs[target] = target
+			}
+		}
+		call := CallSite{
+			Function: fn.StartAddr,
+			Address:  inst.Address,
+			Target:   target,
+		}
+		for i := 0; i < 8; i++ {
+			call.Args[i], call.Known[i] = regs.Get(argReg(i))
+		}
+		calls = append(calls, call)
+	}); err != nil {
+		return nil, err
+	}
+
+	return calls, nil
+}
+
+// resolveStub follows an ADRP x16/LDR x16/BR x16 stub to the address stored in its GOT entry
+func resolveStub(m *macho.File, addr, base uint64) (uint64, error) {
+	var results [1024]byte
+
+	off, err := m.GetOffset(addr)
+	if err != nil {
+		return 0, err
+	}
+	code := make([]byte, 12)
+	if _, err := m.ReadAt(code, int64(off)); err != nil {
+		return 0, err
+	}
+
+	var regs registers
+	var got uint64
+	for i := 0; i < 3; i++ {
+		inst, err := disassemble.Decompose(addr+uint64(i*4), binary.LittleEndian.Uint32(code[i*4:]), &results)
+		if err != nil {
+			return 0, err
+		}
+		switch i {
+		case 0:
+			if inst.Operation != disassemble.ARM64_ADRP {
+				return 0, fmt.Errorf("not a stub")
+			}
+		case 1:
+			if inst.Operation != disassemble.ARM64_LDR || len(inst.Operands) < 2 || inst.Operands[1].Class != disassemble.MEM_OFFSET {
+				return 0, fmt.Errorf("not a stub")
+			}
+			page, ok := regs.Get(inst.Operands[1].Registers[0])
+			if !ok {
+				return 0, fmt.Errorf("not a stub")
+			}
+			got = page + inst.Operands[1].Immediate
+		case 2:
+			if !strings.HasPrefix(inst.Operation.String(), "br") {
+				return 0, fmt.Errorf("not a stub")
+			}
+		}
+		emulate(inst, &regs)
+	}
+
+	return readPointer(m, got, base)
+}
+
+// readPointer reads the pointer stored at the given address
+func readPointer(m *macho.File, addr, base uint64) (uint64, error) {
+	off, err := m.GetOffset(addr)
+	if err != nil {
+		return 0, err
+	}
+	ptr := make([]byte, 8)
+	if _, err := m.ReadAt(ptr, int64(off)); err != nil {
+		return 0, err
+	}
+	return resolvePointer(binary.LittleEndian.Uint64(ptr), base), nil
+}
+
+// resolvePointer converts a raw kernelcache pointer (tagged or chained fixup) into a virtual address
+func resolvePointer(ptr, base uint64) uint64 {
+	if ptr == 0 {
+		return 0
+	}
+	if (ptr>>32)&0xffff >= 0xfff0 { // tagged pointer (or already untagged)
+		return unTag(ptr)
+	}
+	return fixupchains.DyldChainedPtr64KernelCacheRebase{Pointer: ptr}.Target() + base
+}
+
+// getKernelCacheBase returns the base address the kernelcache's chained fixups are relative to
+func getKernelCacheBase(m *macho.File) uint64 {
+	if text := m.Segment("__TEXT"); text != nil {
+		return text.Addr
+	}
+	return m.GetBaseAddress()
+}
+
+// getSymbolMap returns the defined symbols of all the kexts (extra symbols, e.g. from a .a2s cache, take precedence)
+func getSymbolMap(kexts []Kext, extra map[uint64]string) map[uint64]string {
+	syms := make(map[uint64]string)
+	for _, kext := range kexts {
+		if kext.Symtab == nil {
+			continue
+		}
+		for _, sym := range kext.Symtab.Syms {
+			if sym.Value != 0 && sym.Type.IsDefinedInSection() {
+				syms[sym.Value] = sym.Name
+			}
+		}
+	}
+	for addr, sym := range extra {
+		syms[addr] = sym
+	}
+	return syms
+}
@@ -0,0 +1,437 @@
+package lzfse
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	matchHashBits  = 16
+	matchMaxChain  = 32 // max number of candidates to try per position
+	matchMinLength = 4
+
+	compressedBlockHeaderV2Size = 32 // magic, n_raw_bytes and the packed fields
+
+	encodeChunkSize = 1 << 20 // amount of data the matches are searched in at once (plus the history)
+)
+
+// uncompressedBlockHeader is the header of an uncompressed (bvx-) block
+type uncompressedBlockHeader struct {
+	Magic     magic
+	NRawBytes uint32
+}
+
+// EncodeBuffer compresses a buffer using LZFSE.
+//
+// Small buffers are stored as a single LZVN block and blocks that don't compress are stored uncompressed.
+func EncodeBuffer(src []byte) []byte {
+	var e encoder
+	if len(src) < LZFSE_ENCODE_LZVN_THRESHOLD {
+		e.encodeLZVN(src)
+	} else {
+		for start := 0; start < len(src); start += encodeChunkSize {
+			e.encodeChunk(src, start, minInt(start+encodeChunkSize, len(src)))
+		}
+	}
+	return appendUint32(e.dst, uint32(LZFSE_ENDOFSTREAM_BLOCK_MAGIC))
+}
+
+// matchFinder finds LZ matches using hash chains
+type matchFinder struct {
+	src     []byte
+	maxDist int
+	head    []int32 // last position (+1) with each hash
+	prev    []int32 // previous position (+1) with the same hash
+}
+
+func newMatchFinder(src []byte, maxDist int) *matchFinder {
+	return &matchFinder{
+		src:     src,
+		maxDist: maxDist,
+		head:    make([]int32, 1<<matchHashBits),
+		prev:    make([]int32, len(src)),
+	}
+}
+
+func (mf *matchFinder) hash(pos int) uint32 {
+	return (binary.LittleEndian.Uint32(mf.src[pos:]) * 2654435761) >> (32 - matchHashBits)
+}
+
+func (mf *matchFinder) insert(pos int) {
+	if pos+matchMinLength > len(mf.src) {
+		return
+	}
+	h := mf.hash(pos)
+	mf.prev[pos] = mf.head[h]
+	mf.head[h] = int32(pos + 1)
+}
+
+// find returns the longest match (up to LZFSE_ENCODE_MAX_M_VALUE bytes) for the bytes at pos
+func (mf *matchFinder) find(pos int) (length, dist int) {
+	if pos+matchMinLength > len(mf.src) {
+		return 0, 0
+	}
+	max := len(mf.src) - pos
+	if max > LZFSE_ENCODE_MAX_M_VALUE {
+		max = LZFSE_ENCODE_MAX_M_VALUE
+	}
+
+	for cand, n := mf.head[mf.hash(pos)], 0; cand > 0 && n < matchMaxChain; cand, n = mf.prev[cand-1], n+1 {
+		c := int(cand - 1)
+		if pos-c > mf.maxDist {
+			break
+		}
+		if mf.src[c+length] != mf.src[pos+length] {
+			continue // can't be longer
+		}
+		l := 0
+		for l < max && mf.src[c+l] == mf.src[pos+l] {
+			l++
+		}
+		if l > length {
+			length, dist = l, pos-c
+			if l == max {
+				break
+			}
+		}
+	}
+
+	if length < matchMinLength {
+		return 0, 0
+	}
+
+	return length, dist
+}
+
+// lzParse calls emit with the literals preceding each match in src[start:] (and finally with the trailing
+// literals and M=0); src[:start] is history the matches may reference.
+func lzParse(src []byte, start, maxDist int, emit func(lit []byte, M, D int)) {
+	mf := newMatchFinder(src, maxDist)
+	for pos := 0; pos < start; pos++ {
+		mf.insert(pos)
+	}
+
+	lit := start
+	for pos := start; pos < len(src); {
+		M, D := mf.find(pos)
+		mf.insert(pos)
+		if M == 0 {
+			pos++
+			continue
+		}
+		if M2, _ := mf.find(pos + 1); M2 > M { // lazy matching: prefer a longer match at the next position
+			pos++
+			continue
+		}
+		emit(src[lit:pos], M, D)
+		for end := pos + M; pos+1 < end; {
+			pos++
+			mf.insert(pos)
+		}
+		pos++
+		lit = pos
+	}
+
+	if lit < len(src) {
+		emit(src[lit:], 0, 0)
+	}
+}
+
+// encoder is the LZFSE encoder state
+type encoder struct {
+	dst []byte
+	src []byte // data being encoded (including the history)
+
+	// current block
+	blockStart int // offset of the block's first byte in src
+	rawBytes   int
+	literals   []byte
+	lValues    []int32
+	mValues    []int32
+	dValues    []int32
+}
+
+// encode appends the LZFSE blocks of src[start:] to the encoder's dst;
+// src[:start] is history (previously encoded data) the matches may reference
+func (e *encoder) encode(src []byte, start int) {
+	e.src = src
+	e.blockStart = start
+
+	lzParse(src, start, LZFSE_ENCODE_MAX_D_VALUE, e.pushMatch)
+
+	e.flushBlock()
+}
+
+// encodeChunk appends the LZFSE blocks of src[start:end] using the data before start as history
+func (e *encoder) encodeChunk(src []byte, start, end int) {
+	hist := start - LZFSE_ENCODE_MAX_D_VALUE
+	if hist < 0 {
+		hist = 0
+	}
+	e.encode(src[hist:end], start-hist)
+}
+
+// encodeLZVN appends src as a single LZVN (bvxn) block
+func (e *encoder) encodeLZVN(src []byte) {
+	if len(src) == 0 {
+		return
+	}
+	payload := lzvnEncode(nil, src)
+	if len(payload)+12 >= len(src)+8 {
+		e.dst = appendUncompressedBlock(e.dst, src)
+		return
+	}
+	e.dst = appendUint32(e.dst, uint32(LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC))
+	e.dst = appendUint32(e.dst, uint32(len(src)))
+	e.dst = appendUint32(e.dst, uint32(len(payload)))
+	e.dst = append(e.dst, payload...)
+}
+
+// pushMatch adds L literals followed by a match, splitting it if the values are too large to encode
+func (e *encoder) pushMatch(lit []byte, M, D int) {
+	for len(lit) > LZFSE_ENCODE_MAX_L_VALUE {
+		e.pushLMD(lit[:LZFSE_ENCODE_MAX_L_VALUE], 0, 1)
+		lit = lit[LZFSE_ENCODE_MAX_L_VALUE:]
+	}
+	for M > LZFSE_ENCODE_MAX_M_VALUE {
+		e.pushLMD(lit, LZFSE_ENCODE_MAX_M_VALUE, D)
+		lit = nil
+		M -= LZFSE_ENCODE_MAX_M_VALUE
+	}
+	if len(lit) > 0 || M > 0 {
+		if M == 0 {
+			D = 1
+		}
+		e.pushLMD(lit, M, D)
+	}
+}
+
+func (e *encoder) pushLMD(lit []byte, M, D int) {
+	if len(e.lValues) == LZFSE_MATCHES_PER_BLOCK || len(e.literals)+len(lit) > LZFSE_LITERALS_PER_BLOCK {
+		e.flushBlock()
+	}
+	e.literals = append(e.literals, lit...)
+	e.lValues = append(e.lValues, int32(len(lit)))
+	e.mValues = append(e.mValues, int32(M))
+	e.dValues = append(e.dValues, int32(D))
+	e.rawBytes += len(lit) + M
+}
+
+// flushBlock appends the current block, uncompressed if that is smaller
+func (e *encoder) flushBlock() {
+	if e.rawBytes == 0 {
+		return
+	}
+
+	raw := e.src[e.blockStart : e.blockStart+e.rawBytes]
+	if block := e.encodeV2Block(); len(block) < len(raw)+8 {
+		e.dst = append(e.dst, block...)
+	} else {
+		e.dst = appendUncompressedBlock(e.dst, raw)
+	}
+
+	e.blockStart += e.rawBytes
+	e.rawBytes = 0
+	e.literals = e.literals[:0]
+	e.lValues = e.lValues[:0]
+	e.mValues = e.mValues[:0]
+	e.dValues = e.dValues[:0]
+}
+
+func appendUncompressedBlock(dst, raw []byte) []byte {
+	dst = appendUint32(dst, uint32(LZFSE_UNCOMPRESSED_BLOCK_MAGIC))
+	dst = appendUint32(dst, uint32(len(raw)))
+	return append(dst, raw...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+// valueSymbol returns the symbol whose base value range contains v
+func valueSymbol(v int32, base []int32) int {
+	return sort.Search(len(base), func(i int) bool { return base[i] > v }) - 1
+}
+
+// encodeV1FreqValue encode an entry value with a fixed Huffman code (bits are read from LSB).
+// Return the code and nbits, the number of bits of the code.
+func encodeV1FreqValue(value uint16) (uint32, int) {
+	switch value {
+	case 0:
+		return 0, 2 //    0.0
+	case 1:
+		return 2, 2 //    1.0
+	case 2:
+		return 1, 3 //   0.01
+	case 3:
+		return 5, 3 //   1.01
+	case 4:
+		return 3, 5 // 00.011
+	case 5:
+		return 11, 5 // 01.011
+	case 6:
+		return 19, 5 // 10.011
+	case 7:
+		return 27, 5 // 11.011
+	}
+	if value < 24 {
+		return 7 + (uint32(value)-8)<<4, 8 // xxxx.0111
+	}
+	// 24..1047
+	return (uint32(value)-24)<<4 + 15, 14 // xxxxxxxxxx.1111
+}
+
+// encodeV2Block encodes the current block as a bvx2 (lzfse compressed, compressed tables) block
+func (e *encoder) encodeV2Block() []byte {
+	var header compressedBlockHeaderV1
+
+	// Pad the literals to a multiple of 4 (the decoder decodes 4 at a time)
+	literals := e.literals
+	for len(literals)%4 != 0 {
+		literals = append(literals, 0)
+	}
+	header.NLiterals = uint32(len(literals))
+	header.NMatches = uint32(len(e.lValues))
+
+	// L, M, D symbols (a D equal to the previous D is encoded as 0)
+	nMatches := len(e.lValues)
+	lSyms := make([]int, nMatches)
+	mSyms := make([]int, nMatches)
+	dSyms := make([]int, nMatches)
+	dValues := make([]int32, nMatches)
+	dPrev := int32(-1)
+	for i := 0; i < nMatches; i++ {
+		d := e.dValues[i]
+		if d == dPrev {
+			d = 0
+		} else {
+			dPrev = d
+		}
+		dValues[i] = d
+		lSyms[i] = valueSymbol(e.lValues[i], lBaseValue[:])
+		mSyms[i] = valueSymbol(e.mValues[i], mBaseValue[:])
+		dSyms[i] = valueSymbol(d, dBaseValue[:])
+	}
+
+	// Normalized frequency tables
+	var lCounts [LZFSE_ENCODE_L_SYMBOLS]uint32
+	var mCounts [LZFSE_ENCODE_M_SYMBOLS]uint32
+	var dCounts [LZFSE_ENCODE_D_SYMBOLS]uint32
+	var literalCounts [LZFSE_ENCODE_LITERAL_SYMBOLS]uint32
+	for i := 0; i < nMatches; i++ {
+		lCounts[lSyms[i]]++
+		mCounts[mSyms[i]]++
+		dCounts[dSyms[i]]++
+	}
+	for _, lit := range literals {
+		literalCounts[lit]++
+	}
+	fseNormalizeFreq(LZFSE_ENCODE_L_STATES, lCounts[:], header.LFreq[:])
+	fseNormalizeFreq(LZFSE_ENCODE_M_STATES, mCounts[:], header.MFreq[:])
+	fseNormalizeFreq(LZFSE_ENCODE_D_STATES, dCounts[:], header.DFreq[:])
+	fseNormalizeFreq(LZFSE_ENCODE_LITERAL_STATES, literalCounts[:], header.LiteralFreq[:])
+
+	var lEncoder [LZFSE_ENCODE_L_SYMBOLS]fseEncoderEntry
+	var mEncoder [LZFSE_ENCODE_M_SYMBOLS]fseEncoderEntry
+	var dEncoder [LZFSE_ENCODE_D_SYMBOLS]fseEncoderEntry
+	var literalEncoder [LZFSE_ENCODE_LITERAL_SYMBOLS]fseEncoderEntry
+	fseInitEncoderTable(LZFSE_ENCODE_L_STATES, LZFSE_ENCODE_L_SYMBOLS, header.LFreq[:], lEncoder[:])
+	fseInitEncoderTable(LZFSE_ENCODE_M_STATES, LZFSE_ENCODE_M_SYMBOLS, header.MFreq[:], mEncoder[:])
+	fseInitEncoderTable(LZFSE_ENCODE_D_STATES, LZFSE_ENCODE_D_SYMBOLS, header.DFreq[:], dEncoder[:])
+	fseInitEncoderTable(LZFSE_ENCODE_LITERAL_STATES, LZFSE_ENCODE_LITERAL_SYMBOLS, header.LiteralFreq[:], literalEncoder[:])
+
+	// Both streams are written backwards (the decoder reads them from the end) and
+	// start with 8 zero bytes so the decoder can always load a full 64 bits.
+	payload := make([]byte, 8, 8+len(literals)+nMatches*8)
+
+	// Encode literals
+	{
+		var out fseOutStream
+		var state0, state1, state2, state3 uint16
+		for i := len(literals) - 4; i >= 0; i -= 4 {
+			fseEncode(&state3, literalEncoder[:], &out, int(literals[i+3]))
+			fseEncode(&state2, literalEncoder[:], &out, int(literals[i+2]))
+			fseEncode(&state1, literalEncoder[:], &out, int(literals[i+1]))
+			fseEncode(&state0, literalEncoder[:], &out, int(literals[i+0]))
+			payload = fseOutFlush(&out, payload)
+		}
+		payload = fseOutFinish(&out, payload)
+
+		header.NLiteralPayloadBytes = uint32(len(payload))
+		header.LiteralBits = out.AccumNbits
+		header.LiteralState = [4]uint16{state0, state1, state2, state3}
+	}
+
+	// Encode L, M, D
+	{
+		var out fseOutStream
+		var lState, mState, dState uint16
+		payload = append(payload, make([]byte, 8)...)
+		for i := nMatches - 1; i >= 0; i-- {
+			// the decoder pulls L, M then D (each as the value's extra bits below the state bits)
+			fseOutPush(&out, fseBitCount(dExtraBits[dSyms[i]]), uint64(dValues[i]-dBaseValue[dSyms[i]]))
+			fseEncode(&dState, dEncoder[:], &out, dSyms[i])
+			fseOutPush(&out, fseBitCount(mExtraBits[mSyms[i]]), uint64(e.mValues[i]-mBaseValue[mSyms[i]]))
+			fseEncode(&mState, mEncoder[:], &out, mSyms[i])
+			fseOutPush(&out, fseBitCount(lExtraBits[lSyms[i]]), uint64(e.lValues[i]-lBaseValue[lSyms[i]]))
+			fseEncode(&lState, lEncoder[:], &out, lSyms[i])
+			payload = fseOutFlush(&out, payload)
+		}
+		payload = fseOutFinish(&out, payload)
+
+		header.NLmdPayloadBytes = uint32(len(payload)) - header.NLiteralPayloadBytes
+		header.LmdBits = out.AccumNbits
+		header.LState = lState
+		header.MState = mState
+		header.DState = dState
+	}
+
+	// Compressed frequency tables
+	var freqs []byte
+	var accum uint32
+	var accumNbits int
+	for _, table := range [][]uint16{header.LFreq[:], header.MFreq[:], header.DFreq[:], header.LiteralFreq[:]} {
+		for _, f := range table {
+			bits, nbits := encodeV1FreqValue(f)
+			accum |= bits << accumNbits
+			accumNbits += nbits
+			for accumNbits >= 8 {
+				freqs = append(freqs, byte(accum))
+				accum >>= 8
+				accumNbits -= 8
+			}
+		}
+	}
+	if accumNbits > 0 {
+		freqs = append(freqs, byte(accum))
+	}
+
+	v0 := uint64(header.NLiterals) |
+		uint64(header.NLiteralPayloadBytes)<<20 |
+		uint64(header.NMatches)<<40 |
+		uint64(header.LiteralBits+7)<<60
+	v1 := uint64(header.LiteralState[0]) |
+		uint64(header.LiteralState[1])<<10 |
+		uint64(header.LiteralState[2])<<20 |
+		uint64(header.LiteralState[3])<<30 |
+		uint64(header.NLmdPayloadBytes)<<40 |
+		uint64(header.LmdBits+7)<<60
+	v2 := uint64(compressedBlockHeaderV2Size+len(freqs)) |
+		uint64(header.LState)<<32 |
+		uint64(header.MState)<<42 |
+		uint64(header.DState)<<52
+
+	block := make([]byte, 0, compressedBlockHeaderV2Size+len(freqs)+len(payload))
+	block = appendUint32(block, uint32(LZFSE_COMPRESSEDV2_BLOCK_MAGIC))
+	block = appendUint32(block, uint32(e.rawBytes))
+	block = appendUint64(block, v0)
+	block = appendUint64(block, v1)
+	block = appendUint64(block, v2)
+	block = append(block, freqs...)
+
+	return append(block, payload...)
+}
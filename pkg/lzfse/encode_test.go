@@ -0,0 +1,114 @@
+package lzfse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// testInputs returns inputs that exercise every block type the encoder emits
+func testInputs() map[string][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		dat := make([]byte, n)
+		rnd.Read(dat)
+		return dat
+	}
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 60000) // > encodeChunkSize
+
+	return map[string][]byte{
+		"empty":                 {},
+		"one byte":              {0x42},
+		"smaller than a block":  []byte("hello, hello, hello world"),
+		"below lzvn threshold":  text[:LZFSE_ENCODE_LZVN_THRESHOLD-1],
+		"at lzvn threshold":     text[:LZFSE_ENCODE_LZVN_THRESHOLD],
+		"zeros":                 make([]byte, 200000),
+		"text":                  text,
+		"incompressible small":  random(1000),
+		"incompressible":        random(300000),
+		"incompressible chunks": random(encodeChunkSize + 12345),
+		"mixed":                 append(append(random(50000), text[:100000]...), random(50000)...),
+	}
+}
+
+func TestEncodeBufferRoundTrip(t *testing.T) {
+	for name, src := range testInputs() {
+		t.Run(name, func(t *testing.T) {
+			enc := EncodeBuffer(src)
+			dec, err := NewDecoder(enc).DecodeBuffer()
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if !bytes.Equal(dec, src) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d", len(dec), len(src))
+			}
+		})
+	}
+}
+
+func TestEncodeLZVNRoundTrip(t *testing.T) {
+	for name, src := range testInputs() {
+		if len(src) > encodeChunkSize {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			dec, err := DecodeLZVN(EncodeLZVN(src))
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if !bytes.Equal(dec, src) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d", len(dec), len(src))
+			}
+		})
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for name, src := range testInputs() {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			// odd sized writes so blocks don't line up with them
+			for p := src; len(p) > 0; {
+				n := 7777
+				if n > len(p) {
+					n = len(p)
+				}
+				if _, err := w.Write(p[:n]); err != nil {
+					t.Fatalf("failed to write: %v", err)
+				}
+				p = p[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to close: %v", err)
+			}
+
+			dec, err := ioutil.ReadAll(NewReader(bytes.NewReader(buf.Bytes())))
+			if err != nil {
+				t.Fatalf("failed to read stream: %v", err)
+			}
+			if !bytes.Equal(dec, src) {
+				t.Fatalf("stream round trip mismatch: got %d bytes, want %d", len(dec), len(src))
+			}
+
+			dec, err = NewDecoder(buf.Bytes()).DecodeBuffer()
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if !bytes.Equal(dec, src) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d", len(dec), len(src))
+			}
+		})
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	w := NewWriter(ioutil.Discard)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err == nil {
+		t.Fatal("expected an error writing to a closed writer")
+	}
+}
@@ -285,3 +285,149 @@ func fseMaskLsb64(x uint64, nbits fseBitCount) uint64 {
 func fseExtractBits(x uint64, start, nbits fseBitCount) uint64 {
 	return fseMaskLsb64(x>>start, nbits)
 }
+
+// fseEncoderEntry entry for one symbol in the encoder table.
+type fseEncoderEntry struct {
+	s0     int16 // First state requiring a K-bit shift
+	k      int16 // States S >= S0 are shifted K bits. States S < S0 are shifted K-1 bits
+	delta0 int16 // Relative increment used to compute next state if S >= S0
+	delta1 int16 // Relative increment used to compute next state if S < S0
+}
+
+// fseOutStream object representing an output stream.
+type fseOutStream struct {
+	Accum      uint64      // Output bits
+	AccumNbits fseBitCount // Number of valid bits in ACCUM, other bits are 0
+}
+
+// fseOutPush - push n bits of b to the fse stream object.
+func fseOutPush(s *fseOutStream, n fseBitCount, b uint64) {
+	s.Accum |= b << s.AccumNbits
+	s.AccumNbits += n
+}
+
+// fseOutFlush - write the complete bytes of the accumulator to buf.
+func fseOutFlush(s *fseOutStream, buf []byte) []byte {
+	nbits := s.AccumNbits & -8 // number of bits written, multiple of 8
+	for i := fseBitCount(0); i < nbits; i += 8 {
+		buf = append(buf, byte(s.Accum>>i))
+	}
+	s.Accum >>= nbits
+	s.AccumNbits -= nbits
+	return buf
+}
+
+// fseOutFinish - write the remaining bits of the accumulator to buf (zero padded to a byte),
+// leaving AccumNbits in [-7, 0] which is the value the decoder needs to init the stream.
+func fseOutFinish(s *fseOutStream, buf []byte) []byte {
+	nbits := (s.AccumNbits + 7) & -8 // number of bits written, multiple of 8
+	for i := fseBitCount(0); i < nbits; i += 8 {
+		buf = append(buf, byte(s.Accum>>i))
+	}
+	s.Accum = 0
+	s.AccumNbits -= nbits
+	return buf
+}
+
+// fseEncode - encode symbol using the encoder table, and update *pstate, out.
+func fseEncode(pstate *uint16, encoderTable []fseEncoderEntry, out *fseOutStream, symbol int) {
+	s := int32(*pstate)
+	e := encoderTable[symbol]
+	// Number of bits to write
+	nbits := fseBitCount(e.k - 1)
+	delta := int32(e.delta1)
+	if s >= int32(e.s0) {
+		nbits = fseBitCount(e.k)
+		delta = int32(e.delta0)
+	}
+	// Write lower NBITS of state
+	fseOutPush(out, nbits, fseMaskLsb64(uint64(s), nbits))
+	// Update state with remaining bits and delta
+	*pstate = uint16(delta + (s >> nbits))
+}
+
+// fseInitEncoderTable initialize an encoder table T[NSYMBOLS] from the normalized frequencies FREQ[NSYMBOLS].
+func fseInitEncoderTable(nstates, nsymbols int, freq []uint16, t []fseEncoderEntry) {
+	var offset int // current offset
+
+	nClz := bits.LeadingZeros32(uint32(nstates))
+	for i := 0; i < nsymbols; i++ {
+		f := int(freq[i])
+		if f == 0 {
+			continue // skip this symbol, no occurrences
+		}
+		k := bits.LeadingZeros32(uint32(f)) - nClz // shift needed to ensure N <= (F<<K) < 2*N
+		t[i].s0 = int16((f << k) - nstates)
+		t[i].k = int16(k)
+		t[i].delta0 = int16(offset - f + (nstates >> k))
+		if k > 0 { // a symbol with all the states (k == 0) always takes the S >= S0 path
+			t[i].delta1 = int16(offset - f + (nstates >> (k - 1)))
+		}
+		offset += f
+	}
+}
+
+// fseAdjustFreqs removes the states overrun from the symbols, starting with the most frequent.
+func fseAdjustFreqs(freq []uint16, overrun int) {
+	for shift := 3; overrun != 0; shift-- {
+		for sym := range freq {
+			if freq[sym] > 1 {
+				n := int(freq[sym]-1) >> shift
+				if n > overrun {
+					n = overrun
+				}
+				freq[sym] -= uint16(n)
+				overrun -= n
+				if overrun == 0 {
+					break
+				}
+			}
+		}
+	}
+}
+
+// fseNormalizeFreq normalize the symbol counts T[NSYMBOLS] to frequencies FREQ[NSYMBOLS] summing to NSTATES;
+// every used symbol gets a non-zero frequency.
+func fseNormalizeFreq(nstates int, t []uint32, freq []uint16) {
+	var sCount uint32
+	var highprecStep uint32
+	var maxFreq, maxFreqSym int
+
+	remaining := nstates // must be signed; this may become < 0
+	shift := bits.LeadingZeros32(uint32(nstates)) - 1
+
+	// Compute the total number of symbol occurrences
+	for _, c := range t {
+		sCount += c
+	}
+	if sCount != 0 {
+		highprecStep = (1 << 31) / sCount
+	}
+
+	for i, c := range t {
+		// Rescale the occurrence count to get the normalized frequency.
+		// Round up if the fractional part is >= 0.5; otherwise round down.
+		f := int((uint64(c)*uint64(highprecStep))>>shift+1) >> 1
+		// If a symbol was used, it must be given a nonzero normalized frequency.
+		if f == 0 && c != 0 {
+			f = 1
+		}
+		freq[i] = uint16(f)
+		remaining -= f
+		// Remember the maximum frequency and which symbol had it.
+		if f > maxFreq {
+			maxFreq = f
+			maxFreqSym = i
+		}
+	}
+
+	// If there remain states to be assigned, then just assign them to the most
+	// frequent symbol. Alternatively, if we assigned more states than were
+	// actually available, then either remove states from the most frequent symbol
+	// (for minor deficits) or use a slower adjustment algorithm (for major deficits).
+	if -remaining < (maxFreq >> 2) {
+		freq[maxFreqSym] = uint16(int(freq[maxFreqSym]) + remaining)
+	} else {
+		fseAdjustFreqs(freq, -remaining)
+	}
+}
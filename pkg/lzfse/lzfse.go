@@ -29,9 +29,12 @@ func NewDecoder(data []byte) *Decoder {
 	var dst bytes.Buffer
 	dst.Grow(4 * len(data))
 	// TODO: should the scratch be more?
-	scratch := make([]byte, 2*binary.Size(compressedBlockHeaderV1{}))
+	// copy the data so the scratch space doesn't overwrite what follows it in the caller's buffer
+	src := make([]byte, len(data), len(data)+2*binary.Size(compressedBlockHeaderV1{}))
+	copy(src, data)
+	src = src[:cap(src)]
 	return &Decoder{
-		src: bytes.NewReader(append(data, scratch...)),
+		src: bytes.NewReader(src),
 		dst: dst,
 	}
 }
@@ -317,10 +320,24 @@ func (s *Decoder) decode() error {
 				return nil
 			}
 			if s.blockMagic == LZFSE_UNCOMPRESSED_BLOCK_MAGIC {
-				return fmt.Errorf("found LZFSE_UNCOMPRESSED_BLOCK_MAGIC block - not implimented")
+				var header uncompressedBlockHeader
+				if err := binary.Read(s.src, binary.LittleEndian, &header); err != nil {
+					return fmt.Errorf("failed to read LZFSE_UNCOMPRESSED_BLOCK_MAGIC header: %v", err)
+				}
+				s.UncompressedBlockState.NRawBytes = header.NRawBytes
+				s.syncReaders()
+				break
 			}
 			if s.blockMagic == LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC {
-				return fmt.Errorf("found LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC block - not implimented")
+				var header lzvnCompressedBlockHeader
+				if err := binary.Read(s.src, binary.LittleEndian, &header); err != nil {
+					return fmt.Errorf("failed to read LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC header: %v", err)
+				}
+				s.CompressedLzvnBlockState.NRawBytes = header.NRawBytes
+				s.CompressedLzvnBlockState.NPayloadBytes = header.NPayloadBytes
+				s.CompressedLzvnBlockState.DPrev = 0
+				s.syncReaders()
+				break
 			}
 			if s.blockMagic == LZFSE_COMPRESSEDV1_BLOCK_MAGIC || s.blockMagic == LZFSE_COMPRESSEDV2_BLOCK_MAGIC {
 				var header1 compressedBlockHeaderV1
@@ -438,8 +455,12 @@ func (s *Decoder) decode() error {
 			// Here we have an invalid magic number
 			return fmt.Errorf("LZFSE_STATUS_ERROR - invalid magic number")
 		case LZFSE_UNCOMPRESSED_BLOCK_MAGIC:
-			return fmt.Errorf("found LZFSE_UNCOMPRESSED_BLOCK_MAGIC block - not implimented")
-			// break
+			if _, err := io.CopyN(&s.dst, s.src, int64(s.UncompressedBlockState.NRawBytes)); err != nil {
+				return fmt.Errorf("failed to copy LZFSE_UNCOMPRESSED_BLOCK_MAGIC block: %v", err)
+			}
+			s.blockMagic = LZFSE_NO_BLOCK_MAGIC
+			s.syncReaders()
+			break
 		case LZFSE_COMPRESSEDV1_BLOCK_MAGIC:
 			// log.Debug("LZFSE_COMPRESSEDV1_BLOCK_MAGIC")
 			fallthrough
@@ -460,10 +481,23 @@ func (s *Decoder) decode() error {
 			s.syncReaders()
 			break
 		case LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC:
-			return fmt.Errorf("found LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC block - not implimented")
-			// Run LZVN decoder
-			// lzvn_decode(&dstate)
-			// break
+			payload := make([]byte, s.CompressedLzvnBlockState.NPayloadBytes)
+			if _, err := io.ReadFull(s.src, payload); err != nil {
+				return fmt.Errorf("failed to read LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC payload: %v", err)
+			}
+			// matches may reference the output of the previous blocks
+			prev := s.dst.Len()
+			dst, _, err := lzvnDecode(s.dst.Bytes()[:prev:prev], payload)
+			if err != nil {
+				return fmt.Errorf("failed to lzvn decode LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC block: %v", err)
+			}
+			if len(dst)-prev != int(s.CompressedLzvnBlockState.NRawBytes) {
+				return fmt.Errorf("LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC block decoded to %d bytes (expected %d)", len(dst)-prev, s.CompressedLzvnBlockState.NRawBytes)
+			}
+			s.dst.Write(dst[prev:])
+			s.blockMagic = LZFSE_NO_BLOCK_MAGIC
+			s.syncReaders()
+			break
 		default:
 			return fmt.Errorf("LZFSE_STATUS_ERROR: invalid magic")
 		}
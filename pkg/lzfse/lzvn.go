@@ -1,5 +1,10 @@
 package lzfse
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type lzvnOpCode byte
 
 const (
@@ -53,3 +58,202 @@ var opcode_table = [256]lzvnOpCode{
 	large_match, small_match, small_match, small_match, small_match, small_match, small_match, small_match,
 	small_match, small_match, small_match, small_match, small_match, small_match, small_match, small_match,
 }
+
+const (
+	lzvnMaxDistance = 0xffff // max match distance (lrg_d)
+	lzvnMinMatch    = 3
+
+	lzvnEOS = "\x06\x00\x00\x00\x00\x00\x00\x00" // end of stream opcode and padding
+)
+
+// DecodeLZVN decompresses a buffer using LZVN.
+func DecodeLZVN(src []byte) ([]byte, error) {
+	dst, _, err := lzvnDecode(make([]byte, 0, 4*len(src)), src)
+	return dst, err
+}
+
+// lzvnDecode decodes an LZVN stream appending to dst (whose contents may be referenced by the matches)
+// and returns the number of bytes of src consumed (up to and including the end of stream).
+func lzvnDecode(dst, src []byte) ([]byte, int, error) {
+	var dPrev int
+	var i int
+
+	for i < len(src) {
+		var L, M, D int
+
+		op := src[i]
+		n := 1 // opcode size
+		switch opcode_table[op] {
+		case small_distance: // LLMMMDDD DDDDDDDD
+			n = 2
+		case medium_distance, large_distance: // 101LLMMM DDDDDDMM DDDDDDDD, LLMMM111 DDDDDDDD DDDDDDDD
+			n = 3
+		case large_match, large_literal: // 11110000 MMMMMMMM, 11100000 LLLLLLLL
+			n = 2
+		case end_of_stream:
+			n = len(lzvnEOS)
+		}
+		if i+n > len(src) {
+			return dst, i, fmt.Errorf("lzvn opcode %#02x at %#x is truncated", op, i)
+		}
+
+		switch opcode_table[op] {
+		case small_distance:
+			L = int(op >> 6)
+			M = int((op>>3)&7) + 3
+			D = int(op&7)<<8 | int(src[i+1])
+		case medium_distance:
+			L = int((op >> 3) & 3)
+			M = (int(op&7)<<2 | int(src[i+1]&3)) + 3
+			D = int(binary.LittleEndian.Uint16(src[i+1:])) >> 2
+		case large_distance:
+			L = int(op >> 6)
+			M = int((op>>3)&7) + 3
+			D = int(binary.LittleEndian.Uint16(src[i+1:]))
+		case previous_distance: // LLMMM110
+			L = int(op >> 6)
+			M = int((op>>3)&7) + 3
+			D = dPrev
+		case small_match: // 1111MMMM
+			M = int(op & 0xf)
+			D = dPrev
+		case large_match:
+			M = int(src[i+1]) + 16
+			D = dPrev
+		case small_literal: // 1110LLLL
+			L = int(op & 0xf)
+		case large_literal:
+			L = int(src[i+1]) + 16
+		case nop:
+		case end_of_stream:
+			return dst, i + n, nil
+		default:
+			return dst, i, fmt.Errorf("undefined lzvn opcode %#02x at %#x", op, i)
+		}
+		i += n
+
+		if L > 0 {
+			if i+L > len(src) {
+				return dst, i, fmt.Errorf("lzvn literals at %#x are truncated", i)
+			}
+			dst = append(dst, src[i:i+L]...)
+			i += L
+		}
+		if M > 0 {
+			if D == 0 || D > len(dst) {
+				return dst, i, fmt.Errorf("invalid lzvn match distance %d at %#x", D, i)
+			}
+			for j := 0; j < M; j++ { // byte by byte as the match may overlap itself
+				dst = append(dst, dst[len(dst)-D])
+			}
+			dPrev = D
+		}
+	}
+
+	return dst, i, fmt.Errorf("lzvn stream is missing the end of stream opcode")
+}
+
+// EncodeLZVN compresses a buffer using LZVN.
+func EncodeLZVN(src []byte) []byte {
+	return lzvnEncode(make([]byte, 0, len(src)/2+len(lzvnEOS)), src)
+}
+
+// lzvnEncode appends the LZVN stream (including the end of stream) of src to dst
+func lzvnEncode(dst, src []byte) []byte {
+	var dPrev int
+
+	mf := newMatchFinder(src, lzvnMaxDistance)
+
+	lit := 0 // start of the pending literals
+	for pos := 0; pos < len(src); {
+		M, D := mf.find(pos)
+		if M < lzvnMinMatch {
+			mf.insert(pos)
+			pos++
+			continue
+		}
+		dst = lzvnEmitMatch(dst, src[lit:pos], M, D, dPrev)
+		dPrev = D
+		for end := pos + M; pos < end; pos++ {
+			mf.insert(pos)
+		}
+		lit = pos
+	}
+	dst = lzvnEmitLiterals(dst, src[lit:])
+
+	return append(dst, lzvnEOS...)
+}
+
+// lzvnEmitLiterals emits literal only opcodes (sml_l, lrg_l) for all of lit
+func lzvnEmitLiterals(dst, lit []byte) []byte {
+	for len(lit) > 0 {
+		L := len(lit)
+		if L > 0xff+16 {
+			L = 0xff + 16
+		}
+		if L < 16 {
+			dst = append(dst, 0xe0|byte(L))
+		} else {
+			dst = append(dst, 0xe0, byte(L-16))
+		}
+		dst = append(dst, lit[:L]...)
+		lit = lit[L:]
+	}
+	return dst
+}
+
+// lzvnEmitMatch emits the literals followed by a match of M bytes at distance D
+func lzvnEmitMatch(dst, lit []byte, M, D, dPrev int) []byte {
+	// the match opcodes carry up to 3 literals
+	if len(lit) > 3 {
+		dst = lzvnEmitLiterals(dst, lit[:len(lit)-len(lit)%4])
+		lit = lit[len(lit)-len(lit)%4:]
+	}
+	L := byte(len(lit))
+
+	// sml_d, pre_d and lrg_d can't encode the (undefined) opcodes 0111xxxx and 1101xxxx,
+	// so their max match length shrinks as the number of literals grows
+	maxM := 10 - 2*int(L)
+
+	var m int
+	switch {
+	case D == dPrev && L == 0:
+		// match only opcodes below
+	case D == dPrev: // pre_d: LLMMM110
+		m = minInt(M, maxM)
+		dst = append(dst, L<<6|byte(m-3)<<3|6)
+	case M > maxM && D < 1<<14: // med_d: 101LLMMM DDDDDDMM DDDDDDDD
+		m = minInt(M, 34)
+		dst = append(dst, 0xa0|L<<3|byte(m-3)>>2, byte(D<<2)|byte(m-3)&3, byte(D>>6))
+	case D < 6<<8: // sml_d: LLMMMDDD DDDDDDDD
+		m = minInt(M, maxM)
+		dst = append(dst, L<<6|byte(m-3)<<3|byte(D>>8), byte(D))
+	default: // lrg_d: LLMMM111 DDDDDDDD DDDDDDDD
+		m = minInt(M, maxM)
+		dst = append(dst, L<<6|byte(m-3)<<3|7, byte(D), byte(D>>8))
+	}
+	dst = append(dst, lit...)
+
+	// the rest of the match is at the now previous distance
+	for M -= m; M > 0; {
+		n := M
+		if n > 0xff+16 {
+			n = 0xff + 16
+		}
+		if n < 16 {
+			dst = append(dst, 0xf0|byte(n))
+		} else {
+			dst = append(dst, 0xf0, byte(n-16))
+		}
+		M -= n
+	}
+
+	return dst
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
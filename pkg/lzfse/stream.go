@@ -0,0 +1,208 @@
+package lzfse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxHistory is how far back the matches of a block can reference the output of the previous blocks
+const maxHistory = LZFSE_ENCODE_MAX_D_VALUE
+
+// Reader is an io.Reader that decompresses an LZFSE stream one block at a time
+// (only the current block and the history its matches can reference are held in memory).
+type Reader struct {
+	r    io.Reader
+	hist []byte // previous output
+	buf  []byte // decoded output not read yet
+	err  error
+}
+
+// NewReader creates a new Reader reading the LZFSE stream from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Read reads decompressed data.
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.buf) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.nextBlock()
+	}
+	n := copy(p, z.buf)
+	z.buf = z.buf[n:]
+	return n, nil
+}
+
+// readBlock reads the next block (header and payload) from the stream
+func (z *Reader) readBlock() (magic, []byte, error) {
+	block := make([]byte, 4)
+	if _, err := io.ReadFull(z.r, block); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.ErrUnexpectedEOF // the stream must end with LZFSE_ENDOFSTREAM_BLOCK_MAGIC
+		}
+		return 0, nil, err
+	}
+
+	readMore := func(n int) error {
+		start := len(block)
+		block = append(block, make([]byte, n)...)
+		_, err := io.ReadFull(z.r, block[start:])
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	m := magic(binary.LittleEndian.Uint32(block))
+	switch m {
+	case LZFSE_ENDOFSTREAM_BLOCK_MAGIC:
+		return m, nil, nil
+	case LZFSE_UNCOMPRESSED_BLOCK_MAGIC:
+		if err := readMore(4); err != nil {
+			return m, nil, err
+		}
+		if err := readMore(int(binary.LittleEndian.Uint32(block[4:]))); err != nil {
+			return m, nil, err
+		}
+	case LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC:
+		if err := readMore(8); err != nil {
+			return m, nil, err
+		}
+		if err := readMore(int(binary.LittleEndian.Uint32(block[8:]))); err != nil {
+			return m, nil, err
+		}
+	case LZFSE_COMPRESSEDV1_BLOCK_MAGIC:
+		if err := readMore(binary.Size(compressedBlockHeaderV1{}) - 4); err != nil {
+			return m, nil, err
+		}
+		nLiteralPayloadBytes := binary.LittleEndian.Uint32(block[20:])
+		nLmdPayloadBytes := binary.LittleEndian.Uint32(block[24:])
+		if err := readMore(int(nLiteralPayloadBytes + nLmdPayloadBytes)); err != nil {
+			return m, nil, err
+		}
+	case LZFSE_COMPRESSEDV2_BLOCK_MAGIC:
+		if err := readMore(compressedBlockHeaderV2Size - 4); err != nil {
+			return m, nil, err
+		}
+		v0 := binary.LittleEndian.Uint64(block[8:])
+		v1 := binary.LittleEndian.Uint64(block[16:])
+		v2 := binary.LittleEndian.Uint64(block[24:])
+		headerSize := getField(v2, 0, 32)
+		if headerSize < compressedBlockHeaderV2Size {
+			return m, nil, fmt.Errorf("invalid LZFSE_COMPRESSEDV2_BLOCK_MAGIC header size %d", headerSize)
+		}
+		size := headerSize - compressedBlockHeaderV2Size + getField(v0, 20, 20) + getField(v1, 40, 20)
+		if err := readMore(int(size)); err != nil {
+			return m, nil, err
+		}
+	default:
+		return m, nil, fmt.Errorf("LZFSE_STATUS_ERROR - invalid magic number %#x", uint32(m))
+	}
+
+	return m, block, nil
+}
+
+// nextBlock decodes the next block into buf
+func (z *Reader) nextBlock() error {
+	m, block, err := z.readBlock()
+	if err != nil {
+		return err
+	}
+	if m == LZFSE_ENDOFSTREAM_BLOCK_MAGIC {
+		return io.EOF
+	}
+
+	d := NewDecoder(appendUint32(block, uint32(LZFSE_ENDOFSTREAM_BLOCK_MAGIC)))
+	d.dst.Write(z.hist)
+	out, err := d.DecodeBuffer()
+	if err != nil {
+		return err
+	}
+	z.buf = out[len(z.hist):]
+
+	// keep the history the next block's matches can reference
+	if len(out) > maxHistory {
+		out = out[len(out)-maxHistory:]
+	}
+	z.hist = append(z.hist[:0], out...)
+
+	return nil
+}
+
+// Writer is an io.WriteCloser that compresses to an LZFSE stream.
+// The stream is only complete once Close is called.
+type Writer struct {
+	w      io.Writer
+	buf    []byte // history followed by the data not compressed yet
+	hist   int    // length of the history in buf
+	total  int
+	err    error
+	closed bool
+}
+
+// NewWriter creates a new Writer writing the LZFSE stream to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write compresses p, the compressed blocks are written as enough data is buffered.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, fmt.Errorf("lzfse: write to closed writer")
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	z.buf = append(z.buf, p...)
+	z.total += len(p)
+	for len(z.buf)-z.hist >= encodeChunkSize {
+		if z.err = z.flush(z.hist + encodeChunkSize); z.err != nil {
+			return 0, z.err
+		}
+	}
+
+	return len(p), nil
+}
+
+// flush compresses and writes buf[hist:end]
+func (z *Writer) flush(end int) error {
+	var e encoder
+	e.encodeChunk(z.buf, z.hist, end)
+	if _, err := z.w.Write(e.dst); err != nil {
+		return err
+	}
+
+	start := end - maxHistory
+	if start < 0 {
+		start = 0
+	}
+	z.buf = z.buf[:copy(z.buf, z.buf[start:])]
+	z.hist = end - start
+
+	return nil
+}
+
+// Close compresses the buffered data and writes the end of the stream (it doesn't close the underlying writer).
+func (z *Writer) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	if z.err != nil {
+		return z.err
+	}
+
+	var e encoder
+	if z.total < LZFSE_ENCODE_LZVN_THRESHOLD {
+		e.encodeLZVN(z.buf)
+	} else if len(z.buf) > z.hist {
+		e.encodeChunk(z.buf, z.hist, len(z.buf))
+	}
+	_, err := z.w.Write(appendUint32(e.dst, uint32(LZFSE_ENDOFSTREAM_BLOCK_MAGIC)))
+
+	return err
+}
@@ -55,6 +55,11 @@ const (
 	LZFSE_ENCODE_LITERAL_STATES = 1024
 	LZFSE_MATCHES_PER_BLOCK     = 10000
 	LZFSE_LITERALS_PER_BLOCK    = (4 * LZFSE_MATCHES_PER_BLOCK)
+
+	//  Largest L, M and D values that can be encoded (base value + extra bits of the last symbol).
+	LZFSE_ENCODE_MAX_L_VALUE = 315
+	LZFSE_ENCODE_MAX_M_VALUE = 2359
+	LZFSE_ENCODE_MAX_D_VALUE = 262139
 )
 
 type lzfseCompressedBlockLiterals [LZFSE_LITERALS_PER_BLOCK + 64]uint8
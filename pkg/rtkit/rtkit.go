@@ -0,0 +1,211 @@
+// Package rtkit identifies RTKit coprocessor firmwares (AOP, ANE, ISP, DCP, SIO, GFX, etc.)
+package rtkit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/blacktop/go-macho"
+	"github.com/blacktop/go-macho/types"
+)
+
+// Firmware formats
+const (
+	FormatMachO = "macho"
+	FormatRaw   = "raw"
+)
+
+// archScanSize is the amount of a raw firmware scanned to guess its architecture
+const archScanSize = 1 << 20
+
+var versionRE = regexp.MustCompile(`RTKit\w*-\d+(?:\.\d+)*`)
+
+// Components are the coprocessors of the known IM4P types and ftab tags
+var Components = map[string]string{
+	"aopf": "AOP", // Always-On Processor
+	"anef": "ANE", // Apple Neural Engine
+	"ispf": "ISP", // Image Signal Processor
+	"dcpf": "DCP", // Display Coprocessor
+	"dcp2": "DCP",
+	"siof": "SIO", // Smart IO
+	"gfxf": "GFX", // GPU
+	"avef": "AVE", // Video Encoder
+	"pmpf": "PMP", // Power Management Processor
+	"ansf": "ANS", // Storage Processor
+	"mtpf": "MTP", // Multi-Touch Processor
+	"rkos": "RTKit",
+}
+
+// pathNames are the coprocessors of the known firmware paths (e.g. Firmware/AOP/aopfw-t8101aop.im4p)
+var pathNames = []struct {
+	re   *regexp.Regexp
+	name string
+}{
+	{regexp.MustCompile(`(?i)(^|[/_.-])aop`), "AOP"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])ane`), "ANE"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])(isp|adc)`), "ISP"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])dcp`), "DCP"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])sio`), "SIO"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])(agx|gfx|armfw)`), "GFX"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])ave`), "AVE"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])pmp`), "PMP"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])ans`), "ANS"},
+	{regexp.MustCompile(`(?i)(^|[/_.-])(mtp|multitouch)`), "MTP"},
+}
+
+// Segment is a firmware segment
+type Segment struct {
+	Name   string `json:"name"`
+	VMAddr uint64 `json:"vmaddr"`
+	VMSize uint64 `json:"vmsize"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+// Firmware is an identified coprocessor firmware
+type Firmware struct {
+	Name     string    `json:"name"`          // the coprocessor (e.g. AOP) or the tag if it isn't known
+	Tag      string    `json:"tag,omitempty"` // IM4P type or ftab tag
+	Version  string    `json:"version,omitempty"`
+	Arch     string    `json:"arch"`
+	Format   string    `json:"format"`
+	Size     uint64    `json:"size"`
+	Segments []Segment `json:"segments,omitempty"`
+}
+
+func (f Firmware) String() string {
+	version := f.Version
+	if len(version) == 0 {
+		version = "-"
+	}
+	return fmt.Sprintf("%-6s %-5s %-8s %-5s %s (%#x)", f.Name, f.Tag, f.Arch, f.Format, version, f.Size)
+}
+
+// Version returns the RTKit version string of a firmware (empty if it isn't RTKit based)
+func Version(data []byte) string {
+	return string(versionRE.Find(data))
+}
+
+// IsRTKit returns true if data is an RTKit based firmware
+func IsRTKit(data []byte) bool {
+	return versionRE.Match(data) || bytes.Contains(data, []byte("RTKSTACK"))
+}
+
+// Name returns the coprocessor name of an IM4P type or ftab tag
+func Name(tag string) string {
+	if name, ok := Components[tag]; ok {
+		return name
+	}
+	return tag
+}
+
+// NameFromPath returns the coprocessor name of a firmware path (empty if it isn't known)
+func NameFromPath(path string) string {
+	for _, pn := range pathNames {
+		if pn.re.MatchString(path) {
+			return pn.name
+		}
+	}
+	return ""
+}
+
+// Parse identifies a firmware (tag is its IM4P type or ftab tag)
+func Parse(tag string, data []byte) *Firmware {
+	fw := &Firmware{
+		Name:    Name(tag),
+		Tag:     tag,
+		Version: Version(data),
+		Format:  FormatRaw,
+		Size:    uint64(len(data)),
+	}
+
+	if m, err := macho.NewFile(bytes.NewReader(data)); err == nil {
+		fw.Format = FormatMachO
+		fw.Arch = machoArch(m.CPU, m.SubCPU)
+		for _, seg := range m.Segments() {
+			fw.Segments = append(fw.Segments, Segment{
+				Name:   seg.Name,
+				VMAddr: seg.Addr,
+				VMSize: seg.Memsz,
+				Offset: seg.Offset,
+				Size:   seg.Filesz,
+			})
+		}
+		m.Close()
+	} else {
+		fw.Arch = rawArch(data)
+	}
+
+	return fw
+}
+
+// Arch returns the architecture of a Mach-O (or a guess for raw code)
+func Arch(data []byte) string {
+	if arch := MachOArch(data); len(arch) > 0 {
+		return arch
+	}
+	return rawArch(data)
+}
+
+// MachOArch returns the architecture(s) of a Mach-O or universal Mach-O (empty if data isn't a Mach-O)
+func MachOArch(data []byte) string {
+	if m, err := macho.NewFile(bytes.NewReader(data)); err == nil {
+		defer m.Close()
+		return machoArch(m.CPU, m.SubCPU)
+	}
+	if fat, err := macho.NewFatFile(bytes.NewReader(data)); err == nil {
+		defer fat.Close()
+		var arches []string
+		for _, arch := range fat.Arches {
+			arches = append(arches, machoArch(arch.CPU, arch.SubCPU))
+		}
+		return strings.Join(arches, ",")
+	}
+	return ""
+}
+
+func machoArch(cpu types.CPU, sub types.CPUSubtype) string {
+	switch cpu {
+	case types.CPUArm64:
+		if sub&types.CpuSubtypeMask == types.CPUSubtypeArm64E {
+			return "arm64e"
+		}
+		return "arm64"
+	case types.CPUArm6432:
+		return "arm64_32"
+	case types.CPUArm:
+		return strings.ToLower(sub.String(cpu))
+	case types.CPUAmd64:
+		return "x86_64"
+	}
+	return strings.ToLower(cpu.String())
+}
+
+// rawArch guesses the architecture of raw code by counting common arm64 and thumb instructions
+func rawArch(data []byte) string {
+	if len(data) > archScanSize {
+		data = data[:archScanSize]
+	}
+	var arm64, thumb int
+	for off := 0; off+4 <= len(data); off += 2 {
+		if off%4 == 0 {
+			switch binary.LittleEndian.Uint32(data[off:]) {
+			case 0xd65f03c0, 0xd503201f, 0xd503237f: // ret, nop, pacibsp
+				arm64++
+			}
+		}
+		if binary.LittleEndian.Uint16(data[off:]) == 0x4770 { // bx lr
+			thumb++
+		}
+	}
+	switch {
+	case arm64 == 0 && thumb == 0:
+		return "unknown"
+	case arm64 >= thumb:
+		return "arm64"
+	}
+	return "armv7"
+}
@@ -0,0 +1,221 @@
+package sep
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/blacktop/go-macho/types"
+	"github.com/blacktop/ipsw/internal/utils"
+)
+
+// maxImageSize is the maximum size of a sane reconstructed Mach-O
+const maxImageSize = 256 << 20
+
+// segment is a Mach-O segment load command
+type segment struct {
+	Name     string
+	VMAddr   uint64
+	VMSize   uint64
+	FileOff  uint64
+	FileSize uint64
+}
+
+// machoInfo is what's needed from a Mach-O's load commands to reconstruct it
+type machoInfo struct {
+	segments   []segment
+	cmdsEnd    uint64 // end of the load commands
+	uuid       types.UUID
+	hasUUID    bool
+	srcVersion types.SrcVersion
+}
+
+func isMachO(data []byte, off uint64) bool {
+	return off < uint64(len(data)) && utils.IsMachO(data[off:])
+}
+
+// parseMachO parses the load commands of a Mach-O (only the header and load commands need to be in data)
+func parseMachO(data []byte) (*machoInfo, error) {
+	if !isMachO(data, 0) {
+		return nil, fmt.Errorf("invalid Mach-O magic")
+	}
+
+	is64 := types.Magic(binary.LittleEndian.Uint32(data)) == types.Magic64
+	hdrSize := 28
+	if is64 {
+		hdrSize = 32
+	}
+	if len(data) < hdrSize {
+		return nil, fmt.Errorf("Mach-O header is truncated")
+	}
+	ncmds := binary.LittleEndian.Uint32(data[16:])
+	sizeofcmds := binary.LittleEndian.Uint32(data[20:])
+	if uint64(hdrSize)+uint64(sizeofcmds) > uint64(len(data)) {
+		return nil, fmt.Errorf("Mach-O load commands are truncated")
+	}
+
+	info := &machoInfo{cmdsEnd: uint64(hdrSize) + uint64(sizeofcmds)}
+	cmds := data[hdrSize : hdrSize+int(sizeofcmds)]
+	for idx := uint32(0); idx < ncmds; idx++ {
+		if len(cmds) < 8 {
+			return nil, fmt.Errorf("load command %d is truncated", idx)
+		}
+		cmd := types.LoadCmd(binary.LittleEndian.Uint32(cmds))
+		size := binary.LittleEndian.Uint32(cmds[4:])
+		if size < 8 || uint64(size) > uint64(len(cmds)) {
+			return nil, fmt.Errorf("load command %d has an invalid size %#x", idx, size)
+		}
+		lc := cmds[:size]
+
+		var seg *segment
+		switch cmd {
+		case types.LC_SEGMENT:
+			if len(lc) < 40 {
+				return nil, fmt.Errorf("LC_SEGMENT is truncated")
+			}
+			seg = &segment{
+				Name:     cleanName(lc[8:24]),
+				VMAddr:   uint64(binary.LittleEndian.Uint32(lc[24:])),
+				VMSize:   uint64(binary.LittleEndian.Uint32(lc[28:])),
+				FileOff:  uint64(binary.LittleEndian.Uint32(lc[32:])),
+				FileSize: uint64(binary.LittleEndian.Uint32(lc[36:])),
+			}
+		case types.LC_SEGMENT_64:
+			if len(lc) < 56 {
+				return nil, fmt.Errorf("LC_SEGMENT_64 is truncated")
+			}
+			seg = &segment{
+				Name:     cleanName(lc[8:24]),
+				VMAddr:   binary.LittleEndian.Uint64(lc[24:]),
+				VMSize:   binary.LittleEndian.Uint64(lc[32:]),
+				FileOff:  binary.LittleEndian.Uint64(lc[40:]),
+				FileSize: binary.LittleEndian.Uint64(lc[48:]),
+			}
+		case types.LC_UUID:
+			if len(lc) >= 24 {
+				copy(info.uuid[:], lc[8:24])
+				info.hasUUID = true
+			}
+		case types.LC_SOURCE_VERSION:
+			if len(lc) >= 16 {
+				info.srcVersion = types.SrcVersion(binary.LittleEndian.Uint64(lc[8:]))
+			}
+		}
+
+		if seg != nil {
+			// reject file ranges that wrap around (or are too big) before anything is sliced with them
+			if end := seg.FileOff + seg.FileSize; end < seg.FileOff || end > maxImageSize {
+				return nil, fmt.Errorf("segment %s has an invalid file offset %#x (size %#x)", seg.Name, seg.FileOff, seg.FileSize)
+			}
+			info.segments = append(info.segments, *seg)
+		}
+
+		cmds = cmds[size:]
+	}
+
+	if len(info.segments) == 0 {
+		return nil, fmt.Errorf("Mach-O has no segments")
+	}
+
+	return info, nil
+}
+
+// fileSize returns the size of the Mach-O file (the end of its last segment)
+func (m *machoInfo) fileSize() uint64 {
+	var size uint64
+	for _, seg := range m.segments {
+		if end := seg.FileOff + seg.FileSize; end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+// textVMAddr returns the address of the __TEXT segment
+func (m *machoInfo) textVMAddr() uint64 {
+	for _, seg := range m.segments {
+		if seg.Name == "__TEXT" {
+			return seg.VMAddr
+		}
+	}
+	return 0
+}
+
+// splitData returns true if the image's data is stored apart from its text (and should be moved back after it)
+func (f *Firmware) splitData(img *Image) bool {
+	return img.DataSize > 0 && img.TextSize > 0 &&
+		img.DataOffset != img.TextOffset+img.TextSize &&
+		img.DataOffset+img.DataSize <= uint64(len(f.data))
+}
+
+// inspect sets the size of the reconstructed Mach-O (and its source version if the entry has none)
+func (f *Firmware) inspect(img *Image) error {
+	info, err := parseMachO(f.data[img.TextOffset:])
+	if err != nil {
+		return err
+	}
+	size := info.fileSize()
+	if size == 0 || size > maxImageSize {
+		return fmt.Errorf("invalid Mach-O size %#x", size)
+	}
+	img.Size = size
+	if len(img.SourceVersion) == 0 && info.srcVersion != 0 {
+		img.SourceVersion = info.srcVersion.String()
+	}
+	return nil
+}
+
+// Extract reconstructs an embedded Mach-O.
+//
+// The firmware stores the text and data of the apps separately; the segments past the text
+// are copied back from the data so their file offsets match the load commands.
+// Segment bytes that aren't in the firmware (e.g. a stripped __LINKEDIT) are left zeroed.
+func (f *Firmware) Extract(img *Image) ([]byte, error) {
+	info, err := parseMachO(f.data[img.TextOffset:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s Mach-O: %v", img.Name, err)
+	}
+
+	size := info.fileSize()
+	if size == 0 || size > maxImageSize {
+		return nil, fmt.Errorf("%s has an invalid Mach-O size %#x", img.Name, size)
+	}
+	out := make([]byte, size)
+
+	split := f.splitData(img)
+	for _, seg := range info.segments {
+		if seg.FileSize == 0 {
+			continue
+		}
+		src := img.TextOffset + seg.FileOff
+		limit := uint64(len(f.data))
+		if split {
+			if seg.FileOff >= img.TextSize {
+				src = img.DataOffset + (seg.FileOff - img.TextSize)
+				limit = img.DataOffset + img.DataSize
+			} else {
+				limit = img.TextOffset + img.TextSize
+			}
+		}
+		limit = minUint64(limit, uint64(len(f.data)))
+		if src >= limit {
+			continue
+		}
+		n := seg.FileSize
+		if src+n > limit {
+			n = limit - src
+		}
+		copy(out[seg.FileOff:seg.FileOff+n], f.data[src:src+n])
+	}
+
+	// the header and load commands (in case no segment maps them)
+	copy(out[:minUint64(info.cmdsEnd, size)], f.data[img.TextOffset:])
+
+	return out, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
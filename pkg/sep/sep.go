@@ -0,0 +1,489 @@
+// Package sep parses decrypted SEP (Secure Enclave Processor) firmwares and splits them into their Mach-Os
+package sep
+
+// NOTE: https://www.blackhat.com/docs/us-16/materials/us-16-Mandt-Demystifying-The-Secure-Enclave-Processor.pdf
+// NOTE: http://mista.nu/research/sep-paper.pdf
+// NOTE: https://gist.github.com/xerub/0161aacd7258d31c6a27584f90fa2e8c
+// NOTE: https://github.com/matteyeux/sepsplit/blob/master/sepsplit.c
+// NOTE: https://gist.github.com/bazad/fe4e76a0a3b761d9fde7e74654ac14e4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/blacktop/go-macho/types"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/pkg/errors"
+)
+
+// legionStr precedes the offset of the 64-bit firmware header in the SEP boot code
+const legionStr = "Built by legion2"
+
+// Image kinds
+const (
+	KindKernel = "kernel"
+	KindInit   = "init" // SEPOS
+	KindApp    = "app"
+	KindShlib  = "shlib" // shared library
+)
+
+// Layout names
+const (
+	LayoutLegacy = "legacy" // no header (32-bit SEPs); the Mach-Os are found by scanning the image
+	LayoutV1     = "v1"     // 10 field app entries
+	LayoutV2     = "v2"     // 11 field app entries
+	LayoutV3     = "v3"     // 12 field app entries and a shared library count
+)
+
+// ManifestName is the name of the JSON manifest written by Export
+const ManifestName = "manifest.json"
+
+// maxEntries is the maximum number of apps (or shared libraries) of a sane header
+const maxEntries = 256
+
+// Header is the 64-bit SEP firmware header (pointed to by the offset following the legion string).
+// Physical addresses are offsets into the firmware image.
+type Header struct {
+	KernelUUID         types.UUID
+	KernelHeapSize     uint64
+	KernelBasePaddr    uint64 // offset of the kernel Mach-O
+	KernelMaxPaddr     uint64
+	AppImagesBasePaddr uint64
+	AppImagesMaxPaddr  uint64
+	PaddrMax           uint64 // size of the SEP firmware image
+	TZ0MinSize         uint64
+	TZ1MinSize         uint64
+	ARMinSize          uint64 // anti-replay memory
+	NonARMinSize       uint64
+	ShmBase            uint64
+	ShmSize            uint64
+}
+
+// layout is a header layout (the app entries grew fields over time)
+type layout struct {
+	Name        string
+	AppFields   int  // number of 64-bit fields of an app entry (before its name)
+	SplitCounts bool // the app count is followed by a shared library count (two 32-bit counts)
+}
+
+// layouts are the known 64-bit header layouts (newest first).
+//
+// After the Header come the init (SEPOS) entry, a 64-bit field, the app count(s) and the app entries;
+// an entry is its 64-bit fields followed by its name, UUID and source version.
+var layouts = []layout{
+	{Name: LayoutV3, AppFields: 12, SplitCounts: true},
+	{Name: LayoutV2, AppFields: 11},
+	{Name: LayoutV1, AppFields: 10},
+}
+
+// entryTrailer is the name, UUID and source version of an entry
+type entryTrailer struct {
+	Name          [16]byte
+	UUID          types.UUID
+	SourceVersion types.SrcVersion
+}
+
+// initEntry is the init (SEPOS) entry of the header
+type initEntry struct {
+	TextOffset uint64
+	TextVaddr  uint64
+	VMSize     uint64
+	Entry      uint64
+	Unknown    [6]uint64 // mostly zero
+	entryTrailer
+}
+
+// Image is a Mach-O embedded in the SEP firmware (the kernel, SEPOS, an app or a shared library)
+type Image struct {
+	Kind          string   `json:"kind"`
+	Name          string   `json:"name"`
+	UUID          string   `json:"uuid,omitempty"`
+	SourceVersion string   `json:"source_version,omitempty"`
+	TextOffset    uint64   `json:"text_offset"`
+	TextSize      uint64   `json:"text_size,omitempty"`
+	DataOffset    uint64   `json:"data_offset,omitempty"`
+	DataSize      uint64   `json:"data_size,omitempty"`
+	VMBase        uint64   `json:"vm_base,omitempty"`
+	VMSize        uint64   `json:"vm_size,omitempty"` // init only
+	Entry         uint64   `json:"entry,omitempty"`
+	StackSize     uint64   `json:"stack_size,omitempty"`
+	MemSize       uint64   `json:"mem_size,omitempty"`
+	NonARMemSize  uint64   `json:"non_ar_mem_size,omitempty"`
+	HeapSize      uint64   `json:"heap_size,omitempty"`
+	Extra         []uint64 `json:"extra,omitempty"` // fields of newer layouts that aren't understood yet
+	Size          uint64   `json:"size"`            // size of the reconstructed Mach-O
+	File          string   `json:"file,omitempty"`  // set by Export
+}
+
+func (i Image) String() string {
+	s := fmt.Sprintf("%-6s %-16s %s text: %#x-%#x", i.Kind, i.Name, i.UUID, i.TextOffset, i.TextOffset+i.TextSize)
+	if i.DataSize > 0 {
+		s += fmt.Sprintf(" data: %#x-%#x", i.DataOffset, i.DataOffset+i.DataSize)
+	}
+	if len(i.SourceVersion) > 0 {
+		s += fmt.Sprintf(" (%s)", i.SourceVersion)
+	}
+	return s
+}
+
+// Firmware is a parsed SEP firmware
+type Firmware struct {
+	Layout     string   `json:"layout"`
+	Header     *Header  `json:"-"`
+	Kernel     *Image   `json:"kernel"`
+	Init       *Image   `json:"init,omitempty"`
+	Apps       []*Image `json:"apps,omitempty"`
+	SharedLibs []*Image `json:"shared_libs,omitempty"`
+
+	data []byte
+}
+
+// Open opens and parses a decrypted SEP firmware (raw or as an unencrypted IM4P)
+func Open(path string) (*Firmware, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	if len(data) > 0 && data[0] == 0x30 { // ASN.1 SEQUENCE
+		i, err := img4.ParseIm4p(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if i.Encrypted() {
+			return nil, fmt.Errorf("%s is encrypted (decrypt it first)", path)
+		}
+		data = i.Data
+	}
+	return Parse(data)
+}
+
+// Parse parses a decrypted SEP firmware
+func Parse(data []byte) (*Firmware, error) {
+	f := &Firmware{data: data}
+
+	legion := bytes.Index(data, []byte(legionStr))
+	if legion < 0 || legion+len(legionStr)+8 > len(data) {
+		if err := f.parseLegacy(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	hdrOff := binary.LittleEndian.Uint64(data[legion+len(legionStr):])
+	if hdrOff == 0 {
+		if err := f.parseLegacy(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	if hdrOff >= uint64(len(data)) {
+		return nil, fmt.Errorf("SEP firmware header offset %#x is outside of the image", hdrOff)
+	}
+
+	var errs []string
+	for _, l := range layouts {
+		if err := f.parseHeader(hdrOff, l); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", l.Name, err))
+			continue
+		}
+		f.Layout = l.Name
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("failed to parse SEP firmware header at %#x (%s)", hdrOff, strings.Join(errs, "; "))
+}
+
+// Data returns the raw firmware
+func (f *Firmware) Data() []byte {
+	return f.data
+}
+
+// Images returns all the embedded Mach-Os
+func (f *Firmware) Images() []*Image {
+	var images []*Image
+	if f.Kernel != nil {
+		images = append(images, f.Kernel)
+	}
+	if f.Init != nil {
+		images = append(images, f.Init)
+	}
+	images = append(images, f.Apps...)
+	return append(images, f.SharedLibs...)
+}
+
+// Export writes the reconstructed Mach-Os (named <name>_<source version>) and a JSON manifest of them to a folder
+func (f *Firmware) Export(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create folder %s", dir)
+	}
+
+	for _, img := range f.Images() {
+		data, err := f.Extract(img)
+		if err != nil {
+			return err
+		}
+		name := img.Name
+		if len(img.SourceVersion) > 0 {
+			name = fmt.Sprintf("%s_%s", img.Name, img.SourceVersion)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return errors.Wrapf(err, "failed to write %s", name)
+		}
+		img.File = name
+	}
+
+	manifest, err := json.MarshalIndent(f, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ManifestName), manifest, 0644)
+}
+
+var nameRE = regexp.MustCompile(`^[\w.+-]+$`)
+
+func cleanName(name []byte) string {
+	return strings.TrimSpace(string(bytes.TrimRight(name, "\x00")))
+}
+
+// checkEntry validates an entry's name and Mach-O and sets the size of the reconstructed Mach-O
+func (f *Firmware) checkEntry(img *Image) error {
+	if !nameRE.MatchString(img.Name) {
+		return fmt.Errorf("invalid %s name %q", img.Kind, img.Name)
+	}
+	if !isMachO(f.data, img.TextOffset) {
+		return fmt.Errorf("%s %s has no Mach-O at %#x", img.Kind, img.Name, img.TextOffset)
+	}
+	if err := f.inspect(img); err != nil {
+		return errors.Wrapf(err, "invalid %s %s", img.Kind, img.Name)
+	}
+	return nil
+}
+
+// readInit reads the init (SEPOS) entry
+func (f *Firmware) readInit(r *bytes.Reader) (*Image, error) {
+	var e initEntry
+	if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Kind:       KindInit,
+		Name:       cleanName(e.Name[:]),
+		UUID:       e.UUID.String(),
+		TextOffset: e.TextOffset,
+		VMBase:     e.TextVaddr,
+		VMSize:     e.VMSize,
+		Entry:      e.Entry,
+	}
+	if e.SourceVersion != 0 {
+		img.SourceVersion = e.SourceVersion.String()
+	}
+
+	if err := f.checkEntry(img); err != nil {
+		return nil, err
+	}
+	img.TextSize = img.Size // like the kernel, its text isn't stored apart from its data
+
+	return img, nil
+}
+
+// readEntry reads an app (or shared library) entry
+func (f *Firmware) readEntry(r *bytes.Reader, kind string, nfields int) (*Image, error) {
+	fields := make([]uint64, nfields)
+	if err := binary.Read(r, binary.LittleEndian, fields); err != nil {
+		return nil, err
+	}
+	var t entryTrailer
+	if err := binary.Read(r, binary.LittleEndian, &t); err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Kind:         kind,
+		Name:         cleanName(t.Name[:]),
+		UUID:         t.UUID.String(),
+		TextOffset:   fields[0],
+		TextSize:     fields[1],
+		DataOffset:   fields[2],
+		DataSize:     fields[3],
+		VMBase:       fields[4],
+		Entry:        fields[5],
+		StackSize:    fields[6],
+		MemSize:      fields[7],
+		NonARMemSize: fields[8],
+		HeapSize:     fields[9],
+		Extra:        fields[10:],
+	}
+	if len(img.Extra) == 0 {
+		img.Extra = nil
+	}
+	if t.SourceVersion != 0 {
+		img.SourceVersion = t.SourceVersion.String()
+	}
+
+	if err := f.checkEntry(img); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+func (f *Firmware) parseHeader(hdrOff uint64, l layout) error {
+	r := bytes.NewReader(f.data[hdrOff:])
+
+	var hdr Header
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return errors.Wrap(err, "failed to read header")
+	}
+
+	if !isMachO(f.data, hdr.KernelBasePaddr) {
+		return fmt.Errorf("no kernel Mach-O at %#x", hdr.KernelBasePaddr)
+	}
+	kernel := &Image{
+		Kind:       KindKernel,
+		Name:       "kernel",
+		UUID:       hdr.KernelUUID.String(),
+		TextOffset: hdr.KernelBasePaddr,
+	}
+	if err := f.inspect(kernel); err != nil {
+		return errors.Wrap(err, "invalid kernel")
+	}
+	kernel.TextSize = kernel.Size
+
+	init, err := f.readInit(r)
+	if err != nil {
+		return err
+	}
+
+	// a 64-bit field of unknown use precedes the counts
+	var counts struct {
+		Unknown uint64
+		NumApps uint32
+		NumLibs uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &counts); err != nil {
+		return err
+	}
+	if !l.SplitCounts && counts.NumLibs != 0 {
+		return fmt.Errorf("invalid app count %#x", uint64(counts.NumLibs)<<32|uint64(counts.NumApps))
+	}
+	if counts.NumApps > maxEntries || counts.NumLibs > maxEntries {
+		return fmt.Errorf("invalid app count %d (and shared library count %d)", counts.NumApps, counts.NumLibs)
+	}
+
+	var apps, libs []*Image
+	for idx := uint32(0); idx < counts.NumApps; idx++ {
+		app, err := f.readEntry(r, KindApp, l.AppFields)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read app %d", idx)
+		}
+		apps = append(apps, app)
+	}
+	for idx := uint32(0); idx < counts.NumLibs; idx++ {
+		lib, err := f.readEntry(r, KindShlib, l.AppFields)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read shared library %d", idx)
+		}
+		libs = append(libs, lib)
+	}
+
+	f.Header = &hdr
+	f.Kernel = kernel
+	f.Init = init
+	f.Apps = apps
+	f.SharedLibs = libs
+
+	return nil
+}
+
+// legacyPageSize is the alignment of the Mach-Os in legacy SEP firmwares
+const legacyPageSize = 0x1000
+
+// parseLegacy splits a SEP firmware without a header.
+// The Mach-Os are found by scanning the page aligned offsets; the first one is the kernel, the second SEPOS and
+// the rest are the apps, which are named after the app list entry containing their UUID.
+func (f *Firmware) parseLegacy() error {
+	f.Layout = LayoutLegacy
+
+	var offsets []uint64
+	for off := uint64(0); off+4 <= uint64(len(f.data)); off += legacyPageSize {
+		if isMachO(f.data, off) {
+			offsets = append(offsets, off)
+		}
+	}
+	if len(offsets) == 0 {
+		return fmt.Errorf("failed to find any Mach-Os in the SEP firmware (is it decrypted?)")
+	}
+
+	for idx, off := range offsets {
+		img := &Image{TextOffset: off}
+		end := uint64(len(f.data))
+		if idx+1 < len(offsets) {
+			end = offsets[idx+1]
+		}
+
+		info, err := parseMachO(f.data[off:end])
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse Mach-O at %#x", off)
+		}
+		img.Size = info.fileSize()
+		img.TextSize = img.Size
+		img.VMBase = info.textVMAddr()
+		if info.hasUUID {
+			img.UUID = info.uuid.String()
+		}
+		if info.srcVersion != 0 {
+			img.SourceVersion = info.srcVersion.String()
+		}
+
+		switch idx {
+		case 0:
+			img.Kind, img.Name = KindKernel, "kernel"
+			f.Kernel = img
+		case 1:
+			img.Kind, img.Name = KindInit, "SEPOS"
+			f.Init = img
+		default:
+			img.Kind, img.Name = KindApp, fmt.Sprintf("app%d", idx-2)
+			f.Apps = append(f.Apps, img)
+		}
+		if info.hasUUID {
+			if name := f.legacyName(info.uuid, off, end); len(name) > 0 {
+				img.Name = name
+			}
+		}
+	}
+
+	return nil
+}
+
+// legacyName returns the name of the app list entry with the given UUID (the name precedes the UUID)
+func (f *Firmware) legacyName(uuid types.UUID, start, end uint64) string {
+	for pos := 0; ; {
+		idx := bytes.Index(f.data[pos:], uuid[:])
+		if idx < 0 {
+			return ""
+		}
+		idx += pos
+		pos = idx + len(uuid)
+		// skip the Mach-O's own LC_UUID
+		if uint64(idx) >= start && uint64(idx) < end {
+			continue
+		}
+		for _, nameLen := range []int{16, 12} {
+			if idx < nameLen {
+				continue
+			}
+			if name := cleanName(f.data[idx-nameLen : idx]); nameRE.MatchString(name) {
+				return name
+			}
+		}
+	}
+}
@@ -15,7 +15,7 @@ import (
 // SHSH object
 type SHSH struct {
 	ApImg4Ticket []byte
-	Generator    string `plist:"generator"`
+	Generator    string `plist:"generator,omitempty"` // go-plist only uses a tag name followed by an option
 }
 
 // ParseRAW parses a shsh blob out of a raw dump
@@ -46,3 +46,21 @@ func ParseRAW(r io.Reader) error {
 
 	return nil
 }
+
+// Parse parses a shsh blob plist
+func Parse(r io.Reader) (*SHSH, error) {
+	dat, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	shsh := &SHSH{}
+	if _, err := plist.Unmarshal(dat, shsh); err != nil {
+		return nil, fmt.Errorf("failed to parse shsh blob: %v", err)
+	}
+	if len(shsh.ApImg4Ticket) == 0 {
+		return nil, fmt.Errorf("shsh blob has no ApImg4Ticket")
+	}
+
+	return shsh, nil
+}
@@ -0,0 +1,301 @@
+package shsh
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/blacktop/ipsw/pkg/plist"
+	"github.com/pkg/errors"
+)
+
+// Component statuses
+const (
+	StatusOK       = "ok"
+	StatusMismatch = "mismatch" // the ticket has the component with another digest
+	StatusMissing  = "missing"  // the ticket doesn't have the component
+)
+
+// Restore behaviors of the BuildIdentities
+const (
+	BehaviorErase  = "Erase"
+	BehaviorUpdate = "Update"
+)
+
+// VerifyConfig is the configuration for (*SHSH).Verify
+type VerifyConfig struct {
+	ECID     uint64 // the device's ECID (0 to skip the check)
+	Behavior string // the BuildIdentity restore behavior (default is Erase)
+}
+
+// Check is the result of comparing a ticket property to its expected value
+type Check struct {
+	Name     string `json:"name"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	OK       bool   `json:"ok"`
+}
+
+// ComponentResult is the result of checking a BuildIdentity component's digest in the ticket
+type ComponentResult struct {
+	Name   string `json:"name"`
+	Tag    string `json:"tag,omitempty"` // the ticket image (e.g. krnl)
+	Status string `json:"status"`
+}
+
+// Verification is the result of (*SHSH).Verify
+type Verification struct {
+	Identity   string            `json:"identity,omitempty"` // e.g. d421ap (Customer Erase Install (IPSW))
+	Checks     []Check           `json:"checks"`
+	Components []ComponentResult `json:"components"`
+}
+
+// Valid returns true if all the checks passed
+func (v *Verification) Valid() bool {
+	for _, c := range v.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	for _, c := range v.Components {
+		if c.Status != StatusOK {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *Verification) String() string {
+	var out strings.Builder
+
+	status := func(ok bool) string {
+		if ok {
+			return "PASS"
+		}
+		return "FAIL"
+	}
+
+	if len(v.Identity) > 0 {
+		out.WriteString(fmt.Sprintf("BuildIdentity: %s\n", v.Identity))
+	}
+	for _, c := range v.Checks {
+		if c.OK {
+			out.WriteString(fmt.Sprintf("  [%s] %-13s %s\n", status(c.OK), c.Name, c.Actual))
+		} else {
+			out.WriteString(fmt.Sprintf("  [%s] %-13s %s (expected %s)\n", status(c.OK), c.Name, c.Actual, c.Expected))
+		}
+	}
+	if len(v.Components) > 0 {
+		out.WriteString("Components:\n")
+	}
+	for _, c := range v.Components {
+		line := fmt.Sprintf("  [%s] %s", status(c.Status == StatusOK), c.Name)
+		if len(c.Tag) > 0 {
+			line += fmt.Sprintf(" (%s)", c.Tag)
+		}
+		if c.Status != StatusOK {
+			line += ": " + c.Status
+		}
+		out.WriteString(line + "\n")
+	}
+
+	return out.String()
+}
+
+// propertyUint returns a numeric manifest property
+func propertyUint(props img4.ManifestProperties, name string) (uint64, bool) {
+	switch v := props[name].(type) {
+	case int:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case *big.Int:
+		return v.Uint64(), true
+	}
+	return 0, false
+}
+
+func parseHex(s string) (uint64, bool) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 64)
+	return v, err == nil
+}
+
+// NonceHash returns the hash a chip's boot nonce generator is hashed with to produce its BNCH.
+// A12 and later (along with the S4 and T2) use SHA-384 (truncated to 32 bytes), older chips use SHA-1.
+func NonceHash(chip uint64) string {
+	switch {
+	case chip == 0x8006 || chip == 0x8012:
+		return "SHA384"
+	case chip >= 0x8020 && chip < 0x8900:
+		return "SHA384"
+	}
+	return "SHA1"
+}
+
+// nonceSize returns the size of the BNCH for a nonce hash
+func nonceSize(hash string) int {
+	if hash == "SHA1" {
+		return sha1.Size
+	}
+	return 32
+}
+
+// isApComponent returns true for the components that are in the AP ticket
+// (the baseband and coprocessors with tickets of their own, e.g. SE,*, Rap,* or Cryptex1,* aren't)
+func isApComponent(name string) bool {
+	if name == "BasebandFirmware" {
+		return false
+	}
+	return !strings.Contains(name, ",") || strings.HasPrefix(name, "Ap,")
+}
+
+// Verify checks the blob's ApImg4Ticket against a BuildManifest.
+//
+// The ECID, board and chip of the ticket are checked, the BuildIdentity for the ticket's board and chip
+// (and restore behavior) is selected and each of its AP components' digests is looked up in the ticket.
+// The blob's generator must also hash to the ticket's BNCH.
+func (s *SHSH) Verify(bm *plist.BuildManifest, conf *VerifyConfig) (*Verification, error) {
+	if conf == nil {
+		conf = &VerifyConfig{}
+	}
+	behavior := conf.Behavior
+	if len(behavior) == 0 {
+		behavior = BehaviorErase
+	}
+
+	m, err := img4.ParseManifest(s.ApImg4Ticket)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse ApImg4Ticket")
+	}
+
+	v := &Verification{}
+
+	ecid, _ := propertyUint(m.Properties, "ECID")
+	if conf.ECID != 0 {
+		v.Checks = append(v.Checks, Check{
+			Name:     "ECID",
+			Expected: fmt.Sprintf("%#x", conf.ECID),
+			Actual:   fmt.Sprintf("%#x", ecid),
+			OK:       ecid == conf.ECID,
+		})
+	}
+
+	board, okBoard := propertyUint(m.Properties, "BORD")
+	chip, okChip := propertyUint(m.Properties, "CHIP")
+	if !okBoard || !okChip {
+		return nil, errors.New("ApImg4Ticket has no BORD or CHIP")
+	}
+
+	// pick the identity of the ticket's device (and restore behavior) whose digests match the ticket best
+	var best int
+	var boardIDs, chipIDs, behaviors []string
+	for idx := range bm.BuildIdentities {
+		bID := bm.BuildIdentities[idx]
+		bBoard, _ := parseHex(bID.ApBoardID)
+		bChip, _ := parseHex(bID.ApChipID)
+		chipIDs = append(chipIDs, bID.ApChipID)
+		if bChip != chip {
+			continue
+		}
+		boardIDs = append(boardIDs, bID.ApBoardID)
+		if bBoard != board {
+			continue
+		}
+		behaviors = append(behaviors, bID.Info.RestoreBehavior)
+		if !strings.EqualFold(bID.Info.RestoreBehavior, behavior) {
+			continue
+		}
+		digests := make(map[string][]byte)
+		for name, comp := range bID.Manifest {
+			if len(comp.Digest) > 0 && comp.Trusted && isApComponent(name) {
+				digests[name] = comp.Digest
+			}
+		}
+		components := verifyComponents(m, digests)
+		var matched int
+		for _, c := range components {
+			if c.Status == StatusOK {
+				matched++
+			}
+		}
+		if v.Components == nil || matched > best {
+			best = matched
+			v.Components = components
+			v.Identity = fmt.Sprintf("%s (%s)", bID.Info.DeviceClass, bID.Info.Variant)
+		}
+	}
+
+	deviceFound := len(behaviors) > 0
+	expectedBoards := strings.Join(utils.Unique(boardIDs), "|")
+	if len(expectedBoards) == 0 {
+		expectedBoards = "a board of the chip"
+	}
+	v.Checks = append(v.Checks, Check{
+		Name:     "BORD",
+		Expected: expectedBoards,
+		Actual:   fmt.Sprintf("%#x", board),
+		OK:       deviceFound,
+	}, Check{
+		Name:     "CHIP",
+		Expected: strings.Join(utils.Unique(chipIDs), "|"),
+		Actual:   fmt.Sprintf("%#x", chip),
+		OK:       len(boardIDs) > 0,
+	})
+	if deviceFound {
+		identity := Check{Name: "Identity", Expected: behavior, Actual: behavior, OK: v.Components != nil}
+		if !identity.OK {
+			identity.Actual = strings.Join(utils.Unique(behaviors), "|")
+		}
+		v.Checks = append(v.Checks, identity)
+	}
+
+	bnch, _ := m.Properties["BNCH"].([]byte)
+	nonceCheck := Check{Name: "BNCH", Actual: hex.EncodeToString(bnch)}
+	if gen, ok := parseHex(s.Generator); ok {
+		hash := NonceHash(chip)
+		expected := img4.ApNonceFromGenerator(img4.GeneratorBytes(gen), nonceSize(hash))
+		nonceCheck.Name = fmt.Sprintf("BNCH (%s)", hash)
+		nonceCheck.Expected = hex.EncodeToString(expected)
+		nonceCheck.OK = bytes.Equal(bnch, expected)
+	} else {
+		nonceCheck.Expected = "a generator in the blob"
+	}
+	v.Checks = append(v.Checks, nonceCheck)
+
+	return v, nil
+}
+
+// verifyComponents looks up the digest of each component of a BuildIdentity in the ticket
+func verifyComponents(m *img4.Manifest, digests map[string][]byte) []ComponentResult {
+	var names []string
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := []ComponentResult{}
+	for _, name := range names {
+		res := ComponentResult{Name: name, Status: StatusMissing}
+		for _, img := range m.Images {
+			if bytes.Equal(img.Digest, digests[name]) {
+				res.Tag = img.Name
+				res.Status = StatusOK
+				break
+			}
+			if img4.ComponentForType(img.Name) == name {
+				res.Tag = img.Name
+				res.Status = StatusMismatch
+			}
+		}
+		results = append(results, res)
+	}
+
+	return results
+}
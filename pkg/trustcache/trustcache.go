@@ -0,0 +1,261 @@
+// Package trustcache parses the static/restore trust caches found in IPSWs
+package trustcache
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/blacktop/ipsw/pkg/img4"
+	"github.com/pkg/errors"
+)
+
+// CDHashSize is the size of a (truncated) trust cache cdhash
+const CDHashSize = 20
+
+// HashType is the code directory hash type of a trust cache entry
+type HashType uint8
+
+// Hash types
+const (
+	HashTypeNone            HashType = 0
+	HashTypeSHA1            HashType = 1
+	HashTypeSHA256          HashType = 2
+	HashTypeSHA256Truncated HashType = 3
+	HashTypeSHA384          HashType = 4
+	HashTypeSHA512          HashType = 5
+)
+
+func (t HashType) String() string {
+	switch t {
+	case HashTypeNone:
+		return "none"
+	case HashTypeSHA1:
+		return "sha1"
+	case HashTypeSHA256:
+		return "sha256"
+	case HashTypeSHA256Truncated:
+		return "sha256-truncated"
+	case HashTypeSHA384:
+		return "sha384"
+	case HashTypeSHA512:
+		return "sha512"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// Flags are the trust cache entry flags
+type Flags uint8
+
+// Entry flags
+const (
+	FlagAMFID Flags = 0x1 // the binary is only trusted when loaded through amfid
+	FlagANE   Flags = 0x2 // the entry is an Apple Neural Engine model
+)
+
+func (f Flags) String() string {
+	var flags []string
+	if f&FlagAMFID != 0 {
+		flags = append(flags, "amfid")
+	}
+	if f&FlagANE != 0 {
+		flags = append(flags, "ane")
+	}
+	if rest := f &^ (FlagAMFID | FlagANE); rest != 0 {
+		flags = append(flags, fmt.Sprintf("%#x", uint8(rest)))
+	}
+	return strings.Join(flags, "|")
+}
+
+// Entry is a trust cache entry
+type Entry struct {
+	CDHash             [CDHashSize]byte
+	HashType           HashType
+	Flags              Flags
+	ConstraintCategory uint8 // launch constraint category (version 2)
+}
+
+// MarshalJSON implements json.Marshaler
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		CDHash             string `json:"cdhash"`
+		HashType           string `json:"hash_type,omitempty"`
+		Flags              string `json:"flags,omitempty"`
+		ConstraintCategory uint8  `json:"constraint_category,omitempty"`
+	}{
+		CDHash:             hex.EncodeToString(e.CDHash[:]),
+		HashType:           e.HashType.String(),
+		Flags:              e.Flags.String(),
+		ConstraintCategory: e.ConstraintCategory,
+	})
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%x %s [%s] %d", e.CDHash, e.HashType, e.Flags, e.ConstraintCategory)
+}
+
+// TrustCache is a parsed trust cache
+type TrustCache struct {
+	Version uint32  `json:"version"`
+	UUID    UUID    `json:"uuid"`
+	Entries []Entry `json:"entries"`
+}
+
+// UUID is a trust cache UUID
+type UUID [16]byte
+
+func (u UUID) String() string {
+	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (u UUID) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+type header struct {
+	Version    uint32
+	UUID       UUID
+	NumEntries uint32
+}
+
+type entryV1 struct {
+	CDHash   [CDHashSize]byte
+	HashType HashType
+	Flags    Flags
+}
+
+type entryV2 struct {
+	CDHash             [CDHashSize]byte
+	HashType           HashType
+	Flags              Flags
+	ConstraintCategory uint8
+	_                  uint8
+}
+
+// Parse parses a raw trust cache
+func Parse(data []byte) (*TrustCache, error) {
+	r := bytes.NewReader(data)
+
+	var hdr header
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "failed to read trust cache header")
+	}
+
+	var entrySize int
+	switch hdr.Version {
+	case 0:
+		entrySize = CDHashSize
+	case 1:
+		entrySize = binary.Size(entryV1{})
+	case 2:
+		entrySize = binary.Size(entryV2{})
+	default:
+		return nil, errors.Errorf("unsupported trust cache version %d", hdr.Version)
+	}
+	if uint64(hdr.NumEntries)*uint64(entrySize) > uint64(r.Len()) {
+		return nil, errors.Errorf("trust cache has %d entries but only %d bytes of entry data", hdr.NumEntries, r.Len())
+	}
+
+	tc := &TrustCache{
+		Version: hdr.Version,
+		UUID:    hdr.UUID,
+		Entries: make([]Entry, 0, hdr.NumEntries),
+	}
+
+	for i := uint32(0); i < hdr.NumEntries; i++ {
+		var e Entry
+		switch hdr.Version {
+		case 0:
+			if _, err := r.Read(e.CDHash[:]); err != nil {
+				return nil, errors.Wrapf(err, "failed to read trust cache entry %d", i)
+			}
+		case 1:
+			var ent entryV1
+			if err := binary.Read(r, binary.LittleEndian, &ent); err != nil {
+				return nil, errors.Wrapf(err, "failed to read trust cache entry %d", i)
+			}
+			e = Entry{CDHash: ent.CDHash, HashType: ent.HashType, Flags: ent.Flags}
+		case 2:
+			var ent entryV2
+			if err := binary.Read(r, binary.LittleEndian, &ent); err != nil {
+				return nil, errors.Wrapf(err, "failed to read trust cache entry %d", i)
+			}
+			e = Entry{CDHash: ent.CDHash, HashType: ent.HashType, Flags: ent.Flags, ConstraintCategory: ent.ConstraintCategory}
+		}
+		tc.Entries = append(tc.Entries, e)
+	}
+
+	return tc, nil
+}
+
+type img4Container struct {
+	Raw  asn1.RawContent
+	Name string // IMG4
+	IM4P struct {
+		Raw         asn1.RawContent
+		Name        string // IM4P
+		Type        string
+		Description string
+		Data        []byte
+		Kbag        []byte `asn1:"optional"`
+	}
+	Rest []asn1.RawValue `asn1:"optional"`
+}
+
+// ParseImg4Data parses a trust cache IM4P (or IMG4) or a raw trust cache
+func ParseImg4Data(data []byte) (*TrustCache, error) {
+	if len(data) > 0 && data[0] == 0x30 { // ASN.1 SEQUENCE
+		if len(data) > 16 && bytes.Contains(data[:16], []byte("IMG4")) {
+			var i img4Container
+			if _, err := asn1.Unmarshal(data, &i); err != nil {
+				return nil, errors.Wrap(err, "failed to ASN.1 parse Img4")
+			}
+			return Parse(i.IM4P.Data)
+		}
+		i, err := img4.ParseIm4p(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return Parse(i.Data)
+	}
+	return Parse(data)
+}
+
+// Open opens and parses a trust cache file (IM4P, IMG4 or raw)
+func Open(path string) (*TrustCache, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return ParseImg4Data(data)
+}
+
+// Lookup returns the entry of a cdhash (longer code directory hashes are truncated)
+func (tc *TrustCache) Lookup(cdhash []byte) *Entry {
+	if len(cdhash) < CDHashSize {
+		return nil
+	}
+	for idx, e := range tc.Entries {
+		if bytes.Equal(e.CDHash[:], cdhash[:CDHashSize]) {
+			return &tc.Entries[idx]
+		}
+	}
+	return nil
+}
+
+func (tc *TrustCache) String() string {
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("Version: %d\n", tc.Version))
+	out.WriteString(fmt.Sprintf("UUID:    %s\n", tc.UUID))
+	out.WriteString(fmt.Sprintf("Entries: %d\n", len(tc.Entries)))
+	for _, e := range tc.Entries {
+		out.WriteString(fmt.Sprintf("  %s\n", e))
+	}
+	return out.String()
+}
@@ -0,0 +1,306 @@
+// Package vfdecrypt decrypts the encrcdsa (FileVault v2 style) encrypted DMGs of legacy IPSWs
+package vfdecrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Magic is the encrypted DMG magic
+const Magic = "encrcdsa"
+
+const (
+	// KeySize is the size of a VFDecrypt key (AES-128 key followed by the HMAC-SHA1 key)
+	KeySize     = aesKeySize + hmacKeySize
+	aesKeySize  = 16
+	hmacKeySize = 20
+	// DefaultChunkSize is the encrypted chunk size used when the header does not specify one
+	DefaultChunkSize = 4096
+)
+
+// ErrNotEncrypted is returned when the DMG is not an encrcdsa container
+var ErrNotEncrypted = errors.New("not an encrcdsa encrypted DMG")
+
+// Header is the encrcdsa v2 header
+type Header struct {
+	Magic     [8]byte
+	Version   uint32
+	EncIVSize uint32
+	_         [5]uint32
+	UUID      [16]byte
+	BlockSize uint32
+	DataSize  uint64
+	DataOff   uint64
+	_         [0x260]byte
+
+	KdfAlgorithm     uint32
+	KdfPrngAlgorithm uint32
+	KdfIterCount     uint32
+	KdfSaltLen       uint32
+	KdfSalt          [32]byte
+
+	BlobEncIVSize    uint32
+	BlobEncIV        [32]byte
+	BlobEncKeyBits   uint32
+	BlobEncAlgorithm uint32
+	BlobEncPadding   uint32
+	BlobEncMode      uint32
+	EncKeyBlobSize   uint32
+	EncKeyBlob       [0x30]byte
+}
+
+func (h *Header) String() string {
+	return fmt.Sprintf(
+		"Version:    %d\n"+
+			"UUID:       %x\n"+
+			"Block Size: %d\n"+
+			"Data Size:  %d\n"+
+			"Data Off:   %#x\n",
+		h.Version,
+		h.UUID,
+		h.BlockSize,
+		h.DataSize,
+		h.DataOff,
+	)
+}
+
+func (h *Header) chunkSize() int64 {
+	if h.BlockSize == 0 {
+		return DefaultChunkSize
+	}
+	return int64(h.BlockSize)
+}
+
+// IsEncrypted returns true if r starts with the encrcdsa magic
+func IsEncrypted(r io.ReaderAt) bool {
+	magic := make([]byte, len(Magic))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return string(magic) == Magic
+}
+
+// ParseHeader parses the encrcdsa header of an encrypted DMG
+func ParseHeader(r io.ReaderAt) (*Header, error) {
+	if !IsEncrypted(r) {
+		return nil, ErrNotEncrypted
+	}
+	var hdr Header
+	if err := binary.Read(io.NewSectionReader(r, 0, int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "failed to read encrcdsa header")
+	}
+	if hdr.Version != 2 {
+		return nil, errors.Errorf("unsupported encrcdsa version %d", hdr.Version)
+	}
+	return &hdr, nil
+}
+
+// UnwrapKey derives the VFDecrypt key from the password protected key blob of the header
+// (PBKDF2-HMAC-SHA1 derived 3DES-EDE-CBC key)
+func (h *Header) UnwrapKey(password string) ([]byte, error) {
+	saltLen := int(h.KdfSaltLen)
+	if saltLen > len(h.KdfSalt) {
+		return nil, errors.Errorf("invalid KDF salt length %d", saltLen)
+	}
+	blobSize := int(h.EncKeyBlobSize)
+	if blobSize > len(h.EncKeyBlob) || blobSize == 0 || blobSize%des.BlockSize != 0 {
+		return nil, errors.Errorf("invalid encrypted key blob size %d", blobSize)
+	}
+
+	derived := pbkdf2.Key([]byte(password), h.KdfSalt[:saltLen], int(h.KdfIterCount), 24, sha1.New)
+
+	block, err := des.NewTripleDESCipher(derived)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create 3DES cipher")
+	}
+
+	blob := make([]byte, blobSize)
+	cipher.NewCBCDecrypter(block, h.BlobEncIV[:des.BlockSize]).CryptBlocks(blob, h.EncKeyBlob[:blobSize])
+
+	// strip the PKCS#7 padding (a bad padding means a wrong password)
+	pad := int(blob[len(blob)-1])
+	if pad == 0 || pad > des.BlockSize || !bytes.Equal(blob[len(blob)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("failed to unwrap key (wrong password?)")
+	}
+	blob = blob[:len(blob)-pad]
+	if len(blob) < KeySize {
+		return nil, errors.Errorf("unwrapped key is too short (%d bytes)", len(blob))
+	}
+
+	return blob[:KeySize], nil
+}
+
+// ParseKey decodes a hex encoded VFDecrypt key
+func ParseKey(key string) ([]byte, error) {
+	k, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(key), "0x"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to hex decode VFDecrypt key")
+	}
+	if len(k) != KeySize {
+		return nil, errors.Errorf("invalid VFDecrypt key size %d (expected %d)", len(k), KeySize)
+	}
+	return k, nil
+}
+
+// Reader is an io.ReaderAt of the decrypted DMG data
+type Reader struct {
+	Header *Header
+
+	r       io.ReaderAt
+	block   cipher.Block
+	hmacKey []byte
+}
+
+// NewReader returns a Reader that decrypts the encrypted DMG r with the VFDecrypt key
+func NewReader(r io.ReaderAt, key []byte) (*Reader, error) {
+	if len(key) != KeySize {
+		return nil, errors.Errorf("invalid VFDecrypt key size %d (expected %d)", len(key), KeySize)
+	}
+
+	hdr, err := ParseHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.chunkSize()%aes.BlockSize != 0 {
+		return nil, errors.Errorf("invalid chunk size %d", hdr.BlockSize)
+	}
+
+	block, err := aes.NewCipher(key[:aesKeySize])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES cipher")
+	}
+
+	return &Reader{
+		Header:  hdr,
+		r:       r,
+		block:   block,
+		hmacKey: key[aesKeySize:],
+	}, nil
+}
+
+// Size returns the size of the decrypted DMG
+func (r *Reader) Size() int64 {
+	return int64(r.Header.DataSize)
+}
+
+// chunkIV returns the IV of a chunk, HMAC-SHA1(hmac_key, chunk_no)[:16]
+func (r *Reader) chunkIV(chunk uint32) []byte {
+	mac := hmac.New(sha1.New, r.hmacKey)
+	binary.Write(mac, binary.BigEndian, chunk)
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+// readChunk reads and decrypts a whole chunk (the last one may be short)
+func (r *Reader) readChunk(chunk uint32, buf []byte) (int, error) {
+	n, err := r.r.ReadAt(buf, int64(r.Header.DataOff)+int64(chunk)*r.Header.chunkSize())
+	if err != nil && err != io.EOF {
+		return 0, errors.Wrapf(err, "failed to read chunk %d", chunk)
+	}
+	// CBC mode always works in whole blocks.
+	blocks := n - n%aes.BlockSize
+	cipher.NewCBCDecrypter(r.block, r.chunkIV(chunk)).CryptBlocks(buf[:blocks], buf[:blocks])
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.Size() {
+		return 0, io.EOF
+	}
+
+	size := r.Header.chunkSize()
+	buf := make([]byte, size)
+
+	var read int
+	for read < len(p) && off < r.Size() {
+		n, err := r.readChunk(uint32(off/size), buf)
+		if err != nil {
+			return read, err
+		}
+		start := off % size
+		if start >= int64(n) {
+			break // the data is shorter than the header claims
+		}
+		end := int64(n)
+		if rem := r.Size() - (off - start); rem < end {
+			end = rem
+		}
+		c := copy(p[read:], buf[start:end])
+		read += c
+		off += int64(c)
+	}
+
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// WriteTo writes the decrypted DMG to w chunk by chunk
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	size := r.Header.chunkSize()
+	buf := make([]byte, size)
+
+	var written int64
+	for chunk := uint32(0); written < r.Size(); chunk++ {
+		n, err := r.readChunk(chunk, buf)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, errors.Errorf("DMG data is truncated (%d of %d bytes)", written, r.Size())
+		}
+		if rem := r.Size() - written; int64(n) > rem {
+			n = int(rem)
+		}
+		nn, err := w.Write(buf[:n])
+		written += int64(nn)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// DecryptFile decrypts the encrypted DMG in to the DMG out with the VFDecrypt key
+func DecryptFile(in, out string, key []byte) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", in)
+	}
+	defer f.Close()
+
+	r, err := NewReader(f, key)
+	if err != nil {
+		return err
+	}
+
+	o, err := os.Create(out)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", out)
+	}
+	defer o.Close()
+
+	if _, err := r.WriteTo(o); err != nil {
+		return errors.Wrapf(err, "failed to decrypt %s", in)
+	}
+
+	return nil
+}